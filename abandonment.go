@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/engine"
+)
+
+const abandonmentsFile = "abandonments.json"
+
+// Code of the error responses to the players seeking a rated game while they
+// cool down.
+const errorMatchmakingCooldown = "MATCHMAKING_COOLDOWN"
+
+const (
+	// Rated games left for good, without coming back within the reconnect
+	// grace, in positions at least abandonLosingEval centipawns down.
+	abandonLosingEval = 200
+	// Abandonments within the window from which each one more keeps the
+	// player out of rated seeks for a while. The cooldown doubles with
+	// each of them, up to maxAbandonCooldown, and starts over once the
+	// player goes the window without abandoning.
+	abandonmentWindow   = 7 * 24 * time.Hour
+	abandonmentsToCool  = 2
+	baseAbandonCooldown = 15 * time.Minute
+	maxAbandonCooldown  = 24 * time.Hour
+)
+
+// abandonment is a rated game a player left when losing.
+type abandonment struct {
+	GameId string    `json:"gameId"`
+	At     time.Time `json:"at"`
+}
+
+// abandonPenalty is the record of the games a player abandoned within the
+// window and the cooldown they got for it, as shown in their profile.
+type abandonPenalty struct {
+	Abandonments []abandonment `json:"abandonments"`
+	// Cooldowns given since the player last went the window without
+	// abandoning, and when the last one ends.
+	Cooldowns     int       `json:"cooldowns"`
+	CooldownUntil time.Time `json:"cooldownUntil,omitempty"`
+}
+
+// recent drops the abandonments out of the window, forgetting the cooldowns
+// if none is left.
+func (p *abandonPenalty) recent(now time.Time) {
+	kept := []abandonment{}
+	for _, a := range p.Abandonments {
+		if now.Sub(a.At) < abandonmentWindow {
+			kept = append(kept, a)
+		}
+	}
+	p.Abandonments = kept
+	if len(kept) == 0 {
+		p.Cooldowns = 0
+	}
+}
+
+// abandonmentStore keeps the penalties of the players by uid, persisted to
+// the data directory.
+type abandonmentStore struct {
+	m         *sync.Mutex
+	penalties map[string]*abandonPenalty
+}
+
+func newAbandonmentStore() (*abandonmentStore, error) {
+	s := &abandonmentStore{
+		m:         &sync.Mutex{},
+		penalties: make(map[string]*abandonPenalty),
+	}
+	if err := loadJSON(abandonmentsFile, &s.penalties); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the penalty of the player as of now.
+func (s *abandonmentStore) get(uid string) abandonPenalty {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.penalties[uid]
+	if !ok {
+		return abandonPenalty{Abandonments: []abandonment{}}
+	}
+	p.recent(time.Now())
+	return *p
+}
+
+// add records the abandonment, cooling the player down if it's one too many.
+func (s *abandonmentStore) add(uid, gameId string) (abandonPenalty, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	p, ok := s.penalties[uid]
+	if !ok {
+		p = &abandonPenalty{}
+		s.penalties[uid] = p
+	}
+	p.recent(now)
+	p.Abandonments = append(p.Abandonments, abandonment{GameId: gameId, At: now})
+	if len(p.Abandonments) > abandonmentsToCool {
+		cooldown := baseAbandonCooldown << uint(p.Cooldowns)
+		if cooldown > maxAbandonCooldown || cooldown <= 0 {
+			cooldown = maxAbandonCooldown
+		}
+		p.Cooldowns++
+		p.CooldownUntil = now.Add(cooldown)
+	}
+	return *p, saveJSON(abandonmentsFile, s.penalties)
+}
+
+// losing reports whether the player of the color, white or black, is down
+// enough in the current game that leaving it counts as abandoning it.
+func (r *Room) losing(color string) bool {
+	if r.plies == 0 {
+		return false
+	}
+	_, pos, _, err := r.position()
+	if err != nil {
+		r.log.warn("Could not read the position", "err", err)
+		return false
+	}
+	eval := engine.Evaluate(pos)
+	if string(pos.Turn()) != color[:1] {
+		eval = -eval
+	}
+	return eval <= -abandonLosingEval
+}
+
+// recordAbandonment counts the rated game against the player, who left it
+// when losing and didn't come back.
+func (rout *router) recordAbandonment(uid, gameId string) {
+	p, err := rout.abandonments.add(uid, gameId)
+	if err != nil {
+		rootLogger.error("Could not save abandonments", "err", err)
+	}
+	rout.stamps.touch(profileStamp(uid))
+	if !p.CooldownUntil.IsZero() && time.Now().Before(p.CooldownUntil) {
+		rootLogger.info("Player cooling down for abandoning games", "uid", uid,
+			"abandonments", len(p.Abandonments), "until", p.CooldownUntil)
+	}
+}
+
+// refuseIfCoolingDown responds with an error if the user is kept out of the
+// rated seeks for abandoning games, reporting whether they are.
+func (rout *router) refuseIfCoolingDown(w http.ResponseWriter, uid string) bool {
+	p := rout.abandonments.get(uid)
+	if !time.Now().Before(p.CooldownUntil) {
+		return false
+	}
+	writeAPIError(w, http.StatusForbidden, apiError{
+		Code:    errorMatchmakingCooldown,
+		Message: "You abandoned too many games; you can seek rated games again at " +
+			p.CooldownUntil.UTC().Format(time.RFC3339),
+	})
+	return true
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	idGen "github.com/rs/xid"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	accountsFile = "accounts.json"
+
+	minPasswordLength = 8
+
+	// PBKDF2 parameters for password hashing.
+	passwordIterations = 100000
+	passwordKeyLength  = 32
+	passwordSaltLength = 16
+)
+
+var (
+	errUsernameTaken    = errors.New("Username already taken")
+	errWrongCredentials = errors.New("Wrong username or password")
+	errAccountNotFound  = errors.New("Account not found")
+	errEmailTaken       = errors.New("Email address already in use")
+)
+
+// account is a registered user.
+type account struct {
+	Id           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Salt         string    `json:"salt"`
+	Created      time.Time `json:"created"`
+
+	// Email address for account recovery, usable once verified.
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"emailVerified,omitempty"`
+}
+
+// accountStore keeps the registered accounts, persisted to the data
+// directory. Usernames of registered accounts are unique regardless of case.
+type accountStore struct {
+	m *sync.Mutex
+
+	// Accounts mapped by id.
+	accounts map[string]*account
+
+	// Account ids mapped by lowercased username.
+	usernames map[string]string
+}
+
+func newAccountStore() (*accountStore, error) {
+	s := &accountStore{
+		m:         &sync.Mutex{},
+		accounts:  make(map[string]*account),
+		usernames: make(map[string]string),
+	}
+	var accounts []*account
+	if err := loadJSON(accountsFile, &accounts); err != nil {
+		return nil, err
+	}
+	for _, a := range accounts {
+		s.accounts[a.Id] = a
+		s.usernames[strings.ToLower(a.Username)] = a.Id
+	}
+	return s, nil
+}
+
+// save persists the accounts. The caller must hold the lock.
+func (s *accountStore) save() error {
+	accounts := make([]*account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+	return saveJSON(accountsFile, accounts)
+}
+
+// owner returns the id of the account that registered the username, if any.
+func (s *accountStore) owner(username string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	id, ok := s.usernames[strings.ToLower(username)]
+	return id, ok
+}
+
+func (s *accountStore) get(id string) (account, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return account{}, false
+	}
+	return *a, true
+}
+
+// register creates an account with the given id, or a new one if empty.
+func (s *accountStore) register(id, username, password string) (account, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return account{}, err
+	}
+	if id == "" {
+		id = idGen.New().String()
+	}
+	a := &account{
+		Id:           id,
+		Username:     username,
+		PasswordHash: hashPassword(password, salt),
+		Salt:         base64.StdEncoding.EncodeToString(salt),
+		Created:      time.Now(),
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	key := strings.ToLower(username)
+	if _, ok := s.usernames[key]; ok {
+		return account{}, errUsernameTaken
+	}
+	if _, ok := s.accounts[a.Id]; ok {
+		a.Id = idGen.New().String()
+	}
+	s.accounts[a.Id] = a
+	s.usernames[key] = a.Id
+	if err := s.save(); err != nil {
+		delete(s.accounts, a.Id)
+		delete(s.usernames, key)
+		return account{}, err
+	}
+	return *a, nil
+}
+
+// authenticate returns the account if the password is the one of the
+// username. The password is hashed outside the lock, as hashing is slow on
+// purpose.
+func (s *accountStore) authenticate(username, password string) (account, error) {
+	s.m.Lock()
+	id, ok := s.usernames[strings.ToLower(username)]
+	var a account
+	if ok {
+		a = *s.accounts[id]
+	}
+	s.m.Unlock()
+	if !ok {
+		return account{}, errWrongCredentials
+	}
+	salt, err := base64.StdEncoding.DecodeString(a.Salt)
+	if err != nil {
+		return account{}, err
+	}
+	hash := hashPassword(password, salt)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(a.PasswordHash)) != 1 {
+		return account{}, errWrongCredentials
+	}
+	return a, nil
+}
+
+// rename changes the username of the account, keeping it unique.
+func (s *accountStore) rename(id, username string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	key := strings.ToLower(username)
+	if owner, ok := s.usernames[key]; ok && owner != id {
+		return errUsernameTaken
+	}
+	oldKey, oldUsername := strings.ToLower(a.Username), a.Username
+	delete(s.usernames, oldKey)
+	s.usernames[key] = id
+	a.Username = username
+	if err := s.save(); err != nil {
+		delete(s.usernames, key)
+		s.usernames[oldKey] = id
+		a.Username = oldUsername
+		return err
+	}
+	return nil
+}
+
+// find looks up an account by username or verified email address.
+func (s *accountStore) find(login string) (account, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if id, ok := s.usernames[strings.ToLower(login)]; ok {
+		return *s.accounts[id], true
+	}
+	for _, a := range s.accounts {
+		if a.EmailVerified && strings.EqualFold(a.Email, login) {
+			return *a, true
+		}
+	}
+	return account{}, false
+}
+
+// update applies the change to the account and persists it.
+func (s *accountStore) update(id string, change func(a *account)) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	old := *a
+	change(a)
+	if err := s.save(); err != nil {
+		*a = old
+		return err
+	}
+	return nil
+}
+
+// setEmail changes the email address of the account, which needs to be
+// verified again.
+func (s *accountStore) setEmail(id, email string) error {
+	return s.update(id, func(a *account) {
+		a.Email = email
+		a.EmailVerified = false
+	})
+}
+
+// verifyEmail marks the email address of the account as verified, unless
+// another account verified it first: logins by email need it to be unique.
+func (s *accountStore) verifyEmail(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	for _, other := range s.accounts {
+		if other.Id != id && other.EmailVerified && strings.EqualFold(other.Email, a.Email) {
+			return errEmailTaken
+		}
+	}
+	a.EmailVerified = true
+	if err := s.save(); err != nil {
+		a.EmailVerified = false
+		return err
+	}
+	return nil
+}
+
+func (s *accountStore) setPassword(id, password string) error {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash := hashPassword(password, salt)
+	return s.update(id, func(a *account) {
+		a.PasswordHash = hash
+		a.Salt = base64.StdEncoding.EncodeToString(salt)
+	})
+}
+
+// hashPassword derives a key from the password with PBKDF2-HMAC-SHA256.
+func hashPassword(password string, salt []byte) string {
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, passwordKeyLength, sha256.New)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// sessionAccount returns the id of the registered account the session is
+// logged in to, if any.
+func (rout *router) sessionAccount(r *http.Request) (string, bool) {
+	session, _ := rout.store.Get(r, "sess")
+	if registered, _ := session.Values["registered"].(bool); !registered {
+		return "", false
+	}
+	uid, ok := session.Values["uid"].(string)
+	return uid, ok
+}
+
+// logIn sets up the session for the account.
+func (rout *router) logIn(w http.ResponseWriter, r *http.Request, a account) error {
+	session, _ := rout.store.Get(r, "sess")
+	session.Values["uid"] = a.Id
+	session.Values["username"] = a.Username
+	session.Values["registered"] = true
+	session.Values["sid"] = rout.loginSessions.start(a.Id, r)
+	// The browser keeps its id across logins, to tell the accounts used
+	// from it.
+	device, ok := session.Values["device"].(string)
+	if !ok {
+		device = idGen.New().String()
+		session.Values["device"] = device
+	}
+	rout.signals.seen(a.Id, a.Username, remoteIP(r), device)
+	return rout.store.Save(r, w, session)
+}
+
+func writeAccount(w http.ResponseWriter, a account) {
+	res := map[string]string{
+		"uid":      a.Id,
+		"username": a.Username,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		rootLogger.error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		rootLogger.error("Could not write response", "err", err)
+	}
+}
+
+// Register an account with a unique username and log in to it.
+func (rout *router) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if !rout.passChallenge(w, r) {
+		return
+	}
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	if errs := validateUsername(username); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	if len(password) < minPasswordLength {
+		writeError(w, "Password too short", http.StatusBadRequest)
+		return
+	}
+	// Guests keep their uid, so that their rating, messages and invites
+	// carry over to the account.
+	var guestId string
+	if _, registered := rout.sessionAccount(r); !registered {
+		session, _ := rout.store.Get(r, "sess")
+		guestId, _ = session.Values["uid"].(string)
+	}
+	a, err := rout.accounts.register(guestId, username, password)
+	if err != nil {
+		if err == errUsernameTaken {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		requestLogger(r).error("Could not register account", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := rout.logIn(w, r, a); err != nil {
+		requestLogger(r).error("Could not log in", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAccount(w, a)
+}
+
+// Log in to a registered account.
+func (rout *router) handleLogin(w http.ResponseWriter, r *http.Request) {
+	a, err := rout.accounts.authenticate(r.FormValue("username"), r.FormValue("password"))
+	if err != nil {
+		if err == errWrongCredentials {
+			writeError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		requestLogger(r).error("Could not authenticate", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := rout.logIn(w, r, a); err != nil {
+		requestLogger(r).error("Could not log in", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAccount(w, a)
+}
+
+// Log out of the account, going back to an anonymous session.
+func (rout *router) handleLogout(w http.ResponseWriter, r *http.Request) {
+	session, _ := rout.store.Get(r, "sess")
+	if accountId, ok := rout.sessionAccount(r); ok {
+		sid, _ := session.Values["sid"].(string)
+		rout.loginSessions.end(sid, accountId)
+	}
+	delete(session.Values, "uid")
+	delete(session.Values, "username")
+	delete(session.Values, "registered")
+	delete(session.Values, "sid")
+	if err := rout.store.Save(r, w, session); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// meResponse describes the user of the session.
+type meResponse struct {
+	Uid      string `json:"uid"`
+	Username string `json:"username"`
+	// Whether the session is logged in to an account rather than a guest.
+	Registered bool        `json:"registered"`
+	Rating     rating      `json:"rating"`
+	Puzzles    puzzleStats `json:"puzzles"`
+	// Ids of the games being played, to reconnect to.
+	Games []string `json:"games"`
+	// Whether the user acknowledged the fair-play policy, as needed to play
+	// rated games.
+	FairPlay bool `json:"fairPlayAcknowledged"`
+}
+
+// Describe the user of the session, for a client loading to restore its
+// state: whether they are logged in to an account, their ratings and the
+// games they are playing.
+func (rout *router) handleMe(w http.ResponseWriter, r *http.Request) {
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, registered := rout.sessionAccount(r)
+	res := meResponse{
+		Uid:        uid,
+		Username:   username,
+		Registered: registered,
+		Rating:     rout.ratings.get(uid),
+		Puzzles:    rout.puzzles.stats(uid),
+		Games:      rout.matches.of(uid),
+		FairPlay:   rout.fairPlayAcks.acknowledged(uid),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
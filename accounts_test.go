@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestHashPassword(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 with 100000 iterations, as the accounts registered
+	// so far were hashed.
+	const want = "WYEVV1ul0qBt7iGnOFpq5RmH0aOFvmOKTlUAgn9mWYM="
+	if got := hashPassword("correct horse", []byte("0123456789abcdef")); got != want {
+		t.Errorf("hashPassword = %s, want %s", got, want)
+	}
+}
+
+func TestAccountStoreAuthenticates(t *testing.T) {
+	useTempDataDir(t)
+	s, err := newAccountStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.register("", "Magnus", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.PasswordHash == "" || a.PasswordHash == "correct horse" {
+		t.Fatalf("password stored as %q", a.PasswordHash)
+	}
+	if _, err := s.register("", "magnus", "battery staple"); err != errUsernameTaken {
+		t.Errorf("registering the username in lowercase: %v, want %v", err, errUsernameTaken)
+	}
+
+	tests := []struct {
+		username, password string
+		err                error
+	}{
+		{"Magnus", "correct horse", nil},
+		{"MAGNUS", "correct horse", nil},
+		{"Magnus", "correct horsE", errWrongCredentials},
+		{"Magnus", "", errWrongCredentials},
+		{"Hikaru", "correct horse", errWrongCredentials},
+	}
+	for _, tt := range tests {
+		got, err := s.authenticate(tt.username, tt.password)
+		if err != tt.err {
+			t.Errorf("authenticate(%q, %q) = %v, want %v", tt.username, tt.password, err, tt.err)
+		}
+		if err == nil && got.Id != a.Id {
+			t.Errorf("authenticate(%q) logged in to %s, want %s", tt.username, got.Id, a.Id)
+		}
+	}
+
+	// The accounts survive a restart.
+	s, err = newAccountStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.authenticate("magnus", "correct horse"); err != nil {
+		t.Errorf("authenticate after reloading: %v", err)
+	}
+}
+
+func TestAccountStoreSetPassword(t *testing.T) {
+	useTempDataDir(t)
+	s, err := newAccountStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.register("", "Magnus", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setPassword(a.Id, "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.authenticate("Magnus", "correct horse"); err != errWrongCredentials {
+		t.Errorf("old password: %v, want %v", err, errWrongCredentials)
+	}
+	changed, err := s.authenticate("Magnus", "battery staple")
+	if err != nil {
+		t.Fatalf("new password: %v", err)
+	}
+	if changed.Salt == a.Salt {
+		t.Error("the salt wasn't renewed with the password")
+	}
+	if err := s.setPassword("nobody", "battery staple"); err != errAccountNotFound {
+		t.Errorf("setPassword of an unknown account: %v, want %v", err, errAccountNotFound)
+	}
+}
+
+func TestAccountStoreRename(t *testing.T) {
+	useTempDataDir(t)
+	s, err := newAccountStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.register("", "Magnus", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.register("", "Hikaru", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rename(a.Id, "hikaru"); err != errUsernameTaken {
+		t.Errorf("renaming to a taken username: %v, want %v", err, errUsernameTaken)
+	}
+	// Changing the case of one's own username is fine.
+	if err := s.rename(a.Id, "MAGNUS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rename(a.Id, "Carlsen"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.owner("magnus"); ok {
+		t.Error("the old username is still taken")
+	}
+	if _, err := s.authenticate("carlsen", "correct horse"); err != nil {
+		t.Errorf("authenticate with the new username: %v", err)
+	}
+}
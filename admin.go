@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// requireAdmin lets the request through only if it carries the admin token
+// of the settings as a bearer token. Admin endpoints are disabled when the
+// token is unset.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := conf.AdminToken
+		if token == "" {
+			writeError(w, "Admin endpoints are disabled", http.StatusNotFound)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// mountDebug serves the runtime profiles under /admin/debug/pprof/ and the
+// exported variables at /admin/debug/vars to admins, to diagnose goroutine
+// leaks and the like on the running server. Profiles taking longer than the
+// write timeout of the server must ask for fewer seconds.
+func mountDebug(r *mux.Router) {
+	// The handlers expect to be mounted at /debug/pprof/.
+	strip := func(h http.HandlerFunc) http.HandlerFunc {
+		return requireAdmin(http.StripPrefix("/admin", h).ServeHTTP)
+	}
+	r.HandleFunc("/admin/debug/pprof/cmdline", strip(pprof.Cmdline))
+	r.HandleFunc("/admin/debug/pprof/profile", strip(pprof.Profile))
+	r.HandleFunc("/admin/debug/pprof/symbol", strip(pprof.Symbol))
+	r.HandleFunc("/admin/debug/pprof/trace", strip(pprof.Trace))
+	r.PathPrefix("/admin/debug/pprof/").HandlerFunc(strip(pprof.Index))
+	r.HandleFunc("/admin/debug/vars", requireAdmin(expvar.Handler().ServeHTTP))
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/engine"
+	"github.com/luisguve/princechess-server/internal/rules"
+	idGen "github.com/rs/xid"
+)
+
+// Prefix of the user ids of the computer players, followed by the game id.
+const engineUserPrefix = "engine:"
+
+var errEngineConnClosed = errors.New("Engine connection closed")
+
+// engineConn is the connection of a computer player. What the server writes
+// to it is handed to the engine, and the moves of the engine are read back
+// as if a client had sent them, so they go through the same pipeline as the
+// moves of the players.
+type engineConn struct {
+	// Messages from the server to the engine.
+	toEngine chan []byte
+	// Messages from the engine to the server.
+	fromEngine chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newEngineConn() *engineConn {
+	return &engineConn{
+		toEngine:   make(chan []byte, 64),
+		fromEngine: make(chan []byte, 4),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *engineConn) NextReader() (int, io.Reader, error) {
+	select {
+	case msg := <-c.fromEngine:
+		return websocket.TextMessage, bytes.NewReader(msg), nil
+	case <-c.closed:
+		return 0, nil, errEngineConnClosed
+	}
+}
+
+func (c *engineConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	return &engineWriter{c: c}, nil
+}
+
+func (c *engineConn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case websocket.TextMessage:
+		return c.deliver(data)
+	case websocket.CloseMessage:
+		return c.Close()
+	}
+	return nil
+}
+
+func (c *engineConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.WriteMessage(messageType, data)
+}
+
+func (c *engineConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.deliver(data)
+}
+
+func (c *engineConn) SetReadLimit(limit int64)                    {}
+func (c *engineConn) SetReadDeadline(t time.Time) error           { return nil }
+func (c *engineConn) SetWriteDeadline(t time.Time) error          { return nil }
+func (c *engineConn) SetPongHandler(h func(appData string) error) {}
+
+func (c *engineConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *engineConn) deliver(msg []byte) error {
+	select {
+	case c.toEngine<- msg:
+		return nil
+	case <-c.closed:
+		return errEngineConnClosed
+	}
+}
+
+// send hands a message of the engine to the server.
+func (c *engineConn) send(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		rootLogger.error("Could not marshal engine message", "err", err)
+		return
+	}
+	select {
+	case c.fromEngine<- data:
+	case <-c.closed:
+	}
+}
+
+type engineWriter struct {
+	c   *engineConn
+	buf bytes.Buffer
+}
+
+func (w *engineWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *engineWriter) Close() error {
+	return w.c.deliver(w.buf.Bytes())
+}
+
+// enginePlayer plays the games of a room for the computer, reacting to what
+// the server tells it like a client would.
+type enginePlayer struct {
+	conn   *engineConn
+	engine engine.Engine
+	setup  setup
+	// "w" or "b", as in the moves.
+	color string
+	start *rules.Position
+	moves []rules.Move
+	log   logger
+}
+
+// engineEvent is what the computer player cares about of the messages the
+// server sends to players.
+type engineEvent struct {
+	Move *struct {
+		Color string `json:"color"`
+		Pgn   string `json:"pgn"`
+	} `json:"move"`
+	OppReady     string `json:"oppReady"`
+	RematchOffer string `json:"rematchOffer"`
+	OppGone      string `json:"oppGone"`
+	// The game after a takeback, in training games.
+	Takeback string `json:"takeback"`
+	Pgn      string `json:"pgn"`
+}
+
+func (e *enginePlayer) run() {
+	defer func() {
+		if v := recover(); v != nil {
+			reportPanic(e.log, "engine", v)
+			e.conn.Close()
+		}
+	}()
+	for {
+		var msg []byte
+		select {
+		case msg = <-e.conn.toEngine:
+		case <-e.conn.closed:
+			return
+		}
+		var ev engineEvent
+		if err := json.Unmarshal(msg, &ev); err != nil {
+			// Batches of chat messages aren't a single JSON value.
+			continue
+		}
+		switch {
+		case ev.Takeback != "":
+			_, moves, err := rules.ParsePGN(e.start, ev.Pgn)
+			if err != nil {
+				e.log.warn("Could not follow the game", "pgn", ev.Pgn, "err", err)
+				continue
+			}
+			e.moves = moves
+		case ev.Move != nil && ev.Move.Color != "" && ev.Move.Color != e.color:
+			pos, moves, err := rules.ParsePGN(e.start, ev.Move.Pgn)
+			if err != nil {
+				e.log.warn("Could not follow the game", "pgn", ev.Move.Pgn, "err", err)
+				continue
+			}
+			e.moves = moves
+			if pos.Status() == rules.Ongoing {
+				e.play(pos)
+			}
+		case ev.OppReady != "":
+			if e.color == "w" && len(e.moves) == 0 {
+				e.play(e.start)
+			}
+		case ev.RematchOffer != "":
+			e.conn.send(map[string]bool{"acceptRematch": true})
+			// Colors switch for the rematch.
+			if e.color == "w" {
+				e.color = "b"
+			} else {
+				e.color = "w"
+			}
+			e.moves = nil
+			if e.color == "w" {
+				e.play(e.start)
+			}
+		case ev.OppGone != "":
+			e.conn.send(map[string]bool{"finishRoom": true})
+			return
+		}
+	}
+}
+
+// play picks a move in the position and sends it. The server tells when it
+// ends the game.
+func (e *enginePlayer) play(pos *rules.Position) {
+	m, err := e.engine.BestMove(pos)
+	if err != nil {
+		e.log.error("Engine could not move", "err", err)
+		return
+	}
+	e.moves = append(e.moves, m)
+	e.conn.send(map[string]interface{}{
+		"move": map[string]string{
+			"color": e.color,
+			"pgn":   e.setup.pgnHeaders() + rules.FormatMoves(e.start, e.moves),
+		},
+	})
+}
+
+// Play a casual game against the computer at the level given. The computer
+// takes the color left by the player, picked at random unless they ask for
+// one. In training games the player may also take moves back and ask for
+// hints.
+func (rout *router) handlePlayAI(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	level, err := strconv.Atoi(r.FormValue("level"))
+	if err != nil {
+		writeError(w, "Invalid level: " + r.FormValue("level"), http.StatusBadRequest)
+		return
+	}
+	eng, err := engine.New(level)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clock := r.FormValue("clock")
+	control, err := parseTimeControl(clock, r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid clock time: " + clock, http.StatusBadRequest)
+		return
+	}
+	color := r.FormValue("color")
+	switch color {
+	case "white", "black":
+	case "":
+		color = "white"
+		if rand.Intn(2) == 0 {
+			color = "black"
+		}
+	default:
+		writeError(w, "Invalid color: " + color, http.StatusBadRequest)
+		return
+	}
+	var training bool
+	switch t := r.FormValue("training"); t {
+	case "", "false", "0":
+	case "true", "1":
+		training = true
+	default:
+		writeError(w, "Invalid training: " + t, http.StatusBadRequest)
+		return
+	}
+	setup, err := newSetup(variantStandard)
+	if err != nil {
+		requestLogger(r).error("Could not set up the game", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	gameId := idGen.New().String()
+	human := user{
+		id:       uid,
+		username: username,
+	}
+	computer := user{
+		id:       engineUserPrefix + gameId,
+		username: "Computer level " + strconv.Itoa(level),
+	}
+	m := match{
+		gameId:   gameId,
+		control:  control,
+		setup:    setup,
+		training: training,
+	}
+	engineColor := "black"
+	if color == "white" {
+		m.white, m.black = human, computer
+	} else {
+		m.white, m.black = computer, human
+		engineColor = "white"
+	}
+	rout.makeRoom(m)
+	start, err := setup.variant().Position(setup.FEN)
+	if err != nil {
+		requestLogger(r).error("Could not set up the game", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rout.seatEngine(m, engineColor, eng, start)
+
+	res := map[string]interface{}{
+		"color":    color,
+		"roomId":   gameId,
+		"opp":      computer.username,
+		"training": training,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// seatEngine joins the computer to the room of the match, playing the color
+// given.
+func (rout *router) seatEngine(m match, color string, eng engine.Engine, start *rules.Position) {
+	computer := m.white
+	if color == "black" {
+		computer = m.black
+	}
+	conn := newEngineConn()
+	cleanup, switchColors := rout.matchCallbacks(m)
+	log := rootLogger.with("game", m.gameId, "color", color, "uid", computer.id)
+	p := rout.newPlayer(conn, m.gameId, color, m.control, m.baseFor(computer.id), m.setup, m.rated,
+		cleanup, switchColors, computer.username, computer.id, defaultLanguage, log)
+	e := &enginePlayer{
+		conn:   conn,
+		engine: eng,
+		setup:  m.setup,
+		color:  color[:1],
+		start:  start,
+		log:    log,
+	}
+	rout.seat(p, m.control)
+	go e.run()
+	go p.writePump()
+	go p.readPump()
+	rout.ldHub.joinPlayer<- computer.id
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/luisguve/princechess-server/internal/engine"
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+const (
+	// Finished games kept for analysis; the oldest ones are forgotten first.
+	maxAnalyzableGames = 1000
+	// Analyses waiting for the worker.
+	analysisQueueSize = 32
+	// Plies the engine searches in each position of an analyzed game.
+	analysisDepth = 3
+
+	// Centipawns lost by a move, compared to the best one, for it to be an
+	// inaccuracy, a mistake or a blunder.
+	inaccuracyLoss = 50
+	mistakeLoss    = 100
+	blunderLoss    = 300
+	// Evaluations are capped to this many centipawns when comparing moves,
+	// so that missing a mate in 5 for a mate in 7 is not a blunder.
+	maxAnalysisEval = 1000
+
+	analysisQueued  = "queued"
+	analysisRunning = "running"
+	analysisDone    = "done"
+	analysisFailed  = "failed"
+)
+
+var (
+	errAnalysisQueueFull = errors.New("Too many games being analyzed, try again later")
+	errGameNotAnalyzed   = errors.New("Analysis not requested")
+)
+
+// finishedGame is a game whose result is known, kept for analysis.
+type finishedGame struct {
+	gameId string
+	white  user
+	black  user
+	setup  setup
+	pgn    string
+	result string
+	// Training games against the computer don't count as competitive.
+	training bool
+	// Whether the game counted for the ratings of the players.
+	rated bool
+	// Whether each player declared they played without seeing the board.
+	whiteBlindfold bool
+	blackBlindfold bool
+	// Moves with their timing, and the clocks the players started with, for
+	// replays.
+	moves []replayMove
+	clock map[string]int64
+	// Time control of the match and when the game ended, filled in as the
+	// game is kept.
+	control  timeControl
+	finished time.Time
+	// Sends the progress of the analysis to the players, while they are in
+	// the room.
+	notify func(data []byte)
+}
+
+// analyzedMove is a move of an analyzed game with the evaluation of the
+// position it leads to.
+type analyzedMove struct {
+	Ply int    `json:"ply"`
+	SAN string `json:"san"`
+	// Centipawns in favor of White, capped when there's a forced mate.
+	Eval int `json:"eval"`
+	// Moves to mate, positive if White mates, if there's a forced mate.
+	Mate int `json:"mate,omitempty"`
+	// The best move in the position, if the one played lost something.
+	Best     string `json:"best,omitempty"`
+	Loss     int    `json:"loss,omitempty"`
+	Judgment string `json:"judgment,omitempty"`
+}
+
+// gameAnalysis is the analysis of a finished game, done or in progress.
+type gameAnalysis struct {
+	game   finishedGame
+	status string
+	// Positions evaluated, out of all of the game.
+	done  int
+	total int
+	moves []analyzedMove
+	pgn   string
+	err   error
+}
+
+// analysisStore keeps the recently finished games and their analyses, by
+// game id, and analyzes the ones requested in the background, one at a time.
+type analysisStore struct {
+	m     *sync.Mutex
+	games map[string]*gameAnalysis
+	// Ids of the games, in the order they finished.
+	order []string
+	queue chan *gameAnalysis
+	// Called with the id of the game whose analysis changed, if set.
+	changed func(gameId string)
+}
+
+func newAnalysisStore() *analysisStore {
+	return &analysisStore{
+		m:     &sync.Mutex{},
+		games: make(map[string]*gameAnalysis),
+		queue: make(chan *gameAnalysis, analysisQueueSize),
+	}
+}
+
+// keep records the finished game so that its players can ask for analysis.
+// A rematch replaces the previous game of the room.
+func (s *analysisStore) keep(g finishedGame) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.games[g.gameId]; !ok {
+		s.order = append(s.order, g.gameId)
+	}
+	s.games[g.gameId] = &gameAnalysis{game: g}
+	for len(s.order) > maxAnalyzableGames {
+		delete(s.games, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.touch(g.gameId)
+}
+
+func (s *analysisStore) touch(gameId string) {
+	if s.changed != nil {
+		s.changed(gameId)
+	}
+}
+
+// request queues the analysis of the game for one of its players. Analyses
+// already requested are left as they are.
+func (s *analysisStore) request(gameId, uid string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.games[gameId]
+	if !ok {
+		return errGameNotFound
+	}
+	if uid != a.game.white.id && uid != a.game.black.id {
+		return errNotPlayer
+	}
+	if a.status != "" {
+		return nil
+	}
+	a.status = analysisQueued
+	select {
+	case s.queue<- a:
+		s.touch(gameId)
+		return nil
+	default:
+		a.status = ""
+		return errAnalysisQueueFull
+	}
+}
+
+// run analyzes the queued games until the server stops.
+func (s *analysisStore) run() {
+	for a := range s.queue {
+		s.analyze(a)
+	}
+}
+
+func (s *analysisStore) analyze(a *gameAnalysis) {
+	defer func() {
+		if v := recover(); v != nil {
+			reportPanic(rootLogger.with("game", a.game.gameId), "analysis", v)
+			s.fail(a, errors.New("Analysis failed"))
+		}
+	}()
+	start, err := a.game.setup.variant().Position(a.game.setup.startFEN())
+	if err != nil {
+		s.fail(a, err)
+		return
+	}
+	_, moves, err := rules.ParsePGN(start, a.game.pgn)
+	if err != nil {
+		s.fail(a, err)
+		return
+	}
+	positions := []*rules.Position{start}
+	for _, m := range moves {
+		positions = append(positions, positions[len(positions)-1].Apply(m))
+	}
+	s.m.Lock()
+	a.status = analysisRunning
+	a.total = len(positions)
+	s.m.Unlock()
+	s.touch(a.game.gameId)
+
+	best, scores, err := evaluate(positions, func(done int) {
+		s.m.Lock()
+		a.done = done
+		s.m.Unlock()
+		s.touch(a.game.gameId)
+		// Every tenth of the game, not to flood the players.
+		if done*10/a.total > (done-1)*10/a.total {
+			a.progress()
+		}
+	})
+	if err != nil {
+		s.fail(a, err)
+		return
+	}
+
+	analyzed := make([]analyzedMove, len(moves))
+	for i, m := range moves {
+		pos := positions[i]
+		am := analyzedMove{
+			Ply: i + 1,
+			SAN: pos.SAN(m),
+		}
+		// The score after the move is for the opponent of the mover.
+		after := -scores[i+1]
+		am.Eval, am.Mate = whiteEval(after, pos.Turn())
+		am.Loss = capEval(scores[i]) - capEval(after)
+		if am.Loss < inaccuracyLoss {
+			am.Loss = 0
+		} else {
+			am.Best = pos.SAN(best[i])
+			am.Judgment = judge(am.Loss)
+		}
+		analyzed[i] = am
+	}
+
+	s.m.Lock()
+	a.moves = analyzed
+	a.pgn = annotatedPGN(a.game, start, moves, analyzed)
+	a.status = analysisDone
+	s.m.Unlock()
+	s.touch(a.game.gameId)
+	a.progress()
+}
+
+// evaluate returns the best move and the score for the side on turn in each
+// of the positions, calling evaluated with the number of positions evaluated so
+// far after each one.
+func evaluate(positions []*rules.Position, evaluated func(done int)) ([]rules.Move, []int, error) {
+	best := make([]rules.Move, len(positions))
+	scores := make([]int, len(positions))
+	for i, pos := range positions {
+		var err error
+		best[i], scores[i], err = engine.Analyze(pos, analysisDepth)
+		if err == engine.ErrNoMoves {
+			err = nil
+			if pos.InCheck() {
+				scores[i] = -engine.Mate
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		evaluated(i + 1)
+	}
+	return best, scores, nil
+}
+
+func (s *analysisStore) fail(a *gameAnalysis, err error) {
+	rootLogger.warn("Could not analyze game", "game", a.game.gameId, "err", err)
+	s.m.Lock()
+	a.status = analysisFailed
+	a.err = err
+	s.m.Unlock()
+	s.touch(a.game.gameId)
+	a.progress()
+}
+
+// progress tells the players how far the analysis went. The worker is the
+// only writer of the fields read.
+func (a *gameAnalysis) progress() {
+	if a.game.notify == nil {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"status": a.status,
+			"done":   a.done,
+			"total":  a.total,
+		},
+	})
+	if err != nil {
+		rootLogger.error("Could not marshal data", "err", err)
+		return
+	}
+	a.game.notify(data)
+}
+
+// public returns the analysis as sent to the clients.
+func (s *analysisStore) public(gameId string) (map[string]interface{}, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.games[gameId]
+	if !ok {
+		return nil, errGameNotFound
+	}
+	if a.status == "" {
+		return nil, errGameNotAnalyzed
+	}
+	res := map[string]interface{}{
+		"gameId":   gameId,
+		"variant":  a.game.setup.variant().Name(),
+		"white":    a.game.white.username,
+		"black":    a.game.black.username,
+		"result":   a.game.result,
+		"training": a.game.training,
+		"blindfold": map[string]bool{
+			"white": a.game.whiteBlindfold,
+			"black": a.game.blackBlindfold,
+		},
+		"status":   a.status,
+		"done":     a.done,
+		"total":    a.total,
+	}
+	switch a.status {
+	case analysisDone:
+		res["moves"] = a.moves
+		res["pgn"] = a.pgn
+	case analysisFailed:
+		res["error"] = a.err.Error()
+	}
+	return res, nil
+}
+
+// whiteEval turns the score for the side on turn into the evaluation in
+// favor of White, and the moves to mate if there's a forced one.
+func whiteEval(score int, turn byte) (eval, mate int) {
+	if turn == rules.Black {
+		score = -score
+	}
+	switch {
+	case score > engine.MateThreshold:
+		mate = (engine.Mate - score + 1) / 2
+	case score < -engine.MateThreshold:
+		mate = -(engine.Mate + score + 1) / 2
+	}
+	return capEval(score), mate
+}
+
+func capEval(score int) int {
+	if score > maxAnalysisEval {
+		return maxAnalysisEval
+	}
+	if score < -maxAnalysisEval {
+		return -maxAnalysisEval
+	}
+	return score
+}
+
+func judge(loss int) string {
+	switch {
+	case loss >= blunderLoss:
+		return "blunder"
+	case loss >= mistakeLoss:
+		return "mistake"
+	case loss >= inaccuracyLoss:
+		return "inaccuracy"
+	}
+	return ""
+}
+
+// Suffixes of the moves in the annotated PGN, by judgment.
+var judgmentSymbols = map[string]string{
+	"blunder":    "??",
+	"mistake":    "?",
+	"inaccuracy": "?!",
+}
+
+// annotatedPGN writes the game with its moves judged and the best move
+// suggested as a comment after each of the bad ones.
+func annotatedPGN(g finishedGame, start *rules.Position, moves []rules.Move, analyzed []analyzedMove) string {
+	var b strings.Builder
+	b.WriteString(pgnTags(g.setup, g.white.username, g.black.username, g.result))
+	pos := start
+	// Black's moves need their number after a comment.
+	numbered := false
+	for i, m := range moves {
+		if pos.Turn() == rules.White {
+			b.WriteString(strconv.Itoa(pos.Fullmove()) + ". ")
+		} else if i == 0 || !numbered {
+			b.WriteString(strconv.Itoa(pos.Fullmove()) + "... ")
+		}
+		am := analyzed[i]
+		b.WriteString(am.SAN + judgmentSymbols[am.Judgment] + " ")
+		numbered = true
+		if am.Best != "" {
+			b.WriteString("{ " + am.Best + " was best. } ")
+			numbered = false
+		}
+		pos = pos.Apply(m)
+	}
+	b.WriteString(g.result)
+	return b.String()
+}
+
+// Ask for the engine analysis of a game that just finished. Only its players
+// can ask for it; the progress is sent to them over the game connection while
+// they are in the room.
+func (rout *router) handleRequestAnalysis(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch err := rout.analyses.request(mux.Vars(r)["id"], uid); err {
+	case nil:
+	case errGameNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	case errNotPlayer:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	case errAnalysisQueueFull:
+		writeError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Get the analysis of a game: its status while it is being done and the
+// judged moves and annotated PGN once it is.
+func (rout *router) handleGetAnalysis(w http.ResponseWriter, r *http.Request) {
+	res, err := rout.analyses.public(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	idGen "github.com/rs/xid"
+)
+
+const (
+	apiKeysFile = "apikeys.json"
+
+	// Prefix of the API keys, to tell them apart from other bearer tokens.
+	apiKeyPrefix       = "pk_"
+	apiKeySecretLength = 24
+)
+
+// Scopes of the API keys.
+const (
+	scopeReadGames      = "read:games"
+	scopeWriteChallenge = "write:challenge"
+	scopeBotPlay        = "bot:play"
+)
+
+var validScopes = []string{scopeReadGames, scopeWriteChallenge, scopeBotPlay}
+
+var (
+	errInvalidAPIKey = errors.New("Invalid API key")
+	errInvalidScope  = errors.New("Invalid scope")
+)
+
+// apiKey lets an application act on behalf of a registered account, limited
+// to its scopes. Only a hash of the secret part of the key is kept.
+type apiKey struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	AccountId string    `json:"accountId"`
+	Scopes    []string  `json:"scopes"`
+	Hash      string    `json:"hash,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func (k apiKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyStore keeps the API keys by id, persisted to the data directory.
+type apiKeyStore struct {
+	m    *sync.Mutex
+	keys map[string]*apiKey
+}
+
+func newAPIKeyStore() (*apiKeyStore, error) {
+	s := &apiKeyStore{
+		m:    &sync.Mutex{},
+		keys: make(map[string]*apiKey),
+	}
+	if err := loadJSON(apiKeysFile, &s.keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issue creates an API key for the account, returning it along with the full
+// key, which can't be recovered later.
+func (s *apiKeyStore) issue(accountId, name string, scopes []string) (apiKey, string, error) {
+	for _, scope := range scopes {
+		valid := false
+		for _, v := range validScopes {
+			valid = valid || scope == v
+		}
+		if !valid {
+			return apiKey{}, "", errInvalidScope
+		}
+	}
+	secretB := make([]byte, apiKeySecretLength)
+	if _, err := rand.Read(secretB); err != nil {
+		return apiKey{}, "", err
+	}
+	secret := hex.EncodeToString(secretB)
+	k := &apiKey{
+		Id:        idGen.New().String(),
+		Name:      name,
+		AccountId: accountId,
+		Scopes:    scopes,
+		Hash:      hashAPIKeySecret(secret),
+		Created:   time.Now(),
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.keys[k.Id] = k
+	if err := saveJSON(apiKeysFile, s.keys); err != nil {
+		delete(s.keys, k.Id)
+		return apiKey{}, "", err
+	}
+	return *k, apiKeyPrefix + k.Id + "." + secret, nil
+}
+
+// authenticate returns the API key matching the full key.
+func (s *apiKeyStore) authenticate(key string) (apiKey, error) {
+	parts := strings.Split(strings.TrimPrefix(key, apiKeyPrefix), ".")
+	if len(parts) != 2 {
+		return apiKey{}, errInvalidAPIKey
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	k, ok := s.keys[parts[0]]
+	if !ok {
+		return apiKey{}, errInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(parts[1])), []byte(k.Hash)) != 1 {
+		return apiKey{}, errInvalidAPIKey
+	}
+	return *k, nil
+}
+
+// list returns the API keys of the account, without their hashes.
+func (s *apiKeyStore) list(accountId string) []apiKey {
+	s.m.Lock()
+	defer s.m.Unlock()
+	keys := []apiKey{}
+	for _, k := range s.keys {
+		if k.AccountId == accountId {
+			key := *k
+			key.Hash = ""
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// revoke deletes the API key if it belongs to the account.
+func (s *apiKeyStore) revoke(accountId, id string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	k, ok := s.keys[id]
+	if !ok || k.AccountId != accountId {
+		return false, nil
+	}
+	delete(s.keys, id)
+	return true, saveJSON(apiKeysFile, s.keys)
+}
+
+// requireScope lets requests authenticated with an API key through to the
+// handler if the key has the scope; they then act as the account owning the
+// key. Requests without an API key are handled as usual, with the session
+// cookie. API keys are ignored on endpoints not wrapped by requireScope.
+func (rout *router) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(token, apiKeyPrefix) {
+			next(w, r)
+			return
+		}
+		k, err := rout.apiKeys.authenticate(token)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !k.allows(scope) {
+			writeError(w, "The API key lacks the scope " + scope, http.StatusForbidden)
+			return
+		}
+		a, ok := rout.accounts.get(k.AccountId)
+		if !ok {
+			writeError(w, errAccountNotFound.Error(), http.StatusUnauthorized)
+			return
+		}
+		if _, banned := rout.bans.banned(a.Id); banned {
+			writeError(w, "You are banned", http.StatusForbidden)
+			return
+		}
+		// Sessions are cached for the duration of the request, so the
+		// handler sees the owner of the key as the user.
+		session, _ := rout.store.Get(r, "sess")
+		session.Values["uid"] = a.Id
+		session.Values["username"] = a.Username
+		session.Values["registered"] = true
+		next(w, r)
+	}
+}
+
+// Issue an API key for the logged in account.
+func (rout *router) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeError(w, "Empty name", http.StatusBadRequest)
+		return
+	}
+	k, key, err := rout.apiKeys.issue(accountId, name, splitList(r.FormValue("scopes")))
+	if err != nil {
+		if err == errInvalidScope {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestLogger(r).error("Could not issue API key", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"id":     k.Id,
+		"name":   k.Name,
+		"scopes": k.Scopes,
+		"key":    key,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the API keys of the logged in account.
+func (rout *router) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	res := map[string][]apiKey{
+		"keys": rout.apiKeys.list(accountId),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Revoke an API key of the logged in account.
+func (rout *router) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	ok, err := rout.apiKeys.revoke(accountId, mux.Vars(r)["id"])
+	if err != nil {
+		requestLogger(r).error("Could not save API keys", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	bansFile         = "bans.json"
+	restrictionsFile = "restrictions.json"
+)
+
+// ban keeps a user out of the server. Bans without expiration are permanent.
+type ban struct {
+	Uid     string    `json:"uid"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (b ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// banListing pages through the bans, and so the shadow restrictions and the
+// commentators, kept the same way.
+var banListing = listing{
+	sorts:       []string{"created", "expires", "uid"},
+	defaultSort: "-created",
+	filters: []param{
+		form("permanent", "bool", false, "Whether it never expires"),
+		form("reason", "string", false, "Words in the reason, in any case"),
+	},
+}
+
+func (b ban) pageId() string {
+	return b.Uid
+}
+
+func (b ban) sortKey(field string) sortKey {
+	switch field {
+	case "expires":
+		if b.Expires.IsZero() {
+			// Permanent ones last.
+			return sortKey{num: math.MaxFloat64}
+		}
+		return timeKey(b.Expires)
+	case "uid":
+		return sortKey{str: b.Uid}
+	}
+	return timeKey(b.Created)
+}
+
+func (b ban) matches(filter, value string) bool {
+	switch filter {
+	case "permanent":
+		return strconv.FormatBool(b.Expires.IsZero()) == value
+	case "reason":
+		return strings.Contains(strings.ToLower(b.Reason), strings.ToLower(value))
+	}
+	return true
+}
+
+// banStore keeps the bans by uid, persisted to the given file of the data
+// directory. Since registered users get the id of their account as uid,
+// accounts are banned the same way as guests. Shadow restrictions are kept in
+// a banStore of their own.
+type banStore struct {
+	m    *sync.Mutex
+	file string
+	bans map[string]ban
+}
+
+func newBanStore(file string) (*banStore, error) {
+	s := &banStore{
+		m:    &sync.Mutex{},
+		file: file,
+		bans: make(map[string]ban),
+	}
+	if err := loadJSON(file, &s.bans); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// banned returns the ban of the user, if any is in effect.
+func (s *banStore) banned(uid string) (ban, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b, ok := s.bans[uid]
+	if !ok || b.expired(time.Now()) {
+		return ban{}, false
+	}
+	return b, true
+}
+
+func (s *banStore) add(b ban) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.bans[b.Uid] = b
+	return saveJSON(s.file, s.bans)
+}
+
+// lift removes the ban of the user, reporting whether there was one.
+func (s *banStore) lift(uid string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.bans[uid]; !ok {
+		return false, nil
+	}
+	delete(s.bans, uid)
+	return true, saveJSON(s.file, s.bans)
+}
+
+// list returns the bans in effect, forgetting the expired ones.
+func (s *banStore) list() ([]ban, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	bans := make([]ban, 0, len(s.bans))
+	for uid, b := range s.bans {
+		if b.expired(now) {
+			delete(s.bans, uid)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	return bans, saveJSON(s.file, s.bans)
+}
+
+// rejectBanned is a middleware that turns away every request of banned users
+// as soon as their session is resolved.
+func (rout *router) rejectBanned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := rout.store.Get(r, "sess")
+		if uid, ok := session.Values["uid"].(string); ok {
+			if _, banned := rout.bans.banned(uid); banned {
+				writeError(w, "You are banned", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ban a user for the given number of seconds, or forever if not set, and
+// disconnect them.
+func (rout *router) handleBan(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		writeError(w, "Empty uid", http.StatusBadRequest)
+		return
+	}
+	b := ban{
+		Uid:     uid,
+		Reason:  r.FormValue("reason"),
+		Created: time.Now(),
+	}
+	if duration := r.FormValue("duration"); duration != "" {
+		seconds, err := strconv.Atoi(duration)
+		if err != nil || seconds <= 0 {
+			writeError(w, "Invalid duration: " + duration, http.StatusBadRequest)
+			return
+		}
+		b.Expires = b.Created.Add(time.Duration(seconds) * time.Second)
+	}
+	if err := rout.bans.add(b); err != nil {
+		requestLogger(r).error("Could not save bans", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rout.conns.closeAll(uid, closeBanned, "BANNED")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bansPage writes the page of the bans asked for by the request under the
+// key given.
+func bansPage(w http.ResponseWriter, r *http.Request, key string, bans []ban) {
+	q, err := banListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := make([]pageItem, 0, len(bans))
+	for _, b := range bans {
+		items = append(items, b)
+	}
+	page, next := paginate(items, q)
+	list := make([]ban, 0, len(page))
+	for _, item := range page {
+		list = append(list, item.(ban))
+	}
+	res := pageResponse(key, list, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the bans in effect.
+func (rout *router) handleGetBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := rout.bans.list()
+	if err != nil {
+		requestLogger(r).error("Could not save bans", "err", err)
+	}
+	bansPage(w, r, "bans", bans)
+}
+
+// Lift the ban of a user before it expires.
+func (rout *router) handleLiftBan(w http.ResponseWriter, r *http.Request) {
+	ok, err := rout.bans.lift(mux.Vars(r)["uid"])
+	if err != nil {
+		requestLogger(r).error("Could not save bans", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Disconnect every socket of a user without banning them.
+func (rout *router) handleKick(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		writeError(w, "Empty uid", http.StatusBadRequest)
+		return
+	}
+	rout.conns.closeAll(uid, closeKicked, "KICKED")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package main
+
+// declareBlindfold records that the player plays the current game without
+// looking at the board, and tells their opponent and the spectators. It must
+// be declared before the player's first move; a rematch starts sighted.
+func (r *Room) declareBlindfold(color string) {
+	p, opp := r.white, r.black
+	if color == "black" {
+		p, opp = r.black, r.white
+	}
+	if r.result != "" || p.Moved() || r.bughouse != nil {
+		r.sendEvent(p, map[string]string{"blindfoldRefused": "true"})
+		return
+	}
+	if r.blindfold[p.userId] {
+		return
+	}
+	r.blindfold[p.userId] = true
+	r.sendEvent(p, map[string]string{"blindfold": "true"})
+	r.sendEvent(opp, map[string]string{"oppBlindfold": "true"})
+	r.tellSpectators(map[string]string{"blindfold": color})
+	r.tellWatchers(map[string]string{"blindfold": color})
+}
+
+// announce sends the payload to the spectators chatting about the game, if
+// there are any.
+func (sc *spectatorChats) announce(gameId string, payload interface{}) {
+	sc.m.Lock()
+	c, ok := sc.rooms[gameId]
+	sc.m.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c.announcements<- payload:
+	default:
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	idGen "github.com/rs/xid"
+)
+
+// Bughouse is played by two teams of two on two boards. Partners play
+// opposite colors, and the pieces a player captures go to their partner, who
+// may drop them on their board instead of moving. The first board to finish
+// decides the result of both.
+
+var errNotInReserve = errors.New("Piece not in reserve")
+
+// Pieces that can be passed to the partner and dropped, in lowercase.
+const bughousePieces = "pnbrq"
+
+// bughouseGame links the two boards of a bughouse game.
+type bughouseGame struct {
+	m      *sync.Mutex
+	boards [2]*bughouseBoard
+	// Pieces in hand, by user id and piece.
+	reserves map[string]map[string]int
+	// Set when the first board finishes, deciding the result of both.
+	decided bool
+}
+
+// bughouseBoard is one of the boards of a bughouse game, played in its own
+// room.
+type bughouseBoard struct {
+	game   *bughouseGame
+	index  int
+	gameId string
+	white  user
+	black  user
+	// Events from the other board, and the pieces dropped on this one, for
+	// the room of this board.
+	events chan bughouseEvent
+}
+
+// bughouseEvent is either a change in the reserve of a player of the board
+// or the result of the game, decided on the other board.
+type bughouseEvent struct {
+	to       string
+	reserve  map[string]int
+	received string
+	result   string
+}
+
+// bughouseSeat is where a seeker plays: the game id of their board, their
+// color, their opponent and their partner.
+type bughouseSeat struct {
+	gameId        string
+	color         string
+	opp           string
+	partner       string
+	partnerGameId string
+}
+
+// bughouseSeeker is a player waiting for the other three.
+type bughouseSeeker struct {
+	user
+	seat chan bughouseSeat
+}
+
+// bughouseTable queues the players looking for a bughouse game, by time
+// control, and keeps the boards being played by game id.
+type bughouseTable struct {
+	m       *sync.Mutex
+	waiting map[string][]*bughouseSeeker
+	boards  map[string]*bughouseBoard
+}
+
+func newBughouseTable() *bughouseTable {
+	return &bughouseTable{
+		m:       &sync.Mutex{},
+		waiting: make(map[string][]*bughouseSeeker),
+		boards:  make(map[string]*bughouseBoard),
+	}
+}
+
+// board returns the bughouse board of the game, or nil if it's a game of
+// two.
+func (t *bughouseTable) board(gameId string) *bughouseBoard {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.boards[gameId]
+}
+
+// remove forgets the board once its room closes.
+func (t *bughouseTable) remove(gameId string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.boards, gameId)
+}
+
+// seek waits for three more players with the time control, until the
+// timeout. The fourth one to come sets up the boards and calls start with
+// them before telling the others their seats. It reports false if nobody
+// else showed up.
+func (t *bughouseTable) seek(u user, control timeControl, timeout time.Duration, start func(boards [2]*bughouseBoard)) (bughouseSeat, bool) {
+	key := control.String()
+	s := &bughouseSeeker{user: u, seat: make(chan bughouseSeat, 1)}
+	t.m.Lock()
+	queue := t.waiting[key]
+	for i, other := range queue {
+		if other.id == u.id {
+			// The same player seeking again, e.g. from another tab:
+			// cancel the previous seek.
+			other.seat<- bughouseSeat{}
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	queue = append(queue, s)
+	if len(queue) < 4 {
+		t.waiting[key] = queue
+		t.m.Unlock()
+		return t.await(key, s, timeout)
+	}
+	delete(t.waiting, key)
+	boards, seats := t.setUp(queue)
+	t.m.Unlock()
+	start(boards)
+	for i, other := range queue {
+		other.seat<- seats[i]
+	}
+	return <-s.seat, true
+}
+
+// await waits in the queue for the seat, until the timeout.
+func (t *bughouseTable) await(key string, s *bughouseSeeker, timeout time.Duration) (bughouseSeat, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case seat := <-s.seat:
+		return seat, seat.gameId != ""
+	case <-deadline.C:
+	}
+	t.m.Lock()
+	queue := t.waiting[key]
+	for i, other := range queue {
+		if other == s {
+			t.waiting[key] = append(queue[:i:i], queue[i+1:]...)
+			t.m.Unlock()
+			return bughouseSeat{}, false
+		}
+	}
+	t.m.Unlock()
+	// The game was set up as the deadline fired.
+	seat := <-s.seat
+	return seat, seat.gameId != ""
+}
+
+// setUp makes the boards of the four seekers. The first two play on the
+// first board and the other two on the second, each team with a white and a
+// black. It returns the boards and the seats of the seekers, in the same
+// order. The caller must hold the lock.
+func (t *bughouseTable) setUp(seekers []*bughouseSeeker) ([2]*bughouseBoard, []bughouseSeat) {
+	g := &bughouseGame{
+		m:        &sync.Mutex{},
+		reserves: make(map[string]map[string]int),
+	}
+	for i := range g.boards {
+		b := &bughouseBoard{
+			game:   g,
+			index:  i,
+			gameId: idGen.New().String(),
+			white:  seekers[2*i].user,
+			black:  seekers[2*i+1].user,
+			events: make(chan bughouseEvent, 16),
+		}
+		g.boards[i] = b
+		t.boards[b.gameId] = b
+	}
+	for _, s := range seekers {
+		g.reserves[s.id] = make(map[string]int)
+	}
+	a, b := g.boards[0], g.boards[1]
+	return g.boards, []bughouseSeat{
+		{a.gameId, "white", a.black.username, b.black.username, b.gameId},
+		{a.gameId, "black", a.white.username, b.white.username, b.gameId},
+		{b.gameId, "white", b.black.username, a.black.username, a.gameId},
+		{b.gameId, "black", b.white.username, a.white.username, a.gameId},
+	}
+}
+
+// other returns the other board of the game.
+func (b *bughouseBoard) other() *bughouseBoard {
+	return b.game.boards[1-b.index]
+}
+
+// partner returns the partner of the player of the board, who plays the
+// other color on the other board.
+func (b *bughouseBoard) partner(uid string) string {
+	if uid == b.white.id {
+		return b.other().black.id
+	}
+	return b.other().white.id
+}
+
+// eventsFor returns the events for the room of the board, or nil for the
+// rooms of games of two.
+func (b *bughouseBoard) eventsFor() <-chan bughouseEvent {
+	if b == nil {
+		return nil
+	}
+	return b.events
+}
+
+// play takes the piece dropped by the player out of their reserve and passes
+// the piece they captured, if any, to their partner. Drops of pieces not in
+// the reserve are refused.
+func (b *bughouseBoard) play(uid string, m move) error {
+	g := b.game
+	g.m.Lock()
+	defer g.m.Unlock()
+	drop := strings.ToLower(m.Drop)
+	if drop != "" {
+		if g.reserves[uid][drop] == 0 {
+			return errNotInReserve
+		}
+		g.reserves[uid][drop]--
+		b.send(bughouseEvent{to: uid, reserve: copyReserve(g.reserves[uid])})
+	}
+	captured := strings.ToLower(m.Capture)
+	if captured != "" && len(captured) == 1 && strings.Contains(bughousePieces, captured) {
+		partner := b.partner(uid)
+		g.reserves[partner][captured]++
+		b.other().send(bughouseEvent{
+			to:       partner,
+			reserve:  copyReserve(g.reserves[partner]),
+			received: captured,
+		})
+	}
+	return nil
+}
+
+// decide ends both boards with the result of the first one to finish: the
+// team of its winner wins on the other board too, with the other color.
+func (b *bughouseBoard) decide(result string) {
+	g := b.game
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.decided {
+		return
+	}
+	g.decided = true
+	switch result {
+	case resultWhiteWins:
+		result = resultBlackWins
+	case resultBlackWins:
+		result = resultWhiteWins
+	}
+	b.other().send(bughouseEvent{result: result})
+}
+
+// send hands the event to the room of the board, unless it's gone or busy.
+func (b *bughouseBoard) send(ev bughouseEvent) {
+	select {
+	case b.events<- ev:
+	default:
+	}
+}
+
+func copyReserve(reserve map[string]int) map[string]int {
+	c := make(map[string]int, len(reserve))
+	for piece, n := range reserve {
+		if n > 0 {
+			c[piece] = n
+		}
+	}
+	return c
+}
+
+// playBughouse keeps the reserves of the bughouse game up to date with the
+// move. Drops of pieces the player doesn't have are not relayed.
+func (r *Room) playBughouse(m move) bool {
+	p := r.white
+	if m.Color == "b" {
+		p = r.black
+	}
+	if err := r.bughouse.play(p.userId, m); err != nil {
+		data, err := json.Marshal(map[string]string{
+			"dropRefused": m.Drop,
+		})
+		if err != nil {
+			r.log.error("Could not marshal data", "err", err)
+			return false
+		}
+		select {
+		case p.sendEvent<- data:
+		default:
+		}
+		return false
+	}
+	return true
+}
+
+// handleBughouseEvent applies the event from the bughouse game to the room.
+func (r *Room) handleBughouseEvent(ev bughouseEvent) {
+	if ev.result != "" {
+		// The other board finished first.
+		if r.result != "" {
+			return
+		}
+		data, err := json.Marshal(map[string]string{
+			"partnerGameOver": ev.result,
+		})
+		if err != nil {
+			r.log.error("Could not marshal data", "err", err)
+			return
+		}
+		r.stopTimers()
+		r.finish(ev.result)
+		for _, p := range []*player{r.white, r.black} {
+			select {
+			case p.sendEvent<- data:
+			default:
+			}
+		}
+		return
+	}
+	p := r.white
+	if ev.to == r.black.userId {
+		p = r.black
+	}
+	res := map[string]interface{}{
+		"reserve": ev.reserve,
+	}
+	if ev.received != "" {
+		res["received"] = ev.received
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	select {
+	case p.sendEvent<- data:
+	default:
+		r.drop("reserve")
+	}
+}
+
+// Look for a bughouse game with the clock given, in minutes, and an optional
+// increment. The response tells the player their board, color, opponent and
+// partner; it's empty if three other players didn't show up in time.
+func (rout *router) handleBughouse(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	clock := r.FormValue("clock")
+	control, err := parseTimeControl(clock, r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid clock time: " + clock, http.StatusBadRequest)
+		return
+	}
+	u := user{
+		id:       uid,
+		username: username,
+	}
+	seat, ok := rout.bughouse.seek(u, control, conf.MatchTimeout, func(boards [2]*bughouseBoard) {
+		for _, b := range boards {
+			// Bughouse games are unrated.
+			rout.makeRoom(match{
+				gameId:  b.gameId,
+				white:   b.white,
+				black:   b.black,
+				control: control,
+				setup:   setup{
+					Variant: variantStandard,
+					FEN: standardFEN,
+				},
+			})
+		}
+	})
+	if !ok {
+		writeAPIError(w, http.StatusRequestTimeout, apiError{
+			Code:    errorMatchTimeout,
+			Message: "No team found",
+		})
+		return
+	}
+
+	res := map[string]string{
+		"color":         seat.color,
+		"roomId":        seat.gameId,
+		"opp":           seat.opp,
+		"partner":       seat.partner,
+		"partnerRoomId": seat.partnerGameId,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Keys of the stamps of the resources served by the cached endpoints.
+const (
+	// The leaderboard.
+	leaderboardStamp = "leaderboard"
+	// The lists of finished games.
+	gamesStamp = "games"
+)
+
+func profileStamp(uid string) string {
+	return "profile " + uid
+}
+
+func gameStamp(gameId string) string {
+	return "game " + gameId
+}
+
+// stampOf returns the key of the stamp for the endpoints whose responses
+// depend on a single resource.
+func stampOf(key string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return key
+	}
+}
+
+func profileStampOf(r *http.Request) string {
+	return profileStamp(mux.Vars(r)["uid"])
+}
+
+func gameStampOf(r *http.Request) string {
+	return gameStamp(mux.Vars(r)["id"])
+}
+
+// finishedGameStampOf returns the key of the stamp of the game unless it's
+// still being played, as its responses change with every move then.
+func (rout *router) finishedGameStampOf(r *http.Request) string {
+	gameId := mux.Vars(r)["id"]
+	if _, ok := rout.matches.get(gameId); ok {
+		return ""
+	}
+	return gameStamp(gameId)
+}
+
+// cacheStamp is the version of a resource and the time it last changed.
+type cacheStamp struct {
+	version  uint64
+	modified time.Time
+}
+
+// cacheStamps keeps the stamps of the resources whose responses browsers and
+// proxies can cache, by key, touched as the resources change. The resources
+// not touched since the server started date from its start, as they were
+// loaded then.
+type cacheStamps struct {
+	m       *sync.Mutex
+	start   time.Time
+	version uint64
+	stamps  map[string]cacheStamp
+}
+
+func newCacheStamps() *cacheStamps {
+	return &cacheStamps{
+		m:      &sync.Mutex{},
+		start:  time.Now(),
+		stamps: make(map[string]cacheStamp),
+	}
+}
+
+// touch marks the resources as changed.
+func (c *cacheStamps) touch(keys ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		c.version++
+		c.stamps[key] = cacheStamp{version: c.version, modified: now}
+	}
+}
+
+func (c *cacheStamps) get(key string) cacheStamp {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if s, ok := c.stamps[key]; ok {
+		return s
+	}
+	return cacheStamp{modified: c.start}
+}
+
+// etag returns the entity tag of the stamp. It's weak, since the body can be
+// compressed, and tells the runs of the server apart, since the versions
+// start over.
+func (c *cacheStamps) etag(s cacheStamp) string {
+	return `W/"` + strconv.FormatInt(c.start.UnixNano(), 36) + "-" +
+		strconv.FormatUint(s.version, 36) + `"`
+}
+
+// notModified reports whether the request holds the response with the entity
+// tag and the time of modification given. If-None-Match takes precedence over
+// If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// Last-Modified has a resolution of a second.
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// cached serves the responses of the endpoint with the validators of the
+// resource they depend on, whose key is returned by stamp, and answers Not
+// Modified to the requests holding them. The responses are stored by the
+// browsers and proxies but revalidated on each use. Requests for which stamp
+// returns "" go through uncached.
+func (rout *router) cached(stamp func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next(w, r)
+			return
+		}
+		key := stamp(r)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		s := rout.stamps.get(key)
+		etag := rout.stamps.etag(s)
+		h := w.Header()
+		h.Set("ETag", etag)
+		h.Set("Last-Modified", s.modified.UTC().Format(http.TimeFormat))
+		h.Set("Cache-Control", "public, no-cache")
+		if notModified(r, etag, s.modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Seconds clients are asked to wait before seeking a game again when the
+// server is full.
+const serverFullRetry = 30
+
+// full reports whether the server hosts as many games as it's allowed to.
+func (rout *router) full() bool {
+	return conf.MaxGames > 0 && rout.matches.size() >= conf.MaxGames
+}
+
+// refuseIfFull responds with an error if the server can't host more games,
+// so that the games in progress don't suffer from the load.
+func (rout *router) refuseIfFull(w http.ResponseWriter, r *http.Request) bool {
+	if !rout.full() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(serverFullRetry))
+	writeNotices(w, r, http.StatusServiceUnavailable, newNotice(noticeServerFull))
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errChallengeFailed = errors.New("Challenge failed")
+
+// challengeVerifier checks the token of a challenge, such as a CAPTCHA, solved
+// by the user making the request. It guards endpoints prone to abuse.
+type challengeVerifier interface {
+	verify(r *http.Request, token string) error
+}
+
+// newChallengeVerifier sets up the verifier from the settings. Any service
+// with a siteverify API (reCAPTCHA, hCaptcha, Turnstile) can be used by
+// setting captchaVerifyURL and captchaSecret; otherwise no challenge is
+// required.
+func newChallengeVerifier() challengeVerifier {
+	if conf.CaptchaVerifyURL == "" {
+		return noChallenge{}
+	}
+	return siteVerifier{
+		url:    conf.CaptchaVerifyURL,
+		secret: conf.CaptchaSecret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// noChallenge lets every request through.
+type noChallenge struct{}
+
+func (noChallenge) verify(*http.Request, string) error {
+	return nil
+}
+
+type siteVerifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (v siteVerifier) verify(r *http.Request, token string) error {
+	if token == "" {
+		return errChallengeFailed
+	}
+	res, err := v.client.PostForm(v.url, url.Values{
+		"secret":   {v.secret},
+		"response": {token},
+		"remoteip": {remoteIP(r)},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errChallengeFailed
+	}
+	return nil
+}
+
+// passChallenge verifies the challenge token sent in the "challenge" form
+// value, responding with an error if it doesn't pass.
+func (rout *router) passChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if err := rout.challenge.verify(r, r.FormValue("challenge")); err != nil {
+		if err != errChallengeFailed {
+			requestLogger(r).error("Could not verify challenge", "err", err)
+		}
+		writeError(w, "Challenge required", http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
+
+// burstCounter tells when a user does something more than a number of times
+// within a window.
+type burstCounter struct {
+	m      *sync.Mutex
+	max    int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newBurstCounter(max int, window time.Duration) *burstCounter {
+	return &burstCounter{
+		m:      &sync.Mutex{},
+		max:    max,
+		window: window,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+// setLimit changes the number of times allowed within the window.
+func (bc *burstCounter) setLimit(max int, window time.Duration) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	bc.max, bc.window = max, window
+}
+
+// size returns the number of users counted.
+func (bc *burstCounter) size() int {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	return len(bc.hits)
+}
+
+// hit counts one more time for the user, reporting whether they went over
+// the limit.
+func (bc *burstCounter) hit(uid string, now time.Time) bool {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	recent := bc.hits[uid][:0]
+	for _, t := range bc.hits[uid] {
+		if now.Sub(t) < bc.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	bc.hits[uid] = recent
+	return len(recent) > bc.max
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// Running several nodes of the server behind a load balancer: the livedata
+// events of users connected to other nodes (direct messages, invites) and
+// the lobby chat are relayed through a broker. The matchmaking pools are
+// queues in the shared store, so players seeking through different nodes are
+// paired with each other. Invites and games are recorded in the shared store
+// too, so requests reaching another node are proxied to the node hosting
+// them; the balancer needs no sticky routing.
+
+// Topics of the events relayed between nodes.
+const (
+	topicDirect = "prince:direct"
+	topicLobby  = "prince:lobby"
+)
+
+const (
+	// Prefix of the keys of the games in the shared store.
+	matchKeyPrefix = "prince:match:"
+
+	// Games are forgotten by the shared store after this long even if their
+	// node never removed them, e.g. because it crashed.
+	matchRecordTTL = 24 * time.Hour
+
+	// Prefixes of the keys of the invites, by id and by join code, in the
+	// shared store. Both are forgotten when the invite expires.
+	inviteKeyPrefix   = "prince:invite:"
+	joinCodeKeyPrefix = "prince:code:"
+
+	// Prefix of the keys telling the users who opened a socket in any node,
+	// forgotten after presenceTTL.
+	presenceKeyPrefix = "prince:seen:"
+	presenceTTL       = 24 * time.Hour
+)
+
+// sharedStore keeps the state shared by the nodes.
+type sharedStore interface {
+	set(key string, value []byte, ttl time.Duration) error
+	// setNX sets the value only if the key has none, reporting whether it
+	// did.
+	setNX(key string, value []byte, ttl time.Duration) (bool, error)
+	get(key string) ([]byte, bool, error)
+	del(key string) error
+}
+
+// matchRecord tells the nodes where a game is hosted.
+type matchRecord struct {
+	// Base URL of the node hosting the game.
+	Node  string `json:"node"`
+	White string `json:"white"`
+	Black string `json:"black"`
+}
+
+// broker relays events between the nodes of the server.
+type broker interface {
+	publish(topic string, event []byte)
+	subscribe(topic string, handle func(event []byte))
+}
+
+// clusterEvent is a livedata event relayed to the other nodes.
+type clusterEvent struct {
+	Node    string          `json:"node"`
+	Uid     string          `json:"uid,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// lobbyEvent is a change to the lobby chat made in another node.
+type lobbyEvent struct {
+	Message *publicMessage `json:"message,omitempty"`
+	Deleted string         `json:"deleted,omitempty"`
+	Muted   *muteRequest   `json:"muted,omitempty"`
+}
+
+// connect joins the hub to the other nodes through the broker.
+func (hub *livedataHub) connect(peers broker) {
+	hub.peers = peers
+	peers.subscribe(topicDirect, func(event []byte) {
+		if ev, ok := hub.decodeEvent(event); ok {
+			hub.remote<- ev
+		}
+	})
+	peers.subscribe(topicLobby, func(event []byte) {
+		ev, ok := hub.decodeEvent(event)
+		if !ok {
+			return
+		}
+		var le lobbyEvent
+		if err := json.Unmarshal(ev.Payload, &le); err != nil {
+			rootLogger.error("Could not unmarshal lobby event", "err", err)
+			return
+		}
+		hub.lobby.remote<- le
+	})
+}
+
+// decodeEvent decodes an event relayed by the broker, reporting false for
+// invalid events and the ones sent by this node.
+func (hub *livedataHub) decodeEvent(event []byte) (clusterEvent, bool) {
+	var ev clusterEvent
+	if err := json.Unmarshal(event, &ev); err != nil {
+		rootLogger.error("Could not unmarshal cluster event", "err", err)
+		return ev, false
+	}
+	return ev, ev.Node != hub.node
+}
+
+// relay sends the payload to the other nodes, if any, on the topic.
+func (hub *livedataHub) relay(topic, uid string, payload interface{}) {
+	if hub.peers == nil {
+		return
+	}
+	// Notices are only sent back to the user who caused them, who is
+	// connected to this node.
+	if _, ok := payload.(noticeEvent); ok {
+		return
+	}
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		rootLogger.error("Could not marshal cluster event", "err", err)
+		return
+	}
+	event, err := json.Marshal(clusterEvent{
+		Node:    hub.node,
+		Uid:     uid,
+		Payload: payloadB,
+	})
+	if err != nil {
+		rootLogger.error("Could not marshal cluster event", "err", err)
+		return
+	}
+	hub.peers.publish(topic, event)
+}
+
+// recordMatch tells the other nodes the game is hosted in this one.
+func (rout *router) recordMatch(m match) {
+	if rout.shared == nil {
+		return
+	}
+	rec, err := json.Marshal(matchRecord{
+		Node:  conf.AdvertiseURL,
+		White: m.white.id,
+		Black: m.black.id,
+	})
+	if err != nil {
+		rootLogger.error("Could not marshal match record", "err", err)
+		return
+	}
+	if err := rout.shared.set(matchKeyPrefix+m.gameId, rec, matchRecordTTL); err != nil {
+		rootLogger.error("Could not record match", "game", m.gameId, "err", err)
+	}
+}
+
+// forgetMatch removes the game from the shared store once it's over.
+func (rout *router) forgetMatch(gameId string) {
+	if rout.shared == nil {
+		return
+	}
+	if err := rout.shared.del(matchKeyPrefix + gameId); err != nil {
+		rootLogger.error("Could not forget match", "game", gameId, "err", err)
+	}
+}
+
+// proxyGame forwards the request to join a game to the node hosting it, if
+// it's another node, reporting whether it did.
+func (rout *router) proxyGame(w http.ResponseWriter, r *http.Request, gameId, uid string) bool {
+	if rout.shared == nil {
+		return false
+	}
+	recB, ok, err := rout.shared.get(matchKeyPrefix + gameId)
+	if err != nil {
+		requestLogger(r).error("Could not look up match", "game", gameId, "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	var rec matchRecord
+	if err := json.Unmarshal(recB, &rec); err != nil {
+		requestLogger(r).error("Could not unmarshal match record", "game", gameId, "err", err)
+		return false
+	}
+	if rec.Node == conf.AdvertiseURL || (uid != rec.White && uid != rec.Black) {
+		return false
+	}
+	requestLogger(r).info("Proxying game to its node", "game", gameId, "node", rec.Node)
+	return proxyTo(w, r, rec.Node)
+}
+
+// proxyTo forwards the request to the node with the base URL, reporting
+// whether it did.
+func proxyTo(w http.ResponseWriter, r *http.Request, node string) bool {
+	u, err := url.Parse(node)
+	if err != nil {
+		requestLogger(r).error("Invalid node URL", "node", node, "err", err)
+		return false
+	}
+	// The proxy carries the websocket upgrade along.
+	httputil.NewSingleHostReverseProxy(u).ServeHTTP(w, r)
+	return true
+}
+
+// claimJoinCode takes the join code for an invite of this node until it
+// expires, reporting whether no other node has it.
+func (rout *router) claimJoinCode(code string, expires time.Time) bool {
+	ok, err := rout.shared.setNX(joinCodeKeyPrefix+code, []byte(conf.AdvertiseURL), time.Until(expires))
+	if err != nil {
+		// The code is still unique among the invites of this node.
+		rootLogger.error("Could not claim join code", "err", err)
+		return true
+	}
+	return ok
+}
+
+// recordInvite tells the other nodes the invite is hosted in this one. Its
+// join code was recorded when claimed.
+func (rout *router) recordInvite(room *inviteRoom) {
+	if rout.shared == nil {
+		return
+	}
+	err := rout.shared.set(inviteKeyPrefix+room.id, []byte(conf.AdvertiseURL), time.Until(room.expires))
+	if err != nil {
+		rootLogger.error("Could not record invite", "invite", room.id, "err", err)
+	}
+}
+
+// forgetInvite removes the invite and its join code from the shared store
+// once it's used, revoked or expired.
+func (rout *router) forgetInvite(room *inviteRoom) {
+	if rout.shared == nil {
+		return
+	}
+	for _, key := range []string{inviteKeyPrefix + room.id, joinCodeKeyPrefix + room.code} {
+		if err := rout.shared.del(key); err != nil {
+			rootLogger.error("Could not forget invite", "invite", room.id, "err", err)
+		}
+	}
+}
+
+// recordPresence tells the other nodes the user opened a socket in this one.
+func (rout *router) recordPresence(uid string) {
+	if rout.shared == nil {
+		return
+	}
+	if err := rout.shared.set(presenceKeyPrefix+uid, []byte(conf.AdvertiseURL), presenceTTL); err != nil {
+		rootLogger.error("Could not record presence", "uid", uid, "err", err)
+	}
+}
+
+// seenInCluster reports whether the user opened a socket in any node lately.
+func (rout *router) seenInCluster(uid string) bool {
+	if rout.shared == nil {
+		return false
+	}
+	_, ok, err := rout.shared.get(presenceKeyPrefix + uid)
+	if err != nil {
+		rootLogger.error("Could not look up presence", "uid", uid, "err", err)
+	}
+	return ok
+}
+
+// proxyInvite forwards the request about an invite, by its id or join code,
+// to the node hosting it, if it's another node, reporting whether it did.
+func (rout *router) proxyInvite(w http.ResponseWriter, r *http.Request, inviteId string) bool {
+	if rout.shared == nil || inviteId == "" {
+		return false
+	}
+	if _, ok := rout.wr.find(inviteId); ok {
+		return false
+	}
+	node, ok, err := rout.shared.get(inviteKeyPrefix + inviteId)
+	if err == nil && !ok {
+		node, ok, err = rout.shared.get(joinCodeKeyPrefix + normalizeJoinCode(inviteId))
+	}
+	if err != nil {
+		requestLogger(r).error("Could not look up invite", "invite", inviteId, "err", err)
+		return false
+	}
+	if !ok || string(node) == conf.AdvertiseURL {
+		return false
+	}
+	requestLogger(r).info("Proxying invite to its node", "invite", inviteId, "node", string(node))
+	return proxyTo(w, r, string(node))
+}
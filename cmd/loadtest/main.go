@@ -0,0 +1,362 @@
+// Loadtest runs a swarm of simulated players against a running server, to
+// see how the matcher and the rooms hold up under concurrency. Each bot seeks
+// a game, plays a scripted game chatting now and then, sometimes drops the
+// connection and reconnects, and seeks again. Once every bot has played its
+// games, latency percentiles of each operation are reported.
+//
+// The server counts websockets per IP address, so for more than a few bots
+// it must be started with a higher limit:
+//
+//	PRINCE_MAX_CONNS_PER_IP=1000 ./princechess-server
+//	go run ./cmd/loadtest -players 200 -games 5
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Moves of the scripted game. The server checks them, so they must be legal
+// and not end the game before the last one.
+var script = strings.Fields(`c4 f5 h4 c5 f4 a5 a4 h5 Nc3 Nf6 Nf3 Nc6 d3 Nd4 e3 Nb3
+	Ra3 Nxc1 Ixc1 Ng4 Be2 Nxe3 Kd2 Nxg2 b4 axb4 Ra1 Nxf4 Bd1 bxc3+ Kxc3 d5
+	cxd5 Nxd5+ Kc4 e6 Ne5 Ne3+ Kb5 Bd6 Nf3 Nxd1 Ixd1 Be7 a5 Bf6 Ra2 Be7 Ne5
+	Bf6 Nc4 Be7 Ie2 g5 hxg5 Rg8 Rxh5 Rxg5 Rxg5 Bxg5 Kxc5 Be7+ Kb5 Bd7+ Kb6
+	Ic8 If3 f4 Ixf4 e5 Ixe5 Bc6 Nd6+ Bxd6 Ixd6 Ra6+ Kc5 Bd7 d4 Rxd6 Kxd6 Bf5
+	d5 Id7+`)
+
+var (
+	server    = flag.String("server", "http://127.0.0.1:8000", "base URL of the server")
+	origin    = flag.String("origin", "http://localhost:8080", "origin the websockets are opened from")
+	players   = flag.Int("players", 20, "number of bots")
+	games     = flag.Int("games", 3, "games played by each bot")
+	clock     = flag.String("clock", "10", "clock of the games in minutes")
+	moves     = flag.Int("moves", 40, "moves of each game, up to the length of the script")
+	think     = flag.Duration("think", 100*time.Millisecond, "time the bots take to move")
+	chatRate  = flag.Float64("chat", 0.1, "chance of chatting after a move")
+	dropRate  = flag.Float64("reconnect", 0.02, "chance of dropping the connection after a move")
+	ioTimeout = flag.Duration("timeout", 30*time.Second, "time to wait for the server before giving up")
+)
+
+func main() {
+	flag.Parse()
+	if *moves > len(script) {
+		*moves = len(script)
+	}
+	base, err := url.Parse(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid server URL:", err)
+		os.Exit(2)
+	}
+
+	st := newStats()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *players; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := newBot(base, st)
+			if err != nil {
+				st.fail("setup", err)
+				return
+			}
+			for g := 0; g < *games; g++ {
+				if err := b.playGame(); err != nil {
+					st.fail("game", err)
+				}
+			}
+		}()
+		// Don't hit the server with every bot at once.
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	st.report(time.Since(start))
+}
+
+// stats collects the latencies and failures of the operations of the bots.
+type stats struct {
+	m         sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]int
+	lastErr   map[string]error
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[string][]time.Duration),
+		failures:  make(map[string]int),
+		lastErr:   make(map[string]error),
+	}
+}
+
+func (st *stats) observe(op string, d time.Duration) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.latencies[op] = append(st.latencies[op], d)
+}
+
+func (st *stats) fail(op string, err error) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	st.failures[op]++
+	st.lastErr[op] = err
+}
+
+func (st *stats) report(elapsed time.Duration) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	fmt.Printf("%d bots, %d games each, in %v\n\n", *players, *games, elapsed.Round(time.Millisecond))
+	fmt.Printf("%-10s %8s %10s %10s %10s %10s\n", "op", "count", "p50", "p90", "p99", "max")
+	ops := make([]string, 0, len(st.latencies))
+	for op := range st.latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		ds := st.latencies[op]
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		fmt.Printf("%-10s %8d %10v %10v %10v %10v\n", op, len(ds),
+			percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), ds[len(ds)-1])
+	}
+	if len(st.failures) == 0 {
+		return
+	}
+	fmt.Println("\nfailures:")
+	for op, n := range st.failures {
+		fmt.Printf("%-10s %8d  last: %v\n", op, n, st.lastErr[op])
+	}
+}
+
+// percentile of the sorted durations.
+func percentile(ds []time.Duration, p int) time.Duration {
+	i := (len(ds)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return ds[i].Round(time.Microsecond)
+}
+
+// bot is a simulated player. Its session lives in the cookie jar.
+type bot struct {
+	base   *url.URL
+	client *http.Client
+	st     *stats
+	conn   *websocket.Conn
+	gameId string
+	color  string
+	// Moves played so far in the current game.
+	plies int
+	// Time the last move or chat message was sent, to time the reply.
+	sentMove time.Time
+	sentChat time.Time
+}
+
+func newBot(base *url.URL, st *stats) (*bot, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &bot{
+		base:   base,
+		client: &http.Client{Jar: jar, Timeout: *ioTimeout},
+		st:     st,
+	}, nil
+}
+
+// seek asks for a game until an opponent is found.
+func (b *bot) seek() error {
+	u := *b.base
+	u.Path = "/api/v1/play"
+	u.RawQuery = url.Values{"clock": {*clock}}.Encode()
+	for {
+		start := time.Now()
+		res, err := b.client.Get(u.String())
+		if err != nil {
+			return err
+		}
+		var found map[string]string
+		err = json.NewDecoder(res.Body).Decode(&found)
+		res.Body.Close()
+		if res.StatusCode == http.StatusRequestTimeout {
+			// Nobody else was seeking.
+			b.st.observe("seek-miss", time.Since(start))
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("seek: %s", res.Status)
+		}
+		if err != nil {
+			return err
+		}
+		b.st.observe("seek", time.Since(start))
+		b.gameId, b.color = found["roomId"], found["color"]
+		return nil
+	}
+}
+
+// connect opens the websocket of the game. The room may not be set up yet
+// right after the seek, so a missing match is retried for a while.
+func (b *bot) connect(op string) error {
+	u := *b.base
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = "/api/v1/game"
+	u.RawQuery = url.Values{"id": {b.gameId}, "clock": {*clock}}.Encode()
+	header := http.Header{"Origin": {*origin}}
+	for _, c := range b.client.Jar.Cookies(b.base) {
+		header.Add("Cookie", c.String())
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: *ioTimeout}
+	start := time.Now()
+	for {
+		conn, res, err := dialer.Dial(u.String(), header)
+		if err == nil {
+			b.st.observe(op, time.Since(start))
+			b.conn = conn
+			return nil
+		}
+		if res == nil || res.StatusCode != http.StatusNotFound || time.Since(start) > *ioTimeout {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (b *bot) send(msg interface{}) error {
+	b.conn.SetWriteDeadline(time.Now().Add(*ioTimeout))
+	return b.conn.WriteJSON(msg)
+}
+
+func (b *bot) myTurn() bool {
+	return (b.plies%2 == 0) == (b.color == "white")
+}
+
+// move plays the next move of the script, or resigns at the end of it.
+func (b *bot) move() error {
+	time.Sleep(*think)
+	if b.plies >= *moves {
+		if err := b.send(map[string]bool{"resign": true}); err != nil {
+			return err
+		}
+		return errGameOver
+	}
+	b.plies++
+	color := "w"
+	if b.color == "black" {
+		color = "b"
+	}
+	b.sentMove = time.Now()
+	return b.send(map[string]interface{}{
+		"move": map[string]string{
+			"color": color,
+			"pgn":   strings.Join(script[:b.plies], " "),
+		},
+	})
+}
+
+var errGameOver = errors.New("game over")
+
+// playGame seeks and plays a game to the end.
+func (b *bot) playGame() error {
+	if err := b.seek(); err != nil {
+		return err
+	}
+	if err := b.connect("connect"); err != nil {
+		return err
+	}
+	defer func() { b.conn.Close() }()
+	b.plies = 0
+	started := false
+	for {
+		b.conn.SetReadDeadline(time.Now().Add(*ioTimeout))
+		_, data, err := b.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseGoingAway {
+				// The room was closed after the game.
+				return nil
+			}
+			return err
+		}
+		// Chat messages may come several in a frame.
+		for _, line := range strings.Split(string(data), "\n") {
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				return fmt.Errorf("invalid message %q: %v", line, err)
+			}
+			err := b.handle(msg, &started)
+			if err == errGameOver {
+				// Leave the room.
+				return b.send(map[string]bool{"finishRoom": true})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle reacts to a message from the server.
+func (b *bot) handle(msg map[string]interface{}, started *bool) error {
+	switch {
+	case msg["from"] != nil:
+		// Chat messages, or the reason ours was not delivered.
+		if msg["from"] == "you" && !b.sentChat.IsZero() {
+			b.st.observe("chat", time.Since(b.sentChat))
+			b.sentChat = time.Time{}
+		}
+	case msg["oppReady"] != nil:
+		if *started {
+			break
+		}
+		*started = true
+		if b.myTurn() {
+			return b.move()
+		}
+	case msg["move"] != nil:
+		// The opponent moved.
+		b.plies++
+		if err := b.move(); err != nil {
+			return err
+		}
+		if rand.Float64() < *chatRate {
+			b.sentChat = time.Now()
+			return b.send(map[string]string{"chat": "gl hf"})
+		}
+	case msg["clock"] != nil:
+		// The server got our move.
+		b.st.observe("move", time.Since(b.sentMove))
+		if rand.Float64() < *dropRate {
+			return b.reconnect()
+		}
+	case msg["pgn"] != nil:
+		// Back after reconnecting; the opponent may have moved meanwhile.
+		pgn, _ := msg["pgn"].(string)
+		b.plies = len(strings.Fields(pgn))
+		if b.myTurn() {
+			return b.move()
+		}
+	case msg["oppResigned"] != nil, msg["OOT"] != nil, msg["notice"] != nil:
+		return errGameOver
+	}
+	return nil
+}
+
+// reconnect drops the websocket and opens it again.
+func (b *bot) reconnect() error {
+	b.conn.Close()
+	return b.connect("reconnect")
+}
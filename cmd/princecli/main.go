@@ -0,0 +1,600 @@
+// Princecli plays a game against a running server from the terminal, to try
+// changes to the protocol without the web frontend. It seeks a game, or joins
+// one by its id, draws the board after every move and reads moves, in SAN or
+// UCI notation, and commands from the standard input:
+//
+//	/chat <text>    send a chat message
+//	/draw           offer a draw, or accept the one offered
+//	/resign         resign the game
+//	/rematch        offer a rematch, or accept the one offered
+//	/board          draw the board again
+//	/quit           leave the room
+//
+// With -auto it plays random legal moves by itself, as a bot:
+//
+//	go run ./cmd/princecli -clock 1
+//	go run ./cmd/princecli -ai 3 -color black
+//	go run ./cmd/princecli -clock 1 -auto
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+	"github.com/luisguve/princechess-server/internal/rules"
+	"github.com/luisguve/princechess-server/internal/variant"
+)
+
+var (
+	server    = flag.String("server", "http://127.0.0.1:8000", "base URL of the server")
+	origin    = flag.String("origin", "http://localhost:8080", "origin the websocket is opened from")
+	clock     = flag.String("clock", "5", "clock of the game in minutes, to seek in its pool")
+	increment = flag.String("increment", "0", "seconds added to the clock after each move")
+	ai        = flag.Int("ai", 0, "level of the computer to play against, instead of seeking in the pool")
+	color     = flag.String("color", "", "color asked for when seeking or played against the computer, drawn if empty, or in the game of -game")
+	gameId    = flag.String("game", "", "id of a game to join or reconnect to, instead of seeking")
+	username  = flag.String("user", "", "username of the account to log in to; anonymous if empty")
+	password  = flag.String("password", "", "password of the account")
+	auto      = flag.Bool("auto", false, "play random legal moves")
+	think     = flag.Duration("think", time.Second, "time taken to move with -auto")
+	ioTimeout = flag.Duration("timeout", 2*time.Minute, "time to wait for the server before giving up")
+)
+
+func main() {
+	flag.Parse()
+	rand.Seed(time.Now().UnixNano())
+	base, err := url.Parse(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid server URL:", err)
+		os.Exit(2)
+	}
+	c, err := newClient(base)
+	if err == nil && *username != "" {
+		err = c.login()
+	}
+	if err == nil {
+		if *gameId != "" {
+			c.gameId, c.color = *gameId, *color
+		} else {
+			err = c.seek()
+		}
+	}
+	if err == nil {
+		err = c.connect()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer c.conn.Close()
+	if c.color != "" {
+		fmt.Printf("Playing %s against %s in game %s\n", c.color, c.opp, c.gameId)
+	}
+	c.draw()
+
+	go c.readInput()
+	if err := c.readServer(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// client is the player at the terminal. Its session lives in the cookie jar.
+type client struct {
+	base   *url.URL
+	http   *http.Client
+	conn   *websocket.Conn
+	gameId string
+	// Color played, white or black, and the opponent, as far as they are
+	// known.
+	color string
+	opp   string
+
+	// Guards the state of the game, shared by the readers of the server
+	// and the terminal, and the writes to the websocket.
+	m     sync.Mutex
+	start *rules.Position
+	pos   *rules.Position
+	moves []rules.Move
+	// Time left of the players, in milliseconds, as of the last move.
+	whiteClock int64
+	blackClock int64
+	// Offers of the opponent pending an answer.
+	drawOffered    bool
+	rematchOffered bool
+	// Whether the game ended, and whether the player left the room.
+	over bool
+	quit bool
+}
+
+func newClient(base *url.URL) (*client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	start, err := rules.ParseFEN(variant.StandardFEN)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		base:  base,
+		http:  &http.Client{Jar: jar, Timeout: *ioTimeout},
+		start: start,
+		pos:   start,
+	}, nil
+}
+
+func (c *client) url(path string, params url.Values) string {
+	u := *c.base
+	u.Path = "/api/v1" + path
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// apiError reads the message of an error response of the server.
+func apiError(res *http.Response) error {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Error.Message == "" {
+		return errors.New(res.Status)
+	}
+	return fmt.Errorf("%s: %s", body.Error.Code, body.Error.Message)
+}
+
+func (c *client) login() error {
+	res, err := c.http.PostForm(c.url("/login", nil), url.Values{
+		"username": {*username},
+		"password": {*password},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("login: %v", apiError(res))
+	}
+	return nil
+}
+
+// seek asks for a game until an opponent is found, or a game against the
+// computer.
+func (c *client) seek() error {
+	path, params := "/play", url.Values{"clock": {*clock}, "increment": {*increment}, "color": {*color}}
+	if *ai > 0 {
+		path = "/play/ai"
+		params.Set("level", fmt.Sprint(*ai))
+	}
+	fmt.Println("Seeking a game...")
+	for {
+		res, err := c.http.Get(c.url(path, params))
+		if err != nil {
+			return err
+		}
+		if res.StatusCode == http.StatusRequestTimeout {
+			// Nobody else was seeking.
+			res.Body.Close()
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			err := apiError(res)
+			res.Body.Close()
+			return fmt.Errorf("seek: %v", err)
+		}
+		var found map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&found)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		c.gameId, _ = found["roomId"].(string)
+		c.color, _ = found["color"].(string)
+		c.opp, _ = found["opp"].(string)
+		return nil
+	}
+}
+
+// connect opens the websocket of the game. The room may not be set up yet
+// right after the seek, so a missing match is retried for a while.
+func (c *client) connect() error {
+	u := *c.base
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = "/api/v1/game"
+	u.RawQuery = url.Values{
+		"id":       {c.gameId},
+		"clock":    {*clock},
+		"protocol": {strconv.Itoa(protocol.Current)},
+	}.Encode()
+	header := http.Header{"Origin": {*origin}}
+	for _, ck := range c.http.Jar.Cookies(c.base) {
+		header.Add("Cookie", ck.String())
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: *ioTimeout}
+	start := time.Now()
+	for {
+		conn, res, err := dialer.Dial(u.String(), header)
+		if err == nil {
+			c.conn = conn
+			return nil
+		}
+		if res == nil || res.StatusCode != http.StatusNotFound || time.Since(start) > *ioTimeout {
+			return fmt.Errorf("connect: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// send writes the message to the server. The caller must hold the lock.
+func (c *client) send(msg interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(*ioTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+// myTurn reports whether the player is on turn. The caller must hold the
+// lock.
+func (c *client) myTurn() bool {
+	return c.color != "" && !c.over && (c.pos.Turn() == rules.White) == (c.color == "white")
+}
+
+// setPGN replaces the moves of the game with the ones of the PGN sent by the
+// server. The caller must hold the lock.
+func (c *client) setPGN(pgn string) error {
+	pos, moves, err := rules.ParsePGN(c.start, pgn)
+	if err != nil {
+		return fmt.Errorf("invalid PGN %q: %v", pgn, err)
+	}
+	c.pos, c.moves = pos, moves
+	return nil
+}
+
+// play makes the move, in SAN or UCI notation, and sends the game as it
+// stands after it. The caller must hold the lock.
+func (c *client) play(text string) error {
+	if !c.myTurn() {
+		return errors.New("Not your turn")
+	}
+	m, err := c.pos.ParseSAN(text)
+	if err != nil {
+		if m, err = c.pos.ParseMove(text); err != nil {
+			return fmt.Errorf("%v: %s", err, text)
+		}
+	}
+	c.moves = append(c.moves, m)
+	c.pos = c.pos.Apply(m)
+	err = c.send(map[string]interface{}{
+		"move": map[string]string{
+			"color": c.color[:1],
+			"pgn":   rules.FormatMoves(c.start, c.moves),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// The player who ends the game on the board tells the server.
+	var result string
+	switch c.pos.Status() {
+	case rules.Checkmate:
+		result = "1-0"
+		if c.color == "black" {
+			result = "0-1"
+		}
+	case rules.Stalemate, rules.InsufficientMaterial:
+		result = "1/2-1/2"
+	default:
+		return nil
+	}
+	c.over = true
+	return c.send(map[string]interface{}{"gameOver": true, "result": result})
+}
+
+// autoMove plays a random legal move after thinking, if it's the player's
+// turn and the game goes on.
+func (c *client) autoMove() {
+	if !*auto {
+		return
+	}
+	go func() {
+		time.Sleep(*think)
+		c.m.Lock()
+		defer c.m.Unlock()
+		legal := c.pos.LegalMoves()
+		if !c.myTurn() || len(legal) == 0 {
+			return
+		}
+		m := legal[rand.Intn(len(legal))]
+		san := c.pos.SAN(m)
+		fmt.Println("Playing", san)
+		if err := c.play(san); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		c.drawLocked()
+	}()
+}
+
+func (c *client) draw() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.drawLocked()
+}
+
+// drawLocked draws the board from the side of the player, with the last
+// move and the clocks. The caller must hold the lock.
+func (c *client) drawLocked() {
+	var b strings.Builder
+	ranks, files := []int{7, 6, 5, 4, 3, 2, 1, 0}, []int{0, 1, 2, 3, 4, 5, 6, 7}
+	if c.color == "black" {
+		ranks, files = []int{0, 1, 2, 3, 4, 5, 6, 7}, []int{7, 6, 5, 4, 3, 2, 1, 0}
+	}
+	b.WriteByte('\n')
+	for _, rank := range ranks {
+		fmt.Fprintf(&b, " %d ", rank+1)
+		for _, file := range files {
+			piece := c.pos.Piece(rank*8 + file)
+			if piece == 0 {
+				piece = '.'
+			}
+			b.WriteByte(' ')
+			b.WriteByte(piece)
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("   ")
+	for _, file := range files {
+		b.WriteByte(' ')
+		b.WriteByte(byte('a' + file))
+	}
+	b.WriteByte('\n')
+	if len(c.moves) > 0 {
+		fmt.Fprintf(&b, "Moves: %s\n", rules.FormatMoves(c.start, c.moves))
+	}
+	if c.whiteClock != 0 || c.blackClock != 0 {
+		fmt.Fprintf(&b, "Clocks: white %v, black %v\n", msDuration(c.whiteClock), msDuration(c.blackClock))
+	}
+	switch {
+	case c.pos.Status() != rules.Ongoing:
+		fmt.Fprintf(&b, "Game over: %s\n", c.pos.Status())
+	case c.myTurn():
+		b.WriteString("Your move\n")
+	}
+	fmt.Print(b.String())
+}
+
+func msDuration(ms int64) time.Duration {
+	return (time.Duration(ms) * time.Millisecond).Round(100 * time.Millisecond)
+}
+
+// setClocks keeps the clocks sent by the server along with a move. The caller
+// must hold the lock.
+func (c *client) setClocks(msg map[string]interface{}) {
+	white, _ := msg["whiteClockMs"].(float64)
+	black, _ := msg["blackClockMs"].(float64)
+	c.whiteClock, c.blackClock = int64(white), int64(black)
+}
+
+// readServer handles the messages of the server until the connection closes.
+func (c *client) readServer() error {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.m.Lock()
+			quit := c.quit
+			c.m.Unlock()
+			if quit {
+				return nil
+			}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) &&
+				(closeErr.Code == websocket.CloseGoingAway || closeErr.Code == websocket.CloseNormalClosure) {
+				fmt.Println("The room closed", closeErr.Text)
+				return nil
+			}
+			return err
+		}
+		// Chat messages may come several in a frame.
+		for _, line := range strings.Split(string(data), "\n") {
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				return fmt.Errorf("invalid message %q: %v", line, err)
+			}
+			c.m.Lock()
+			err := c.handle(msg)
+			c.m.Unlock()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+}
+
+// handle reacts to a message of the server. The caller must hold the lock.
+func (c *client) handle(msg map[string]interface{}) error {
+	switch {
+	case msg["from"] != nil && msg["chat"] != nil:
+		fmt.Printf("<%v> %v\n", msg["from"], msg["chat"])
+	case msg["chatError"] != nil:
+		fmt.Println("Message not sent:", noticeText(msg["chatError"]))
+	case msg["move"] != nil:
+		// The opponent moved.
+		mv, _ := msg["move"].(map[string]interface{})
+		pgn, _ := mv["pgn"].(string)
+		if err := c.setPGN(pgn); err != nil {
+			return err
+		}
+		c.setClocks(msg)
+		c.drawOffered = false
+		c.drawLocked()
+		if c.myTurn() {
+			c.autoMove()
+		}
+	case msg["pgn"] != nil:
+		// Back in the game; the opponent may have moved meanwhile.
+		pgn, _ := msg["pgn"].(string)
+		if err := c.setPGN(pgn); err != nil {
+			return err
+		}
+		c.drawLocked()
+		if c.myTurn() {
+			c.autoMove()
+		}
+	case msg["whiteClockMs"] != nil:
+		// The server got our move.
+		c.setClocks(msg)
+		fmt.Printf("Clocks: white %v, black %v\n", msDuration(c.whiteClock), msDuration(c.blackClock))
+	case msg["oppReady"] != nil:
+		fmt.Println("Your opponent is in the game")
+		if c.myTurn() {
+			c.autoMove()
+		}
+	case msg["waitingOpp"] != nil:
+		fmt.Println("Your opponent lost the connection; waiting for them to come back")
+	case msg["oppGone"] != nil:
+		fmt.Println("Your opponent left")
+	case msg["drawOffer"] == "true":
+		c.drawOffered = true
+		fmt.Println("Your opponent offers a draw; /draw to accept")
+	case msg["oppAcceptedDraw"] != nil:
+		c.over = true
+		fmt.Println("Draw agreed")
+	case msg["oppResigned"] != nil:
+		c.over = true
+		fmt.Println("Your opponent resigned")
+	case msg["OOT"] == "MY_CLOCK":
+		c.over = true
+		fmt.Println("You ran out of time")
+	case msg["OOT"] == "OPP_CLOCK":
+		c.over = true
+		fmt.Println("Your opponent ran out of time")
+	case msg["rematchOffer"] == "true":
+		c.rematchOffered = true
+		fmt.Println("Your opponent offers a rematch; /rematch to accept")
+	case msg["oppAcceptedRematch"] != nil:
+		c.rematch()
+	case msg["notice"] != nil:
+		fmt.Println(noticeText(msg["notice"]))
+	case msg["protocolDeprecated"] != nil:
+		fmt.Println(noticeText(msg["protocolDeprecated"]))
+	case msg["protocol"] != nil:
+		// The versions the server speaks, one of them ours.
+	case msg["spectators"] != nil:
+		fmt.Printf("Spectators: %v\n", msg["spectators"])
+	default:
+		data, _ := json.Marshal(msg)
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+// rematch starts the game over, with the colors switched. The caller must
+// hold the lock.
+func (c *client) rematch() {
+	c.rematchOffered, c.drawOffered, c.over = false, false, false
+	if c.color == "white" {
+		c.color = "black"
+	} else if c.color == "black" {
+		c.color = "white"
+	}
+	c.pos, c.moves, c.whiteClock, c.blackClock = c.start, nil, 0, 0
+	fmt.Printf("Rematch: you play %s\n", c.color)
+	c.drawLocked()
+	if c.myTurn() {
+		c.autoMove()
+	}
+}
+
+// noticeText returns the text of a notice of the server, or its code if it
+// wasn't translated.
+func noticeText(v interface{}) string {
+	n, _ := v.(map[string]interface{})
+	if text, ok := n["text"].(string); ok && text != "" {
+		return text
+	}
+	return fmt.Sprint(n["code"])
+}
+
+// readInput sends the moves and commands typed in the terminal to the server.
+func (c *client) readInput() {
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			continue
+		}
+		c.m.Lock()
+		err := c.command(line)
+		c.m.Unlock()
+		if err == errQuit {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+var errQuit = errors.New("quit")
+
+// command runs a line typed in the terminal. The caller must hold the lock.
+func (c *client) command(line string) error {
+	if !strings.HasPrefix(line, "/") {
+		if err := c.play(line); err != nil {
+			return err
+		}
+		c.drawLocked()
+		return nil
+	}
+	cmd, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch cmd {
+	case "/chat":
+		return c.send(map[string]string{"chat": arg})
+	case "/draw":
+		if c.drawOffered {
+			c.drawOffered, c.over = false, true
+			return c.send(map[string]bool{"acceptDraw": true})
+		}
+		return c.send(map[string]bool{"drawOffer": true})
+	case "/resign":
+		c.over = true
+		return c.send(map[string]bool{"resign": true})
+	case "/rematch":
+		if c.rematchOffered {
+			if err := c.send(map[string]bool{"acceptRematch": true}); err != nil {
+				return err
+			}
+			c.rematch()
+			return nil
+		}
+		return c.send(map[string]bool{"rematchOffer": true})
+	case "/board":
+		c.drawLocked()
+		return nil
+	case "/quit":
+		if err := c.send(map[string]bool{"finishRoom": true}); err != nil {
+			return err
+		}
+		c.quit = true
+		c.conn.Close()
+		return errQuit
+	}
+	return fmt.Errorf("Unknown command %s", cmd)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const commBansFile = "comm_bans.json"
+
+// Kinds of communication bans. Unlike bans, they keep the user from talking
+// to the others rather than from playing.
+const (
+	// Silences the user in every chat: the lobby, the spectators' chats and
+	// the chat with their opponents.
+	commBanChat = "chat"
+	// Silences the user in the chats of a single game, the one with their
+	// opponent if they play it and the one of its spectators.
+	commBanGameChat = "gameChat"
+	// Keeps the user from inviting others to play.
+	commBanChallenge = "challenge"
+)
+
+// Code of the error responses to the invites of users banned from
+// challenging.
+const errorChallengeBanned = "CHALLENGE_BANNED"
+
+// Layout of the expiration of the communication bans, as told to the users.
+const commBanExpiresLayout = "2006-01-02 15:04 MST"
+
+func validCommBanKind(kind string) bool {
+	switch kind {
+	case commBanChat, commBanGameChat, commBanChallenge:
+		return true
+	}
+	return false
+}
+
+// commBan restricts what a user can say. Bans without expiration are
+// permanent.
+type commBan struct {
+	Id      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Uid     string    `json:"uid"`
+	GameId  string    `json:"gameId,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// commBanId returns the id of the ban of the kind, so that banning a user
+// again replaces the ban they had.
+func commBanId(kind, uid, gameId string) string {
+	id := kind + ":" + uid
+	if gameId != "" {
+		id += ":" + gameId
+	}
+	return id
+}
+
+func (b commBan) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+var commBanListing = listing{
+	sorts:       []string{"created", "expires"},
+	defaultSort: "-created",
+	filters: []param{
+		form("kind", "string", false, "chat, gameChat or challenge"),
+		form("uid", "string", false, ""),
+		form("gameId", "string", false, ""),
+	},
+}
+
+func (b commBan) pageId() string {
+	return b.Id
+}
+
+func (b commBan) sortKey(field string) sortKey {
+	if field == "expires" {
+		if b.Expires.IsZero() {
+			// Permanent ones last.
+			return sortKey{num: math.MaxFloat64}
+		}
+		return timeKey(b.Expires)
+	}
+	return timeKey(b.Created)
+}
+
+func (b commBan) matches(filter, value string) bool {
+	switch filter {
+	case "kind":
+		return b.Kind == value
+	case "uid":
+		return b.Uid == value
+	case "gameId":
+		return b.GameId == value
+	}
+	return true
+}
+
+// commBanStore keeps the communication bans by id, persisted to the data
+// directory.
+type commBanStore struct {
+	m    *sync.Mutex
+	bans map[string]commBan
+}
+
+func newCommBanStore() (*commBanStore, error) {
+	s := &commBanStore{
+		m:    &sync.Mutex{},
+		bans: make(map[string]commBan),
+	}
+	if err := loadJSON(commBansFile, &s.bans); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// banned returns the ban of the kind of the user in effect, if any. Bans of
+// the chat of a game are looked up for the game given.
+func (s *commBanStore) banned(kind, uid, gameId string) (commBan, bool) {
+	if kind != commBanGameChat {
+		gameId = ""
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	b, ok := s.bans[commBanId(kind, uid, gameId)]
+	if !ok || b.expired(time.Now()) {
+		return commBan{}, false
+	}
+	return b, true
+}
+
+func (s *commBanStore) add(b commBan) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.bans[b.Id] = b
+	return saveJSON(commBansFile, s.bans)
+}
+
+// lift removes the ban, reporting whether there was one.
+func (s *commBanStore) lift(id string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.bans[id]; !ok {
+		return false, nil
+	}
+	delete(s.bans, id)
+	return true, saveJSON(commBansFile, s.bans)
+}
+
+// list returns the bans in effect, forgetting the expired ones.
+func (s *commBanStore) list() ([]commBan, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	bans := make([]commBan, 0, len(s.bans))
+	for id, b := range s.bans {
+		if b.expired(now) {
+			delete(s.bans, id)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	return bans, saveJSON(commBansFile, s.bans)
+}
+
+// silenced returns the notice for the user if they are banned from the chats
+// of the game, every game's if gameId is empty.
+func (rout *router) silenced(uid, gameId string) (notice, bool) {
+	b, ok := rout.commBans.banned(commBanChat, uid, "")
+	if !ok && gameId != "" {
+		b, ok = rout.commBans.banned(commBanGameChat, uid, gameId)
+	}
+	if !ok {
+		return notice{}, false
+	}
+	if b.Expires.IsZero() {
+		return newNotice(noticeChatBanned), true
+	}
+	return newNotice(noticeChatBannedUntil, b.Expires.UTC().Format(commBanExpiresLayout)), true
+}
+
+// refuseIfChallengeBanned responds with an error if the user is banned from
+// inviting others, reporting whether they are.
+func (rout *router) refuseIfChallengeBanned(w http.ResponseWriter, uid string) bool {
+	b, ok := rout.commBans.banned(commBanChallenge, uid, "")
+	if !ok {
+		return false
+	}
+	msg := "You are banned from challenging other players"
+	if !b.Expires.IsZero() {
+		msg += " until " + b.Expires.UTC().Format(commBanExpiresLayout)
+	}
+	writeAPIError(w, http.StatusForbidden, apiError{Code: errorChallengeBanned, Message: msg})
+	return true
+}
+
+// Ban a user from a chat or from challenging for the given number of seconds,
+// or forever if not set. Banning them again replaces the ban.
+func (rout *router) handleCommBan(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		writeError(w, "Empty uid", http.StatusBadRequest)
+		return
+	}
+	kind := r.FormValue("kind")
+	if !validCommBanKind(kind) {
+		writeError(w, "Invalid kind: " + kind, http.StatusBadRequest)
+		return
+	}
+	gameId := r.FormValue("gameId")
+	if (kind == commBanGameChat) != (gameId != "") {
+		writeError(w, "Bans of the chat of a game, and only them, need the game", http.StatusBadRequest)
+		return
+	}
+	b := commBan{
+		Id:      commBanId(kind, uid, gameId),
+		Kind:    kind,
+		Uid:     uid,
+		GameId:  gameId,
+		Reason:  r.FormValue("reason"),
+		Created: time.Now(),
+	}
+	if duration := r.FormValue("duration"); duration != "" {
+		seconds, err := strconv.Atoi(duration)
+		if err != nil || seconds <= 0 {
+			writeError(w, "Invalid duration: " + duration, http.StatusBadRequest)
+			return
+		}
+		b.Expires = b.Created.Add(time.Duration(seconds) * time.Second)
+	}
+	if err := rout.commBans.add(b); err != nil {
+		requestLogger(r).error("Could not save communication bans", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resB, err := json.Marshal(b)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the communication bans in effect.
+func (rout *router) handleGetCommBans(w http.ResponseWriter, r *http.Request) {
+	q, err := commBanListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bans, err := rout.commBans.list()
+	if err != nil {
+		requestLogger(r).error("Could not save communication bans", "err", err)
+	}
+	items := make([]pageItem, 0, len(bans))
+	for _, b := range bans {
+		items = append(items, b)
+	}
+	page, next := paginate(items, q)
+	list := make([]commBan, 0, len(page))
+	for _, item := range page {
+		list = append(list, item.(commBan))
+	}
+	res := pageResponse("bans", list, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Lift a communication ban before it expires.
+func (rout *router) handleLiftCommBan(w http.ResponseWriter, r *http.Request) {
+	ok, err := rout.commBans.lift(mux.Vars(r)["id"])
+	if err != nil {
+		requestLogger(r).error("Could not save communication bans", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
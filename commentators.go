@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Commentators are spectators whose messages in the spectator chat are
+// highlighted, and also reach the spectators following the game on /watch,
+// /tv or its stream. Players never see them, as the rest of the spectator
+// chat. The grants are kept in a banStore, with the event as the reason.
+
+const commentatorsFile = "commentators.json"
+
+// commentator reports whether the user may comment the games.
+func (rout *router) commentator(uid string) bool {
+	_, ok := rout.commentators.banned(uid)
+	return ok
+}
+
+// relayCommentary hands the message of a commentator to the spectators of the
+// game outside the spectator chat.
+func (rout *router) relayCommentary(gameId string, msg publicMessage) {
+	room, ok := rout.rm.live.get(gameId)
+	if !ok {
+		return
+	}
+	select {
+	case room.commentary<- msg:
+	case <-room.closed:
+	}
+}
+
+// comment sends the message of a commentator to the spectators. It isn't
+// held back by the broadcast delay, since commentators watch the game with
+// the delay too.
+func (r *Room) comment(msg publicMessage) {
+	data, err := json.Marshal(map[string]publicMessage{
+		"commentary": msg,
+	})
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	r.deliver(spectatorUpdate{data: data})
+}
+
+// Let a user comment the games, for the given number of seconds or until
+// revoked. The event they comment is kept as the reason.
+func (rout *router) handleGrantCommentator(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		writeError(w, "Empty uid", http.StatusBadRequest)
+		return
+	}
+	grant := ban{
+		Uid:     uid,
+		Reason:  r.FormValue("event"),
+		Created: time.Now(),
+	}
+	if duration := r.FormValue("duration"); duration != "" {
+		seconds, err := strconv.Atoi(duration)
+		if err != nil || seconds <= 0 {
+			writeError(w, "Invalid duration: " + duration, http.StatusBadRequest)
+			return
+		}
+		grant.Expires = grant.Created.Add(time.Duration(seconds) * time.Second)
+	}
+	if err := rout.commentators.add(grant); err != nil {
+		requestLogger(r).error("Could not save commentators", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List the users who may comment the games.
+func (rout *router) handleGetCommentators(w http.ResponseWriter, r *http.Request) {
+	commentators, err := rout.commentators.list()
+	if err != nil {
+		requestLogger(r).error("Could not save commentators", "err", err)
+	}
+	bansPage(w, r, "commentators", commentators)
+}
+
+// Take the commentator role away from a user.
+func (rout *router) handleRevokeCommentator(w http.ResponseWriter, r *http.Request) {
+	ok, err := rout.commentators.lift(mux.Vars(r)["uid"])
+	if err != nil {
+		requestLogger(r).error("Could not save commentators", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Commentator not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types of the responses worth compressing. The JSON responses don't
+// set theirs, and are sniffed as plain text.
+var compressibleTypes = []string{
+	"application/json",
+	"application/x-chess-pgn",
+	"application/x-ndjson",
+	"text/",
+}
+
+func compressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncoding returns the encoding of the compressed response the client
+// accepts, gzip or deflate, preferring gzip, or "" if it accepts neither.
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		accepted[coding] = true
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if q, err := strconv.ParseFloat(f[2:], 64); err == nil && q == 0 {
+					accepted[coding] = false
+				}
+			}
+		}
+	}
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// compressResponses compresses the responses for the clients accepting it,
+// once their body is long enough to be worth it. Websocket upgrades go
+// through untouched, since the connection is hijacked.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !conf.Compression || r.Method == "HEAD" ||
+			strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the beginning of the body of a response until it
+// reaches the minimum size to compress it, and compresses the rest as it is
+// written. Bodies shorter than that are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	// Whether the status was sent, and the writer compressing the body if
+	// it's compressed.
+	started bool
+	w       io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	cw.status = status
+	// Bodiless responses.
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.started {
+		if cw.w != nil {
+			return cw.w.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= conf.CompressionMinSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what was written so far, compressed if the response is worth
+// compressing even if it's short yet, as streams are.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.start(true); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start sends the status and the buffered body, setting up the compression of
+// the body if compress is set and its media type is worth it.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		var err error
+		switch cw.encoding {
+		case "gzip":
+			cw.w, err = gzip.NewWriterLevel(cw.ResponseWriter, conf.CompressionLevel)
+		case "deflate":
+			cw.w, err = flate.NewWriter(cw.ResponseWriter, conf.CompressionLevel)
+		}
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.w != nil {
+		_, err = cw.w.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends the rest of the response: the body as it is if it never reached
+// the minimum size, or the end of the compressed body.
+func (cw *compressWriter) close() {
+	if !cw.started {
+		if cw.status == 0 {
+			// Nothing was written: the server sends 200 with no body.
+			return
+		}
+		if err := cw.start(false); err != nil {
+			return
+		}
+	}
+	if cw.w != nil {
+		cw.w.Close()
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// File the settings are read from unless PRINCE_CONFIG names another one.
+const defaultConfigFile = "config.json"
+
+// config holds the settings of the server. They are read from a JSON file
+// whose keys are the json tags of the fields, and each one can be overridden
+// with the environment variable of its env tag. Durations are written as Go
+// durations, e.g. "90s" or "10m", and lists as JSON arrays in the file or
+// comma separated in the environment.
+//
+// Settings tagged reload are read again on SIGHUP or POST /admin/reload, and
+// are read through confMu since they may change while they are in use. The
+// others need a restart.
+type config struct {
+	// Address to listen on. The PORT environment variable, set by Heroku,
+	// takes precedence and listens on every interface.
+	Addr        string `json:"addr" env:"PRINCE_ADDR"`
+	DataDir     string `json:"dataDir" env:"PRINCE_DATA_DIR"`
+	FrontendURL string `json:"frontendURL" env:"PRINCE_FRONTEND_URL"`
+
+	// Certificate and private key files, in PEM format, to serve HTTPS
+	// without a reverse proxy. If RedirectAddr is set as well, plain HTTP
+	// requests to it are redirected to HTTPS.
+	TLSCert      string `json:"tlsCert" env:"PRINCE_TLS_CERT"`
+	TLSKey       string `json:"tlsKey" env:"PRINCE_TLS_KEY"`
+	RedirectAddr string `json:"redirectAddr" env:"PRINCE_REDIRECT_ADDR"`
+
+	// Domains to get certificates for from Let's Encrypt instead, which are
+	// kept in ACMECacheDir, "acme" in the data directory by default. The
+	// HTTP challenges are answered on RedirectAddr, which must then be
+	// reachable on port 80.
+	ACMEDomains  []string `json:"acmeDomains" env:"PRINCE_ACME_DOMAINS"`
+	ACMECacheDir string   `json:"acmeCacheDir" env:"PRINCE_ACME_CACHE_DIR"`
+	ACMEEmail    string   `json:"acmeEmail" env:"PRINCE_ACME_EMAIL"`
+
+	// Redis server relaying events between the nodes when the server runs in
+	// several of them, and the base URL the other nodes reach this one at.
+	RedisAddr     string `json:"redisAddr" env:"PRINCE_REDIS_ADDR"`
+	RedisPassword string `json:"redisPassword" env:"PRINCE_REDIS_PASSWORD"`
+	AdvertiseURL  string `json:"advertiseURL" env:"PRINCE_ADVERTISE_URL"`
+
+	// Keys of the session cookies, read from cookie_hash.env if unset, and of
+	// the tokens sent by email, which defaults to the session key.
+	SessionKey string `json:"sessionKey" env:"PRINCE_SESSION_KEY"`
+	EncKey     string `json:"encKey" env:"PRINCE_ENC_KEY"`
+	TokenKey   string `json:"tokenKey" env:"PRINCE_TOKEN_KEY"`
+
+	ReadTimeout  time.Duration `json:"readTimeout" env:"PRINCE_READ_TIMEOUT"`
+	WriteTimeout time.Duration `json:"writeTimeout" env:"PRINCE_WRITE_TIMEOUT"`
+
+	// Whether the responses are compressed with gzip or deflate for the
+	// clients accepting it, at the level given, from 1 for the fastest to 9
+	// for the smallest. Bodies shorter than CompressionMinSize bytes are sent
+	// as they are.
+	Compression        bool `json:"compression" env:"PRINCE_COMPRESSION"`
+	CompressionLevel   int  `json:"compressionLevel" env:"PRINCE_COMPRESSION_LEVEL"`
+	CompressionMinSize int  `json:"compressionMinSize" env:"PRINCE_COMPRESSION_MIN_SIZE"`
+
+	// Time given to ongoing HTTP requests to finish on shutdown, and to the
+	// rooms to wrap up their games.
+	ShutdownTimeout     time.Duration `json:"shutdownTimeout" env:"PRINCE_SHUTDOWN_TIMEOUT"`
+	AdjudicationTimeout time.Duration `json:"adjudicationTimeout" env:"PRINCE_ADJUDICATION_TIMEOUT"`
+
+	// Origins allowed to make requests, "*" for any unless credentials are
+	// allowed, and the rest of the CORS settings. The headers allowed by
+	// default are those the API reads.
+	CORSOrigins     []string `json:"corsOrigins" env:"PRINCE_CORS_ORIGINS" reload:"true"`
+	CORSHeaders     []string `json:"corsHeaders" env:"PRINCE_CORS_HEADERS"`
+	CORSCredentials bool     `json:"corsCredentials" env:"PRINCE_CORS_CREDENTIALS"`
+	CORSMaxAge      int      `json:"corsMaxAge" env:"PRINCE_CORS_MAX_AGE"`
+	CORSDebug       bool     `json:"corsDebug" env:"PRINCE_CORS_DEBUG"`
+
+	// Time allowed to write a message to the peer, and to read the next pong
+	// message from the peer.
+	WriteWait time.Duration `json:"writeWait" env:"PRINCE_WRITE_WAIT"`
+	PongWait  time.Duration `json:"pongWait" env:"PRINCE_PONG_WAIT"`
+
+	// Time a player has to come back after disconnecting from a game before
+	// the opponent is told they left.
+	ReconnectGrace time.Duration `json:"reconnectGrace" env:"PRINCE_RECONNECT_GRACE" reload:"true"`
+
+	// Time the players have to make the first move of a game once both are
+	// in the room before the game is aborted. Zero never aborts them.
+	FirstMoveTimeout time.Duration `json:"firstMoveTimeout" env:"PRINCE_FIRST_MOVE_TIMEOUT" reload:"true"`
+
+	// Most games hosted at once; new games are refused beyond it. Zero means
+	// no limit.
+	MaxGames int `json:"maxGames" env:"PRINCE_MAX_GAMES"`
+
+	// Spectators of a game the room sends every update to; the ones coming
+	// after them poll snapshots of the game from a cache. Zero means no
+	// limit.
+	MaxWatchers int `json:"maxWatchers" env:"PRINCE_MAX_WATCHERS"`
+
+	// Time a player waits in a matchmaking pool for an opponent, unless they
+	// ask for another, up to MaxMatchWait.
+	MatchTimeout time.Duration `json:"matchTimeout" env:"PRINCE_MATCH_TIMEOUT"`
+	MaxMatchWait time.Duration `json:"maxMatchWait" env:"PRINCE_MAX_MATCH_WAIT"`
+
+	// Rooms whose second player doesn't join within HalfRoomTTL of the first
+	// one are closed. They are looked for every RoomSweepInterval.
+	HalfRoomTTL       time.Duration `json:"halfRoomTTL" env:"PRINCE_HALF_ROOM_TTL"`
+	RoomSweepInterval time.Duration `json:"roomSweepInterval" env:"PRINCE_ROOM_SWEEP_INTERVAL"`
+
+	// Most websockets open at once, in total and from a single IP address.
+	// Zero means no limit.
+	MaxConns      int `json:"maxConns" env:"PRINCE_MAX_CONNS"`
+	MaxConnsPerIP int `json:"maxConnsPerIP" env:"PRINCE_MAX_CONNS_PER_IP"`
+
+	// Whether the server runs behind a reverse proxy, such as the router of
+	// Heroku, that appends the address of the client to X-Forwarded-For.
+	TrustProxy bool `json:"trustProxy" env:"PRINCE_TRUST_PROXY"`
+
+	// Maximum message size allowed from peer. Messages between MaxMessageSize
+	// and MaxFrameSize are dropped without closing the connection; larger
+	// frames close it.
+	MaxMessageSize int64 `json:"maxMessageSize" env:"PRINCE_MAX_MESSAGE_SIZE"`
+	MaxFrameSize   int64 `json:"maxFrameSize" env:"PRINCE_MAX_FRAME_SIZE"`
+
+	// Maximum length of a chat message, in characters.
+	MaxChatLength int `json:"maxChatLength" env:"PRINCE_MAX_CHAT_LENGTH" reload:"true"`
+
+	// Users may send up to ChatBurst messages within ChatWindow.
+	ChatBurst  int           `json:"chatBurst" env:"PRINCE_CHAT_BURST" reload:"true"`
+	ChatWindow time.Duration `json:"chatWindow" env:"PRINCE_CHAT_WINDOW" reload:"true"`
+
+	// Invites expire after InviteExpiration unless the host picks another
+	// expiration, up to MaxInviteExpiration. Players of an invite game can
+	// invite each other again within ReinviteWindow after it ends.
+	InviteExpiration    time.Duration `json:"inviteExpiration" env:"PRINCE_INVITE_EXPIRATION"`
+	MaxInviteExpiration time.Duration `json:"maxInviteExpiration" env:"PRINCE_MAX_INVITE_EXPIRATION"`
+	ReinviteWindow      time.Duration `json:"reinviteWindow" env:"PRINCE_REINVITE_WINDOW"`
+
+	// Users creating more than InviteBurst invites within InviteBurstWindow
+	// must pass a challenge to create more.
+	InviteBurst       int           `json:"inviteBurst" env:"PRINCE_INVITE_BURST" reload:"true"`
+	InviteBurstWindow time.Duration `json:"inviteBurstWindow" env:"PRINCE_INVITE_BURST_WINDOW" reload:"true"`
+
+	// Limits of the time controls players can pick.
+	MaxBaseMinutes      int `json:"maxBaseMinutes" env:"PRINCE_MAX_BASE_MINUTES"`
+	MaxIncrementSeconds int `json:"maxIncrementSeconds" env:"PRINCE_MAX_INCREMENT_SECONDS"`
+
+	// Message shown to every user, e.g. to announce maintenance.
+	Banner string `json:"banner" env:"PRINCE_BANNER" reload:"true"`
+
+	// Versions of the websocket protocol scheduled for removal, and the date
+	// they stop being served, as 2006-01-02. The clients speaking them are
+	// warned on connecting and in the banner of livedata.
+	DeprecatedProtocols []string `json:"deprecatedProtocols" env:"PRINCE_DEPRECATED_PROTOCOLS" reload:"true"`
+	ProtocolSunset      string   `json:"protocolSunset" env:"PRINCE_PROTOCOL_SUNSET" reload:"true"`
+
+	// Bearer token of the admin endpoints, which are disabled if it's empty.
+	AdminToken string `json:"adminToken" env:"PRINCE_ADMIN_TOKEN"`
+
+	// Siteverify API of a CAPTCHA service (reCAPTCHA, hCaptcha, Turnstile)
+	// and its secret. No challenge is required if the URL is empty.
+	CaptchaVerifyURL string `json:"captchaVerifyURL" env:"PRINCE_CAPTCHA_VERIFY_URL"`
+	CaptchaSecret    string `json:"captchaSecret" env:"PRINCE_CAPTCHA_SECRET"`
+
+	// SMTP server the emails are sent through, as host:port, the user to
+	// authenticate as, if any, and the address they are sent from. Without
+	// a server the emails are only logged.
+	SMTPAddr     string `json:"smtpAddr" env:"PRINCE_SMTP_ADDR"`
+	SMTPUser     string `json:"smtpUser" env:"PRINCE_SMTP_USER"`
+	SMTPPassword string `json:"smtpPassword" env:"PRINCE_SMTP_PASSWORD"`
+	MailFrom     string `json:"mailFrom" env:"PRINCE_MAIL_FROM"`
+
+	// Least level of the lines logged, debug, info, warn or error, and their
+	// format, text or json.
+	LogLevel  string `json:"logLevel" env:"PRINCE_LOG_LEVEL" reload:"true"`
+	LogFormat string `json:"logFormat" env:"PRINCE_LOG_FORMAT"`
+
+	// Words not allowed anywhere in a username, besides the built-in ones.
+	BannedWords []string `json:"bannedWords" env:"PRINCE_BANNED_WORDS" reload:"true"`
+}
+
+// Settings of the running server.
+var conf = defaultConfig()
+
+// Guards the settings tagged reload.
+var confMu = &sync.RWMutex{}
+
+func defaultConfig() *config {
+	return &config{
+		Addr:                "127.0.0.1:8000",
+		DataDir:             "data",
+		FrontendURL:         "https://princechess.netlify.app",
+		ReadTimeout:         15 * time.Second,
+		WriteTimeout:        15 * time.Second,
+		Compression:         true,
+		CompressionLevel:    6,
+		CompressionMinSize:  1024,
+		ShutdownTimeout:     10 * time.Second,
+		AdjudicationTimeout: 5 * time.Second,
+		CORSOrigins:         []string{"http://localhost:8080", "https://princechess.netlify.app"},
+		CORSHeaders:         []string{"Authorization", "Content-Type", "If-None-Match", "If-Modified-Since", "X-Request-Id"},
+		CORSCredentials:     true,
+		WriteWait:           10 * time.Second,
+		PongWait:            60 * time.Second,
+		ReconnectGrace:      5 * time.Second,
+		FirstMoveTimeout:    30 * time.Second,
+		MatchTimeout:        5 * time.Second,
+		MaxMatchWait:        5 * time.Minute,
+		HalfRoomTTL:         2 * time.Minute,
+		RoomSweepInterval:   30 * time.Second,
+		MaxConns:            1000,
+		MaxConnsPerIP:       20,
+		MaxWatchers:         200,
+		MaxMessageSize:      512,
+		MaxFrameSize:        64 * 1024,
+		MaxChatLength:       200,
+		ChatBurst:           5,
+		ChatWindow:          10 * time.Second,
+		InviteExpiration:    60 * time.Second,
+		MaxInviteExpiration: 24 * time.Hour,
+		ReinviteWindow:      10 * time.Minute,
+		InviteBurst:         5,
+		InviteBurstWindow:   10 * time.Minute,
+		MaxBaseMinutes:      180,
+		MaxIncrementSeconds: 180,
+		LogLevel:            "info",
+		LogFormat:           "text",
+	}
+}
+
+// pingPeriod is how often pings are sent to the peer. It must be less than
+// PongWait.
+func (c *config) pingPeriod() time.Duration {
+	return (c.PongWait * 9) / 10
+}
+
+func (c *config) corsOrigins() []string {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.CORSOrigins
+}
+
+func (c *config) reconnectGrace() time.Duration {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.ReconnectGrace
+}
+
+func (c *config) firstMoveTimeout() time.Duration {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.FirstMoveTimeout
+}
+
+func (c *config) maxChatLength() int {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.MaxChatLength
+}
+
+// chatLimits returns the number of chat messages users may send within the
+// window.
+func (c *config) chatLimits() (burst int, window time.Duration) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.ChatBurst, c.ChatWindow
+}
+
+func (c *config) banner() string {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.Banner
+}
+
+// logLevel returns the least level of the lines logged.
+func (c *config) logLevel() logLevel {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	level, _ := parseLogLevel(c.LogLevel)
+	return level
+}
+
+func (c *config) bannedWords() []string {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return c.BannedWords
+}
+
+// protocolSunset returns the date the version of the protocol stops being
+// served, if it's scheduled for removal.
+func (c *config) protocolSunset(version int) (string, bool) {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	for _, v := range c.DeprecatedProtocols {
+		if v == strconv.Itoa(version) {
+			return c.ProtocolSunset, true
+		}
+	}
+	return "", false
+}
+
+// update sets the settings tagged reload to the ones of next, returning the
+// json keys of the settings that changed: the ones applied and the ones that
+// need a restart to take effect.
+func (c *config) update(next *config) (applied, ignored []string) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	cur, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		if reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		key := field.Tag.Get("json")
+		if field.Tag.Get("reload") != "true" {
+			ignored = append(ignored, key)
+			continue
+		}
+		cur.Field(i).Set(nv.Field(i))
+		applied = append(applied, key)
+	}
+	return applied, ignored
+}
+
+// loadConfig reads the settings from the config file, if any, and the
+// environment. A missing config file is an error only if it was named by
+// PRINCE_CONFIG.
+func loadConfig() (*config, error) {
+	c := defaultConfig()
+	path, named := os.LookupEnv("PRINCE_CONFIG")
+	if !named {
+		path = defaultConfigFile
+	}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := c.decode(b); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case named || !os.IsNotExist(err):
+		return nil, err
+	}
+	if err := c.overrideFromEnv(); err != nil {
+		return nil, err
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		c.Addr = ":" + port
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return nil, errors.New("tlsCert and tlsKey must be set together")
+	}
+	if c.TLSCert != "" && len(c.ACMEDomains) > 0 {
+		return nil, errors.New("tlsCert and acmeDomains can't be set together")
+	}
+	if c.RedisAddr != "" && c.AdvertiseURL == "" {
+		return nil, errors.New("advertiseURL must be set along with redisAddr")
+	}
+	if c.CORSCredentials {
+		for _, origin := range c.CORSOrigins {
+			if origin == "*" {
+				return nil, errors.New(`corsOrigins can't be "*" along with corsCredentials`)
+			}
+		}
+	}
+	if _, ok := parseLogLevel(c.LogLevel); !ok {
+		return nil, errors.New("logLevel must be debug, info, warn or error")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return nil, errors.New("logFormat must be text or json")
+	}
+	if c.CompressionLevel < gzip.BestSpeed || c.CompressionLevel > gzip.BestCompression {
+		return nil, errors.New("compressionLevel must be between 1 and 9")
+	}
+	for _, v := range c.DeprecatedProtocols {
+		if n, err := strconv.Atoi(v); err != nil || !protocol.Supports(n) || n == protocol.Current {
+			return nil, fmt.Errorf("deprecatedProtocols: %q is not a supported version older than %d", v, protocol.Current)
+		}
+	}
+	if len(c.DeprecatedProtocols) > 0 {
+		if _, err := time.Parse(sunsetLayout, c.ProtocolSunset); err != nil {
+			return nil, errors.New("protocolSunset must be a date as 2006-01-02 along with deprecatedProtocols")
+		}
+	}
+	return c, nil
+}
+
+// decode sets the settings present in the JSON config file. Unknown keys are
+// rejected so that typos don't go unnoticed.
+func (c *config) decode(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("json")
+		value, ok := raw[key]
+		if !ok {
+			continue
+		}
+		delete(raw, key)
+		field := v.Field(i).Addr().Interface()
+		if _, isDuration := field.(*time.Duration); isDuration {
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			if err := parseSetting(field, s); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			continue
+		}
+		if err := json.Unmarshal(value, field); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	for key := range raw {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// overrideFromEnv sets the settings whose environment variable is set.
+func (c *config) overrideFromEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+		if err := parseSetting(v.Field(i).Addr().Interface(), value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// parseSetting parses the value into the setting pointed to by field.
+func parseSetting(field interface{}, value string) error {
+	var err error
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *[]string:
+		*f = splitList(value)
+	case *bool:
+		*f, err = strconv.ParseBool(value)
+	case *int:
+		*f, err = strconv.Atoi(value)
+	case *int64:
+		*f, err = strconv.ParseInt(value, 10, 64)
+	case *time.Duration:
+		*f, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unsupported setting type %T", field)
+	}
+	return err
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// Close codes of the sockets of users removed by an admin.
+const (
+	closeBanned = 4003
+	closeKicked = 4004
+)
+
+// Close code of the sockets refused for exceeding the connection limits.
+const closeTooManyConns = 4006
+
+// connRegistry keeps track of the open websockets of every user, so that they
+// can be closed from outside of their pumps, and caps the number of sockets
+// open at once.
+type connRegistry struct {
+	m *sync.Mutex
+
+	// IP address of the client of each socket, by user.
+	conns map[string]map[protocol.Conn]string
+
+	// Open sockets in total and by IP address.
+	total int
+	perIP map[string]int
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		m:     &sync.Mutex{},
+		conns: make(map[string]map[protocol.Conn]string),
+		perIP: make(map[string]int),
+	}
+}
+
+// add registers the socket, reporting false if it would exceed the limits of
+// open sockets.
+func (cr *connRegistry) add(uid, ip string, conn protocol.Conn) bool {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	if conf.MaxConns > 0 && cr.total >= conf.MaxConns {
+		return false
+	}
+	if conf.MaxConnsPerIP > 0 && cr.perIP[ip] >= conf.MaxConnsPerIP {
+		return false
+	}
+	if cr.conns[uid] == nil {
+		cr.conns[uid] = make(map[protocol.Conn]string)
+	}
+	cr.conns[uid][conn] = ip
+	cr.total++
+	cr.perIP[ip]++
+	return true
+}
+
+func (cr *connRegistry) remove(uid string, conn protocol.Conn) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	ip, ok := cr.conns[uid][conn]
+	if !ok {
+		return
+	}
+	delete(cr.conns[uid], conn)
+	if len(cr.conns[uid]) == 0 {
+		delete(cr.conns, uid)
+	}
+	cr.total--
+	if cr.perIP[ip]--; cr.perIP[ip] == 0 {
+		delete(cr.perIP, ip)
+	}
+}
+
+// online reports whether the user has a socket open on this node.
+func (cr *connRegistry) online(uid string) bool {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	return len(cr.conns[uid]) > 0
+}
+
+// sizes returns the number of open sockets, and of users and IP addresses
+// they belong to.
+func (cr *connRegistry) sizes() map[string]int {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	return map[string]int{
+		"total": cr.total,
+		"users": len(cr.conns),
+		"ips":   len(cr.perIP),
+	}
+}
+
+// admitConn registers the socket of the user, closing it if it exceeds the
+// limits of open sockets. The caller must remove admitted sockets once they
+// are closed.
+func (rout *router) admitConn(uid string, conn protocol.Conn, r *http.Request) bool {
+	if rout.conns.add(uid, remoteIP(r), conn) {
+		rout.recordPresence(uid)
+		return true
+	}
+	requestLogger(r).warn("Too many connections", "ip", remoteIP(r))
+	closeWithNotice(conn, closeTooManyConns, newNotice(noticeTooManyConns), requestLanguage(r))
+	conn.Close()
+	return false
+}
+
+// closeAll closes every socket of the user with the given close code and
+// reason. The pumps of the sockets clean up after themselves once their reads
+// fail.
+func (cr *connRegistry) closeAll(uid string, closeCode int, reason string) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+	payload := websocket.FormatCloseMessage(closeCode, reason)
+	for conn := range cr.conns[uid] {
+		// WriteControl is safe to call concurrently with the writers of the
+		// pumps.
+		conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(conf.WriteWait))
+		conn.Close()
+	}
+}
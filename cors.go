@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// checkOrigin reports whether the websocket upgrade request comes from one of
+// the origins allowed by the CORS settings. Browsers always send the Origin
+// header, so requests without one aren't made by a website on behalf of a
+// visitor; requests from the host of the server itself are allowed too.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	return allowedOrigin(origin) || sameHost(r, origin)
+}
+
+// allowedOrigin reports whether the origin is one of the allowed by the CORS
+// settings. Any origin, "*", is only allowed for requests without
+// credentials: otherwise every website could act on behalf of the visitors
+// logged in.
+func allowedOrigin(origin string) bool {
+	for _, allowed := range conf.corsOrigins() {
+		if (allowed == "*" && !conf.CORSCredentials) || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameHost reports whether the origin is the host of the server itself.
+func sameHost(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// corsOptions returns the CORS settings of the server, so that it can be
+// deployed along with any frontend. The allowed origins are looked up on each
+// request, since they can be reloaded.
+func corsOptions() cors.Options {
+	return cors.Options{
+		AllowOriginFunc:  allowedOrigin,
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
+		AllowedHeaders:   conf.CORSHeaders,
+		AllowCredentials: conf.CORSCredentials,
+		MaxAge:           conf.CORSMaxAge,
+		Debug:            conf.CORSDebug,
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/cors"
+)
+
+// useCORS sets the allowed origins and credentials for the test.
+func useCORS(t *testing.T, origins []string, credentials bool) {
+	t.Helper()
+	oldOrigins, oldCredentials := conf.CORSOrigins, conf.CORSCredentials
+	conf.CORSOrigins, conf.CORSCredentials = origins, credentials
+	t.Cleanup(func() {
+		conf.CORSOrigins, conf.CORSCredentials = oldOrigins, oldCredentials
+	})
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	useCORS(t, []string{"https://princechess.netlify.app"}, true)
+	if !allowedOrigin("https://PrinceChess.netlify.app") {
+		t.Error("allowed origin refused")
+	}
+	if allowedOrigin("https://evil.example") {
+		t.Error("unknown origin allowed")
+	}
+
+	// Any origin only goes without credentials.
+	useCORS(t, []string{"*"}, true)
+	if allowedOrigin("https://evil.example") {
+		t.Error(`"*" allowed an origin along with credentials`)
+	}
+	useCORS(t, []string{"*"}, false)
+	if !allowedOrigin("https://evil.example") {
+		t.Error(`"*" refused an origin without credentials`)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	useCORS(t, []string{"https://princechess.netlify.app"}, true)
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://princechess.netlify.app", true},
+		{"https://api.princechess.com", true},
+		{"https://evil.example", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://api.princechess.com/livedata", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if ok := checkOrigin(r); ok != tt.ok {
+			t.Errorf("checkOrigin from %q = %v, want %v", tt.origin, ok, tt.ok)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	useCORS(t, []string{"https://princechess.netlify.app"}, true)
+	h := cors.New(corsOptions()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	preflight := func(origin, headers string) http.Header {
+		r := httptest.NewRequest("OPTIONS", "/game", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		r.Header.Set("Access-Control-Request-Headers", headers)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Header()
+	}
+
+	got := preflight("https://princechess.netlify.app", "Authorization, If-None-Match, X-Request-Id")
+	if o := got.Get("Access-Control-Allow-Origin"); o != "https://princechess.netlify.app" {
+		t.Errorf("Access-Control-Allow-Origin %q, want the origin", o)
+	}
+	if c := got.Get("Access-Control-Allow-Credentials"); c != "true" {
+		t.Errorf("Access-Control-Allow-Credentials %q, want true", c)
+	}
+	if allowed := got.Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "X-Request-Id") {
+		t.Errorf("Access-Control-Allow-Headers %q, want the headers the API reads", allowed)
+	}
+
+	if o := preflight("https://evil.example", "Authorization").Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("unknown origin allowed: %q", o)
+	}
+}
+
+func TestLoadConfigRefusesAnyOriginWithCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prince")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	old, had := os.LookupEnv("PRINCE_CONFIG")
+	os.Setenv("PRINCE_CONFIG", path)
+	defer func() {
+		if had {
+			os.Setenv("PRINCE_CONFIG", old)
+		} else {
+			os.Unsetenv("PRINCE_CONFIG")
+		}
+	}()
+
+	for _, tt := range []struct {
+		config string
+		ok     bool
+	}{
+		{`{"corsOrigins": ["*"]}`, false},
+		{`{"corsOrigins": ["*"], "corsCredentials": false}`, true},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfig()
+		if (err == nil) != tt.ok {
+			t.Errorf("loadConfig of %s: %v", tt.config, err)
+		}
+		if err == nil && len(c.CORSHeaders) == 0 {
+			t.Error("no headers allowed by default")
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// How often the dashboard is sent the list of rooms.
+const dashboardInterval = 2 * time.Second
+
+// Flags of the rooms on the dashboard, for the admins to spot the ones worth
+// a look.
+const (
+	// A player left and has yet to come back.
+	flagDisconnected = "disconnected"
+	// Nobody made the first move yet.
+	flagNoFirstMove = "noFirstMove"
+	// The spectators are kept behind the players.
+	flagDelayed = "delayed"
+	// A player declared they play blindfold.
+	flagBlindfold = "blindfold"
+	// The room hosts a board of a bughouse game.
+	flagBughouse = "bughouse"
+	// A player is under a shadow restriction, or has a fair-play report
+	// pending review.
+	flagRestricted = "restricted"
+	flagReported   = "reported"
+)
+
+// roomSummary is a room being hosted, as listed on the dashboard.
+type roomSummary struct {
+	GameId  string     `json:"gameId"`
+	Variant string     `json:"variant"`
+	White   gamePlayer `json:"white"`
+	Black   gamePlayer `json:"black"`
+	// Time left of each player in milliseconds, the color on turn and the
+	// half-moves played.
+	Clocks     map[string]int64 `json:"clocks"`
+	Turn       string           `json:"turn"`
+	Plies      int              `json:"plies"`
+	Spectators int              `json:"spectators"`
+	Rated      bool             `json:"rated"`
+	Training   bool             `json:"training"`
+	Result     string           `json:"result,omitempty"`
+	Flags      []string         `json:"flags"`
+}
+
+// summary returns the state of the room for the dashboard, with the flags the
+// room knows of.
+func (r *Room) summary() roomSummary {
+	turn := "white"
+	if r.onTurn() == "b" {
+		turn = "black"
+	}
+	s := roomSummary{
+		GameId:     r.white.gameId,
+		Variant:    r.white.setup.variant().Name(),
+		White:      gamePlayer{Id: r.white.userId, Username: r.white.username},
+		Black:      gamePlayer{Id: r.black.userId, Username: r.black.username},
+		Clocks:     r.clocks(),
+		Turn:       turn,
+		Plies:      r.plies,
+		Spectators: r.spectatorCount(),
+		Rated:      r.rated,
+		Training:   r.training,
+		Result:     r.result,
+		Flags:      []string{},
+	}
+	if r.waitingPlayer {
+		s.Flags = append(s.Flags, flagDisconnected)
+	}
+	if r.firstMoveTimer != nil {
+		s.Flags = append(s.Flags, flagNoFirstMove)
+	}
+	if r.broadcastDelay > 0 {
+		s.Flags = append(s.Flags, flagDelayed)
+	}
+	if len(r.blindfold) > 0 {
+		s.Flags = append(s.Flags, flagBlindfold)
+	}
+	if r.bughouse != nil {
+		s.Flags = append(s.Flags, flagBughouse)
+	}
+	return s
+}
+
+// inspect asks the room for its summary, reporting false if it closed.
+func (r *Room) inspect() (roomSummary, bool) {
+	reply := make(chan roomSummary, 1)
+	select {
+	case r.inspections<- reply:
+	case <-r.closed:
+		return roomSummary{}, false
+	}
+	return <-reply, true
+}
+
+// roomSummaries returns the rooms being hosted, by game id.
+func (rout *router) roomSummaries() []roomSummary {
+	ids := rout.rm.live.ids()
+	sort.Strings(ids)
+	reported := rout.reports.pendingUids()
+	rooms := make([]roomSummary, 0, len(ids))
+	for _, id := range ids {
+		room, ok := rout.rm.live.get(id)
+		if !ok {
+			continue
+		}
+		s, ok := room.inspect()
+		if !ok {
+			continue
+		}
+		for _, uid := range []string{s.White.Id, s.Black.Id} {
+			if rout.restricted(uid) {
+				s.Flags = append(s.Flags, flagRestricted)
+				break
+			}
+		}
+		if reported[s.White.Id] || reported[s.Black.Id] {
+			s.Flags = append(s.Flags, flagReported)
+		}
+		rooms = append(rooms, s)
+	}
+	return rooms
+}
+
+// dashboardMessage is a message of an admin on the dashboard: the id of the
+// game to view, replacing the one viewed, or "" to stop viewing it.
+type dashboardMessage struct {
+	View *string `json:"view"`
+}
+
+// dashboard streams the rooms being hosted to an admin, along with the game
+// of the one they view, as its spectators see it.
+type dashboard struct {
+	conn protocol.Conn
+	lang string
+	// Inbound ids of the games to view, and what's wrong with the last
+	// message that didn't fit its schema.
+	view    chan string
+	invalid chan error
+	// Closed once the admin's connection goes away.
+	gone chan struct{}
+	// Spectator of the room viewed, if any, and the id of its game.
+	viewing   *watcher
+	viewingId string
+}
+
+// Reading goroutine - the admin only picks the game to view.
+func (d *dashboard) readPump() {
+	defer func() {
+		close(d.gone)
+		d.conn.Close()
+	}()
+	d.conn.SetReadLimit(conf.MaxFrameSize)
+	d.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	d.conn.SetPongHandler(func(string) error { d.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	for {
+		data, oversized, err := readMessage(d.conn)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				rootLogger.warn("Dashboard connection closed unexpectedly", "err", err)
+			}
+			return
+		}
+		if oversized {
+			continue
+		}
+		var msg dashboardMessage
+		err = protocol.Decode(data, &msg)
+		if err == nil && msg.View == nil {
+			err = errors.New("missing view")
+		}
+		if err != nil {
+			select {
+			case <-d.invalid:
+			default:
+			}
+			d.invalid<- err
+			continue
+		}
+		select {
+		case d.view<- *msg.View:
+		case <-d.gone:
+			return
+		}
+	}
+}
+
+// run is the writing goroutine: it sends the rooms every dashboardInterval
+// and relays the game viewed.
+func (d *dashboard) run(rout *router) {
+	ticker := time.NewTicker(conf.pingPeriod())
+	rooms := time.NewTicker(dashboardInterval)
+	defer func() {
+		ticker.Stop()
+		rooms.Stop()
+		d.stopViewing()
+		d.conn.Close()
+	}()
+	if !d.write(map[string]interface{}{"rooms": rout.roomSummaries()}) {
+		return
+	}
+	for {
+		select {
+		case <-rooms.C:
+			if !d.write(map[string]interface{}{"rooms": rout.roomSummaries()}) {
+				return
+			}
+		case gameId := <-d.view:
+			if !d.startViewing(rout, gameId) {
+				return
+			}
+		case data, ok := <-d.viewed():
+			gameId := d.viewingId
+			if !ok {
+				// The room closed or let the viewer go.
+				d.viewing, d.viewingId = nil, ""
+				if !d.write(map[string]string{"viewClosed": gameId}) {
+					return
+				}
+				break
+			}
+			ok = d.write(map[string]interface{}{
+				"view": map[string]interface{}{
+					"gameId": gameId,
+					"event":  json.RawMessage(data),
+				},
+			})
+			if !ok {
+				return
+			}
+		case err := <-d.invalid:
+			ev := noticeEvent{key: "error", notice: newNotice(noticeInvalidMessage, err)}
+			if !d.write(ev.localize(d.lang)) {
+				return
+			}
+		case <-ticker.C:
+			d.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := d.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-d.gone:
+			return
+		}
+	}
+}
+
+// startViewing follows the game as a spectator hidden from its players,
+// leaving the one viewed before. It reports false if the admin is gone.
+func (d *dashboard) startViewing(rout *router, gameId string) bool {
+	d.stopViewing()
+	if gameId == "" {
+		return true
+	}
+	room, ok := rout.rm.live.get(gameId)
+	if !ok {
+		ev := noticeEvent{key: "error", notice: newNotice(noticeRoomNotFound)}
+		return d.write(ev.localize(d.lang))
+	}
+	wt := &watcher{
+		uid:    "admin",
+		room:   room,
+		send:   make(chan []byte, watcherBufferSize),
+		hidden: true,
+	}
+	select {
+	case room.watch<- wt:
+	case <-room.closed:
+		ev := noticeEvent{key: "error", notice: newNotice(noticeGameOver)}
+		return d.write(ev.localize(d.lang))
+	}
+	d.viewing, d.viewingId = wt, gameId
+	return true
+}
+
+func (d *dashboard) stopViewing() {
+	if d.viewing != nil {
+		d.viewing.room.leave(d.viewing)
+		d.viewing, d.viewingId = nil, ""
+	}
+}
+
+// viewed returns the channel of the game viewed, nil if none.
+func (d *dashboard) viewed() <-chan []byte {
+	if d.viewing == nil {
+		return nil
+	}
+	return d.viewing.send
+}
+
+func (d *dashboard) write(payload interface{}) bool {
+	d.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+	return d.conn.WriteJSON(payload) == nil
+}
+
+// Stream the rooms being hosted, with their players, clocks, moves,
+// spectators and flags, every couple of seconds. The admin may send
+// {"view": gameId} to follow a game as a spectator the players don't know of,
+// and {"view": ""} to stop.
+func (rout *router) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	d := &dashboard{
+		conn:    conn,
+		lang:    requestLanguage(r),
+		view:    make(chan string),
+		invalid: make(chan error, 1),
+		gone:    make(chan struct{}),
+	}
+	requestLogger(r).info("Dashboard opened", "ip", remoteIP(r))
+	go d.run(rout)
+	go d.readPump()
+}
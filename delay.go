@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest delay the spectators of a game can be kept behind its players.
+const maxBroadcastDelay = 30 * time.Minute
+
+var errInvalidDelay = errors.New("Invalid delay")
+
+// holdBack queues the update for the spectators until the broadcast delay
+// passes.
+func (r *Room) holdBack(u spectatorUpdate) {
+	snapshot, err := json.Marshal(r.snapshot())
+	if err != nil {
+		r.log.error("Could not marshal snapshot", "err", err)
+		return
+	}
+	u.snapshot = snapshot
+	u.due = r.clock.Now().Add(r.broadcastDelay)
+	r.heldBack = append(r.heldBack, u)
+	if r.heldTimer == nil {
+		r.heldTimer = r.clock.NewTimer(r.broadcastDelay)
+	}
+}
+
+// heldBackDue returns the channel of the timer releasing the held back
+// updates, or nil if there are none.
+func (r *Room) heldBackDue() <-chan time.Time {
+	if r.heldTimer == nil {
+		return nil
+	}
+	return r.heldTimer.C()
+}
+
+// releaseHeldBack delivers the held back updates that are due, in order, and
+// sets the timer for the next one.
+func (r *Room) releaseHeldBack() {
+	now := r.clock.Now()
+	for len(r.heldBack) > 0 && !r.heldBack[0].due.After(now) {
+		u := r.heldBack[0]
+		r.heldBack = r.heldBack[1:]
+		r.deliver(u)
+	}
+	if len(r.heldBack) == 0 {
+		r.heldTimer = nil
+		return
+	}
+	r.heldTimer = r.clock.NewTimer(r.heldBack[0].due.Sub(now))
+}
+
+// changeBroadcastDelay sets how long the spectators are kept behind. The
+// updates already held back keep their time; without a delay they are all
+// delivered right away.
+func (r *Room) changeBroadcastDelay(d time.Duration) {
+	if d == r.broadcastDelay {
+		return
+	}
+	if r.broadcastDelay == 0 && !r.startBroadcastDelay() {
+		return
+	}
+	r.broadcastDelay = d
+	r.log.info("Broadcast delay changed", "delay", d)
+	if d > 0 {
+		return
+	}
+	if r.heldTimer != nil {
+		r.heldTimer.Stop()
+		r.heldTimer = nil
+	}
+	for _, u := range r.heldBack {
+		r.deliver(u)
+	}
+	r.heldBack = nil
+	r.spectatorView, r.spectatorViewOver = nil, false
+}
+
+// startBroadcastDelay makes the spectators see the game as it is when the
+// delay starts until the first update held back is due.
+func (r *Room) startBroadcastDelay() bool {
+	snapshot, err := json.Marshal(r.snapshot())
+	if err != nil {
+		r.log.error("Could not marshal snapshot", "err", err)
+		return false
+	}
+	r.spectatorView, r.spectatorViewOver = snapshot, r.result != ""
+	return true
+}
+
+// delay returns the broadcast delay set for the game, if any.
+func (l *liveRooms) delay(gameId string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.delays[gameId]
+}
+
+// setDelay sets the broadcast delay of the game, for its room once it's
+// hosted, and hands it to the room if it already is.
+func (l *liveRooms) setDelay(gameId string, d time.Duration) {
+	l.m.Lock()
+	if d == 0 {
+		delete(l.delays, gameId)
+	} else {
+		l.delays[gameId] = d
+	}
+	r, ok := l.rooms[gameId]
+	l.m.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case r.setBroadcastDelay<- d:
+	case <-r.closed:
+	}
+}
+
+// forgetDelay drops the broadcast delay of a game that is over.
+func (l *liveRooms) forgetDelay(gameId string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	delete(l.delays, gameId)
+}
+
+// Set how many seconds the spectators of a game are kept behind its players,
+// e.g. in the finals of an arena; zero broadcasts it in real time again. The
+// players are not affected.
+func (rout *router) handleSetBroadcastDelay(w http.ResponseWriter, r *http.Request) {
+	gameId := mux.Vars(r)["id"]
+	secs, err := strconv.Atoi(r.FormValue("seconds"))
+	d := time.Duration(secs) * time.Second
+	if err != nil || d < 0 || d > maxBroadcastDelay {
+		writeError(w, errInvalidDelay.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := rout.matches.get(gameId); !ok {
+		writeError(w, errGameNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	rout.rm.live.setDelay(gameId, d)
+	w.WriteHeader(http.StatusNoContent)
+}
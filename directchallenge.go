@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	idGen "github.com/rs/xid"
+)
+
+var (
+	errDirectChallengeNotFound = errors.New("Challenge not found")
+	errNotChallenged           = errors.New("The challenge is for another player")
+	errNotChallenger           = errors.New("Only the challenger can cancel the challenge")
+)
+
+// directChallenge is a game offered to one player in particular, delivered
+// over their livedata socket, as opposed to an invite link anyone can open.
+type directChallenge struct {
+	Id        string     `json:"id"`
+	From      gamePlayer `json:"from"`
+	To        gamePlayer `json:"to"`
+	Clock     int        `json:"clock"`
+	Increment int        `json:"increment"`
+	Rated     bool       `json:"rated"`
+	// Color the challenger asked for, empty if drawn.
+	Color   string    `json:"color,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	control timeControl
+}
+
+// directChallenges keeps the challenges by id until they are answered,
+// cancelled or expire.
+type directChallenges struct {
+	m          *sync.Mutex
+	challenges map[string]directChallenge
+}
+
+func newDirectChallenges() *directChallenges {
+	return &directChallenges{
+		m:          &sync.Mutex{},
+		challenges: make(map[string]directChallenge),
+	}
+}
+
+func (s *directChallenges) add(c directChallenge) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.challenges[c.Id] = c
+}
+
+// take removes the challenge if check accepts it; otherwise the error of
+// check is returned.
+func (s *directChallenges) take(id string, check func(c directChallenge) error) (directChallenge, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok := s.challenges[id]
+	if !ok {
+		return directChallenge{}, errDirectChallengeNotFound
+	}
+	if err := check(c); err != nil {
+		return directChallenge{}, err
+	}
+	delete(s.challenges, id)
+	return c, nil
+}
+
+// expire removes the challenge, reporting whether it was still open.
+func (s *directChallenges) expire(id string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.challenges[id]; !ok {
+		return false
+	}
+	delete(s.challenges, id)
+	return true
+}
+
+func (s *directChallenges) size() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.challenges)
+}
+
+// challengeClosed lets the player know the challenge is off, for the reason
+// given: declined, cancelled or expired.
+func (rout *router) challengeClosed(uid string, c directChallenge, reason string) {
+	rout.ldHub.direct<- directDelivery{
+		uid: uid,
+		payload: map[string]interface{}{
+			"challengeClosed": map[string]string{
+				"challengeId": c.Id,
+				"reason":      reason,
+			},
+		},
+	}
+}
+
+// Challenge an online player, by their uid or username, to a game. They hear
+// of it through livedata and have until the challenge expires to answer.
+func (rout *router) handleDirectChallenge(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rout.refuseIfChallengeBanned(w, uid) {
+		return
+	}
+	to := r.FormValue("to")
+	if to == "" {
+		writeError(w, "Empty opponent", http.StatusBadRequest)
+		return
+	}
+	opp := gamePlayer{Id: to}
+	if id, ok := rout.accounts.owner(to); ok {
+		opp.Id = id
+	}
+	if a, ok := rout.accounts.get(opp.Id); ok {
+		opp.Username = a.Username
+	}
+	if opp.Id == uid {
+		writeError(w, "You can't challenge yourself", http.StatusBadRequest)
+		return
+	}
+	// Players connected to other nodes can't be told apart from those
+	// offline, so the challenge goes out to them anyway.
+	if rout.shared == nil && !rout.conns.online(opp.Id) {
+		writeError(w, "The player is not online", http.StatusConflict)
+		return
+	}
+	if rout.inviteBursts.hit(uid, time.Now()) && !rout.passChallenge(w, r) {
+		return
+	}
+
+	clock := r.FormValue("clock")
+	control, err := parseTimeControl(clock, r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid time control: " + clock + "+" + r.FormValue("increment"), http.StatusBadRequest)
+		return
+	}
+	color, err := parseColorPreference(r.FormValue("color"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Challenges are casual unless the challenger asks otherwise.
+	rated := false
+	if flag := r.FormValue("rated"); flag != "" {
+		if rated, err = strconv.ParseBool(flag); err != nil {
+			writeError(w, "Invalid rated flag: " + flag, http.StatusBadRequest)
+			return
+		}
+	}
+	if rated && rout.refuseIfNotAcknowledged(w, uid) {
+		return
+	}
+
+	now := time.Now()
+	c := directChallenge{
+		Id:        idGen.New().String(),
+		From:      gamePlayer{Id: uid, Username: username},
+		To:        opp,
+		Clock:     control.minutes(),
+		Increment: control.seconds(),
+		Rated:     rated,
+		Color:     color,
+		Created:   now,
+		Expires:   now.Add(conf.InviteExpiration),
+		control:   control,
+	}
+	rout.challenges.add(c)
+	time.AfterFunc(conf.InviteExpiration, func() {
+		if rout.challenges.expire(c.Id) {
+			rout.challengeClosed(c.From.Id, c, "expired")
+			rout.challengeClosed(c.To.Id, c, "expired")
+		}
+	})
+	rout.ldHub.direct<- directDelivery{
+		uid:     opp.Id,
+		payload: map[string]interface{}{"challenge": c},
+	}
+
+	resB, err := json.Marshal(c)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// takeDirectChallenge removes the challenge of the request if it's addressed
+// to the user, responding with an error otherwise.
+func (rout *router) takeDirectChallenge(w http.ResponseWriter, r *http.Request, uid string) (directChallenge, bool) {
+	c, err := rout.challenges.take(mux.Vars(r)["id"], func(c directChallenge) error {
+		if c.To.Id != uid {
+			return errNotChallenged
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		return c, true
+	case errDirectChallengeNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+	}
+	return c, false
+}
+
+// Accept a challenge, starting the game right away.
+func (rout *router) handleAcceptDirectChallenge(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, ok := rout.takeDirectChallenge(w, r, uid)
+	if !ok {
+		return
+	}
+
+	challenger := user{id: c.From.Id, username: c.From.Username}
+	guest := user{id: uid, username: username}
+	m := match{
+		gameId:  idGen.New().String(),
+		control: c.control,
+		rated:   c.Rated && rout.ratedFor(challenger.id, uid),
+	}
+	challengerWhite := rand.Intn(2) == 0
+	if c.Color != "" {
+		challengerWhite = c.Color == "white"
+	}
+	color := "black"
+	m.white, m.black = challenger, guest
+	if !challengerWhite {
+		color = "white"
+		m.white, m.black = guest, challenger
+	}
+	rout.makeRoom(m)
+	challengerColor := "white"
+	if color == "white" {
+		challengerColor = "black"
+	}
+	rout.ldHub.direct<- directDelivery{
+		uid: challenger.id,
+		payload: map[string]interface{}{
+			"challengeAccepted": map[string]interface{}{
+				"challengeId": c.Id,
+				"color":       challengerColor,
+				"roomId":      m.gameId,
+				"opp":         username,
+				"rated":       m.rated,
+			},
+		},
+	}
+	requestLogger(r).info("Challenge accepted", "challengeId", c.Id, "gameId", m.gameId)
+
+	res := map[string]interface{}{
+		"color":  color,
+		"roomId": m.gameId,
+		"opp":    challenger.username,
+		"rated":  m.rated,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Decline a challenge, letting the challenger know.
+func (rout *router) handleDeclineDirectChallenge(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, ok := rout.takeDirectChallenge(w, r, uid)
+	if !ok {
+		return
+	}
+	rout.challengeClosed(c.From.Id, c, "declined")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Cancel a challenge before it's answered. Only the challenger can.
+func (rout *router) handleCancelDirectChallenge(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := rout.challenges.take(mux.Vars(r)["id"], func(c directChallenge) error {
+		if c.From.Id != uid {
+			return errNotChallenger
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errDirectChallengeNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	rout.challengeClosed(c.To.Id, c, "cancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
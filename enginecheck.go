@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+const (
+	// Reports waiting for the engine.
+	engineCheckQueueSize = 32
+	// Fewest moves of a player, after the opening and leaving out the forced
+	// ones and those of decided positions, to score their play by.
+	minEngineCheckMoves = 10
+
+	// Percentage of moves matching the engine and average centipawn loss
+	// of a typical human player and of an engine. The score of the play
+	// goes from 0 at the former to 100 at the latter, the matches weighing
+	// more than the loss.
+	humanMoveMatch    = 40
+	engineMoveMatch   = 90
+	humanAverageLoss  = 60
+	engineAverageLoss = 10
+	moveMatchWeight   = 0.6
+)
+
+var (
+	errEngineCheckQueueFull = errors.New("Too many reports waiting for the engine")
+	errTooFewMoves          = errors.New("Too few moves to compare with the engine")
+)
+
+// engineCheck compares the moves of a reported player with those of the
+// engine, for the moderators to weigh the report.
+type engineCheck struct {
+	Status string `json:"status"`
+	// Moves compared, the percentage of them that matched the best move of
+	// the engine and the average centipawns they lost.
+	Moves       int `json:"moves,omitempty"`
+	MoveMatch   int `json:"moveMatch,omitempty"`
+	AverageLoss int `json:"averageLoss,omitempty"`
+	// Likelihood, from 0 to 100, that the player was helped by an engine.
+	Score int    `json:"score"`
+	Error string `json:"error,omitempty"`
+}
+
+// engineCheckJob is the comparison of the moves of the player of the color, w
+// or b, in the game with the engine, for the report.
+type engineCheckJob struct {
+	reportId string
+	game     finishedGame
+	color    string
+}
+
+// queueEngineCheck has the engine go through the game of the report in the
+// background. The report must have been queued with the check.
+func (rout *router) queueEngineCheck(rep fairPlayReport, g finishedGame) {
+	select {
+	case rout.engineChecks<- engineCheckJob{reportId: rep.Id, game: g, color: rep.Color}:
+	default:
+		rout.finishEngineCheck(rep.Id, engineCheck{Status: analysisFailed, Error: errEngineCheckQueueFull.Error()})
+	}
+}
+
+// runEngineChecks goes through the queued reports until the server stops,
+// one at a time. The checks left unfinished by the last run of the server
+// fail, since the games are gone.
+func (rout *router) runEngineChecks() {
+	if err := rout.reports.abandonEngineChecks(); err != nil {
+		rootLogger.error("Could not save reports", "err", err)
+	}
+	for job := range rout.engineChecks {
+		rout.runEngineCheck(job)
+	}
+}
+
+func (rout *router) runEngineCheck(job engineCheckJob) {
+	defer func() {
+		if v := recover(); v != nil {
+			reportPanic(rootLogger.with("report", job.reportId), "engine check", v)
+			rout.finishEngineCheck(job.reportId, engineCheck{Status: analysisFailed, Error: "Engine check failed"})
+		}
+	}()
+	ok, err := rout.reports.update(job.reportId, func(rep *fairPlayReport) {
+		rep.Engine = &engineCheck{Status: analysisRunning}
+	})
+	if err != nil {
+		rootLogger.error("Could not save reports", "err", err)
+	}
+	if !ok {
+		// Dismissed while queued.
+		return
+	}
+	check, err := compareWithEngine(job.game, job.color)
+	if err != nil {
+		rootLogger.warn("Could not compare the moves with the engine", "report", job.reportId, "err", err)
+		check = engineCheck{Status: analysisFailed, Error: err.Error()}
+	}
+	rout.finishEngineCheck(job.reportId, check)
+}
+
+func (rout *router) finishEngineCheck(reportId string, check engineCheck) {
+	if _, err := rout.reports.update(reportId, func(rep *fairPlayReport) {
+		rep.Engine = &check
+	}); err != nil {
+		rootLogger.error("Could not save reports", "err", err)
+	}
+}
+
+// compareWithEngine scores the moves of the player of the color in the game
+// by how often they matched the best move of the engine and how many
+// centipawns they lost.
+func compareWithEngine(g finishedGame, color string) (engineCheck, error) {
+	start, err := g.setup.variant().Position(g.setup.startFEN())
+	if err != nil {
+		return engineCheck{}, err
+	}
+	_, moves, err := rules.ParsePGN(start, g.pgn)
+	if err != nil {
+		return engineCheck{}, err
+	}
+	positions := []*rules.Position{start}
+	for _, m := range moves {
+		positions = append(positions, positions[len(positions)-1].Apply(m))
+	}
+	best, scores, err := evaluate(positions, func(int) {})
+	if err != nil {
+		return engineCheck{}, err
+	}
+
+	var compared, matched, loss int
+	for i, m := range moves {
+		pos := positions[i]
+		if i < openingPlies || string(pos.Turn()) != color || len(pos.LegalMoves()) < 2 {
+			continue
+		}
+		// Any move wins or loses a decided position.
+		if capEval(scores[i]) == maxAnalysisEval || capEval(scores[i]) == -maxAnalysisEval {
+			continue
+		}
+		compared++
+		if m == best[i] {
+			matched++
+		}
+		if lost := capEval(scores[i]) - capEval(-scores[i+1]); lost > 0 {
+			loss += lost
+		}
+	}
+	if compared < minEngineCheckMoves {
+		return engineCheck{}, errTooFewMoves
+	}
+	check := engineCheck{
+		Status:      analysisDone,
+		Moves:       compared,
+		MoveMatch:   matched * 100 / compared,
+		AverageLoss: loss / compared,
+	}
+	matchShare := between(float64(check.MoveMatch-humanMoveMatch) / (engineMoveMatch - humanMoveMatch))
+	lossShare := between(float64(humanAverageLoss-check.AverageLoss) / (humanAverageLoss - engineAverageLoss))
+	check.Score = int(math.Round(100 * (moveMatchWeight*matchShare + (1-moveMatchWeight)*lossShare)))
+	return check, nil
+}
+
+// between clamps x to [0, 1].
+func between(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
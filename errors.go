@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/luisguve/princechess-server/internal/httpapi"
+)
+
+// Code of the error responses of the requests that waited for an opponent in
+// vain.
+const errorMatchTimeout = "MATCH_TIMEOUT"
+
+// apiError is the body of every error response of the API, under "error".
+type apiError = httpapi.Error
+
+// writeError responds with the error message and the given status code,
+// which names the error, e.g. NOT_FOUND.
+func writeError(w http.ResponseWriter, message string, status int) {
+	httpapi.WriteError(w, message, status)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e apiError) {
+	httpapi.Write(w, status, e)
+}
+
+// The routes not found, the methods not allowed and the WebSocket handshakes
+// that fail answer in the envelope of the errors too; the upgrader writes the
+// response of the latter.
+var (
+	notFoundHandler         = httpapi.NotFound
+	methodNotAllowedHandler = httpapi.MethodNotAllowed
+)
+
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	writeError(w, reason.Error(), status)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const fairPlayAcksFile = "fairplay_acks.json"
+
+// Code of the error responses to the users who have to acknowledge the
+// fair-play policy before playing rated games.
+const errorFairPlayNotAcknowledged = "FAIR_PLAY_NOT_ACKNOWLEDGED"
+
+// fairPlayAck is when a user last acknowledged the fair-play policy and when
+// they were last flagged for their play, which has them acknowledge it again.
+type fairPlayAck struct {
+	Acknowledged time.Time `json:"acknowledged"`
+	Flagged      time.Time `json:"flagged,omitempty"`
+}
+
+// fairPlayAckStore keeps the acknowledgements of the users by uid, persisted
+// to the data directory, for the moderators to point to.
+type fairPlayAckStore struct {
+	m    *sync.Mutex
+	acks map[string]fairPlayAck
+}
+
+func newFairPlayAckStore() (*fairPlayAckStore, error) {
+	s := &fairPlayAckStore{
+		m:    &sync.Mutex{},
+		acks: make(map[string]fairPlayAck),
+	}
+	if err := loadJSON(fairPlayAcksFile, &s.acks); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// acknowledged reports whether the user acknowledged the policy since they
+// were last flagged.
+func (s *fairPlayAckStore) acknowledged(uid string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ack, ok := s.acks[uid]
+	return ok && ack.Acknowledged.After(ack.Flagged)
+}
+
+func (s *fairPlayAckStore) acknowledge(uid string) (fairPlayAck, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ack := s.acks[uid]
+	ack.Acknowledged = time.Now()
+	s.acks[uid] = ack
+	return ack, saveJSON(fairPlayAcksFile, s.acks)
+}
+
+// flag has the user acknowledge the policy again before their next rated
+// game.
+func (s *fairPlayAckStore) flag(uid string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ack := s.acks[uid]
+	ack.Flagged = time.Now()
+	s.acks[uid] = ack
+	return saveJSON(fairPlayAcksFile, s.acks)
+}
+
+// flagged has the reported user acknowledge the policy again.
+func (rout *router) flagged(rep fairPlayReport) {
+	if err := rout.fairPlayAcks.flag(rep.Uid); err != nil {
+		rootLogger.error("Could not save fair-play acknowledgements", "err", err)
+	}
+}
+
+// refuseIfNotAcknowledged responds with an error if the user has yet to
+// acknowledge the fair-play policy, reporting whether they have to.
+func (rout *router) refuseIfNotAcknowledged(w http.ResponseWriter, uid string) bool {
+	if rout.fairPlayAcks.acknowledged(uid) {
+		return false
+	}
+	writeAPIError(w, http.StatusForbidden, apiError{
+		Code:    errorFairPlayNotAcknowledged,
+		Message: "Acknowledge the fair-play policy before playing rated games",
+	})
+	return true
+}
+
+// Acknowledge the fair-play policy, as needed before the first rated game and
+// after being flagged for review.
+func (rout *router) handleFairPlayAck(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ack, err := rout.fairPlayAcks.acknowledge(uid)
+	if err != nil {
+		requestLogger(r).error("Could not save fair-play acknowledgements", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestLogger(r).info("Fair-play policy acknowledged", "uid", uid)
+
+	resB, err := json.Marshal(ack)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// How often the spectators beyond conf.MaxWatchers look for a newer snapshot
+// of the game.
+const spectatorPollInterval = time.Second
+
+// spectatorCache is the last state of a game as its spectators see it,
+// shared by the spectators the room doesn't send every update to. The room
+// refreshes it while there are any.
+type spectatorCache struct {
+	m        *sync.Mutex
+	snapshot []byte
+	over     bool
+	// Incremented on every refresh.
+	version int
+}
+
+func newSpectatorCache() *spectatorCache {
+	return &spectatorCache{m: &sync.Mutex{}}
+}
+
+func (c *spectatorCache) set(snapshot []byte, over bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.snapshot, c.over = snapshot, over
+	c.version++
+}
+
+func (c *spectatorCache) get() ([]byte, bool, int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.snapshot, c.over, c.version
+}
+
+// follow sends the watcher the snapshots of the game as the cache changes,
+// polling it, until the watcher leaves or the room closes. Snapshots the
+// watcher is too slow to take are skipped.
+func (c *spectatorCache) follow(w *watcher, closed <-chan struct{}) {
+	defer close(w.send)
+	poll := time.NewTicker(spectatorPollInterval)
+	defer poll.Stop()
+	sent := -1
+	for {
+		data, over, version := c.get()
+		if version != sent {
+			select {
+			case w.send<- data:
+				sent = version
+			default:
+			}
+		}
+		if over && w.leaveOnGameOver && version == sent {
+			return
+		}
+		select {
+		case <-poll.C:
+		case <-w.stop:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// addOverflow has the spectator follow the game from the cache, since the
+// room sends its updates to as many spectators as it can already. The data
+// is the state of the game as the spectators see it.
+func (r *Room) addOverflow(w *watcher, data []byte, over bool) {
+	if len(r.overflow) == 0 {
+		r.cache.set(data, over)
+	}
+	r.overflow[w] = true
+	w.stop = make(chan struct{})
+	go r.cache.follow(w, r.closed)
+}
+
+// refreshCache updates the cache with the state of the game after the update
+// delivered to the spectators. The messages besides the state of the game,
+// such as the commentary, don't reach the spectators following the cache.
+func (r *Room) refreshCache(u spectatorUpdate) {
+	snapshot := u.snapshot
+	if snapshot == nil {
+		if r.broadcastDelay > 0 {
+			// Not a change of the game held back.
+			return
+		}
+		var err error
+		if snapshot, err = json.Marshal(r.snapshot()); err != nil {
+			r.log.error("Could not marshal snapshot", "err", err)
+			return
+		}
+	}
+	r.cache.set(snapshot, u.over)
+}
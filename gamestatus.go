@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a game, as told by /game/{id}.
+const (
+	// The players were matched but their room isn't hosting the game yet.
+	gameWaiting  = "waiting"
+	gameActive   = "active"
+	gameFinished = "finished"
+)
+
+// Most games whose status can be asked for in a batch.
+const maxBatchGames = 100
+
+// gamePlayer is a player of a game, as told by /game/{id}.
+type gamePlayer struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// gameStatus is the state of a game, for the clients to decide whether to
+// reconnect to it, watch it or show its result before opening a socket.
+type gameStatus struct {
+	GameId  string     `json:"gameId"`
+	Status  string     `json:"status"`
+	Variant string     `json:"variant"`
+	White   gamePlayer `json:"white"`
+	Black   gamePlayer `json:"black"`
+	// Base time in minutes and increment in seconds.
+	Clock     int  `json:"clock"`
+	Increment int  `json:"increment"`
+	Training  bool `json:"training"`
+	// Time left of each player in milliseconds, and the half-moves played.
+	Clocks map[string]int64 `json:"clocks"`
+	Plies  int              `json:"plies"`
+	Result string           `json:"result,omitempty"`
+}
+
+// liveStatus fills in the state of the game hosted by the room, as far as the
+// spectators have seen it; the broadcast delay holds for this too. It returns
+// false if the room closed meanwhile.
+func liveStatus(room *Room, s *gameStatus) (bool, error) {
+	wt := &watcher{
+		room: room,
+		send: make(chan []byte, watcherBufferSize),
+	}
+	select {
+	case room.watch<- wt:
+	case <-room.closed:
+		return false, nil
+	}
+	defer room.leave(wt)
+	data, ok := <-wt.send
+	if !ok {
+		return false, nil
+	}
+	var ev struct {
+		Snapshot struct {
+			Ply    int              `json:"ply"`
+			Clock  map[string]int64 `json:"clock"`
+			Result string           `json:"result"`
+		} `json:"snapshot"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return false, err
+	}
+	s.Plies = ev.Snapshot.Ply
+	s.Clocks = ev.Snapshot.Clock
+	s.Result = ev.Snapshot.Result
+	s.Status = gameActive
+	if s.Result != "" {
+		s.Status = gameFinished
+	}
+	return true, nil
+}
+
+// gameStatus returns the status of the game, reporting false if it is neither
+// being played nor recently finished.
+func (rout *router) gameStatus(gameId string) (gameStatus, bool, error) {
+	var s gameStatus
+	found := false
+	if m, ok := rout.matches.get(gameId); ok {
+		s = gameStatus{
+			GameId:    gameId,
+			Status:    gameWaiting,
+			Variant:   m.setup.variant().Name(),
+			White:     gamePlayer{Id: m.white.id, Username: m.white.username},
+			Black:     gamePlayer{Id: m.black.id, Username: m.black.username},
+			Clock:     m.control.minutes(),
+			Increment: m.control.seconds(),
+			Training:  m.training,
+			Clocks: map[string]int64{
+				"white": m.baseFor(m.white.id).Milliseconds(),
+				"black": m.baseFor(m.black.id).Milliseconds(),
+			},
+		}
+		found = true
+		if room, hosted := rout.rm.live.get(gameId); hosted {
+			live, err := liveStatus(room, &s)
+			if err != nil {
+				return s, false, err
+			}
+			// The game ended as the room closed.
+			found = live
+		}
+	}
+	if !found {
+		g, ok := rout.analyses.finished(gameId)
+		if !ok {
+			return s, false, nil
+		}
+		clocks := g.clock
+		if len(g.moves) > 0 {
+			clocks = g.moves[len(g.moves) - 1].clock
+		}
+		s = gameStatus{
+			GameId:    gameId,
+			Status:    gameFinished,
+			Variant:   g.setup.variant().Name(),
+			White:     gamePlayer{Id: g.white.id, Username: g.white.username},
+			Black:     gamePlayer{Id: g.black.id, Username: g.black.username},
+			Clock:     g.control.minutes(),
+			Increment: g.control.seconds(),
+			Training:  g.training,
+			Clocks:    clocks,
+			Plies:     len(g.moves),
+			Result:    g.result,
+		}
+	}
+	return s, true, nil
+}
+
+// Get the status of a game: waiting for its players to join, being played or
+// recently finished, with its players, time control, clocks and result.
+func (rout *router) handleGameStatus(w http.ResponseWriter, r *http.Request) {
+	s, ok, err := rout.gameStatus(mux.Vars(r)["id"])
+	if err != nil {
+		requestLogger(r).error("Could not unmarshal snapshot", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+
+	resB, err := json.Marshal(s)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Get the status of several games at once, as /game/{id} tells it, in the
+// order of the ids given. The ids of the games not found are listed apart.
+func (rout *router) handleGamesBatch(w http.ResponseWriter, r *http.Request) {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(r.FormValue("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		writeError(w, "No game ids given", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxBatchGames {
+		writeError(w, "Too many game ids; up to " + strconv.Itoa(maxBatchGames), http.StatusBadRequest)
+		return
+	}
+	games := make([]gameStatus, 0, len(ids))
+	notFound := []string{}
+	for _, id := range ids {
+		s, ok, err := rout.gameStatus(id)
+		if err != nil {
+			requestLogger(r).error("Could not unmarshal snapshot", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		games = append(games, s)
+	}
+	res := map[string]interface{}{
+		"games":    games,
+		"notFound": notFound,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -5,10 +5,12 @@ module github.com/luisguve/princechess-server
 go 1.14
 
 require (
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/sessions v1.2.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/joho/godotenv v1.3.0
 	github.com/rs/cors v1.7.0
 	github.com/rs/xid v1.3.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Pieces a player can give as odds, and the file of the back rank they are
+// taken from when there are two of them. The pawn is the one of the f-file,
+// as in the classic "pawn and move" odds.
+var oddsPieces = map[string]struct {
+	piece byte
+	file  int
+}{
+	"prince": {'I', -1},
+	"rook":   {'R', 0},
+	"knight": {'N', 1},
+	"bishop": {'B', 2},
+	"pawn":   {'P', 5},
+}
+
+var (
+	errInvalidOdds     = errors.New("Invalid odds")
+	errIllegalPosition = errors.New("Illegal position")
+)
+
+// validOdds reports whether the piece can be given as odds. An empty one
+// means no odds.
+func validOdds(odds string) bool {
+	_, ok := oddsPieces[odds]
+	return ok || odds == ""
+}
+
+// giveOdds removes the piece from the starting position of the player of the
+// given color. With no piece on the usual file, e.g. in a Prince960 game, the
+// piece closest to the a-file goes.
+func (s setup) giveOdds(odds, color string) (setup, error) {
+	o, ok := oddsPieces[odds]
+	if !ok {
+		return setup{}, errInvalidOdds
+	}
+	fields := strings.Fields(s.FEN)
+	if len(fields) != 6 {
+		return setup{}, errIllegalPosition
+	}
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return setup{}, errIllegalPosition
+	}
+	piece := o.piece
+	// White's pieces are on the last ranks of the FEN.
+	back, front := 7, 6
+	if color == "black" {
+		back, front = 0, 1
+		piece += 'a' - 'A'
+	}
+	row := back
+	if o.piece == 'P' {
+		row = front
+	}
+	squares := expandRank(ranks[row])
+	file := o.file
+	if file < 0 || squares[file] != piece {
+		file = strings.IndexByte(string(squares), piece)
+	}
+	if file < 0 {
+		return setup{}, errInvalidOdds
+	}
+	squares[file] = 0
+	ranks[row] = compressRank(squares)
+	fields[0] = strings.Join(ranks, "/")
+	if o.piece == 'R' {
+		fields[2] = dropCastling(fields[2], color, file, squares)
+	}
+	s.FEN = strings.Join(fields, " ")
+	s.Odds = odds
+	s.OddsBy = color
+	if err := validatePosition(s.FEN); err != nil {
+		return setup{}, err
+	}
+	return s, nil
+}
+
+// dropCastling takes away from the castling rights of the player of the given
+// color the right to castle with the rook that was on the file. The rights
+// are either in the usual notation or name the files of the rooks.
+func dropCastling(rights, color string, file int, rank []byte) string {
+	king := strings.IndexAny(string(rank), "Kk")
+	side := byte('K')
+	if file < king {
+		side = 'Q'
+	}
+	fileLetter := byte('A' + file)
+	if color == "black" {
+		side += 'a' - 'A'
+		fileLetter += 'a' - 'A'
+	}
+	var b strings.Builder
+	for i := 0; i < len(rights); i++ {
+		if rights[i] != side && rights[i] != fileLetter {
+			b.WriteByte(rights[i])
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+// expandRank returns the eight squares of a rank in FEN, empty ones as zero.
+func expandRank(rank string) []byte {
+	squares := make([]byte, 0, 8)
+	for i := 0; i < len(rank); i++ {
+		c := rank[i]
+		if c >= '1' && c <= '8' {
+			for n := byte(0); n < c-'0'; n++ {
+				squares = append(squares, 0)
+			}
+			continue
+		}
+		squares = append(squares, c)
+	}
+	return squares
+}
+
+// compressRank is the inverse of expandRank.
+func compressRank(squares []byte) string {
+	var b strings.Builder
+	empty := 0
+	for _, c := range squares {
+		if c == 0 {
+			empty++
+			continue
+		}
+		if empty > 0 {
+			b.WriteByte(byte('0' + empty))
+			empty = 0
+		}
+		b.WriteByte(c)
+	}
+	if empty > 0 {
+		b.WriteByte(byte('0' + empty))
+	}
+	return b.String()
+}
+
+// validatePosition checks that a starting position is one a game can be
+// played from: eight full ranks, one king and at most one prince per side, no
+// pawns on the first or last rank, and a rook to castle with for every
+// castling right.
+func validatePosition(fen string) error {
+	fields := strings.Fields(fen)
+	if len(fields) != 6 || (fields[1] != "w" && fields[1] != "b") {
+		return errIllegalPosition
+	}
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return errIllegalPosition
+	}
+	board := make([][]byte, 8)
+	kings, princes := map[byte]int{}, map[byte]int{}
+	for i, rank := range ranks {
+		board[i] = expandRank(rank)
+		if len(board[i]) != 8 {
+			return errIllegalPosition
+		}
+		for _, c := range board[i] {
+			switch c {
+			case 0, 'Q', 'R', 'B', 'N', 'q', 'r', 'b', 'n':
+			case 'K', 'k':
+				kings[c]++
+			case 'I', 'i':
+				princes[c]++
+			case 'P', 'p':
+				if i == 0 || i == 7 {
+					return errIllegalPosition
+				}
+			default:
+				return errIllegalPosition
+			}
+		}
+	}
+	if kings['K'] != 1 || kings['k'] != 1 || princes['I'] > 1 || princes['i'] > 1 {
+		return errIllegalPosition
+	}
+	if fields[2] == "-" {
+		return nil
+	}
+	for i := 0; i < len(fields[2]); i++ {
+		c := fields[2][i]
+		rank, rook, king := board[7], byte('R'), byte('K')
+		if c >= 'a' {
+			rank, rook, king = board[0], 'r', 'k'
+			c -= 'a' - 'A'
+		}
+		k := strings.IndexByte(string(rank), king)
+		if k < 0 {
+			return errIllegalPosition
+		}
+		switch {
+		case c == 'K':
+			if strings.IndexByte(string(rank[k+1:]), rook) < 0 {
+				return errIllegalPosition
+			}
+		case c == 'Q':
+			if strings.IndexByte(string(rank[:k]), rook) < 0 {
+				return errIllegalPosition
+			}
+		case c >= 'A' && c <= 'H':
+			if rank[c-'A'] != rook {
+				return errIllegalPosition
+			}
+		default:
+			return errIllegalPosition
+		}
+	}
+	return nil
+}
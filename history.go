@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// gameSummary is a finished game, as listed in the history of the games.
+type gameSummary struct {
+	GameId  string     `json:"gameId"`
+	White   gamePlayer `json:"white"`
+	Black   gamePlayer `json:"black"`
+	Variant string     `json:"variant"`
+	Result  string     `json:"result"`
+	Plies   int        `json:"plies"`
+	// Base time in minutes and increment in seconds.
+	Clock     int       `json:"clock"`
+	Increment int       `json:"increment"`
+	Training  bool      `json:"training"`
+	Finished  time.Time `json:"finished"`
+}
+
+var gameHistoryListing = listing{
+	sorts:       []string{"finished", "plies"},
+	defaultSort: "-finished",
+	filters: []param{
+		form("player", "string", false, "Uid of either player"),
+		form("variant", "string", false, ""),
+		form("result", "string", false, "1-0, 0-1 or 1/2-1/2"),
+	},
+}
+
+func (g gameSummary) pageId() string {
+	return g.GameId
+}
+
+func (g gameSummary) sortKey(field string) sortKey {
+	if field == "plies" {
+		return sortKey{num: float64(g.Plies)}
+	}
+	return timeKey(g.Finished)
+}
+
+func (g gameSummary) matches(filter, value string) bool {
+	switch filter {
+	case "player":
+		return g.White.Id == value || g.Black.Id == value
+	case "variant":
+		return g.Variant == value
+	case "result":
+		return g.Result == value
+	}
+	return true
+}
+
+// List the games finished recently, latest first unless sorted otherwise.
+// The games of players under shadow restrictions are left out.
+func (rout *router) handleGameHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := gameHistoryListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items := []pageItem{}
+	for _, g := range rout.analyses.recent() {
+		if rout.restricted(g.white.id) || rout.restricted(g.black.id) {
+			continue
+		}
+		items = append(items, gameSummary{
+			GameId:    g.gameId,
+			White:     gamePlayer{Id: g.white.id, Username: g.white.username},
+			Black:     gamePlayer{Id: g.black.id, Username: g.black.username},
+			Variant:   g.setup.variant().Name(),
+			Result:    g.result,
+			Plies:     len(g.moves),
+			Clock:     g.control.minutes(),
+			Increment: g.control.seconds(),
+			Training:  g.training,
+			Finished:  g.finished,
+		})
+	}
+	page, next := paginate(items, q)
+	games := make([]gameSummary, 0, len(page))
+	for _, item := range page {
+		games = append(games, item.(gameSummary))
+	}
+	res := pageResponse("games", games, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+const defaultLanguage = "en"
+
+// Codes of the messages generated by the server. They are stable, so clients
+// may rely on them to render their own text.
+const (
+	noticeLinkExpired        = "LINK_EXPIRED"
+	noticeSelfPlay           = "SELF_PLAY"
+	noticeRoomNotFound       = "ROOM_NOT_FOUND"
+	noticeUnsetClock         = "UNSET_CLOCK"
+	noticeInvalidClock       = "INVALID_CLOCK"
+	noticeInternalError      = "INTERNAL_ERROR"
+	noticeMessageTooLong     = "MESSAGE_TOO_LONG"
+	noticeChatTooLong        = "CHAT_TOO_LONG"
+	noticeChatMuted          = "CHAT_MUTED"
+	noticeChatTimedOut       = "CHAT_TIMED_OUT"
+	noticeChatBanned         = "CHAT_BANNED"
+	noticeChatBannedUntil    = "CHAT_BANNED_UNTIL"
+	noticeChatRateLimited    = "CHAT_RATE_LIMITED"
+	noticeGameOver           = "GAME_OVER"
+	noticeInviteRevoked      = "INVITE_REVOKED"
+	noticeServerShutdown     = "SERVER_SHUTDOWN"
+	noticeGameAborted        = "GAME_ABORTED"
+	noticeNoFirstMove        = "NO_FIRST_MOVE"
+	noticeServerFull         = "SERVER_FULL"
+	noticeTooManyConns       = "TOO_MANY_CONNECTIONS"
+	noticeInvalidMessage     = "INVALID_MESSAGE"
+	noticeProtocolDeprecated = "PROTOCOL_DEPRECATED"
+	noticeNoOpponent         = "NO_OPPONENT"
+	noticeIllegalMove        = "ILLEGAL_MOVE"
+
+	noticeUsernameTooShort     = "USERNAME_TOO_SHORT"
+	noticeUsernameTooLong      = "USERNAME_TOO_LONG"
+	noticeUsernameInvalidChars = "USERNAME_INVALID_CHARS"
+	noticeUsernameReserved     = "USERNAME_RESERVED"
+	noticeUsernameProfane      = "USERNAME_PROFANE"
+)
+
+// Text of the notices by language. The arguments of a notice are formatted
+// into the text in order.
+var translations = map[string]map[string]string{
+	"en": {
+		noticeLinkExpired:        "Time is out - Link expired",
+		noticeSelfPlay:           "You can't play against yourself",
+		noticeRoomNotFound:       "Room not found",
+		noticeUnsetClock:         "Unset clock",
+		noticeInvalidClock:       "Invalid clock",
+		noticeInternalError:      "Internal server error",
+		noticeMessageTooLong:     "Your message is too long",
+		noticeChatTooLong:        "Chat messages can't be longer than %d characters",
+		noticeChatMuted:          "You are muted in this chat",
+		noticeChatTimedOut:       "You are timed out from the chat for %v more",
+		noticeChatBanned:         "You are banned from the chat",
+		noticeChatBannedUntil:    "You are banned from the chat until %s",
+		noticeChatRateLimited:    "You sent more than %d messages in %v; you are timed out from the chat for %v",
+		noticeGameOver:           "Game over",
+		noticeInviteRevoked:      "The invite was revoked",
+		noticeServerShutdown:     "The server is restarting; the game was aborted",
+		noticeGameAborted:        "Something went wrong on the server; the game was aborted",
+		noticeNoFirstMove:        "No move was made within %v; the game was aborted",
+		noticeServerFull:         "The server is full, try again soon",
+		noticeTooManyConns:       "Too many open connections, close some tabs and try again",
+		noticeInvalidMessage:     "Invalid message: %v",
+		noticeProtocolDeprecated: "This version of the app stops working on %s; reload the page to update it",
+		noticeNoOpponent:         "No opponent found",
+		noticeIllegalMove:        "Move not played: %v",
+
+		noticeUsernameTooShort:     "Usernames must be at least %d characters long",
+		noticeUsernameTooLong:      "Usernames can't be longer than %d characters",
+		noticeUsernameInvalidChars: "Usernames may only contain letters, digits, \"_\" and \"-\"",
+		noticeUsernameReserved:     "This username is reserved",
+		noticeUsernameProfane:      "This username contains inappropriate words",
+	},
+	"es": {
+		noticeLinkExpired:        "Se acabó el tiempo - El enlace expiró",
+		noticeSelfPlay:           "No puedes jugar contra ti mismo",
+		noticeRoomNotFound:       "Sala no encontrada",
+		noticeUnsetClock:         "Reloj no especificado",
+		noticeInvalidClock:       "Reloj inválido",
+		noticeInternalError:      "Error interno del servidor",
+		noticeMessageTooLong:     "Tu mensaje es demasiado largo",
+		noticeChatTooLong:        "Los mensajes no pueden tener más de %d caracteres",
+		noticeChatMuted:          "Estás silenciado en este chat",
+		noticeChatTimedOut:       "No puedes escribir en el chat por %v más",
+		noticeChatBanned:         "Tienes prohibido escribir en el chat",
+		noticeChatBannedUntil:    "Tienes prohibido escribir en el chat hasta el %s",
+		noticeChatRateLimited:    "Enviaste más de %d mensajes en %v; no puedes escribir en el chat por %v",
+		noticeGameOver:           "Partida terminada",
+		noticeInviteRevoked:      "La invitación fue revocada",
+		noticeServerShutdown:     "El servidor se está reiniciando; la partida fue anulada",
+		noticeGameAborted:        "Algo salió mal en el servidor; la partida fue anulada",
+		noticeNoFirstMove:        "No se hizo ninguna jugada en %v; la partida fue anulada",
+		noticeServerFull:         "El servidor está lleno, inténtalo de nuevo en breve",
+		noticeTooManyConns:       "Demasiadas conexiones abiertas, cierra algunas pestañas e inténtalo de nuevo",
+		noticeInvalidMessage:     "Mensaje inválido: %v",
+		noticeProtocolDeprecated: "Esta versión de la aplicación dejará de funcionar el %s; recarga la página para actualizarla",
+		noticeNoOpponent:         "No se encontró ningún oponente",
+		noticeIllegalMove:        "Jugada no realizada: %v",
+
+		noticeUsernameTooShort:     "Los nombres de usuario deben tener al menos %d caracteres",
+		noticeUsernameTooLong:      "Los nombres de usuario no pueden tener más de %d caracteres",
+		noticeUsernameInvalidChars: "Los nombres de usuario solo pueden contener letras, dígitos, \"_\" y \"-\"",
+		noticeUsernameReserved:     "Este nombre de usuario está reservado",
+		noticeUsernameProfane:      "Este nombre de usuario contiene palabras inapropiadas",
+	},
+}
+
+// notice is a message generated by the server, identified by a stable code
+// and localized right before being sent to the user.
+type notice struct {
+	code string
+	args []interface{}
+}
+
+func newNotice(code string, args ...interface{}) notice {
+	return notice{code: code, args: args}
+}
+
+// localizedNotice is the wire format of a notice.
+type localizedNotice struct {
+	Code string `json:"code"`
+	Text string `json:"text,omitempty"`
+}
+
+func (n notice) localize(lang string) localizedNotice {
+	text, ok := translations[lang][n.code]
+	if !ok {
+		text = translations[defaultLanguage][n.code]
+	}
+	if len(n.args) > 0 {
+		text = fmt.Sprintf(text, n.args...)
+	}
+	return localizedNotice{
+		Code: n.code,
+		Text: text,
+	}
+}
+
+// noticeEvent is a notice sent under the given key over a socket whose writer
+// knows the language of the user.
+type noticeEvent struct {
+	key    string
+	notice notice
+}
+
+func (ev noticeEvent) localize(lang string) map[string]localizedNotice {
+	return map[string]localizedNotice{
+		ev.key: ev.notice.localize(lang),
+	}
+}
+
+// requestLanguage picks the language of the messages for the user making
+// the request from the "lang" query parameter or the Accept-Language header,
+// falling back to the default language.
+func requestLanguage(r *http.Request) string {
+	candidates := []string{r.URL.Query().Get("lang")}
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		candidates = append(candidates, strings.Split(tag, ";")[0])
+	}
+	for _, tag := range candidates {
+		// Only the primary language subtag is taken into account.
+		lang := strings.ToLower(strings.TrimSpace(strings.Split(tag, "-")[0]))
+		if _, ok := translations[lang]; ok {
+			return lang
+		}
+	}
+	return defaultLanguage
+}
+
+// writeNotices responds with the localized notices as errors, with the given
+// status code. The first one names the error.
+func writeNotices(w http.ResponseWriter, r *http.Request, status int, errs ...notice) {
+	lang := requestLanguage(r)
+	details := make([]apiError, len(errs))
+	for i, n := range errs {
+		l := n.localize(lang)
+		details[i] = apiError{Code: l.Code, Message: l.Text}
+	}
+	e := details[0]
+	if len(details) > 1 {
+		e.Details = details
+	}
+	writeAPIError(w, status, e)
+}
+
+// closeWithNotice sends the localized notice as a text message, then closes
+// the connection with its code as the reason.
+func closeWithNotice(conn protocol.Conn, closeCode int, n notice, lang string) {
+	conn.WriteJSON(map[string]localizedNotice{
+		"notice": n.localize(lang),
+	})
+	payload := websocket.FormatCloseMessage(closeCode, n.code)
+	conn.WriteMessage(websocket.CloseMessage, payload)
+}
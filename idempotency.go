@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Parameter carrying the id the client gave the request, which its
+	// retries carry too.
+	requestIdParam = "requestId"
+	// How long the response to a request is kept for its retries.
+	idempotencyTTL  = 10 * time.Minute
+	maxRequestIdLen = 64
+)
+
+// pastRequest is a request made with a request id, and its response once it
+// is done.
+type pastRequest struct {
+	// The method, path and parameters of the request.
+	fingerprint string
+	// Closed when the response is recorded.
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	// Set if the handler panicked, leaving no response to replay.
+	aborted bool
+}
+
+// pastRequests keeps the responses to the requests made with a request id,
+// by user and id, so that the retries of a seek or a join get its result
+// rather than seeking or joining again.
+type pastRequests struct {
+	m        *sync.Mutex
+	requests map[string]*pastRequest
+}
+
+func newPastRequests() *pastRequests {
+	return &pastRequests{
+		m:        &sync.Mutex{},
+		requests: make(map[string]*pastRequest),
+	}
+}
+
+// start returns the request made with the key before, or registers the one
+// given and reports true if there was none.
+func (p *pastRequests) start(key string, req *pastRequest) (*pastRequest, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if past, ok := p.requests[key]; ok {
+		return past, false
+	}
+	p.requests[key] = req
+	return req, true
+}
+
+func (p *pastRequests) forget(key string, req *pastRequest) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.requests[key] == req {
+		delete(p.requests, key)
+	}
+}
+
+// responseRecorder writes the response through, keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body = append(rec.body, b...)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes the requests carrying a request id safe to retry: a retry
+// waits for the request to be done if it isn't yet, and gets the same
+// response. Server errors aren't kept, so their retries go through again.
+func (rout *router) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.FormValue(requestIdParam)
+		if requestId == "" {
+			next(w, r)
+			return
+		}
+		if len(requestId) > maxRequestIdLen {
+			writeError(w, "Request id too long", http.StatusBadRequest)
+			return
+		}
+		uid, _, err := rout.sessionUser(w, r)
+		if err != nil {
+			requestLogger(r).error("Could not save session", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		params := url.Values{}
+		for k, v := range r.Form {
+			if k != requestIdParam {
+				params[k] = v
+			}
+		}
+		req := &pastRequest{
+			fingerprint: r.Method + " " + r.URL.Path + "?" + params.Encode(),
+			done:        make(chan struct{}),
+		}
+		key := uid + " " + requestId
+		past, first := rout.pastRequests.start(key, req)
+		if !first {
+			if past.fingerprint != req.fingerprint {
+				writeError(w, "Request id used for another request", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-past.done:
+			case <-r.Context().Done():
+				return
+			}
+			if past.aborted {
+				writeError(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			h := w.Header()
+			for k, v := range past.header {
+				if k != "X-Request-Id" {
+					h[k] = v
+				}
+			}
+			h.Set("Idempotent-Replayed", "true")
+			w.WriteHeader(past.status)
+			if _, err := w.Write(past.body); err != nil {
+				requestLogger(r).error("Could not write response", "err", err)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			req.status, req.body = rec.status, rec.body
+			req.header = w.Header().Clone()
+			// recoverPanics responds to a panicking handler once this
+			// returns; the retries go through again rather than get an
+			// empty response.
+			req.aborted = !completed
+			close(req.done)
+			if req.aborted || req.status >= http.StatusInternalServerError {
+				rout.pastRequests.forget(key, req)
+				return
+			}
+			time.AfterFunc(idempotencyTTL, func() {
+				rout.pastRequests.forget(key, req)
+			})
+		}()
+		next(rec, r)
+		completed = true
+	}
+}
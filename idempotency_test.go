@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/luisguve/princechess-server/internal/protocol/protocoltest"
+)
+
+// newIdempotencyRouter returns a router with sessions and the past requests,
+// enough to run the idempotent handlers.
+func newIdempotencyRouter() *router {
+	return &router{
+		store:        sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+		pastRequests: newPastRequests(),
+	}
+}
+
+// session makes requests as one user: the cookie of the first response is
+// sent along with the next requests.
+type session struct {
+	cookies []*http.Cookie
+}
+
+func (s *session) do(h http.Handler, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if method == "GET" {
+		r = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range s.cookies {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		s.cookies = cookies
+	}
+	return rec
+}
+
+func TestIdempotentReplaysTheResponse(t *testing.T) {
+	rout := newIdempotencyRouter()
+	var calls int32
+	h := rout.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Call", string(rune('0'+n)))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"call":` + string(rune('0'+n)) + `}`))
+	})
+	var alice, bob session
+	form := url.Values{"clock": {"5"}, requestIdParam: {"seek-1"}}
+	first := alice.do(h, "POST", "/seeks", form)
+	retry := alice.do(h, "POST", "/seeks", form)
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("X-Call") != "1" {
+		t.Errorf("retry got %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response not marked")
+	}
+
+	// The ids are per user.
+	bob.do(h, "POST", "/seeks", form)
+	if calls != 2 {
+		t.Errorf("another user's request with the same id called the handler %d times in all, want 2", calls)
+	}
+	// Requests without an id always go through.
+	alice.do(h, "POST", "/seeks", url.Values{"clock": {"5"}})
+	if calls != 3 {
+		t.Errorf("request without an id not handled")
+	}
+}
+
+func TestIdempotentRefusesAnotherRequestWithTheId(t *testing.T) {
+	rout := newIdempotencyRouter()
+	h := rout.idempotent(func(w http.ResponseWriter, r *http.Request) {})
+	var alice session
+	alice.do(h, "POST", "/seeks", url.Values{"clock": {"5"}, requestIdParam: {"id"}})
+	if rec := alice.do(h, "POST", "/seeks", url.Values{"clock": {"3"}, requestIdParam: {"id"}}); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("id reused for other parameters: %d, want 422", rec.Code)
+	}
+	if rec := alice.do(h, "POST", "/challenge", url.Values{"clock": {"5"}, requestIdParam: {"id"}}); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("id reused for another path: %d, want 422", rec.Code)
+	}
+	long := strings.Repeat("x", maxRequestIdLen+1)
+	if rec := alice.do(h, "POST", "/seeks", url.Values{requestIdParam: {long}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("id too long: %d, want 400", rec.Code)
+	}
+}
+
+func TestIdempotentRetriesFailures(t *testing.T) {
+	rout := newIdempotencyRouter()
+	var calls int32
+	h := rout.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			writeError(w, "Try again", http.StatusServiceUnavailable)
+		case 2:
+			panic("handler failed")
+		}
+	})
+	var alice session
+	form := url.Values{requestIdParam: {"id"}}
+	if rec := alice.do(h, "POST", "/join", form); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first try: %d", rec.Code)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic didn't go through")
+			}
+		}()
+		alice.do(h, "POST", "/join", form)
+	}()
+	if rec := alice.do(h, "POST", "/join", form); rec.Code != http.StatusOK || calls != 3 {
+		t.Errorf("retry after the failures: %d after %d calls, want 200 after 3", rec.Code, calls)
+	}
+}
+
+func TestIdempotentRetryWaitsForTheRequest(t *testing.T) {
+	rout := newIdempotencyRouter()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var calls int32
+	h := rout.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		w.Write([]byte("paired"))
+	})
+	var alice session
+	form := url.Values{requestIdParam: {"id"}}
+	// Get the cookie first, for both requests to be of the same user.
+	alice.do(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rout.sessionUser(w, r)
+	}), "GET", "/me", nil)
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first<- alice.do(h, "GET", "/play", form) }()
+	<-started
+	retry := make(chan *httptest.ResponseRecorder)
+	go func() { retry<- alice.do(h, "GET", "/play", form) }()
+	close(release)
+	for _, rec := range []*httptest.ResponseRecorder{<-first, <-retry} {
+		if rec.Body.String() != "paired" {
+			t.Errorf("response %q, want paired", rec.Body)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestPostingASeekIsSafeToRetry(t *testing.T) {
+	useTempDataDir(t)
+	rout := newIdempotencyRouter()
+	var err error
+	if rout.ratings, err = newRatingStore(); err != nil {
+		t.Fatal(err)
+	}
+	if rout.commBans, err = newCommBanStore(); err != nil {
+		t.Fatal(err)
+	}
+	rout.m = &sync.Mutex{}
+	rout.matches = newMatchTable()
+	rout.seeks = newSeekBoard()
+	rout.ldHub = newLivedataHub()
+	go rout.ldHub.run()
+
+	h := rout.idempotent(rout.handlePostSeek)
+	var alice session
+	form := url.Values{"clock": {"5"}, requestIdParam: {"seek"}}
+	first := alice.do(h, "POST", "/seeks", form)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("posting the seek: %d %s", first.Code, first.Body)
+	}
+	retry := alice.do(h, "POST", "/seeks", form)
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("retry got %s, want %s", retry.Body, first.Body)
+	}
+	if seeks := rout.seeks.list(); len(seeks) != 1 {
+		t.Errorf("%d seeks open after a retry, want 1", len(seeks))
+	}
+}
+
+func TestChallengingIsSafeToRetry(t *testing.T) {
+	useTempDataDir(t)
+	rout := newIdempotencyRouter()
+	var err error
+	if rout.accounts, err = newAccountStore(); err != nil {
+		t.Fatal(err)
+	}
+	if rout.commBans, err = newCommBanStore(); err != nil {
+		t.Fatal(err)
+	}
+	rout.m = &sync.Mutex{}
+	rout.matches = newMatchTable()
+	rout.conns = newConnRegistry()
+	rout.challenges = newDirectChallenges()
+	rout.inviteBursts = newBurstCounter(conf.InviteBurst, conf.InviteBurstWindow)
+	rout.ldHub = newLivedataHub()
+	go rout.ldHub.run()
+
+	var alice, bob session
+	var bobId string
+	bob.do(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bobId, _, _ = rout.sessionUser(w, r)
+	}), "GET", "/me", nil)
+	rout.conns.add(bobId, "192.0.2.1", protocoltest.NewConn())
+
+	challenge := rout.idempotent(rout.handleDirectChallenge)
+	form := url.Values{"to": {bobId}, "clock": {"5"}, requestIdParam: {"challenge"}}
+	first := alice.do(challenge, "POST", "/challenge", form)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("challenging: %d %s", first.Code, first.Body)
+	}
+	if retry := alice.do(challenge, "POST", "/challenge", form); retry.Body.String() != first.Body.String() {
+		t.Errorf("retry got %s, want %s", retry.Body, first.Body)
+	}
+	if n := rout.challenges.size(); n != 1 {
+		t.Fatalf("%d challenges open after a retry, want 1", n)
+	}
+
+	var c directChallenge
+	if err := json.Unmarshal(first.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	accept := mux.NewRouter()
+	accept.HandleFunc("/challenge/{id}/accept", rout.idempotent(rout.handleAcceptDirectChallenge))
+	path := "/challenge/" + c.Id + "/accept"
+	form = url.Values{requestIdParam: {"accept"}}
+	accepted := bob.do(accept, "POST", path, form)
+	if accepted.Code != http.StatusOK {
+		t.Fatalf("accepting: %d %s", accepted.Code, accepted.Body)
+	}
+	if retry := bob.do(accept, "POST", path, form); retry.Body.String() != accepted.Body.String() {
+		t.Errorf("retry got %s, want %s", retry.Body, accepted.Body)
+	}
+	if n := rout.matches.size(); n != 1 {
+		t.Errorf("%d games set up after a retry, want 1", n)
+	}
+}
@@ -0,0 +1,153 @@
+// Package clock lets the game timing code run against a fake time source, so
+// that flagging, increments and reconnect windows can be simulated without
+// waiting for them.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a timer sending the time on its channel after d.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f after d, returning a timer to stop it.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a *time.Timer with its channel behind a method.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the clock of the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Fake is a clock whose time only moves forward when told to. Timers fire
+// while advancing it, in order, from the goroutine advancing it.
+type Fake struct {
+	m      sync.Mutex
+	now    time.Time
+	active map[*fakeTimer]struct{}
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:    now,
+		active: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		f: f,
+		c: make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{
+		f:  f,
+		fn: fn,
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers due meanwhile.
+func (f *Fake) Advance(d time.Duration) {
+	f.m.Lock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for t := range f.active {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		delete(f.active, next)
+		f.now = next.when
+		f.m.Unlock()
+		next.fire()
+		f.m.Lock()
+	}
+	f.now = end
+	f.m.Unlock()
+}
+
+type fakeTimer struct {
+	f    *Fake
+	c    chan time.Time
+	fn   func()
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) fire() {
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	// Like a real timer, drop the time if the last one wasn't received.
+	select {
+	case t.c<- t.when:
+	default:
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.m.Lock()
+	defer t.f.m.Unlock()
+	_, active := t.f.active[t]
+	delete(t.f.active, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.m.Lock()
+	defer t.f.m.Unlock()
+	_, active := t.f.active[t]
+	t.when = t.f.now.Add(d)
+	t.f.active[t] = struct{}{}
+	return active
+}
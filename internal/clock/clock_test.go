@@ -0,0 +1,149 @@
+package clock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeAdvanceFiresInOrder(t *testing.T) {
+	f := NewFake(epoch)
+	var fired []time.Duration
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		d := d
+		f.AfterFunc(d, func() {
+			if now := f.Now(); !now.Equal(epoch.Add(d)) {
+				t.Errorf("timer of %v fired at %v, want %v", d, now, epoch.Add(d))
+			}
+			fired = append(fired, d)
+		})
+	}
+
+	f.Advance(1500 * time.Millisecond)
+	if want := []time.Duration{time.Second}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	f.Advance(5 * time.Second)
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(fired, want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	if now := f.Now(); !now.Equal(epoch.Add(6500 * time.Millisecond)) {
+		t.Errorf("now is %v after advancing, want %v", now, epoch.Add(6500*time.Millisecond))
+	}
+}
+
+func TestFakeAdvanceFiresTimersSetWhileFiring(t *testing.T) {
+	f := NewFake(epoch)
+	var fired []string
+	f.AfterFunc(time.Second, func() {
+		fired = append(fired, "first")
+		f.AfterFunc(time.Second, func() {
+			fired = append(fired, "second")
+		})
+	})
+	f.AfterFunc(1500*time.Millisecond, func() {
+		fired = append(fired, "between")
+	})
+	f.Advance(2 * time.Second)
+	if want := []string{"first", "between", "second"}; !reflect.DeepEqual(fired, want) {
+		t.Errorf("fired %v, want %v", fired, want)
+	}
+}
+
+func TestFakeTimerSendsTheTimeItFired(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	f.Advance(time.Hour)
+	select {
+	case at := <-timer.C():
+		if !at.Equal(epoch.Add(time.Second)) {
+			t.Errorf("timer sent %v, want %v", at, epoch.Add(time.Second))
+		}
+	default:
+		t.Fatal("timer didn't fire")
+	}
+}
+
+func TestFakeStop(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+	if !timer.Stop() {
+		t.Error("Stop of an active timer reported false")
+	}
+	f.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+	if timer.Stop() {
+		t.Error("Stop of a stopped timer reported true")
+	}
+}
+
+func TestFakeStopFiredTimer(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+	f.Advance(time.Second)
+	if timer.Stop() {
+		t.Error("Stop of a fired timer reported true")
+	}
+	// Stopping doesn't drain the channel, like a real timer.
+	select {
+	case <-timer.C():
+	default:
+		t.Error("the time of the fired timer is gone after Stop")
+	}
+}
+
+func TestFakeResetFiredTimer(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+	f.Advance(time.Second)
+	<-timer.C()
+	if timer.Reset(2 * time.Second) {
+		t.Error("Reset of a fired timer reported true")
+	}
+	f.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("reset timer fired early")
+	default:
+	}
+	f.Advance(time.Second)
+	select {
+	case at := <-timer.C():
+		if want := epoch.Add(3 * time.Second); !at.Equal(want) {
+			t.Errorf("reset timer sent %v, want %v", at, want)
+		}
+	default:
+		t.Fatal("reset timer didn't fire")
+	}
+}
+
+func TestFakeResetActiveTimer(t *testing.T) {
+	f := NewFake(epoch)
+	fired := 0
+	timer := f.AfterFunc(time.Second, func() { fired++ })
+	f.Advance(500 * time.Millisecond)
+	if !timer.Reset(time.Second) {
+		t.Error("Reset of an active timer reported false")
+	}
+	f.Advance(999 * time.Millisecond)
+	if fired != 0 {
+		t.Fatal("timer fired at its old time after Reset")
+	}
+	f.Advance(time.Millisecond)
+	if fired != 1 {
+		t.Errorf("timer fired %d times, want 1", fired)
+	}
+}
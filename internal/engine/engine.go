@@ -0,0 +1,248 @@
+// Package engine picks moves for the computer opponent. Engines are behind an
+// interface so that a stronger one can replace the built-in search without
+// touching the rooms.
+package engine
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// Levels of the built-in engine, from a beginner to its full strength.
+const (
+	MinLevel = 1
+	MaxLevel = 8
+)
+
+var (
+	ErrInvalidLevel = errors.New("Invalid level")
+	ErrNoMoves      = errors.New("No legal moves")
+)
+
+// Engine picks a move to play in a position.
+type Engine interface {
+	BestMove(pos *rules.Position) (rules.Move, error)
+}
+
+// New returns the built-in engine playing at the level. Higher levels search
+// deeper and blunder less.
+func New(level int) (Engine, error) {
+	if level < MinLevel || level > MaxLevel {
+		return nil, ErrInvalidLevel
+	}
+	return &searcher{
+		depth: (level + 1) / 2,
+		// Centipawns of noise added to the scores of the moves.
+		noise: (MaxLevel - level) * 40,
+	}, nil
+}
+
+// Analyze searches the position the plies given at full strength. It returns
+// the best move and its score in centipawns for the side on turn; scores
+// beyond MateThreshold are mates, Mate minus the plies to mate.
+func Analyze(pos *rules.Position, depth int) (rules.Move, int, error) {
+	s := &searcher{depth: depth}
+	return s.best(pos)
+}
+
+// searcher is an alpha-beta search over material and piece placement.
+type searcher struct {
+	depth int
+	noise int
+}
+
+const (
+	// Score of being mated is minus Mate plus the plies until then.
+	Mate          = 100000
+	MateThreshold = Mate - 1000
+	// Captures are followed this many plies past the search depth, so
+	// that the engine doesn't stop counting in the middle of an exchange.
+	quiescenceDepth = 4
+)
+
+var pieceValues = map[byte]int{
+	'P': 100,
+	'N': 320,
+	'B': 330,
+	'R': 500,
+	'Q': 900,
+	'I': 400,
+	'K': 0,
+}
+
+func (s *searcher) BestMove(pos *rules.Position) (rules.Move, error) {
+	m, _, err := s.best(pos)
+	return m, err
+}
+
+func (s *searcher) best(pos *rules.Position) (rules.Move, int, error) {
+	moves := pos.LegalMoves()
+	if len(moves) == 0 {
+		return rules.Move{}, 0, ErrNoMoves
+	}
+	// Shuffled first so that the engine varies between equally good moves.
+	rand.Shuffle(len(moves), func(i, j int) {
+		moves[i], moves[j] = moves[j], moves[i]
+	})
+	order(pos, moves)
+	best, bestScore := moves[0], -Mate-1
+	for _, m := range moves {
+		next := pos.Apply(m)
+		score := -s.search(next, s.depth-1, -Mate-1, Mate+1, 1)
+		if s.noise > 0 {
+			score += rand.Intn(2*s.noise+1) - s.noise
+		}
+		if score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best, bestScore, nil
+}
+
+// search returns the score of the position for the side on turn.
+func (s *searcher) search(pos *rules.Position, depth, alpha, beta, ply int) int {
+	if _, ok := pos.PromotedPrince(); ok {
+		// Only the side that just moved can have promoted it.
+		return -Mate + ply
+	}
+	if depth <= 0 {
+		return s.quiesce(pos, alpha, beta, quiescenceDepth, ply)
+	}
+	moves := pos.LegalMoves()
+	if len(moves) == 0 {
+		if pos.InCheck() {
+			// Sooner mates score higher.
+			return -Mate + ply
+		}
+		return 0
+	}
+	order(pos, moves)
+	for _, m := range moves {
+		next := pos.Apply(m)
+		score := -s.search(next, depth-1, -beta, -alpha, ply+1)
+		if score >= beta {
+			return beta
+		}
+		if score > alpha {
+			alpha = score
+		}
+	}
+	return alpha
+}
+
+// quiesce follows the captures from the position until it's quiet.
+func (s *searcher) quiesce(pos *rules.Position, alpha, beta, depth, ply int) int {
+	if _, ok := pos.PromotedPrince(); ok {
+		return -Mate + ply
+	}
+	stand := Evaluate(pos)
+	if depth == 0 || stand >= beta {
+		return stand
+	}
+	if stand > alpha {
+		alpha = stand
+	}
+	moves := pos.LegalMoves()
+	order(pos, moves)
+	for _, m := range moves {
+		if !pos.IsCapture(m) {
+			break
+		}
+		next := pos.Apply(m)
+		score := -s.quiesce(next, -beta, -alpha, depth-1, ply+1)
+		if score >= beta {
+			return beta
+		}
+		if score > alpha {
+			alpha = score
+		}
+	}
+	return alpha
+}
+
+// order sorts the moves to search the most promising first: promotions of the
+// prince, captures of the most valuable pieces by the least valuable ones,
+// then promotions of pawns.
+func order(pos *rules.Position, moves []rules.Move) {
+	key := func(m rules.Move) int {
+		k := 0
+		if pos.IsCapture(m) {
+			victim := pieceValues[upper(pos.Piece(m.To))]
+			if victim == 0 {
+				// En passant.
+				victim = pieceValues['P']
+			}
+			k += 10*victim - pieceValues[upper(pos.Piece(m.From))] + 10000
+		}
+		if m.Promotion != 0 {
+			k += pieceValues[upper(m.Promotion)]
+		}
+		if upper(pos.Piece(m.From)) == 'I' && (m.To/8 == 0 || m.To/8 == 7) {
+			k += Mate
+		}
+		return k
+	}
+	sort.SliceStable(moves, func(i, j int) bool {
+		return key(moves[i]) > key(moves[j])
+	})
+}
+
+// Evaluate scores the position in centipawns for the side on turn: the
+// material of each side plus a bonus for pieces near the center and pawns and
+// princes close to promoting.
+func Evaluate(pos *rules.Position) int {
+	score := 0
+	for sq := 0; sq < 64; sq++ {
+		c := pos.Piece(sq)
+		if c == 0 {
+			continue
+		}
+		piece := upper(c)
+		v := pieceValues[piece]
+		file, rank := sq%8, sq/8
+		switch piece {
+		case 'N', 'B', 'Q':
+			v += 10 - 3*(distance(file)+distance(rank))
+		case 'P':
+			advance := rank - 1
+			if c != piece {
+				advance = 6 - rank
+			}
+			v += 5*advance + 5 - 2*distance(file)
+		case 'I':
+			// The closer to the last rank, the harder to stop.
+			advance := rank
+			if c != piece {
+				advance = 7 - rank
+			}
+			v += 4 * advance * advance
+		}
+		if c == piece {
+			score += v
+		} else {
+			score -= v
+		}
+	}
+	if pos.Turn() == rules.Black {
+		return -score
+	}
+	return score
+}
+
+// distance returns how far a file or rank is from the center of the board.
+func distance(i int) int {
+	if i < 4 {
+		return 3 - i
+	}
+	return i - 4
+}
+
+func upper(c byte) byte {
+	if c >= 'a' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+func mustParse(t *testing.T, fen string) *rules.Position {
+	t.Helper()
+	pos, err := rules.ParseFEN(fen)
+	if err != nil {
+		t.Fatalf("ParseFEN(%q): %v", fen, err)
+	}
+	return pos
+}
+
+func TestAnalyzePromotesThePrince(t *testing.T) {
+	// Taking the knight is worth less than promoting the prince.
+	pos := mustParse(t, "4k3/2I5/8/8/8/8/8/n3K3 w - - 0 1")
+	m, score, err := Analyze(pos, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pos.Apply(m).PromotedPrince(); !ok {
+		t.Errorf("best move %s, want the prince to the last rank", pos.SAN(m))
+	}
+	if score < MateThreshold {
+		t.Errorf("score %d, want a win", score)
+	}
+}
+
+func TestAnalyzeStopsThePrince(t *testing.T) {
+	// The black prince promotes next move unless the rook takes it.
+	pos := mustParse(t, "4k3/8/8/8/8/8/5i2/R5K1 w - - 0 1")
+	m, _, err := Analyze(pos, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := pos.Apply(m)
+	for _, reply := range next.LegalMoves() {
+		if _, ok := next.Apply(reply).PromotedPrince(); ok {
+			t.Errorf("after %s black can still promote the prince", pos.SAN(m))
+		}
+	}
+}
+
+func TestAnalyzeMates(t *testing.T) {
+	pos := mustParse(t, "6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1")
+	m, score, err := Analyze(pos, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if san := pos.SAN(m); san != "Ra8#" {
+		t.Errorf("best move %s, want Ra8#", san)
+	}
+	if score != Mate-1 {
+		t.Errorf("score %d, want %d", score, Mate-1)
+	}
+}
+
+func TestNewRejectsLevels(t *testing.T) {
+	for _, level := range []int{MinLevel - 1, MaxLevel + 1} {
+		if _, err := New(level); err != ErrInvalidLevel {
+			t.Errorf("New(%d) = %v, want %v", level, err, ErrInvalidLevel)
+		}
+	}
+	e, err := New(MaxLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.BestMove(mustParse(t, "k7/2I5/1K6/8/8/8/8/8 b - - 0 1")); err != ErrNoMoves {
+		t.Errorf("BestMove in stalemate: %v, want %v", err, ErrNoMoves)
+	}
+}
@@ -0,0 +1,55 @@
+// Package game keeps the clocks of a game. The rooms relay the moves and
+// time the players out; the time each player has left is worked out here, so
+// that it can be tested without sockets or timers.
+package game
+
+import "time"
+
+// Clock is the time of one player.
+type Clock struct {
+	// Time the player starts each game with.
+	Base time.Duration
+	// Time the player had left as of their last move.
+	TimeLeft time.Duration
+	// When the player last moved, zero before their first move.
+	LastMove time.Time
+}
+
+// NewClock returns the clock of a player starting with the base time.
+func NewClock(base time.Duration) Clock {
+	return Clock{Base: base, TimeLeft: base}
+}
+
+// Restart sets the clock back to the start of a game.
+func (c *Clock) Restart() {
+	c.TimeLeft = c.Base
+	c.LastMove = time.Time{}
+}
+
+// Moved reports whether the player made a move.
+func (c *Clock) Moved() bool {
+	return !c.LastMove.IsZero()
+}
+
+// Move charges the player who moved at now for the time since the move of
+// the opponent, and adds the increment to their clock. The first move of each
+// player takes no time off their clock. It returns the time charged.
+func Move(turn, opp *Clock, increment time.Duration, now time.Time) time.Duration {
+	var elapsed time.Duration
+	if turn.Moved() && opp.Moved() {
+		elapsed = now.Sub(opp.LastMove)
+	}
+	turn.LastMove = now
+	turn.TimeLeft += increment - elapsed
+	return elapsed
+}
+
+// Remaining returns the time the players have left as of now, counting the
+// time the player on turn has been thinking since the move of the other. The
+// clocks run once both players moved.
+func Remaining(turn, opp Clock, now time.Time) (time.Duration, time.Duration) {
+	if !turn.Moved() || !opp.Moved() {
+		return turn.TimeLeft, opp.TimeLeft
+	}
+	return turn.TimeLeft - now.Sub(opp.LastMove), opp.TimeLeft
+}
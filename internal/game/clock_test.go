@@ -0,0 +1,47 @@
+package game
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMove(t *testing.T) {
+	white, black := NewClock(time.Minute), NewClock(time.Minute)
+	inc := 2 * time.Second
+
+	// The first move of each player is free.
+	if elapsed := Move(&white, &black, inc, epoch); elapsed != 0 || white.TimeLeft != 62*time.Second {
+		t.Errorf("first white move took %v, left %v; want 0, 62s", elapsed, white.TimeLeft)
+	}
+	if elapsed := Move(&black, &white, inc, epoch.Add(5*time.Second)); elapsed != 0 || black.TimeLeft != 62*time.Second {
+		t.Errorf("first black move took %v, left %v; want 0, 62s", elapsed, black.TimeLeft)
+	}
+	// White thought from black's move on.
+	if elapsed := Move(&white, &black, inc, epoch.Add(8*time.Second)); elapsed != 3*time.Second || white.TimeLeft != 61*time.Second {
+		t.Errorf("3s white move took %v, left %v; want 3s, 61s", elapsed, white.TimeLeft)
+	}
+	if black.TimeLeft != 62*time.Second {
+		t.Errorf("black has %v after white moved, want 62s", black.TimeLeft)
+	}
+
+	white.Restart()
+	if white.TimeLeft != time.Minute || white.Moved() {
+		t.Errorf("restarted clock %+v", white)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	white, black := NewClock(time.Minute), NewClock(time.Minute)
+	Move(&white, &black, 0, epoch)
+	// The clocks don't run before both players moved.
+	if w, b := Remaining(black, white, epoch.Add(time.Hour)); w != time.Minute || b != time.Minute {
+		t.Errorf("Remaining before black moved = %v, %v; want 1m, 1m", w, b)
+	}
+	Move(&black, &white, 0, epoch.Add(10*time.Second))
+	turn, opp := Remaining(white, black, epoch.Add(25*time.Second))
+	if turn != 45*time.Second || opp != time.Minute {
+		t.Errorf("Remaining after white thought 15s = %v, %v; want 45s, 1m", turn, opp)
+	}
+}
@@ -0,0 +1,55 @@
+// Package httpapi holds what the HTTP endpoints share on the wire: every
+// error response, whatever the endpoint, answers in the same JSON envelope.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Error is the body of every error response of the API, under "error".
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Every problem found, when a request has several, as the validation
+	// of a username.
+	Details []Error `json:"details,omitempty"`
+}
+
+// StatusCode names the HTTP status as the code of an error, e.g. NOT_FOUND.
+func StatusCode(status int) string {
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// WriteError responds with the message and the given status, which names
+// the error. It's used in place of http.Error, whose plain text responses the
+// clients would have to tell apart from the JSON ones.
+func WriteError(w http.ResponseWriter, message string, status int) {
+	Write(w, status, Error{Code: StatusCode(status), Message: message})
+}
+
+// Write responds with the error and the given status.
+func Write(w http.ResponseWriter, status int, e Error) {
+	resB, err := json.Marshal(map[string]Error{"error": e})
+	if err != nil {
+		resB = []byte(`{"error":{"code":"INTERNAL_SERVER_ERROR","message":""}}`)
+		status = http.StatusInternalServerError
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(resB)
+}
+
+// The routes not found and the methods not allowed answer in the envelope of
+// the errors too.
+var (
+	NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, "Not found", http.StatusNotFound)
+	})
+	MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+)
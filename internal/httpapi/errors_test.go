@@ -0,0 +1,63 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder) Error {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var body map[string]Error
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	return body["error"]
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, "No such game", http.StatusNotFound)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+	if e := decode(t, rec); e.Code != "NOT_FOUND" || e.Message != "No such game" {
+		t.Errorf("error %+v", e)
+	}
+}
+
+func TestWriteDetails(t *testing.T) {
+	rec := httptest.NewRecorder()
+	want := Error{
+		Code:    "INVALID_USERNAME",
+		Message: "Invalid username",
+		Details: []Error{{Code: "TOO_SHORT", Message: "Too short"}},
+	}
+	Write(rec, http.StatusBadRequest, want)
+	if e := decode(t, rec); !reflect.DeepEqual(e, want) {
+		t.Errorf("error %+v, want %+v", e, want)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		h      http.Handler
+		status int
+		code   string
+	}{
+		{NotFound, http.StatusNotFound, "NOT_FOUND"},
+		{MethodNotAllowed, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		tt.h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if e := decode(t, rec); rec.Code != tt.status || e.Code != tt.code {
+			t.Errorf("%d %s, want %d %s", rec.Code, e.Code, tt.status, tt.code)
+		}
+	}
+}
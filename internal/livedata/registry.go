@@ -0,0 +1,94 @@
+// Package livedata keeps the connections to the live data socket, over which
+// the players online hear how many players and games there are, and the
+// events addressed to them. A player may have the site open in several tabs,
+// each with its own connection.
+package livedata
+
+// Info is the real-time information sent to every client.
+type Info struct {
+	Players int    `json:"players"`
+	Games   int    `json:"games"`
+	Full    bool   `json:"full"`
+	Banner  string `json:"banner,omitempty"`
+}
+
+// Client is a connection to the live data socket.
+type Client struct {
+	UID string
+	// Buffered channel of outbound messages, closed once the client is
+	// dropped.
+	Send chan interface{}
+}
+
+// NewClient returns a client of the user buffering that many messages.
+func NewClient(uid string, buffer int) *Client {
+	return &Client{UID: uid, Send: make(chan interface{}, buffer)}
+}
+
+// Registry is the set of clients connected, by user. It isn't safe for
+// concurrent use: a single goroutine, the hub, owns it.
+type Registry struct {
+	online map[string]map[*Client]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{online: make(map[string]map[*Client]bool)}
+}
+
+// Add registers the client.
+func (r *Registry) Add(c *Client) {
+	if r.online[c.UID] == nil {
+		r.online[c.UID] = make(map[*Client]bool)
+	}
+	r.online[c.UID][c] = true
+}
+
+// Users returns the number of users with a client connected.
+func (r *Registry) Users() int {
+	return len(r.online)
+}
+
+// SendAll sends the payload to every client.
+func (r *Registry) SendAll(payload interface{}) {
+	for _, clients := range r.online {
+		for c := range clients {
+			r.Send(c, payload)
+		}
+	}
+}
+
+// Deliver sends the payload to every client of the user, reporting whether
+// they have any.
+func (r *Registry) Deliver(uid string, payload interface{}) bool {
+	clients, ok := r.online[uid]
+	if !ok {
+		return false
+	}
+	for c := range clients {
+		r.Send(c, payload)
+	}
+	return true
+}
+
+// Send queues the payload for the client, dropping the client if it can't
+// keep up.
+func (r *Registry) Send(c *Client, payload interface{}) {
+	select {
+	case c.Send <- payload:
+	default:
+		r.Drop(c)
+	}
+}
+
+// Drop closes the channel of the client, unless it was dropped already.
+func (r *Registry) Drop(c *Client) {
+	clients := r.online[c.UID]
+	if !clients[c] {
+		return
+	}
+	close(c.Send)
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(r.online, c.UID)
+	}
+}
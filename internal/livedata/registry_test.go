@@ -0,0 +1,56 @@
+package livedata
+
+import "testing"
+
+func TestRegistryKeysClientsByConnection(t *testing.T) {
+	r := NewRegistry()
+	first, second := NewClient("a", 4), NewClient("a", 4)
+	r.Add(first)
+	r.Add(second)
+	if n := r.Users(); n != 1 {
+		t.Fatalf("%d users online, want 1", n)
+	}
+	if !r.Deliver("a", "hello") {
+		t.Fatal("user with two tabs not online")
+	}
+	for _, c := range []*Client{first, second} {
+		if payload := <-c.Send; payload != "hello" {
+			t.Errorf("tab got %v, want hello", payload)
+		}
+	}
+
+	// Dropping a tab leaves the other connected, and dropping it twice is
+	// harmless.
+	r.Drop(first)
+	r.Drop(first)
+	if _, ok := <-first.Send; ok {
+		t.Error("dropped client still open")
+	}
+	if !r.Deliver("a", "still there") || <-second.Send != "still there" {
+		t.Error("second tab not delivered to after the first was dropped")
+	}
+	r.Drop(second)
+	if r.Users() != 0 || r.Deliver("a", "gone") {
+		t.Error("user online after closing every tab")
+	}
+}
+
+func TestRegistryDropsSlowClients(t *testing.T) {
+	r := NewRegistry()
+	slow, fast := NewClient("slow", 2), NewClient("fast", 8)
+	r.Add(slow)
+	r.Add(fast)
+	for i := 0; i < 4; i++ {
+		r.SendAll(i)
+	}
+	if len(fast.Send) != 4 {
+		t.Errorf("fast client has %d messages, want 4", len(fast.Send))
+	}
+	n := 0
+	for range slow.Send {
+		n++
+	}
+	if n != 2 || r.Users() != 1 {
+		t.Errorf("slow client got %d messages, %d users online; want 2, 1", n, r.Users())
+	}
+}
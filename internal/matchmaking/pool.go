@@ -0,0 +1,148 @@
+// Package matchmaking pairs the players looking for a game. It knows nothing
+// about rooms or ratings: the caller decides what to do with a pairing.
+package matchmaking
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/clock"
+)
+
+// Seeker is a player looking for a game.
+type Seeker struct {
+	ID       string
+	Username string
+	// Color the seeker asked for, "white" or "black"; empty if either will
+	// do.
+	Color string
+}
+
+// Pairing is a game between two seekers. Each one plays the color they asked
+// for, unless both asked for the same one; the colors are drawn otherwise.
+type Pairing struct {
+	GameID string
+	White  Seeker
+	Black  Seeker
+}
+
+// Pool pairs the players looking for a game with a time control, in the order
+// they came: each seeker is paired with the one waiting the longest, or waits
+// in the queue until someone comes.
+type Pool struct {
+	m sync.Mutex
+	// Seekers waiting for an opponent, the one waiting the longest first.
+	queue []*seek
+	// Times the seekers out.
+	clock clock.Clock
+}
+
+// seek is a seeker waiting in the pool.
+type seek struct {
+	seeker Seeker
+	// The seeker pairing with the waiting one sends the pairing through it.
+	// An empty pairing tells the waiting seeker to give up. Buffered, so
+	// that the sender doesn't wait for the seeker to pick it up.
+	paired chan Pairing
+}
+
+func NewPool() *Pool {
+	return &Pool{clock: clock.Real}
+}
+
+// Seek pairs the seeker with the one waiting the longest in the pool or, if
+// there's none, waits in the queue for an opponent until the timeout. newID
+// makes up the id of the game when the seeker finds someone waiting. It
+// reports false if nobody showed up.
+func (p *Pool) Seek(s Seeker, timeout time.Duration, newID func() string) (Pairing, bool) {
+	p.m.Lock()
+	// The same player seeking again, e.g. from another tab, cancels the
+	// previous seek.
+	p.cancel(s.ID)
+	if len(p.queue) == 0 {
+		own := &seek{seeker: s, paired: make(chan Pairing, 1)}
+		p.queue = append(p.queue, own)
+		deadline := p.clock.NewTimer(timeout)
+		p.m.Unlock()
+		return p.await(own, deadline)
+	}
+	waiting := p.queue[0]
+	p.queue = p.queue[1:]
+	p.m.Unlock()
+	pairing := Pair(newID(), waiting.seeker, s)
+	waiting.paired<- pairing
+	return pairing, true
+}
+
+// Pair makes the pairing of the seeker with the one waiting for an opponent,
+// for pools queueing the seekers elsewhere.
+func Pair(gameID string, waiting, s Seeker) Pairing {
+	pairing := Pairing{GameID: gameID}
+	pairing.White, pairing.Black = assignColors(waiting, s)
+	return pairing
+}
+
+// assignColors returns the seekers as white and black, as they asked, drawing
+// the colors if neither asked for one or both asked for the same.
+func assignColors(a, b Seeker) (white, black Seeker) {
+	switch {
+	case a.Color != b.Color && (a.Color == "white" || b.Color == "black"):
+		return a, b
+	case a.Color != b.Color:
+		return b, a
+	case rand.Intn(2) == 0:
+		return a, b
+	}
+	return b, a
+}
+
+// Cancel takes the seeker with the id off the queue, if waiting; their Seek
+// reports false.
+func (p *Pool) Cancel(id string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.cancel(id)
+}
+
+// cancel takes the seeker off the queue. The caller must hold the lock.
+func (p *Pool) cancel(id string) {
+	for i, w := range p.queue {
+		if w.seeker.ID == id {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			w.paired<- Pairing{}
+			return
+		}
+	}
+}
+
+// Waiting returns the number of seekers waiting in the pool.
+func (p *Pool) Waiting() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.queue)
+}
+
+// await waits in the queue for an opponent to send the pairing until the
+// deadline fires.
+func (p *Pool) await(own *seek, deadline clock.Timer) (Pairing, bool) {
+	defer deadline.Stop()
+	var pairing Pairing
+	select {
+	case pairing = <-own.paired:
+	case <-deadline.C():
+		p.m.Lock()
+		for i, w := range p.queue {
+			if w == own {
+				p.queue = append(p.queue[:i], p.queue[i+1:]...)
+				p.m.Unlock()
+				return Pairing{}, false
+			}
+		}
+		p.m.Unlock()
+		// An opponent took the seek off the queue as the deadline fired,
+		// and is about to send the pairing.
+		pairing = <-own.paired
+	}
+	return pairing, pairing.GameID != ""
+}
@@ -0,0 +1,192 @@
+package matchmaking
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/clock"
+)
+
+const timeout = 5 * time.Second
+
+type seekResult struct {
+	pairing Pairing
+	ok      bool
+}
+
+func newFakePool() (*Pool, *clock.Fake) {
+	c := clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	p := NewPool()
+	p.clock = c
+	return p, c
+}
+
+// gameIDs makes up the ids game1, game2 and so on.
+func gameIDs() func() string {
+	n := 0
+	return func() string {
+		n++
+		return "game" + strconv.Itoa(n)
+	}
+}
+
+// seekAsync seeks in the background, waiting until the seeker is in the
+// queue.
+func seekAsync(t *testing.T, p *Pool, s Seeker, newID func() string) <-chan seekResult {
+	t.Helper()
+	waiting := p.Waiting()
+	res := make(chan seekResult, 1)
+	go func() {
+		pairing, ok := p.Seek(s, timeout, newID)
+		res<- seekResult{pairing, ok}
+	}()
+	waitFor(t, func() bool { return p.Waiting() == waiting+1 })
+	return res
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pool")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, res <-chan seekResult) seekResult {
+	t.Helper()
+	select {
+	case r := <-res:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("seek didn't return")
+	}
+	return seekResult{}
+}
+
+func players(p Pairing) map[string]bool {
+	return map[string]bool{p.White.ID: true, p.Black.ID: true}
+}
+
+func TestPoolPairsInArrivalOrder(t *testing.T) {
+	p, _ := newFakePool()
+	newID := gameIDs()
+
+	first := seekAsync(t, p, Seeker{ID: "a"}, newID)
+	pairing, ok := p.Seek(Seeker{ID: "b"}, timeout, newID)
+	if !ok {
+		t.Fatal("b wasn't paired with a waiting a")
+	}
+	if got := players(pairing); !got["a"] || !got["b"] {
+		t.Fatalf("b paired as %+v, want with a", pairing)
+	}
+	if r := receive(t, first); !r.ok || r.pairing != pairing {
+		t.Fatalf("a got %+v, %v, want %+v", r.pairing, r.ok, pairing)
+	}
+
+	third := seekAsync(t, p, Seeker{ID: "c"}, newID)
+	pairing, ok = p.Seek(Seeker{ID: "d"}, timeout, newID)
+	if !ok {
+		t.Fatal("d wasn't paired with a waiting c")
+	}
+	if got := players(pairing); !got["c"] || !got["d"] {
+		t.Fatalf("d paired as %+v, want with c", pairing)
+	}
+	if pairing.GameID != "game2" {
+		t.Errorf("game id %q, want game2", pairing.GameID)
+	}
+	receive(t, third)
+	if n := p.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	p, _ := newFakePool()
+	res := seekAsync(t, p, Seeker{ID: "a"}, gameIDs())
+	p.Cancel("a")
+	if r := receive(t, res); r.ok {
+		t.Fatalf("cancelled seek paired as %+v", r.pairing)
+	}
+	if n := p.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+	// Cancelling someone not waiting is a no-op.
+	p.Cancel("b")
+}
+
+func TestPoolSeekingAgainCancelsTheFirstSeek(t *testing.T) {
+	p, _ := newFakePool()
+	newID := gameIDs()
+	first := seekAsync(t, p, Seeker{ID: "a"}, newID)
+	second := make(chan seekResult, 1)
+	go func() {
+		pairing, ok := p.Seek(Seeker{ID: "a"}, timeout, newID)
+		second<- seekResult{pairing, ok}
+	}()
+	if r := receive(t, first); r.ok {
+		t.Fatalf("replaced seek paired as %+v", r.pairing)
+	}
+	waitFor(t, func() bool { return p.Waiting() == 1 })
+	p.Cancel("a")
+	receive(t, second)
+}
+
+func TestPoolTimeout(t *testing.T) {
+	p, c := newFakePool()
+	res := seekAsync(t, p, Seeker{ID: "a"}, gameIDs())
+	c.Advance(timeout - time.Millisecond)
+	select {
+	case r := <-res:
+		t.Fatalf("seek returned %+v, %v before the timeout", r.pairing, r.ok)
+	default:
+	}
+	c.Advance(time.Millisecond)
+	if r := receive(t, res); r.ok {
+		t.Fatalf("timed out seek paired as %+v", r.pairing)
+	}
+	if n := p.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+}
+
+func TestAssignColors(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		white string
+	}{
+		{"white", "", "a"},
+		{"black", "", "b"},
+		{"", "white", "b"},
+		{"", "black", "a"},
+		{"white", "black", "a"},
+		{"black", "white", "b"},
+	}
+	for _, tt := range tests {
+		a, b := Seeker{ID: "a", Color: tt.a}, Seeker{ID: "b", Color: tt.b}
+		white, black := assignColors(a, b)
+		if white.ID != tt.white || black.ID == tt.white {
+			t.Errorf("assignColors(%q, %q) = %s, %s; want %s as white", tt.a, tt.b, white.ID, black.ID, tt.white)
+		}
+	}
+}
+
+func TestAssignColorsDrawsWhenTheyClash(t *testing.T) {
+	for _, color := range []string{"", "white", "black"} {
+		a, b := Seeker{ID: "a", Color: color}, Seeker{ID: "b", Color: color}
+		whites := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			white, black := assignColors(a, b)
+			if white.ID == black.ID {
+				t.Fatalf("assignColors(%q, %q) gave both colors to %s", color, color, white.ID)
+			}
+			whites[white.ID] = true
+		}
+		if len(whites) != 2 {
+			t.Errorf("assignColors(%q, %q) always gave white to the same seeker", color, color)
+		}
+	}
+}
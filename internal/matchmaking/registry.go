@@ -0,0 +1,41 @@
+package matchmaking
+
+import "sync"
+
+// Registry keeps a pool for each time control, set up the first time someone
+// seeks a game with it. The keys are up to the caller, as long as each time
+// control has its own.
+type Registry struct {
+	m     sync.Mutex
+	pools map[string]*Pool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		pools: make(map[string]*Pool),
+	}
+}
+
+// Pool returns the pool of the time control with the key.
+func (r *Registry) Pool(key string) *Pool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	p, ok := r.pools[key]
+	if !ok {
+		p = NewPool()
+		r.pools[key] = p
+	}
+	return p
+}
+
+// Waiting returns the number of seekers waiting in each pool set up so far,
+// by key.
+func (r *Registry) Waiting() map[string]int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	waiting := make(map[string]int, len(r.pools))
+	for key, p := range r.pools {
+		waiting[key] = p.Waiting()
+	}
+	return waiting
+}
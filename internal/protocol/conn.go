@@ -0,0 +1,148 @@
+// Package protocol holds what the websocket endpoints share on the wire, so
+// that the code talking to clients can run against a fake connection.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the part of a websocket connection the server uses. It is
+// satisfied by *websocket.Conn.
+type Conn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteMessage(messageType int, data []byte) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	WriteJSON(v interface{}) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// ReadMessage reads the next data message from the connection. Messages
+// longer than limit are discarded and reported as oversized instead of
+// failing, so the connection stays usable.
+func ReadMessage(conn Conn, limit int64) (msg []byte, oversized bool, err error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, false, err
+	}
+	msg, err = ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(msg)) > limit {
+		// Drain the rest of the message.
+		if _, err = io.Copy(ioutil.Discard, r); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	return msg, false, nil
+}
+
+// SendText JSON-marshals the data and sends it as a text message, giving up
+// after the write wait.
+func SendText(conn Conn, data interface{}, wait time.Duration) error {
+	dataB, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(wait))
+
+	w, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(dataB)
+
+	return w.Close()
+}
+
+// Decode unmarshals the JSON message into v, which describes every field the
+// message may have. Unknown fields, values of the wrong type and anything
+// after the value are errors, worded for the client to tell what to fix.
+func Decode(msg []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return describe(err)
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
+
+func describe(err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("invalid JSON at offset %d: %v", e.Offset, e)
+	case *json.UnmarshalTypeError:
+		if e.Field == "" {
+			return fmt.Errorf("expected a %s, got %s", jsonType(e.Type), e.Value)
+		}
+		return fmt.Errorf("field %q: expected a %s, got %s", e.Field, jsonType(e.Type), e.Value)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("incomplete JSON")
+	}
+	// Unknown fields, as `json: unknown field "x"`.
+	return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// jsonType names the JSON type the Go type is decoded from.
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Ptr:
+		return jsonType(t.Elem())
+	}
+	return "object"
+}
+
+// Versions of the protocol, which the clients announce when they connect.
+// The server speaks every version in Supported, oldest first.
+const (
+	// Spoken by the clients that don't announce a version, written before
+	// the versions were.
+	Version1 = 1
+	// The first version announced. Its messages are those of Version1, so
+	// that the clients not announcing one can be told apart and retired.
+	Version2 = 2
+	Current  = Version2
+)
+
+var Supported = []int{Version1, Version2}
+
+// Supports reports whether the server speaks the version of the protocol.
+func Supports(version int) bool {
+	for _, v := range Supported {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/protocol/protocoltest"
+)
+
+func TestReadMessageDiscardsOversizedMessages(t *testing.T) {
+	conn := protocoltest.NewConn()
+	conn.In <- []byte(strings.Repeat("x", 11))
+	conn.In <- []byte("0123456789")
+	close(conn.In)
+
+	if msg, oversized, err := ReadMessage(conn, 10); err != nil || !oversized || msg != nil {
+		t.Errorf("ReadMessage of 11 bytes = %q, %v, %v; want oversized", msg, oversized, err)
+	}
+	// The connection is still usable.
+	if msg, oversized, err := ReadMessage(conn, 10); err != nil || oversized || string(msg) != "0123456789" {
+		t.Errorf("ReadMessage of 10 bytes = %q, %v, %v", msg, oversized, err)
+	}
+	if _, _, err := ReadMessage(conn, 10); err != protocoltest.ErrClosed {
+		t.Errorf("ReadMessage of a closed connection: %v, want %v", err, protocoltest.ErrClosed)
+	}
+}
+
+func TestSendText(t *testing.T) {
+	conn := protocoltest.NewConn()
+	if err := SendText(conn, map[string]string{"chat": "hi"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(<-conn.Out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["chat"] != "hi" {
+		t.Errorf("sent %v, want the chat", got)
+	}
+	if err := SendText(conn, func() {}, time.Second); err == nil {
+		t.Error("SendText of a func didn't fail")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var m struct {
+		Text string `json:"text"`
+		Ply  int    `json:"ply"`
+	}
+	tests := []struct {
+		msg string
+		err string
+	}{
+		{`{"text":"hi","ply":3}`, ""},
+		{`{"text":"hi"`, "incomplete JSON"},
+		{`{"text":1}`, `field "text": expected a string, got number`},
+		{`{"ply":"3"}`, `field "ply": expected a number, got string`},
+		{`{"txt":"hi"}`, `unknown field "txt"`},
+		{`{"text":"hi"} {}`, "unexpected data after the message"},
+	}
+	for _, tt := range tests {
+		err := Decode([]byte(tt.msg), &m)
+		if got := errString(err); got != tt.err {
+			t.Errorf("Decode(%s) = %q, want %q", tt.msg, got, tt.err)
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestSupports(t *testing.T) {
+	for _, v := range Supported {
+		if !Supports(v) {
+			t.Errorf("version %d not supported", v)
+		}
+	}
+	if Supports(Current + 1) {
+		t.Errorf("version %d supported", Current+1)
+	}
+}
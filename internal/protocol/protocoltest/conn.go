@@ -0,0 +1,68 @@
+// Package protocoltest provides a fake websocket connection, for the tests of
+// the code talking to clients.
+package protocoltest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned by the reads of a connection whose In was closed.
+var ErrClosed = errors.New("connection closed")
+
+// Conn is a protocol.Conn for the tests: they queue what the client sends in
+// In and read what the server sends from Out, one message per frame. Closing
+// In closes the connection for the reader.
+type Conn struct {
+	In  chan []byte
+	Out chan []byte
+}
+
+// NewConn returns a connection buffering 16 messages each way.
+func NewConn() *Conn {
+	return &Conn{In: make(chan []byte, 16), Out: make(chan []byte, 16)}
+}
+
+func (c *Conn) NextReader() (int, io.Reader, error) {
+	msg, ok := <-c.In
+	if !ok {
+		return 0, nil, ErrClosed
+	}
+	return websocket.TextMessage, bytes.NewReader(msg), nil
+}
+
+// writer sends the message when closed.
+type writer struct {
+	bytes.Buffer
+	out chan []byte
+}
+
+func (w *writer) Close() error {
+	w.out <- w.Bytes()
+	return nil
+}
+
+func (c *Conn) NextWriter(int) (io.WriteCloser, error) {
+	return &writer{out: c.Out}, nil
+}
+
+// WriteMessage sends the data messages; the control messages, as closing,
+// are dropped.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+		c.Out <- data
+	}
+	return nil
+}
+
+func (c *Conn) WriteControl(int, []byte, time.Time) error { return nil }
+func (c *Conn) WriteJSON(v interface{}) error             { return nil }
+func (c *Conn) SetReadLimit(int64)                        {}
+func (c *Conn) SetReadDeadline(time.Time) error           { return nil }
+func (c *Conn) SetWriteDeadline(time.Time) error          { return nil }
+func (c *Conn) SetPongHandler(func(string) error)         {}
+func (c *Conn) Close() error                              { return nil }
@@ -0,0 +1,310 @@
+package rules
+
+import "strings"
+
+var (
+	knightSteps = [][2]int{{1, 2}, {2, 1}, {2, -1}, {1, -2}, {-1, -2}, {-2, -1}, {-2, 1}, {-1, 2}}
+	kingSteps   = [][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	rookDirs    = [][2]int{{1, 0}, {0, 1}, {-1, 0}, {0, -1}}
+	bishopDirs  = [][2]int{{1, 1}, {-1, 1}, {-1, -1}, {1, -1}}
+)
+
+// step returns the square reached from sq moving df files and dr ranks, or -1
+// if it's off the board.
+func step(sq, df, dr int) int {
+	f, r := sq%8+df, sq/8+dr
+	if f < 0 || f > 7 || r < 0 || r > 7 {
+		return -1
+	}
+	return r*8 + f
+}
+
+// LegalMoves returns the moves the side on turn can play.
+func (p *Position) LegalMoves() []Move {
+	var moves []Move
+	for _, m := range p.pseudoLegalMoves() {
+		next := p.apply(m)
+		if !next.attacked(next.king(p.turn), next.turn) {
+			moves = append(moves, m)
+		}
+	}
+	return moves
+}
+
+// pseudoLegalMoves returns the moves of the side on turn without checking
+// whether they leave their king in check. Castling is fully checked.
+func (p *Position) pseudoLegalMoves() []Move {
+	var moves []Move
+	for from, c := range p.board {
+		if c == 0 || colorOf(c) != p.turn {
+			continue
+		}
+		switch upper(c) {
+		case 'P':
+			moves = p.pawnMoves(from, moves)
+		case 'N':
+			moves = p.stepMoves(from, knightSteps, moves)
+		case 'B':
+			moves = p.slideMoves(from, bishopDirs, moves)
+		case 'R':
+			moves = p.slideMoves(from, rookDirs, moves)
+		case 'Q':
+			moves = p.slideMoves(from, bishopDirs, moves)
+			moves = p.slideMoves(from, rookDirs, moves)
+		case 'K':
+			moves = p.stepMoves(from, kingSteps, moves)
+			moves = p.castleMoves(from, moves)
+		case 'I':
+			moves = p.stepMoves(from, kingSteps, moves)
+		}
+	}
+	return moves
+}
+
+// canLand reports whether a piece of the side on turn can move to the square:
+// it's empty or taken by the opponent.
+func (p *Position) canLand(sq int) bool {
+	return p.board[sq] == 0 || colorOf(p.board[sq]) != p.turn
+}
+
+func (p *Position) stepMoves(from int, steps [][2]int, moves []Move) []Move {
+	for _, s := range steps {
+		if to := step(from, s[0], s[1]); to >= 0 && p.canLand(to) {
+			moves = append(moves, Move{From: from, To: to})
+		}
+	}
+	return moves
+}
+
+func (p *Position) slideMoves(from int, dirs [][2]int, moves []Move) []Move {
+	for _, d := range dirs {
+		for to := step(from, d[0], d[1]); to >= 0; to = step(to, d[0], d[1]) {
+			if !p.canLand(to) {
+				break
+			}
+			moves = append(moves, Move{From: from, To: to})
+			if p.board[to] != 0 {
+				break
+			}
+		}
+	}
+	return moves
+}
+
+func (p *Position) pawnMoves(from int, moves []Move) []Move {
+	dir, start, last := 1, 1, 7
+	if p.turn == Black {
+		dir, start, last = -1, 6, 0
+	}
+	add := func(to int) {
+		if to/8 != last {
+			moves = append(moves, Move{From: from, To: to})
+			return
+		}
+		for _, promo := range []byte("qrbn") {
+			if p.turn == White {
+				promo = upper(promo)
+			}
+			moves = append(moves, Move{From: from, To: to, Promotion: promo})
+		}
+	}
+	if to := step(from, 0, dir); to >= 0 && p.board[to] == 0 {
+		add(to)
+		if to2 := step(to, 0, dir); from/8 == start && p.board[to2] == 0 {
+			add(to2)
+		}
+	}
+	for _, df := range []int{-1, 1} {
+		to := step(from, df, dir)
+		if to < 0 {
+			continue
+		}
+		if (p.board[to] != 0 && colorOf(p.board[to]) != p.turn) || to == p.ep {
+			add(to)
+		}
+	}
+	return moves
+}
+
+// castleKingFile returns the file the king ends on after castling.
+func castleKingFile(m Move) int {
+	if m.To > m.From {
+		return 6
+	}
+	return 2
+}
+
+func (p *Position) castleMoves(king int, moves []Move) []Move {
+	rank := king / 8
+	for _, rookFile := range p.castling[p.turn] {
+		rook := rank*8 + rookFile
+		m := Move{From: king, To: rook, Castle: true}
+		kingTo := rank*8 + castleKingFile(m)
+		rookTo := kingTo - 1
+		if rook < king {
+			rookTo = kingTo + 1
+		}
+		// Every square the king and the rook cross or land on must be
+		// empty, but for the two of them.
+		lo, hi := minInt(king, rook, kingTo, rookTo), maxInt(king, rook, kingTo, rookTo)
+		clear := true
+		for sq := lo; sq <= hi; sq++ {
+			if sq != king && sq != rook && p.board[sq] != 0 {
+				clear = false
+				break
+			}
+		}
+		if !clear {
+			continue
+		}
+		// And the king can't castle out of, through or into check. It's
+		// lifted from the board so that it doesn't hide the squares
+		// behind it.
+		lifted := *p
+		lifted.board[king] = 0
+		lo, hi = minInt(king, kingTo), maxInt(king, kingTo)
+		safe := true
+		for sq := lo; sq <= hi; sq++ {
+			if lifted.attacked(sq, opponent(p.turn)) {
+				safe = false
+				break
+			}
+		}
+		if safe {
+			moves = append(moves, m)
+		}
+	}
+	return moves
+}
+
+// apply returns the position after the move, without checking it.
+func (p *Position) apply(m Move) *Position {
+	next := &Position{
+		board:    p.board,
+		turn:     opponent(p.turn),
+		castling: make(map[byte][]int),
+		ep:       -1,
+		halfmove: p.halfmove + 1,
+		fullmove: p.fullmove,
+		shredder: p.shredder,
+	}
+	if p.turn == Black {
+		next.fullmove++
+	}
+	piece := p.board[m.From]
+	rank := m.From / 8
+	switch {
+	case m.Castle:
+		kingTo := rank*8 + castleKingFile(m)
+		rookTo := kingTo - 1
+		if m.To < m.From {
+			rookTo = kingTo + 1
+		}
+		rook := p.board[m.To]
+		next.board[m.From], next.board[m.To] = 0, 0
+		next.board[kingTo], next.board[rookTo] = piece, rook
+	default:
+		if p.board[m.To] != 0 || upper(piece) == 'P' {
+			next.halfmove = 0
+		}
+		if upper(piece) == 'P' && m.To == p.ep {
+			// Take the pawn that moved past the square.
+			next.board[m.To%8+rank*8] = 0
+		}
+		if upper(piece) == 'P' && (m.To-m.From == 16 || m.From-m.To == 16) {
+			next.ep = (m.From + m.To) / 2
+		}
+		next.board[m.From] = 0
+		next.board[m.To] = piece
+		if m.Promotion != 0 {
+			next.board[m.To] = m.Promotion
+		}
+	}
+	// Castling rights are lost when the king moves and when a rook moves
+	// or is taken.
+	for color, files := range p.castling {
+		backRank := 0
+		if color == Black {
+			backRank = 7
+		}
+		for _, f := range files {
+			sq := backRank*8 + f
+			if upper(piece) == 'K' && colorOf(piece) == color {
+				continue
+			}
+			if m.From == sq || m.To == sq {
+				continue
+			}
+			next.castling[color] = append(next.castling[color], f)
+		}
+	}
+	return next
+}
+
+// attacked reports whether a piece of the given color attacks the square.
+func (p *Position) attacked(sq int, by byte) bool {
+	is := func(sq int, pieces string) bool {
+		c := p.board[sq]
+		return c != 0 && colorOf(c) == by && strings.IndexByte(pieces, upper(c)) >= 0
+	}
+	for _, s := range knightSteps {
+		if from := step(sq, s[0], s[1]); from >= 0 && is(from, "N") {
+			return true
+		}
+	}
+	for _, s := range kingSteps {
+		if from := step(sq, s[0], s[1]); from >= 0 && is(from, "KI") {
+			return true
+		}
+	}
+	dir := -1
+	if by == Black {
+		dir = 1
+	}
+	for _, df := range []int{-1, 1} {
+		if from := step(sq, df, dir); from >= 0 && is(from, "P") {
+			return true
+		}
+	}
+	slides := []struct {
+		dirs   [][2]int
+		pieces string
+	}{
+		{rookDirs, "RQ"},
+		{bishopDirs, "BQ"},
+	}
+	for _, s := range slides {
+		for _, d := range s.dirs {
+			for from := step(sq, d[0], d[1]); from >= 0; from = step(from, d[0], d[1]) {
+				if p.board[from] == 0 {
+					continue
+				}
+				if is(from, s.pieces) {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
+func minInt(xs ...int) int {
+	m := xs[0]
+	for _, x := range xs[1:] {
+		if x < m {
+			m = x
+		}
+	}
+	return m
+}
+
+func maxInt(xs ...int) int {
+	m := xs[0]
+	for _, x := range xs[1:] {
+		if x > m {
+			m = x
+		}
+	}
+	return m
+}
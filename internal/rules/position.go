@@ -0,0 +1,460 @@
+// Package rules knows how the pieces of prince chess move. It parses positions
+// in FEN, lists the legal moves, in UCI notation, and tells when a game is
+// over, so that the server can check what the clients claim instead of
+// relaying it blindly.
+//
+// Prince chess is chess with a prince, written I, in place of the queen. The
+// prince steps one square in any direction, like the king, but it isn't
+// royal: it may be taken and may move to attacked squares. A prince reaching
+// the last rank is promoted, which wins the game for its side. Pawns still
+// promote to a queen, rook, bishop or knight.
+//
+// Castling follows the Chess960 rules, so it works from any back rank the
+// server sets up: the king ends on the c or g file and the rook next to it.
+package rules
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidFEN  = errors.New("Invalid FEN")
+	ErrIllegalMove = errors.New("Illegal move")
+	ErrInvalidMove = errors.New("Invalid move")
+
+	// Well formed FENs whose position can't happen in a game.
+	ErrKingCount       = errors.New("Each side must have one king")
+	ErrPrinceCount     = errors.New("Each side can have one prince at most")
+	ErrPawnOnBackRank  = errors.New("Pawns can't be on the first or last rank")
+	ErrCastlingRights  = errors.New("Castling rights without the king and rook on the back rank")
+	ErrOpponentInCheck = errors.New("The side not on turn is in check")
+)
+
+// Colors, as in FEN.
+const (
+	White = 'w'
+	Black = 'b'
+)
+
+// Position is the state of a game: where the pieces are, whose turn it is and
+// what they are allowed to do that the board alone doesn't tell.
+type Position struct {
+	// Pieces by square, a1 first and h8 last, as in FEN: uppercase for
+	// white and lowercase for black. Empty squares are zero.
+	board [64]byte
+	turn  byte
+	// Files of the rooks each color can still castle with, by color.
+	castling map[byte][]int
+	// Square a pawn can capture en passant, or -1.
+	ep       int
+	halfmove int
+	fullmove int
+	// Whether castling rights are written with the files of the rooks.
+	shredder bool
+}
+
+// Move is a move in UCI notation. Castling is written as the king taking its
+// own rook, so that it is never ambiguous from a shuffled back rank.
+type Move struct {
+	From, To  int
+	Promotion byte
+	Castle    bool
+}
+
+// String returns the move in UCI notation, e.g. "e2e4" or "e7e8q".
+func (m Move) String() string {
+	s := squareName(m.From) + squareName(m.To)
+	if m.Promotion != 0 {
+		s += string(lower(m.Promotion))
+	}
+	return s
+}
+
+// ParseFEN parses a position. Besides being well formed, it must have one king
+// per side and one prince at most, no pawns on the first or last rank, rooks
+// for the castling rights and the side not on turn must not be in check.
+func ParseFEN(fen string) (*Position, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return nil, ErrInvalidFEN
+	}
+	p := &Position{
+		castling: make(map[byte][]int),
+		ep:       -1,
+		fullmove: 1,
+	}
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return nil, ErrInvalidFEN
+	}
+	kings, princes := map[byte]int{}, map[byte]int{}
+	for i, rank := range ranks {
+		file := 0
+		for j := 0; j < len(rank); j++ {
+			c := rank[j]
+			if c >= '1' && c <= '8' {
+				file += int(c - '0')
+				continue
+			}
+			if file > 7 || !strings.ContainsRune("PNBRQKIpnbrqki", rune(c)) {
+				return nil, ErrInvalidFEN
+			}
+			if (c == 'P' || c == 'p') && (i == 0 || i == 7) {
+				return nil, ErrPawnOnBackRank
+			}
+			if c == 'K' || c == 'k' {
+				kings[c]++
+			}
+			if c == 'I' || c == 'i' {
+				princes[c]++
+			}
+			p.board[(7-i)*8+file] = c
+			file++
+		}
+		if file != 8 {
+			return nil, ErrInvalidFEN
+		}
+	}
+	if kings['K'] != 1 || kings['k'] != 1 {
+		return nil, ErrKingCount
+	}
+	if princes['I'] > 1 || princes['i'] > 1 {
+		return nil, ErrPrinceCount
+	}
+	switch fields[1] {
+	case "w":
+		p.turn = White
+	case "b":
+		p.turn = Black
+	default:
+		return nil, ErrInvalidFEN
+	}
+	if err := p.parseCastling(fields[2]); err != nil {
+		return nil, err
+	}
+	if fields[3] != "-" {
+		sq, ok := parseSquare(fields[3])
+		if !ok || (sq/8 != 2 && sq/8 != 5) {
+			return nil, ErrInvalidFEN
+		}
+		p.ep = sq
+	}
+	var err error
+	if len(fields) > 4 {
+		if p.halfmove, err = strconv.Atoi(fields[4]); err != nil || p.halfmove < 0 {
+			return nil, ErrInvalidFEN
+		}
+	}
+	if len(fields) > 5 {
+		if p.fullmove, err = strconv.Atoi(fields[5]); err != nil || p.fullmove < 1 {
+			return nil, ErrInvalidFEN
+		}
+	}
+	if p.attacked(p.king(opponent(p.turn)), p.turn) {
+		return nil, ErrOpponentInCheck
+	}
+	return p, nil
+}
+
+func (p *Position) parseCastling(rights string) error {
+	if rights == "-" {
+		return nil
+	}
+	for i := 0; i < len(rights); i++ {
+		c := rights[i]
+		color, rook, rank := byte(White), byte('R'), 0
+		if c >= 'a' {
+			color, rook, rank = Black, 'r', 7
+			c -= 'a' - 'A'
+		}
+		king := p.king(color)
+		if king/8 != rank {
+			return ErrCastlingRights
+		}
+		file := -1
+		switch {
+		case c == 'K':
+			// The outermost rook on the side of the h-file.
+			for f := 7; f > king%8; f-- {
+				if p.board[rank*8+f] == rook {
+					file = f
+					break
+				}
+			}
+		case c == 'Q':
+			for f := 0; f < king%8; f++ {
+				if p.board[rank*8+f] == rook {
+					file = f
+					break
+				}
+			}
+		case c >= 'A' && c <= 'H':
+			p.shredder = true
+			if p.board[rank*8+int(c-'A')] == rook {
+				file = int(c - 'A')
+			}
+		default:
+			return ErrInvalidFEN
+		}
+		if file < 0 {
+			return ErrCastlingRights
+		}
+		p.castling[color] = append(p.castling[color], file)
+	}
+	return nil
+}
+
+// FEN returns the position in FEN.
+func (p *Position) FEN() string {
+	var b strings.Builder
+	for rank := 7; rank >= 0; rank-- {
+		empty := 0
+		for file := 0; file < 8; file++ {
+			c := p.board[rank*8+file]
+			if c == 0 {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				b.WriteByte(byte('0' + empty))
+				empty = 0
+			}
+			b.WriteByte(c)
+		}
+		if empty > 0 {
+			b.WriteByte(byte('0' + empty))
+		}
+		if rank > 0 {
+			b.WriteByte('/')
+		}
+	}
+	b.WriteByte(' ')
+	b.WriteByte(p.turn)
+	b.WriteByte(' ')
+	b.WriteString(p.castlingFEN())
+	b.WriteByte(' ')
+	if p.ep < 0 {
+		b.WriteByte('-')
+	} else {
+		b.WriteString(squareName(p.ep))
+	}
+	b.WriteString(" " + strconv.Itoa(p.halfmove) + " " + strconv.Itoa(p.fullmove))
+	return b.String()
+}
+
+func (p *Position) castlingFEN() string {
+	rights := ""
+	for _, color := range []byte{White, Black} {
+		king := p.king(color) % 8
+		files := append([]int(nil), p.castling[color]...)
+		// The h-side first, as in "KQkq".
+		for i := range files {
+			for j := i + 1; j < len(files); j++ {
+				if files[j] > files[i] {
+					files[i], files[j] = files[j], files[i]
+				}
+			}
+		}
+		for _, f := range files {
+			c := byte('A' + f)
+			if !p.shredder {
+				c = 'Q'
+				if f > king {
+					c = 'K'
+				}
+			}
+			if color == Black {
+				c = lower(c)
+			}
+			rights += string(c)
+		}
+	}
+	if rights == "" {
+		return "-"
+	}
+	return rights
+}
+
+// Turn returns the color on turn, White or Black.
+func (p *Position) Turn() byte {
+	return p.turn
+}
+
+// Fullmove returns the number of the move being played, counted from 1 and
+// increased after each move of Black.
+func (p *Position) Fullmove() int {
+	return p.fullmove
+}
+
+// Piece returns the piece on the square, or zero if it's empty.
+func (p *Position) Piece(sq int) byte {
+	return p.board[sq]
+}
+
+// InCheck reports whether the king of the side on turn is attacked.
+func (p *Position) InCheck() bool {
+	return p.attacked(p.king(p.turn), opponent(p.turn))
+}
+
+// ParseMove finds the legal move written in UCI notation. Castling is also
+// accepted as the king moving to the c or g file, as in standard chess.
+func (p *Position) ParseMove(uci string) (Move, error) {
+	if len(uci) != 4 && len(uci) != 5 {
+		return Move{}, ErrInvalidMove
+	}
+	from, ok1 := parseSquare(uci[:2])
+	to, ok2 := parseSquare(uci[2:4])
+	if !ok1 || !ok2 {
+		return Move{}, ErrInvalidMove
+	}
+	for _, m := range p.LegalMoves() {
+		if m.From != from {
+			continue
+		}
+		if m.String() == uci {
+			return m, nil
+		}
+		if m.Castle && len(uci) == 4 && to == m.From/8*8+castleKingFile(m) &&
+			(m.To-m.From)*(to-m.From) > 0 {
+			return m, nil
+		}
+	}
+	return Move{}, ErrIllegalMove
+}
+
+// Play returns the position after the move, which must be legal.
+func (p *Position) Play(m Move) (*Position, error) {
+	for _, legal := range p.LegalMoves() {
+		if legal == m {
+			return p.apply(m), nil
+		}
+	}
+	return nil, ErrIllegalMove
+}
+
+// Apply returns the position after a move taken from LegalMoves, without
+// checking it again.
+func (p *Position) Apply(m Move) *Position {
+	return p.apply(m)
+}
+
+// PlayUCI plays a move in UCI notation.
+func (p *Position) PlayUCI(uci string) (*Position, error) {
+	m, err := p.ParseMove(uci)
+	if err != nil {
+		return nil, err
+	}
+	return p.apply(m), nil
+}
+
+// Status of a game after a move.
+const (
+	Ongoing   = "ongoing"
+	Checkmate = "checkmate"
+	Stalemate = "stalemate"
+	// Neither side has enough material left to mate.
+	InsufficientMaterial = "insufficientMaterial"
+	// A prince reached the last rank.
+	PrincePromoted = "princePromoted"
+)
+
+// Status tells whether the game is over in the position and how.
+func (p *Position) Status() string {
+	if _, ok := p.PromotedPrince(); ok {
+		return PrincePromoted
+	}
+	if len(p.LegalMoves()) == 0 {
+		if p.InCheck() {
+			return Checkmate
+		}
+		return Stalemate
+	}
+	if p.insufficientMaterial() {
+		return InsufficientMaterial
+	}
+	return Ongoing
+}
+
+// PromotedPrince returns the color of the prince on the last rank, if any. Its
+// side won the game.
+func (p *Position) PromotedPrince() (byte, bool) {
+	for file := 0; file < 8; file++ {
+		if p.board[7*8+file] == 'I' {
+			return White, true
+		}
+		if p.board[file] == 'i' {
+			return Black, true
+		}
+	}
+	return 0, false
+}
+
+// insufficientMaterial reports whether only the kings are left, maybe with a
+// single minor piece. A prince can always be promoted.
+func (p *Position) insufficientMaterial() bool {
+	minors := 0
+	for _, c := range p.board {
+		switch upper(c) {
+		case 0, 'K':
+		case 'N', 'B':
+			minors++
+		default:
+			return false
+		}
+	}
+	return minors <= 1
+}
+
+func (p *Position) king(color byte) int {
+	k := byte('K')
+	if color == Black {
+		k = 'k'
+	}
+	for sq, c := range p.board {
+		if c == k {
+			return sq
+		}
+	}
+	return -1
+}
+
+func parseSquare(s string) (int, bool) {
+	if len(s) != 2 || s[0] < 'a' || s[0] > 'h' || s[1] < '1' || s[1] > '8' {
+		return 0, false
+	}
+	return int(s[1]-'1')*8 + int(s[0]-'a'), true
+}
+
+func squareName(sq int) string {
+	return string([]byte{byte('a' + sq%8), byte('1' + sq/8)})
+}
+
+func colorOf(c byte) byte {
+	if c >= 'a' {
+		return Black
+	}
+	return White
+}
+
+func opponent(color byte) byte {
+	if color == White {
+		return Black
+	}
+	return White
+}
+
+func upper(c byte) byte {
+	if c >= 'a' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
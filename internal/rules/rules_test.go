@@ -0,0 +1,160 @@
+package rules
+
+import "testing"
+
+const startFEN = "rnbikbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBIKBNR w KQkq - 0 1"
+
+func mustParse(t *testing.T, fen string) *Position {
+	t.Helper()
+	p, err := ParseFEN(fen)
+	if err != nil {
+		t.Fatalf("ParseFEN(%q): %v", fen, err)
+	}
+	return p
+}
+
+func TestStartingMoves(t *testing.T) {
+	p := mustParse(t, startFEN)
+	// The prince is boxed in, like the queen in chess.
+	if n := len(p.LegalMoves()); n != 20 {
+		t.Errorf("%d legal moves from the start, want 20", n)
+	}
+	if got := p.FEN(); got != startFEN {
+		t.Errorf("FEN() = %q, want %q", got, startFEN)
+	}
+}
+
+func TestParseFENRejects(t *testing.T) {
+	tests := []struct {
+		fen string
+		err error
+	}{
+		{"4k3/8/8/8/8/8/8/4K3 w - -", nil},
+		{"4k3/8/8/8/8/8/8/4KK2 w - -", ErrKingCount},
+		{"4k3/8/8/8/8/8/8/2II1K2 w - -", ErrPrinceCount},
+		{"4k3/8/8/8/8/8/8/P3K3 w - -", ErrPawnOnBackRank},
+		{"4k3/8/8/8/8/8/8/4K3 w K -", ErrCastlingRights},
+		{"4k3/3I4/8/8/8/8/8/4K3 w - -", ErrOpponentInCheck},
+		{"4k3/8/8/8/8/8/8/4K2X w - -", ErrInvalidFEN},
+	}
+	for _, tt := range tests {
+		if _, err := ParseFEN(tt.fen); err != tt.err {
+			t.Errorf("ParseFEN(%q) = %v, want %v", tt.fen, err, tt.err)
+		}
+	}
+}
+
+func TestPrinceMovesLikeAKingButIsNotRoyal(t *testing.T) {
+	// The rook on a2 guards the second rank.
+	p := mustParse(t, "4k3/8/8/8/8/8/r7/3IK3 w - - 0 1")
+	for _, uci := range []string{"d1c1", "d1c2", "d1d2", "d1e2"} {
+		if _, err := p.ParseMove(uci); err != nil {
+			t.Errorf("prince move %s: %v", uci, err)
+		}
+	}
+	if _, err := p.ParseMove("d1d3"); err != ErrIllegalMove {
+		t.Errorf("prince moving two squares: %v, want %v", err, ErrIllegalMove)
+	}
+	if _, err := p.ParseMove("e1e2"); err != ErrIllegalMove {
+		t.Errorf("king moving into check: %v, want %v", err, ErrIllegalMove)
+	}
+	// Taking the prince is just a capture.
+	p = mustParse(t, "4k3/8/8/8/8/8/r7/I3K3 b - - 0 1")
+	m, err := p.ParseMove("a2a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsCapture(m) || p.SAN(m) != "Rxa1+" {
+		t.Errorf("rook taking the prince is %q, want Rxa1+", p.SAN(m))
+	}
+}
+
+func TestPrinceGivesCheck(t *testing.T) {
+	p := mustParse(t, "4k3/3I4/8/8/8/8/8/4K3 b - - 0 1")
+	if !p.InCheck() {
+		t.Error("king next to the enemy prince is not in check")
+	}
+	if _, err := p.ParseMove("e8d7"); err != nil {
+		t.Errorf("king taking the prince: %v", err)
+	}
+}
+
+func TestPrincePromoted(t *testing.T) {
+	p := mustParse(t, "4k3/2I5/8/8/8/8/8/4K3 w - - 0 1")
+	if s := p.Status(); s != Ongoing {
+		t.Fatalf("status %q before the promotion, want %q", s, Ongoing)
+	}
+	m, err := p.ParseSAN("Ic8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := p.Apply(m)
+	if s := next.Status(); s != PrincePromoted {
+		t.Errorf("status %q after the prince reached the last rank, want %q", s, PrincePromoted)
+	}
+	if color, ok := next.PromotedPrince(); !ok || color != White {
+		t.Errorf("PromotedPrince() = %c, %v; want w, true", color, ok)
+	}
+
+	p = mustParse(t, "4k3/8/8/8/8/8/5i2/1K6 b - - 0 1")
+	next, err = p.PlayUCI("f2f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if color, ok := next.PromotedPrince(); !ok || color != Black {
+		t.Errorf("PromotedPrince() = %c, %v; want b, true", color, ok)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		fen    string
+		status string
+	}{
+		{"R5k1/5ppp/8/8/8/8/8/6K1 b - - 0 1", Checkmate},
+		{"k7/2I5/1K6/8/8/8/8/8 b - - 0 1", Stalemate},
+		{"4k3/8/8/8/8/8/8/3NK3 b - - 0 1", InsufficientMaterial},
+		// A prince can still be promoted.
+		{"4k3/8/8/8/8/8/8/3IK3 b - - 0 1", Ongoing},
+	}
+	for _, tt := range tests {
+		if s := mustParse(t, tt.fen).Status(); s != tt.status {
+			t.Errorf("Status(%q) = %q, want %q", tt.fen, s, tt.status)
+		}
+	}
+}
+
+func TestPGNRoundTrip(t *testing.T) {
+	start := mustParse(t, startFEN)
+	pgn := "1. e4 e5 2. Nf3 Nc6 3. Bc4 Bc5 4. O-O Nf6 5. Ie2 d6 6. c3 Id7"
+	pos, moves, err := ParsePGN(start, "[Event \"Casual\"]\n"+pgn+" *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatMoves(start, moves); got != pgn {
+		t.Errorf("FormatMoves = %q, want %q", got, pgn)
+	}
+	if pos.Turn() != White || pos.Fullmove() != 7 {
+		t.Errorf("after the game %c is on turn at move %d, want w at 7", pos.Turn(), pos.Fullmove())
+	}
+	if _, _, err := ParsePGN(start, "1. e4 Qh4"); err != ErrIllegalMove {
+		t.Errorf("queen move from the start: %v, want %v", err, ErrIllegalMove)
+	}
+}
+
+func TestCastlingFromAShuffledRank(t *testing.T) {
+	// Chess960 castling: the king on b1 and the rook on a1 end on c1 and
+	// d1.
+	p := mustParse(t, "rk2b1nr/pp4pp/8/8/8/8/PP4PP/RK2B1NR w HAha - 0 1")
+	m, err := p.ParseMove("b1a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := p.Apply(m)
+	if next.Piece(2) != 'K' || next.Piece(3) != 'R' {
+		t.Errorf("after O-O-O the back rank is %q, want the king on c1 and the rook on d1", next.FEN())
+	}
+	if p.SAN(m) != "O-O-O" {
+		t.Errorf("SAN = %q, want O-O-O", p.SAN(m))
+	}
+}
@@ -0,0 +1,196 @@
+package rules
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SAN returns the legal move in Standard Algebraic Notation, e.g. "Nbd7",
+// "exd5", "e8=Q+" or "O-O".
+func (p *Position) SAN(m Move) string {
+	s := p.sanNoCheck(m)
+	next := p.apply(m)
+	if next.InCheck() {
+		if len(next.LegalMoves()) == 0 {
+			return s + "#"
+		}
+		return s + "+"
+	}
+	return s
+}
+
+// sanNoCheck returns the move in SAN without the check mark.
+func (p *Position) sanNoCheck(m Move) string {
+	var s string
+	piece := upper(p.board[m.From])
+	switch {
+	case m.Castle:
+		s = "O-O-O"
+		if m.To > m.From {
+			s = "O-O"
+		}
+	case piece == 'P':
+		if p.IsCapture(m) {
+			s = string('a'+byte(m.From%8)) + "x"
+		}
+		s += squareName(m.To)
+		if m.Promotion != 0 {
+			s += "=" + string(upper(m.Promotion))
+		}
+	default:
+		s = string(piece)
+		// Tell the move apart from the ones of the pieces of the same kind
+		// landing on the same square.
+		var sameFile, sameRank, ambiguous bool
+		for _, other := range p.LegalMoves() {
+			if other.To != m.To || other.From == m.From || other.Castle ||
+				upper(p.board[other.From]) != piece {
+				continue
+			}
+			ambiguous = true
+			sameFile = sameFile || other.From%8 == m.From%8
+			sameRank = sameRank || other.From/8 == m.From/8
+		}
+		if ambiguous {
+			name := squareName(m.From)
+			switch {
+			case !sameFile:
+				s += name[:1]
+			case !sameRank:
+				s += name[1:]
+			default:
+				s += name
+			}
+		}
+		if p.IsCapture(m) {
+			s += "x"
+		}
+		s += squareName(m.To)
+	}
+	return s
+}
+
+// IsCapture reports whether the move takes a piece.
+func (p *Position) IsCapture(m Move) bool {
+	if m.Castle {
+		return false
+	}
+	return p.board[m.To] != 0 || (upper(p.board[m.From]) == 'P' && m.To == p.ep)
+}
+
+// ParseSAN finds the legal move written in Standard Algebraic Notation.
+// Check marks, annotations and the "=" of promotions are optional, and
+// castling may be written with zeros.
+func (p *Position) ParseSAN(san string) (Move, error) {
+	want := normalizeSAN(san)
+	if want == "" {
+		return Move{}, ErrInvalidMove
+	}
+	for _, m := range p.LegalMoves() {
+		if normalizeSAN(p.sanNoCheck(m)) == want {
+			return m, nil
+		}
+	}
+	return Move{}, ErrIllegalMove
+}
+
+func normalizeSAN(san string) string {
+	san = strings.TrimRight(san, "+#!?")
+	san = strings.Replace(san, "0", "O", -1)
+	return strings.Replace(san, "=", "", -1)
+}
+
+// ParsePGN plays the moves of the movetext of a PGN from the position given.
+// Tags, comments, variations, move numbers and the result are skipped. It
+// returns the position reached and the moves played.
+func ParsePGN(start *Position, pgn string) (*Position, []Move, error) {
+	pos := start
+	var moves []Move
+	for _, tok := range pgnTokens(pgn) {
+		m, err := pos.ParseSAN(tok)
+		if err != nil {
+			return nil, nil, err
+		}
+		moves = append(moves, m)
+		pos = pos.apply(m)
+	}
+	return pos, moves, nil
+}
+
+// pgnTokens returns the moves in the movetext of a PGN.
+func pgnTokens(pgn string) []string {
+	var (
+		tokens []string
+		b      strings.Builder
+		depth  int // of comments and variations
+		inTag  bool
+	)
+	flush := func() {
+		tok := b.String()
+		b.Reset()
+		// Drop move numbers, e.g. "12." or "12...", glued or not.
+		if i := strings.LastIndexByte(tok, '.'); i >= 0 {
+			tok = tok[i+1:]
+		}
+		switch {
+		case tok == "", tok == "*", tok == "1-0", tok == "0-1", tok == "1/2-1/2",
+			tok[0] == '$':
+		default:
+			if _, err := strconv.Atoi(tok); err != nil {
+				tokens = append(tokens, tok)
+			}
+		}
+	}
+	for i := 0; i < len(pgn); i++ {
+		c := pgn[i]
+		switch {
+		case inTag:
+			if c == ']' {
+				inTag = false
+			}
+		case c == '[' && depth == 0:
+			inTag = true
+		case c == '{' || c == '(':
+			flush()
+			depth++
+		case c == '}' || c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth > 0:
+		case c == ';':
+			// Comment to the end of the line.
+			for i < len(pgn) && pgn[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\n' || c == '\r' || c == '\t':
+			flush()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// FormatMoves writes the moves played from the position as PGN movetext,
+// e.g. "1. e4 e5 2. Nf3".
+func FormatMoves(start *Position, moves []Move) string {
+	var b strings.Builder
+	pos := start
+	for i, m := range moves {
+		if pos.turn == White {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(strconv.Itoa(pos.fullmove) + ". ")
+		} else if i == 0 {
+			b.WriteString(strconv.Itoa(pos.fullmove) + "... ")
+		} else {
+			b.WriteByte(' ')
+		}
+		b.WriteString(pos.SAN(m))
+		pos = pos.apply(m)
+	}
+	return b.String()
+}
@@ -0,0 +1,238 @@
+// Package variant holds the rules games can be played with. Each variant
+// knows how its games start, which moves are legal and when the game is
+// over; matches, invites and finished games name theirs by identifier.
+package variant
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// Identifiers of the built-in variants.
+const (
+	StandardName = "standard"
+	// Like Chess960: the back rank is shuffled, with the bishops on squares
+	// of opposite colors and the king between the rooks. The prince starts
+	// next to the king, as it does in the usual setup.
+	Prince960Name = "prince960"
+)
+
+// StandardFEN is the usual starting position, with the princes where the
+// queens stand in chess.
+const StandardFEN = "rnbikbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBIKBNR w KQkq - 0 1"
+
+// Results of the games, as in PGN.
+const (
+	WhiteWins = "1-0"
+	BlackWins = "0-1"
+	Draw      = "1/2-1/2"
+)
+
+// Variant is a set of rules games can be played with.
+type Variant interface {
+	// Name identifies the variant.
+	Name() string
+	// InitialFEN returns the starting position of a new game, drawn at
+	// random by the variants that shuffle it.
+	InitialFEN() (string, error)
+	// Position parses a position of a game of the variant.
+	Position(fen string) (*rules.Position, error)
+	// LegalMoves lists the moves of the side on turn in the position.
+	LegalMoves(pos *rules.Position) []rules.Move
+	// Outcome tells whether the game is over in the position: its result
+	// and how it ended, or empty strings while it goes on.
+	Outcome(pos *rules.Position) (result, reason string)
+}
+
+var registry = make(map[string]Variant)
+
+// Register makes the variant available by its name. It's meant to be called
+// from init functions, before games start.
+func Register(v Variant) {
+	registry[v.Name()] = v
+}
+
+// Get returns the variant with the name.
+func Get(name string) (Variant, bool) {
+	v, ok := registry[name]
+	return v, ok
+}
+
+// Names returns the names of the variants available, sorted.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	// Standard is played from the usual setup.
+	Standard Variant = orthodox{name: StandardName, initial: func() (string, error) {
+		return StandardFEN, nil
+	}}
+	// Prince960 shuffles the back ranks.
+	Prince960 Variant = orthodox{name: Prince960Name, initial: func() (string, error) {
+		rank, err := shuffledBackRank()
+		if err != nil {
+			return "", err
+		}
+		return fen960(rank), nil
+	}}
+)
+
+func init() {
+	Register(Standard)
+	Register(Prince960)
+}
+
+// orthodox are the variants played by the rules of prince chess, as the rules
+// package knows them, told apart by how their games start.
+type orthodox struct {
+	name    string
+	initial func() (string, error)
+}
+
+func (v orthodox) Name() string {
+	return v.name
+}
+
+func (v orthodox) InitialFEN() (string, error) {
+	return v.initial()
+}
+
+func (v orthodox) Position(fen string) (*rules.Position, error) {
+	return rules.ParseFEN(fen)
+}
+
+func (v orthodox) LegalMoves(pos *rules.Position) []rules.Move {
+	return pos.LegalMoves()
+}
+
+// Outcome ends the game on mate, a promoted prince, stalemate and when neither
+// side can mate.
+func (v orthodox) Outcome(pos *rules.Position) (result, reason string) {
+	switch status := pos.Status(); status {
+	case rules.PrincePromoted:
+		if color, _ := pos.PromotedPrince(); color == rules.White {
+			return WhiteWins, status
+		}
+		return BlackWins, status
+	case rules.Checkmate:
+		if pos.Turn() == rules.White {
+			return BlackWins, status
+		}
+		return WhiteWins, status
+	case rules.Stalemate, rules.InsufficientMaterial:
+		return Draw, status
+	}
+	return "", ""
+}
+
+// shuffledBackRank returns the pieces of the white back rank from the a to
+// the h file, placed at random: a bishop on a dark and one on a light
+// square, the prince and the knights anywhere, then a rook, the king and the
+// other rook on the squares left, in that order. Ranks with the prince away
+// from the king are drawn again.
+func shuffledBackRank() ([]byte, error) {
+	for {
+		rank, err := drawBackRank()
+		if err != nil {
+			return nil, err
+		}
+		if validBackRank(rank) {
+			return rank, nil
+		}
+	}
+}
+
+func drawBackRank() ([]byte, error) {
+	rank := make([]byte, 8)
+	// free returns the index of the nth empty square.
+	free := func(n int) int {
+		for i, p := range rank {
+			if p != 0 {
+				continue
+			}
+			if n == 0 {
+				return i
+			}
+			n--
+		}
+		panic("no empty square")
+	}
+	// a1 is dark, so dark squares have even indices.
+	dark, err := randIntn(4)
+	if err != nil {
+		return nil, err
+	}
+	light, err := randIntn(4)
+	if err != nil {
+		return nil, err
+	}
+	rank[2*dark] = 'B'
+	rank[2*light+1] = 'B'
+	for i, piece := range []byte("INN") {
+		n, err := randIntn(6 - i)
+		if err != nil {
+			return nil, err
+		}
+		rank[free(n)] = piece
+	}
+	for _, piece := range []byte("RKR") {
+		rank[free(0)] = piece
+	}
+	return rank, nil
+}
+
+// validBackRank reports whether the white back rank is one a Prince960 game
+// can start from: the pieces of the usual setup, the bishops on squares of
+// opposite colors, the king between the rooks and the prince next to it.
+func validBackRank(rank []byte) bool {
+	if len(rank) != 8 {
+		return false
+	}
+	sorted := append([]byte(nil), rank...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if string(sorted) != "BBIKNNRR" {
+		return false
+	}
+	bishops := strings.IndexByte(string(rank), 'B') + strings.LastIndexByte(string(rank), 'B')
+	king := strings.IndexByte(string(rank), 'K')
+	prince := strings.IndexByte(string(rank), 'I')
+	return bishops%2 == 1 &&
+		strings.IndexByte(string(rank), 'R') < king &&
+		strings.LastIndexByte(string(rank), 'R') > king &&
+		(prince == king-1 || prince == king+1)
+}
+
+// fen960 returns the starting position with the back rank given. Castling
+// rights name the files of the rooks, as in Shredder-FEN, since they may not
+// start on the corners.
+func fen960(rank []byte) string {
+	white := string(rank)
+	black := strings.ToLower(white)
+	castling := ""
+	for i := len(rank) - 1; i >= 0; i-- {
+		if rank[i] == 'R' {
+			castling += string(rune('A' + i))
+		}
+	}
+	castling += strings.ToLower(castling)
+	return black + "/pppppppp/8/8/8/8/PPPPPPPP/" + white + " w " + castling + " - 0 1"
+}
+
+// randIntn returns a uniformly random number in [0, n).
+func randIntn(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
@@ -0,0 +1,87 @@
+package variant
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+func TestValidBackRank(t *testing.T) {
+	tests := []struct {
+		rank  string
+		valid bool
+	}{
+		{"RNBIKBNR", true},
+		{"BBNNRIKR", true},
+		{"RKINNRBB", true},
+		// The prince away from the king.
+		{"RNBKBNIR", false},
+		// The bishops on squares of the same color.
+		{"RBNIKBNR", false},
+		// The king outside the rooks.
+		{"KIRNBBNR", false},
+		// A queen instead of the prince.
+		{"RNBQKBNR", false},
+		{"RNBIKBN", false},
+	}
+	for _, tt := range tests {
+		if valid := validBackRank([]byte(tt.rank)); valid != tt.valid {
+			t.Errorf("validBackRank(%s) = %v, want %v", tt.rank, valid, tt.valid)
+		}
+	}
+}
+
+func TestPrince960StartingPositions(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		fen, err := Prince960.InitialFEN()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos, err := Prince960.Position(fen)
+		if err != nil {
+			t.Fatalf("%s: %v", fen, err)
+		}
+		ranks := strings.Split(strings.Fields(fen)[0], "/")
+		white := ranks[7]
+		if !validBackRank([]byte(white)) {
+			t.Fatalf("%s: invalid back rank", fen)
+		}
+		if ranks[0] != strings.ToLower(white) {
+			t.Fatalf("%s: the back ranks don't mirror each other", fen)
+		}
+		if n := len(Prince960.LegalMoves(pos)); n < 18 {
+			t.Errorf("%s: %d legal moves", fen, n)
+		}
+		seen[white] = true
+	}
+	// There are 248 back ranks to draw from.
+	if len(seen) < 100 {
+		t.Errorf("%d different back ranks in 500 games", len(seen))
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		fen    string
+		result string
+		reason string
+	}{
+		{StandardFEN, "", ""},
+		{"2I1k3/8/8/8/8/8/8/4K3 b - - 0 1", WhiteWins, rules.PrincePromoted},
+		{"4k3/8/8/8/8/8/8/4K1i1 w - - 0 1", BlackWins, rules.PrincePromoted},
+		{"R5k1/5ppp/8/8/8/8/8/6K1 b - - 0 1", WhiteWins, rules.Checkmate},
+		{"k7/2I5/1K6/8/8/8/8/8 b - - 0 1", Draw, rules.Stalemate},
+		{"4k3/8/8/8/8/8/8/3BK3 w - - 0 1", Draw, rules.InsufficientMaterial},
+	}
+	for _, tt := range tests {
+		pos, err := Standard.Position(tt.fen)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.fen, err)
+		}
+		if result, reason := Standard.Outcome(pos); result != tt.result || reason != tt.reason {
+			t.Errorf("Outcome(%s) = %q, %q; want %q, %q", tt.fen, result, reason, tt.result, tt.reason)
+		}
+	}
+}
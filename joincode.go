@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+const joinCodeLength = 6
+
+// Characters of the join codes. Those easily mistaken for one another when
+// typed by hand (0/O, 1/I/L) are left out.
+const joinCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// newJoinCode generates a random code for friends to type instead of the full
+// invite link.
+func newJoinCode() (string, error) {
+	code := make([]byte, joinCodeLength)
+	max := big.NewInt(int64(len(joinCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = joinCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// normalizeJoinCode makes codes typed by users case and space insensitive.
+func normalizeJoinCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
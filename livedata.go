@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"expvar"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/livedata"
+	"github.com/luisguve/princechess-server/internal/protocol"
 	idGen "github.com/rs/xid"
 	// idGen "github.com/segmentio/ksuid"
 )
@@ -14,15 +17,14 @@ import (
 // Send information of users connected and ongoing games
 func (rout *router) handleLivedata(w http.ResponseWriter, r *http.Request) {
 	// Upgrade to websocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Could not upgrade conn", http.StatusInternalServerError)
+	conn := upgrade(w, r)
+	if conn == nil {
 		return
 	}
+	version, _ := protocolVersion(r)
 	session, err := rout.store.Get(r, "sess")
 	if err != nil {
-		log.Printf("handleLivedata: get cookie error: %v", err)
+		requestLogger(r).warn("Could not get session", "err", err)
 	}
 	uidBlob := session.Values["uid"]
 	var (
@@ -33,29 +35,54 @@ func (rout *router) handleLivedata(w http.ResponseWriter, r *http.Request) {
 		uid = idGen.New().String()
 		session.Values["uid"] = uid
 		if err := rout.store.Save(r, w, session); err != nil {
-			log.Println(err)
+			requestLogger(r).error("Could not save session", "err", err)
 			payload := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
 			conn.WriteMessage(websocket.CloseMessage, payload)
 			return
 		}
 	}
+	username, ok := session.Values["username"].(string)
+	if !ok {
+		username = DEFAULT_USERNAME
+	}
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
 	client := &livedataClient{
-		uid:  uid,
-		hub:  rout.ldHub,
-		conn: conn,
-		send: make(chan livedata, 256),
+		Client:   livedata.NewClient(uid, 256),
+		username: username,
+		lang:     requestLanguage(r),
+		protocol: version,
+		hub:      rout.ldHub,
+		conn:     conn,
+	}
+	// Catch up with the lobby chat and the open seeks before registering to
+	// receive new messages.
+	client.Send<- map[string]interface{}{
+		"lobbyChatHistory": rout.ldHub.lobby.recentMessages(),
+		"seeks":            rout.seeks.list(),
 	}
 	rout.ldHub.register<- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
-	go client.readPump()
+	go func() {
+		client.readPump()
+		rout.conns.remove(uid, conn)
+	}()
 }
 
+var (
+	// Users connected to livedata, and players in games, as last seen by
+	// the hub.
+	livedataClients = expvar.NewInt("livedataClients")
+	playersInGames  = expvar.NewInt("playersInGames")
+)
+
 type livedataHub struct {
-	// Players online.
-	online map[string]*livedataClient
+	// Connections of the players online.
+	clients *livedata.Registry
 
 	// Number of players in ongoing games
 	playing map[string]bool
@@ -70,101 +97,166 @@ type livedataHub struct {
 	register   chan *livedataClient
 
 	// Unregister requests from the clients.
-	unregister chan string
+	unregister chan *livedataClient
+
+	// Events addressed to a single online user.
+	direct chan directDelivery
+
+	// Events addressed to every online user.
+	broadcast chan interface{}
+
+	// Public chat of the lobby.
+	lobby *lobbyChat
+
+	// Id of this node, and the broker relaying events to the other nodes,
+	// nil if the server runs in a single node.
+	node  string
+	peers broker
+
+	// Events addressed to users, relayed by other nodes.
+	remote chan clusterEvent
+
+	// Reports whether the server refuses new games for being full.
+	full func() bool
+
+	// Asks to send the info again to every client, e.g. after the banner
+	// changed.
+	refresh chan struct{}
+}
+
+// directDelivery is an event sent only to the livedata socket of the user
+// identified by uid.
+type directDelivery struct {
+	uid     string
+	payload interface{}
 }
 
 func newLivedataHub() *livedataHub {
-	return &livedataHub{
-		online:     make(map[string]*livedataClient),
+	hub := &livedataHub{
+		clients:    livedata.NewRegistry(),
 		playing:    make(map[string]bool),
 		joinPlayer: make(chan string),
 		finishGame: make(chan match),
 		register:   make(chan *livedataClient),
-		unregister: make(chan string),
+		unregister: make(chan *livedataClient),
+		direct:     make(chan directDelivery),
+		broadcast:  make(chan interface{}),
+		node:       idGen.New().String(),
+		remote:     make(chan clusterEvent),
+		full:       func() bool { return false },
+		refresh:    make(chan struct{}),
 	}
+	hub.lobby = newLobbyChat(hub)
+	return hub
 }
 
 func (hub *livedataHub) run() {
 	for {
+		livedataClients.Set(int64(hub.clients.Users()))
+		playersInGames.Set(int64(len(hub.playing)))
 		select {
 		case client := <-hub.register:
-			hub.online[client.uid] = client
-		case uid := <-hub.unregister:
-			if client, ok := hub.online[uid]; ok {
-				close(client.send)
-				delete(hub.online, uid)
-			}
+			hub.clients.Add(client.Client)
+		case client := <-hub.unregister:
+			hub.clients.Drop(client.Client)
 		case userId := <-hub.joinPlayer:
 			hub.playing[userId] = true
 		case players := <-hub.finishGame:
 			delete(hub.playing, players.white.id)
 			delete(hub.playing, players.black.id)
-		}
-		info := livedata{
-			Players: len(hub.online) + len(hub.playing),
-			Games:   len(hub.playing) / 2,
+		case <-hub.refresh:
+		case d := <-hub.direct:
+			if !hub.clients.Deliver(d.uid, d.payload) {
+				// The user may be connected to another node.
+				hub.relay(topicDirect, d.uid, d.payload)
+			}
+			// The numbers didn't change.
+			continue
+		case ev := <-hub.remote:
+			hub.clients.Deliver(ev.Uid, ev.Payload)
+			continue
+		case payload := <-hub.broadcast:
+			hub.clients.SendAll(payload)
+			continue
 		}
 		// Send real-time info to every client.
-		// Note: potentially a time-costly operation).
-		go func() {
-			for uid, client := range hub.online {
-				select {
-				case client.send<- info:
-				default:
-					close(client.send)
-					delete(hub.online, uid)
-				}
-			}
-		}()
+		hub.clients.SendAll(livedata.Info{
+			Players: hub.clients.Users() + len(hub.playing),
+			Games:   len(hub.playing) / 2,
+			Full:    hub.full(),
+			Banner:  conf.banner(),
+		})
 	}
 }
 
-type livedata struct {
-	Players int `json:"players"`
-	Games   int `json:"games"`
-}
-
 type livedataClient struct {
-	uid string
-	hub *livedataHub
+	*livedata.Client
+	username string
+	lang     string
+	protocol int
+	hub      *livedataHub
 
-	conn *websocket.Conn
-
-	// Buffered channel of outbound messages.
-	send chan livedata
+	conn protocol.Conn
 }
 
-// Reading goroutine - it only reads ping messages.
+// Reading goroutine - it reads ping messages and lobby chat messages.
 func (c *livedataClient) readPump() {
 	defer func() {
-		c.hub.unregister<- c.uid
+		c.hub.unregister<- c
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(conf.MaxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
 	for {
-		_, _, err := c.conn.ReadMessage()
+		msg, oversized, err := readMessage(c.conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				rootLogger.warn("Livedata connection closed unexpectedly", "uid", c.UID, "err", err)
 			}
 			break
 		}
+		if oversized {
+			c.hub.lobby.reject(c.UID, newNotice(noticeMessageTooLong))
+			continue
+		}
+		m, err := decodeChatInput(msg)
+		c.hub.lobby.broadcast<- publicMessage{
+			Text:     m.Text,
+			Username: c.username,
+			userId:   c.UID,
+			invalid:  err,
+		}
+	}
+}
+
+// encode JSON-marshals the outbound message, localizing it if it's a notice.
+// The banner warns the clients speaking a deprecated version of the protocol.
+func (c *livedataClient) encode(info interface{}) ([]byte, error) {
+	switch info := info.(type) {
+	case noticeEvent:
+		return json.Marshal(info.localize(c.lang))
+	case livedata.Info:
+		if sunset, deprecated := conf.protocolSunset(c.protocol); deprecated {
+			warning := newNotice(noticeProtocolDeprecated, sunset).localize(c.lang).Text
+			info.Banner = strings.TrimSpace(warning + "\n" + info.Banner)
+		}
+		return json.Marshal(info)
 	}
+	return json.Marshal(info)
 }
 
 // Writing goroutine - it sends real-time info and ping messages to the client.
 func (c *livedataClient) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(conf.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
 	for {
 		select {
-		case info, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case info, ok := <-c.Send:
+			c.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 			if !ok {
 				// The hub closed the channel.
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -173,37 +265,23 @@ func (c *livedataClient) writePump() {
 
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
-				log.Println(err)
+				rootLogger.error("Could not make next writer", "uid", c.UID, "err", err)
 				return
 			}
-			infoB, err := json.Marshal(info)
+			infoB, err := c.encode(info)
 			if err != nil {
-				log.Println("Could not marshal info:", err)
+				rootLogger.error("Could not marshal info", "err", err)
 				payload := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
 				c.conn.WriteMessage(websocket.CloseMessage, payload)
 				return
 			}
+			// One message per frame, for the client to parse each.
 			w.Write(infoB)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				info = <-c.send
-				infoB, err = json.Marshal(info)
-				if err != nil {
-					log.Println("Could not marshal info:", err)
-					payload := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
-					c.conn.WriteMessage(websocket.CloseMessage, payload)
-					return
-				}
-				w.Write(infoB)
-			}
-
 			if err := w.Close(); err != nil {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
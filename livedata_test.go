@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/livedata"
+	"github.com/luisguve/princechess-server/internal/protocol/protocoltest"
+)
+
+func newTestClient(hub *livedataHub, uid string) *livedataClient {
+	return &livedataClient{Client: livedata.NewClient(uid, 4), hub: hub}
+}
+
+// receive reads what the hub sent the client until the payload that isn't
+// the live info, reporting false if the client was dropped.
+func receive(t *testing.T, c *livedataClient) (interface{}, bool) {
+	t.Helper()
+	for {
+		select {
+		case payload, ok := <-c.Send:
+			if !ok {
+				return nil, false
+			}
+			if _, info := payload.(livedata.Info); !info {
+				return payload, true
+			}
+		case <-time.After(time.Second):
+			t.Fatal("nothing sent to the client")
+		}
+	}
+}
+
+func TestLivedataHubKeysClientsByConnection(t *testing.T) {
+	hub := newLivedataHub()
+	go hub.run()
+	first, second := newTestClient(hub, "a"), newTestClient(hub, "a")
+	hub.register<- first
+	hub.register<- second
+
+	hub.direct<- directDelivery{uid: "a", payload: "hello"}
+	for _, c := range []*livedataClient{first, second} {
+		if payload, ok := receive(t, c); !ok || payload != "hello" {
+			t.Fatalf("tab got %v, %v, want hello", payload, ok)
+		}
+	}
+
+	// Closing a tab leaves the other connected, and closing it twice is
+	// harmless.
+	hub.unregister<- first
+	hub.unregister<- first
+	hub.direct<- directDelivery{uid: "a", payload: "still there"}
+	if payload, ok := receive(t, second); !ok || payload != "still there" {
+		t.Fatalf("second tab got %v, %v after the first closed", payload, ok)
+	}
+	if _, ok := receive(t, first); ok {
+		t.Fatal("closed tab still receives")
+	}
+}
+
+func TestLivedataHubDropsSlowClients(t *testing.T) {
+	hub := newLivedataHub()
+	go hub.run()
+	slow, fast := newTestClient(hub, "slow"), newTestClient(hub, "fast")
+	hub.register<- slow
+	hub.register<- fast
+	// The live info and the broadcasts fill the buffer of the slow client.
+	for i := 0; i < cap(slow.Send)+1; i++ {
+		hub.broadcast<- i
+		if payload, ok := receive(t, fast); !ok || payload != i {
+			t.Fatalf("fast client got %v, %v, want %d", payload, ok, i)
+		}
+	}
+	// The live info going out after it was dropped doesn't close it again.
+	hub.refresh<- struct{}{}
+	hub.unregister<- slow
+	n := 0
+	for range slow.Send {
+		n++
+	}
+	if n > cap(slow.Send) {
+		t.Errorf("slow client got %d messages past its buffer", n)
+	}
+}
+
+func TestLivedataClientSendsOneMessagePerFrame(t *testing.T) {
+	conn := protocoltest.NewConn()
+	c := &livedataClient{Client: livedata.NewClient("a", 4), conn: conn}
+	c.Send<- map[string]string{"first": "1"}
+	c.Send<- map[string]string{"second": "2"}
+	close(c.Send)
+	go c.writePump()
+	for _, want := range []string{"first", "second"} {
+		var got map[string]string
+		if err := json.Unmarshal(<-conn.Out, &got); err != nil {
+			t.Fatalf("frame isn't a single message: %v", err)
+		}
+		if _, ok := got[want]; !ok {
+			t.Errorf("frame %v, want %s", got, want)
+		}
+	}
+}
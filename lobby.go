@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/luisguve/princechess-server/internal/protocol"
+	idGen "github.com/rs/xid"
+)
+
+// Number of messages kept to show to users joining a public chat.
+const publicChatHistory = 50
+
+// chatInput is a message from a user to a public chat.
+type chatInput struct {
+	Text string `json:"chat"`
+}
+
+// decodeChatInput reads the message sent to a public chat.
+func decodeChatInput(msg []byte) (chatInput, error) {
+	var m chatInput
+	if err := protocol.Decode(msg, &m); err != nil {
+		return m, err
+	}
+	if m.Text == "" {
+		return m, errors.New("missing chat")
+	}
+	return m, nil
+}
+
+// publicMessage is a message posted to a public chat (the lobby or the
+// spectators of a game).
+type publicMessage struct {
+	Id       string    `json:"id"`
+	Text     string    `json:"chat"`
+	Username string    `json:"from"`
+	Sent     time.Time `json:"sent"`
+	// Set on the messages of commentators in the spectator chats, to
+	// highlight them.
+	Commentator bool `json:"commentator,omitempty"`
+	userId      string
+
+	// Set if the message didn't fit the read limit, or to what's wrong with
+	// it if it didn't fit its schema.
+	tooLong bool
+	invalid error
+
+	// Set if the sender is under a shadow restriction: the message is only
+	// shown back to them.
+	shadowed bool
+}
+
+// muteRequest silences a user in a public chat until the given time.
+type muteRequest struct {
+	Uid   string    `json:"uid"`
+	Until time.Time `json:"until"`
+}
+
+// publicChat holds the state shared by the public chats: recent messages,
+// rate limits and mutes. It's owned by the goroutine hosting the chat.
+type publicChat struct {
+	recent  []publicMessage
+	limiter *chatLimiter
+	muted   map[string]time.Time
+	// Returns the notice for the user if they are banned from the chat.
+	silenced func(uid string) (notice, bool)
+}
+
+func newPublicChat() publicChat {
+	return publicChat{
+		limiter:  newChatLimiter(),
+		muted:    make(map[string]time.Time),
+		silenced: func(string) (notice, bool) { return notice{}, false },
+	}
+}
+
+// post validates the message and adds it to the recent messages. It returns
+// false if the message must not be delivered, along with the reason to tell
+// the sender, if any.
+func (c *publicChat) post(msg publicMessage) (publicMessage, bool, notice) {
+	now := time.Now()
+	if until, ok := c.muted[msg.userId]; ok {
+		if now.Before(until) {
+			return msg, false, newNotice(noticeChatMuted)
+		}
+		delete(c.muted, msg.userId)
+	}
+	if reason, banned := c.silenced(msg.userId); banned {
+		return msg, false, reason
+	}
+	if msg.tooLong {
+		return msg, false, newNotice(noticeMessageTooLong)
+	}
+	if msg.invalid != nil {
+		return msg, false, newNotice(noticeInvalidMessage, msg.invalid)
+	}
+	if ok, reason := c.limiter.allow(msg.userId, now); !ok {
+		return msg, false, reason
+	}
+	msg.Id = idGen.New().String()
+	msg.Text = strings.TrimSpace(strings.Replace(msg.Text, newline, space, -1))
+	msg.Sent = now
+	if msg.Text == "" {
+		return msg, false, notice{}
+	}
+	if len([]rune(msg.Text)) > conf.maxChatLength() {
+		return msg, false, newNotice(noticeChatTooLong, conf.maxChatLength())
+	}
+	if msg.shadowed {
+		return msg, true, notice{}
+	}
+	c.remember(msg)
+	return msg, true, notice{}
+}
+
+// remember adds the message to the recent messages.
+func (c *publicChat) remember(msg publicMessage) {
+	c.recent = append(c.recent, msg)
+	if len(c.recent) > publicChatHistory {
+		c.recent = c.recent[len(c.recent)-publicChatHistory:]
+	}
+}
+
+// delete removes the message from the recent messages.
+func (c *publicChat) delete(id string) {
+	for i, msg := range c.recent {
+		if msg.Id == id {
+			c.recent = append(c.recent[:i], c.recent[i+1:]...)
+			return
+		}
+	}
+}
+
+// history returns a copy of the recent messages.
+func (c *publicChat) history() []publicMessage {
+	recent := make([]publicMessage, len(c.recent))
+	copy(recent, c.recent)
+	return recent
+}
+
+// lobbyChat is the public chat room of the lobby. It's fed by the livedata
+// sockets and delivers through the livedata hub, but runs its own broadcast
+// loop so a busy chat doesn't hold up the live numbers.
+type lobbyChat struct {
+	publicChat
+
+	hub *livedataHub
+
+	// Inbound messages from the livedata clients.
+	broadcast chan publicMessage
+
+	// Requests for the recent messages.
+	historyReq chan chan []publicMessage
+
+	// Moderation: silence a user until the given time.
+	mute chan muteRequest
+
+	// Moderation: delete a message by id.
+	remove chan string
+
+	// Reports whether the user is under a shadow restriction.
+	shadowed func(uid string) bool
+
+	// Messages and deletions relayed by other nodes.
+	remote chan lobbyEvent
+}
+
+func newLobbyChat(hub *livedataHub) *lobbyChat {
+	return &lobbyChat{
+		publicChat: newPublicChat(),
+		hub:        hub,
+		broadcast:  make(chan publicMessage),
+		historyReq: make(chan chan []publicMessage),
+		mute:       make(chan muteRequest),
+		remove:     make(chan string),
+		shadowed:   func(string) bool { return false },
+		remote:     make(chan lobbyEvent),
+	}
+}
+
+func (l *lobbyChat) run() {
+	for {
+		select {
+		case msg := <-l.broadcast:
+			msg.shadowed = l.shadowed(msg.userId)
+			msg, ok, reason := l.post(msg)
+			if !ok {
+				if reason.code != "" {
+					l.reject(msg.userId, reason)
+				}
+				break
+			}
+			event := map[string]interface{}{
+				"lobbyChat": msg,
+			}
+			if msg.shadowed {
+				l.hub.direct<- directDelivery{
+					uid:     msg.userId,
+					payload: event,
+				}
+				break
+			}
+			l.hub.broadcast<- event
+			l.hub.relay(topicLobby, "", lobbyEvent{Message: &msg})
+		case ev := <-l.remote:
+			if ev.Muted != nil {
+				l.muted[ev.Muted.Uid] = ev.Muted.Until
+				break
+			}
+			if ev.Message != nil {
+				l.remember(*ev.Message)
+				l.hub.broadcast<- map[string]interface{}{
+					"lobbyChat": *ev.Message,
+				}
+				break
+			}
+			l.delete(ev.Deleted)
+			l.hub.broadcast<- map[string]string{
+				"lobbyChatDeleted": ev.Deleted,
+			}
+		case res := <-l.historyReq:
+			res<- l.history()
+		case req := <-l.mute:
+			l.muted[req.Uid] = req.Until
+			l.hub.relay(topicLobby, "", lobbyEvent{Muted: &req})
+		case id := <-l.remove:
+			l.delete(id)
+			l.hub.broadcast<- map[string]string{
+				"lobbyChatDeleted": id,
+			}
+			l.hub.relay(topicLobby, "", lobbyEvent{Deleted: id})
+		}
+	}
+}
+
+// reject tells the user why their message didn't make it to the chat.
+func (l *lobbyChat) reject(uid string, reason notice) {
+	l.hub.direct<- directDelivery{
+		uid: uid,
+		payload: noticeEvent{
+			key:    "lobbyChatError",
+			notice: reason,
+		},
+	}
+}
+
+// recentMessages returns the last messages posted to the lobby.
+func (l *lobbyChat) recentMessages() []publicMessage {
+	res := make(chan []publicMessage)
+	l.historyReq<- res
+	return <-res
+}
+
+// parseMuteRequest reads the user to mute and for how long from the request.
+func parseMuteRequest(r *http.Request) (muteRequest, error) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		return muteRequest{}, errors.New("Empty uid")
+	}
+	duration := r.FormValue("duration")
+	seconds, err := strconv.Atoi(duration)
+	if err != nil || seconds <= 0 {
+		return muteRequest{}, errors.New("Invalid duration: " + duration)
+	}
+	return muteRequest{
+		Uid:   uid,
+		Until: time.Now().Add(time.Duration(seconds) * time.Second),
+	}, nil
+}
+
+// Silence a user in the lobby chat for a while.
+func (rout *router) handleMuteLobbyChat(w http.ResponseWriter, r *http.Request) {
+	req, err := parseMuteRequest(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rout.ldHub.lobby.mute<- req
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete a message from the lobby chat.
+func (rout *router) handleDeleteLobbyMessage(w http.ResponseWriter, r *http.Request) {
+	rout.ldHub.lobby.remove<- mux.Vars(r)["id"]
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	idGen "github.com/rs/xid"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (lvl logLevel) String() string {
+	return levelNames[lvl]
+}
+
+var logMu = &sync.Mutex{}
+
+// parseLogLevel parses the name of a level, regardless of case.
+func parseLogLevel(name string) (logLevel, bool) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), true
+		}
+	}
+	return levelInfo, false
+}
+
+// logger writes leveled log lines with key-value fields. Loggers are values:
+// with returns a copy carrying more fields, so a logger can be handed down to
+// every log line of a request or a game.
+type logger struct {
+	fields []interface{}
+}
+
+// rootLogger logs the lines not tied to a request or a game.
+var rootLogger = logger{}
+
+// with returns a logger adding the key-value pairs to every line.
+func (l logger) with(kv ...interface{}) logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return logger{fields: fields}
+}
+
+func (l logger) debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l logger) info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l logger) warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l logger) error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// fatal logs the message as an error and exits.
+func (l logger) fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l logger) log(level logLevel, msg string, kv []interface{}) {
+	if level < conf.logLevel() {
+		return
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var line string
+	if conf.LogFormat == "json" {
+		entry := map[string]interface{}{
+			"time":  now,
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			if err, ok := fields[i+1].(error); ok {
+				entry[key] = err.Error()
+			} else {
+				entry[key] = fields[i+1]
+			}
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"Could not marshal log line"}`, now))
+		}
+		line = string(b)
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&sb, " %v=%q", fields[i], fmt.Sprint(fields[i+1]))
+		}
+		line = sb.String()
+	}
+	logMu.Lock()
+	fmt.Fprintln(os.Stderr, line)
+	logMu.Unlock()
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger of the request, which tags the lines with
+// its id.
+func requestLogger(r *http.Request) logger {
+	if l, ok := r.Context().Value(loggerKey{}).(logger); ok {
+		return l
+	}
+	return rootLogger
+}
+
+// withRequestID is a middleware that gives every request an id, taken from
+// the X-Request-Id header if the proxy in front of the server sets one. The
+// id is sent back in the same header.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = idGen.New().String()
+		}
+		w.Header().Set("X-Request-Id", id)
+		l := rootLogger.with("request", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+	})
+}
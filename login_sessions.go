@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	idGen "github.com/rs/xid"
+)
+
+const (
+	loginSessionsFile = "sessions.json"
+
+	// How often the last seen time of a session is persisted.
+	lastSeenResolution = time.Minute
+)
+
+// loginSession is a device logged in to an account. The cookie of the device
+// holds the id of its session, so revoking the session logs the device out.
+type loginSession struct {
+	Id        string    `json:"id"`
+	AccountId string    `json:"accountId"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// loginSessionStore keeps the login sessions by id, persisted to the data
+// directory.
+type loginSessionStore struct {
+	m        *sync.Mutex
+	sessions map[string]*loginSession
+}
+
+func newLoginSessionStore() (*loginSessionStore, error) {
+	s := &loginSessionStore{
+		m:        &sync.Mutex{},
+		sessions: make(map[string]*loginSession),
+	}
+	if err := loadJSON(loginSessionsFile, &s.sessions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// remoteIP returns the IP address of the client, without the port. Behind a
+// trusted proxy, it's the last address the proxy added to X-Forwarded-For.
+func remoteIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); conf.TrustProxy && forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// start records a new session of the account for the device making the
+// request, returning its id.
+func (s *loginSessionStore) start(accountId string, r *http.Request) string {
+	now := time.Now()
+	ls := &loginSession{
+		Id:        idGen.New().String(),
+		AccountId: accountId,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   now,
+		LastSeen:  now,
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sessions[ls.Id] = ls
+	if err := saveJSON(loginSessionsFile, s.sessions); err != nil {
+		requestLogger(r).error("Could not save sessions", "err", err)
+	}
+	return ls.Id
+}
+
+// touch updates the last activity of the session, reporting whether it is
+// still valid for the account.
+func (s *loginSessionStore) touch(id, accountId string, r *http.Request) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ls, ok := s.sessions[id]
+	if !ok || ls.AccountId != accountId {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(ls.LastSeen) < lastSeenResolution {
+		return true
+	}
+	ls.LastSeen = now
+	ls.IP = remoteIP(r)
+	if err := saveJSON(loginSessionsFile, s.sessions); err != nil {
+		requestLogger(r).error("Could not save sessions", "err", err)
+	}
+	return true
+}
+
+// end revokes the session if it belongs to the account.
+func (s *loginSessionStore) end(id, accountId string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ls, ok := s.sessions[id]
+	if !ok || ls.AccountId != accountId {
+		return false
+	}
+	delete(s.sessions, id)
+	if err := saveJSON(loginSessionsFile, s.sessions); err != nil {
+		rootLogger.error("Could not save sessions", "err", err)
+	}
+	return true
+}
+
+// endAll revokes every session of the account.
+func (s *loginSessionStore) endAll(accountId string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for id, ls := range s.sessions {
+		if ls.AccountId == accountId {
+			delete(s.sessions, id)
+		}
+	}
+	if err := saveJSON(loginSessionsFile, s.sessions); err != nil {
+		rootLogger.error("Could not save sessions", "err", err)
+	}
+}
+
+func (s *loginSessionStore) list(accountId string) []loginSession {
+	s.m.Lock()
+	defer s.m.Unlock()
+	list := []loginSession{}
+	for _, ls := range s.sessions {
+		if ls.AccountId == accountId {
+			list = append(list, *ls)
+		}
+	}
+	return list
+}
+
+// trackSession is a middleware that keeps the login sessions up to date and
+// logs out the devices whose session was revoked.
+func (rout *router) trackSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accountId, ok := rout.sessionAccount(r)
+		if ok {
+			session, _ := rout.store.Get(r, "sess")
+			sid, hasSid := session.Values["sid"].(string)
+			switch {
+			case !hasSid:
+				// Logged in before sessions were tracked.
+				session.Values["sid"] = rout.loginSessions.start(accountId, r)
+				if err := rout.store.Save(r, w, session); err != nil {
+					requestLogger(r).error("Could not save session", "err", err)
+				}
+			case !rout.loginSessions.touch(sid, accountId, r):
+				delete(session.Values, "uid")
+				delete(session.Values, "username")
+				delete(session.Values, "registered")
+				delete(session.Values, "sid")
+				if err := rout.store.Save(r, w, session); err != nil {
+					requestLogger(r).error("Could not save session", "err", err)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// List the devices logged in to the account.
+func (rout *router) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	session, _ := rout.store.Get(r, "sess")
+	sid, _ := session.Values["sid"].(string)
+	res := map[string]interface{}{
+		"sessions": rout.loginSessions.list(accountId),
+		"current":  sid,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Log out a device of the account.
+func (rout *router) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if !rout.loginSessions.end(mux.Vars(r)["id"], accountId) {
+		writeError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
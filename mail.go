@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// mailer sends emails to users. Deployments without an SMTP server log the
+// emails instead.
+type mailer interface {
+	send(to, subject, body string) error
+}
+
+// newMailer sets up the mailer from the SMTP settings.
+func newMailer() mailer {
+	if conf.SMTPAddr == "" {
+		return logMailer{}
+	}
+	m := smtpMailer{
+		addr: conf.SMTPAddr,
+		from: conf.MailFrom,
+	}
+	if conf.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(conf.SMTPAddr)
+		m.auth = smtp.PlainAuth("", conf.SMTPUser, conf.SMTPPassword, host)
+	}
+	return m
+}
+
+// logMailer notes the emails in the log, for development. The body is left
+// out since it carries login tokens.
+type logMailer struct{}
+
+func (logMailer) send(to, subject, body string) error {
+	rootLogger.info("Mail not sent: no SMTP server set up", "to", to, "subject", subject)
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m smtpMailer) send(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
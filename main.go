@@ -8,19 +8,22 @@ import (
 	// "flag"
 	"encoding/json"
 	"fmt"
-	"log"
 	"errors"
+	"net"
 	"net/http"
 	"math/rand"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/luisguve/princechess-server/internal/matchmaking"
     "github.com/rs/cors"
 	idGen "github.com/rs/xid"
 	// "github.com/segmentio/ksuid"
@@ -30,51 +33,381 @@ const DEFAULT_USERNAME = "mistery"
 
 // var port = flag.String("port", "8000", "http service address")
 
+// router holds the state of the server. Each structure guards its own state
+// with a lock of its own, or owns it from a dedicated goroutine fed through
+// channels. No lock is held while acquiring another one or while sending on a
+// channel, so there is no locking order to keep.
 type router struct {
-	rm           *roomMatcher
-	wr           waitRooms
-	m            *sync.Mutex
-	store        *sessions.CookieStore
-	count        int
-	matches      map[string]match // map game ids to matches
-	waiting1min  user // ids of users
-	waiting3min  user
-	waiting5min  user
-	waiting10min user
-	opp1min      chan match
-	opp3min      chan match
-	opp5min      chan match
-	opp10min     chan match
-	ldHub        *livedataHub
+	rm             *roomMatcher
+	wr             *waitRooms
+	m              *sync.Mutex
+	store          *sessions.CookieStore
+	matches        *matchTable
+	pools          *matchmaking.Registry
+	ldHub          *livedataHub
+	messages       *messageStore
+	accounts       *accountStore
+	ratings        *ratingStore
+	bans           *banStore
+	restrictions   *banStore
+	commentators   *banStore
+	conns          *connRegistry
+	tokens         *tokenSigner
+	apiKeys        *apiKeyStore
+	loginSessions  *loginSessionStore
+	challenge      challengeVerifier
+	inviteBursts   *burstCounter
+	mailer         mailer
+	spectatorChats *spectatorChats
+	puzzles        *puzzleStore
+	analyses       *analysisStore
+	notable        *notableGames
+	bughouse       *bughouseTable
+	pastRequests   *pastRequests
+	stamps         *cacheStamps
+	reports        *reportStore
+	commBans       *commBanStore
+	engineChecks   chan engineCheckJob
+	results        *resultHistory
+	resultChains   *resultChainStore
+	signals        *accountSignals
+	fairPlayAcks   *fairPlayAckStore
+	abandonments   *abandonmentStore
+	seeks          *seekBoard
+	challenges     *directChallenges
+
+	// Invite games that ended recently, for the players to invite each other
+	// again.
+	finishedInvites *finishedInvites
+
+	// Set when the server is shutting down. Guarded by m.
+	closing bool
+
+	// State shared with the other nodes, nil if the server runs in a single
+	// node.
+	shared sharedStore
+	// Pools shared with the other nodes, nil if the server runs in a single
+	// node.
+	sharedPools *sharedPools
 }
 
+// Close code of the wait room when the host revokes the invite.
+const closeInviteRevoked = 4001
+
 type inviteRoom struct {
-	clock string
-	host  user
-	opp   chan match
+	id      string
+	code    string
+	control timeControl
+	rated   bool
+	host    user
+	opp     chan match
+	expires time.Time
+
+	// Only the user with this id can accept the invite, if set.
+	guest string
+
+	// Color of the host, picked at random when the friend joins if empty.
+	hostColor string
+
+	// Variant of the game. The starting position is drawn when the friend
+	// joins.
+	variant string
+
+	// Piece given as odds, taken from the host unless guestOdds is set.
+	odds      string
+	guestOdds bool
+
+	// Time the friend starts with, if different from the one of the host.
+	guestBase time.Duration
+
+	// Closed when the host revokes the invite.
+	revoked chan struct{}
+
+	// Signaled when someone other than the host opens the invite.
+	viewed chan struct{}
+}
+
+// guestMinutes returns the time the friend starts with, in minutes.
+func (room *inviteRoom) guestMinutes() int {
+	if room.guestBase == 0 {
+		return room.control.minutes()
+	}
+	return int(room.guestBase / time.Minute)
 }
 
+// open makes the channels of a new or restored invite.
+func (room *inviteRoom) open() {
+	// Buffered so the friend can join while the host is not waiting.
+	room.opp = make(chan match, 1)
+	room.revoked = make(chan struct{})
+	// Views while the host is away are coalesced into one.
+	room.viewed = make(chan struct{}, 1)
+}
+
+// savedInvite is an open invite as kept in the data directory.
+type savedInvite struct {
+	Id        string        `json:"id"`
+	Code      string        `json:"code"`
+	Base      time.Duration `json:"base"`
+	Increment time.Duration `json:"increment"`
+	Rated     bool          `json:"rated,omitempty"`
+	HostId    string        `json:"hostId"`
+	HostName  string        `json:"hostName"`
+	Expires   time.Time     `json:"expires"`
+	Guest     string        `json:"guest,omitempty"`
+	HostColor string        `json:"hostColor,omitempty"`
+	Variant   string        `json:"variant"`
+	Odds      string        `json:"odds,omitempty"`
+	GuestOdds bool          `json:"guestOdds,omitempty"`
+	GuestBase time.Duration `json:"guestBase,omitempty"`
+}
+
+const invitesFile = "invites.json"
+
 // Rooms for invite links
 type waitRooms struct {
-	rooms1min  map[string]*inviteRoom
-	rooms3min  map[string]*inviteRoom
-	rooms5min  map[string]*inviteRoom
-	rooms10min map[string]*inviteRoom
+	m *sync.Mutex
+
+	// Rooms by invite id, whatever their time control.
+	rooms map[string]*inviteRoom
+
+	// Invites accepted by the friend, by id, until the host takes the
+	// match from their wait room. They are not kept across restarts, as
+	// their games aren't.
+	accepted map[string]*inviteRoom
+
+	// Ids of the invites by join code.
+	codes map[string]string
+
+	// Claims the join code among the nodes until the invite expires,
+	// reporting whether no other node has it. Set when the server runs in
+	// several nodes.
+	claimCode func(code string, expires time.Time) bool
 }
 
-func newWaitRooms() waitRooms {
-	return waitRooms{
-		rooms1min:  make(map[string]*inviteRoom),
-		rooms3min:  make(map[string]*inviteRoom),
-		rooms5min:  make(map[string]*inviteRoom),
-		rooms10min: make(map[string]*inviteRoom),
+var (
+	errInviteNotFound   = errors.New("Invite link not found")
+	errNotInviteHost    = errors.New("Only the host can revoke the invite")
+	errInviteForAnother = errors.New("The invite is for another player")
+)
+
+// newWaitRooms restores the invites still open from the data directory.
+func newWaitRooms() (*waitRooms, error) {
+	wr := &waitRooms{
+		m:        &sync.Mutex{},
+		rooms:    make(map[string]*inviteRoom),
+		accepted: make(map[string]*inviteRoom),
+		codes:    make(map[string]string),
+	}
+	var saved []savedInvite
+	if err := loadJSON(invitesFile, &saved); err != nil {
+		return nil, err
 	}
+	now := time.Now()
+	for _, s := range saved {
+		if !now.Before(s.Expires) {
+			continue
+		}
+		room := &inviteRoom{
+			id:        s.Id,
+			code:      s.Code,
+			control:   timeControl{base: s.Base, increment: s.Increment},
+			rated:     s.Rated,
+			host:      user{id: s.HostId, username: s.HostName},
+			expires:   s.Expires,
+			guest:     s.Guest,
+			hostColor: s.HostColor,
+			variant:   s.Variant,
+			odds:      s.Odds,
+			guestOdds: s.GuestOdds,
+			guestBase: s.GuestBase,
+		}
+		room.open()
+		wr.rooms[room.id] = room
+		wr.codes[room.code] = room.id
+	}
+	return wr, nil
+}
+
+// save writes the open invites to the data directory. The caller must hold
+// the lock.
+func (wr *waitRooms) save() {
+	saved := make([]savedInvite, 0, len(wr.rooms))
+	for _, room := range wr.rooms {
+		saved = append(saved, savedInvite{
+			Id:        room.id,
+			Code:      room.code,
+			Base:      room.control.base,
+			Increment: room.control.increment,
+			Rated:     room.rated,
+			HostId:    room.host.id,
+			HostName:  room.host.username,
+			Expires:   room.expires,
+			Guest:     room.guest,
+			HostColor: room.hostColor,
+			Variant:   room.variant,
+			Odds:      room.odds,
+			GuestOdds: room.guestOdds,
+			GuestBase: room.guestBase,
+		})
+	}
+	if err := saveJSON(invitesFile, saved); err != nil {
+		rootLogger.error("Could not save invites", "err", err)
+	}
+}
+
+// open returns the invites open, for their expiration to be watched again
+// after a restart.
+func (wr *waitRooms) open() []*inviteRoom {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	rooms := make([]*inviteRoom, 0, len(wr.rooms))
+	for _, room := range wr.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// add registers the invite, giving it a join code not used by any other
+// invite.
+func (wr *waitRooms) add(room *inviteRoom) error {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	for {
+		code, err := newJoinCode()
+		if err != nil {
+			return err
+		}
+		if _, taken := wr.codes[code]; !taken && (wr.claimCode == nil || wr.claimCode(code, room.expires)) {
+			room.code = code
+			wr.codes[code] = room.id
+			break
+		}
+	}
+	wr.rooms[room.id] = room
+	wr.save()
+	return nil
+}
+
+// sizes returns the number of invites by time control, and of join codes.
+func (wr *waitRooms) sizes() map[string]int {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	sizes := map[string]int{"codes": len(wr.codes)}
+	for _, room := range wr.rooms {
+		sizes[room.control.String()]++
+	}
+	return sizes
+}
+
+// find looks up the invite by its id or join code, regardless of its clock.
+// Accepted invites are found by their id until the host takes the match.
+func (wr *waitRooms) find(inviteId string) (*inviteRoom, bool) {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	if room, ok := wr.accepted[inviteId]; ok {
+		return room, true
+	}
+	return wr.lookup(inviteId)
+}
+
+// take removes the invite, looked up by its id or join code, if check
+// accepts it; otherwise the error of check is returned.
+func (wr *waitRooms) take(inviteId string, check func(room *inviteRoom) error) (*inviteRoom, error) {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	room, ok := wr.lookup(inviteId)
+	if !ok {
+		return nil, errInviteNotFound
+	}
+	if err := check(room); err != nil {
+		return nil, err
+	}
+	wr.remove(room)
+	wr.save()
+	return room, nil
+}
+
+// accept takes the invite like take, keeping it for the host to find in
+// their wait room until handOver.
+func (wr *waitRooms) accept(inviteId string, check func(room *inviteRoom) error) (*inviteRoom, error) {
+	room, err := wr.take(inviteId, check)
+	if err != nil {
+		return nil, err
+	}
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	wr.accepted[room.id] = room
+	return room, nil
+}
+
+// handOver forgets the accepted invite once the host took the match.
+func (wr *waitRooms) handOver(room *inviteRoom) {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	if wr.accepted[room.id] == room {
+		delete(wr.accepted, room.id)
+	}
+}
+
+// expire removes the invite, open or accepted, unless it was removed
+// already, reporting whether it was still there.
+func (wr *waitRooms) expire(room *inviteRoom) bool {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	if wr.accepted[room.id] == room {
+		delete(wr.accepted, room.id)
+		return true
+	}
+	if wr.rooms[room.id] != room {
+		return false
+	}
+	wr.remove(room)
+	wr.save()
+	return true
+}
+
+// lookup finds the invite by its id or join code. The caller must hold the
+// lock.
+func (wr *waitRooms) lookup(inviteId string) (*inviteRoom, bool) {
+	if id, ok := wr.codes[normalizeJoinCode(inviteId)]; ok {
+		inviteId = id
+	}
+	room, ok := wr.rooms[inviteId]
+	return room, ok
+}
+
+// remove deletes the invite and its join code. The caller must hold the
+// lock.
+func (wr *waitRooms) remove(room *inviteRoom) {
+	delete(wr.codes, room.code)
+	delete(wr.rooms, room.id)
 }
 
 type match struct {
-	gameId string
-	white  user
-	black  user
+	gameId  string
+	white   user
+	black   user
+	control timeControl
+	// Whether the result of the game updates the ratings of the players.
+	rated bool
+	// Whether the game was set up from an invite.
+	invite bool
+	// Variant and starting position; the zero value is a standard game.
+	setup setup
+	// Time each player starts with by user id, when they differ.
+	clocks map[string]time.Duration
+	// Whether the player may take moves back and ask for hints, in games
+	// against the computer.
+	training bool
+}
+
+// baseFor returns the time the user starts their games of the match with.
+func (m match) baseFor(uid string) time.Duration {
+	if base, ok := m.clocks[uid]; ok {
+		return base
+	}
+	return m.control.base
 }
 
 type user struct {
@@ -82,72 +415,39 @@ type user struct {
 	username string
 }
 
-func (rout *router) makeRoom(m match) {
-	rout.m.Lock()
-	defer rout.m.Unlock()
-	rout.count++
-	rout.matches[m.gameId] = m
-}
-
-func (rout *router) newMatch(uid, username string, waiting *user, opp chan match) (playRoomId, color, oppUsername string) {
-	deadline := time.NewTimer(5 * time.Second)
-	rout.m.Lock()
-	if waiting.id == "" {
-		*waiting = user{
-			id:       uid,
-			username: username,
-		}
-		rout.m.Unlock()
-		select {
-		case match := <-opp:
-			deadline.Stop()
-			if match.gameId == "" {
-				// game cancelled
-				return
-			}
-			match.white = user{
-				id: uid,
-				username: username,
-			}
-
-			rout.makeRoom(match)
-			playRoomId = match.gameId
-			color = "white"
-			oppUsername = match.black.username
-		case <-deadline.C:
-			rout.m.Lock()
-			defer rout.m.Unlock()
-			*waiting = user{}
-			return
+// sessionUser returns the id and username of the user making the request,
+// assigning a new id to the session if it doesn't have one yet.
+func (rout *router) sessionUser(w http.ResponseWriter, r *http.Request) (uid, username string, err error) {
+	session, err := rout.store.Get(r, "sess")
+	if err != nil {
+		requestLogger(r).warn("Could not get session", "err", err)
+	}
+	var ok bool
+	if uid, ok = session.Values["uid"].(string); !ok {
+		uid = idGen.New().String()
+		session.Values["uid"] = uid
+		if err := rout.store.Save(r, w, session); err != nil {
+			return "", "", err
 		}
-	} else {
-		if waiting.id == uid {
-			// reset
-			opp<- match{}
-			*waiting = user{}
-			rout.m.Unlock()
-			return rout.newMatch(uid, username, waiting, opp)
-		}
-		playRoomId = idGen.New().String()
-		opp<- match{
-			gameId: playRoomId,
-			black:  user{
-				id: uid,
-				username: username,
-			},
-		}
-		oppUsername = waiting.username
-		*waiting = user{}
-		rout.m.Unlock()
-		color = "black"
 	}
-	return
+	if username, ok = session.Values["username"].(string); !ok {
+		username = DEFAULT_USERNAME
+	}
+	return uid, username, nil
+}
+
+func (rout *router) makeRoom(m match) {
+	rout.matches.add(m)
+	rout.recordMatch(m)
 }
 
 func (rout *router) handlePlay(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
 	session, err := rout.store.Get(r, "sess")
 	if err != nil {
-		log.Printf("Get cookie error: %v", err)
+		requestLogger(r).warn("Could not get session", "err", err)
 	}
 	uidBlob := session.Values["uid"]
 	var (
@@ -158,8 +458,8 @@ func (rout *router) handlePlay(w http.ResponseWriter, r *http.Request) {
 		uid = idGen.New().String()
 		session.Values["uid"] = uid
 		if err := rout.store.Save(r, w, session); err != nil {
-			log.Println(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			requestLogger(r).error("Could not save session", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
@@ -170,32 +470,47 @@ func (rout *router) handlePlay(w http.ResponseWriter, r *http.Request) {
 	}
 	vars := mux.Vars(r)
 	if vars["clock"] == "" {
-		http.Error(w, "Empty clock time", http.StatusBadRequest)
+		writeError(w, "Empty clock time", http.StatusBadRequest)
 		return
 	}
-	var (
-		waiting *user
-		waitOpp chan match
-	)
-	switch vars["clock"] {
-	case "1":
-		waiting = &rout.waiting1min
-		waitOpp = rout.opp1min
-	case "3":
-		waiting = &rout.waiting3min
-		waitOpp = rout.opp3min
-	case "5":
-		waiting = &rout.waiting5min
-		waitOpp = rout.opp5min
-	case "10":
-		waiting = &rout.waiting10min
-		waitOpp = rout.opp10min
-	default:
-		http.Error(w, "Invalid clock time: " + vars["clock"], http.StatusBadRequest)
+	control, err := parseTimeControl(vars["clock"], r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid time control: " + vars["clock"] + "+" + r.FormValue("increment"), http.StatusBadRequest)
+		return
+	}
+	asked, err := parseColorPreference(r.FormValue("color"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := parseMatchWait(r.FormValue("maxWait"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The response has to go out before the write timeout.
+	if window := streamWindow(); conf.WriteTimeout > 0 && wait > window {
+		wait = window
+	}
+	// Each time control, increment included, has its own pool.
+	pool := rout.pool(control)
+	// The request blocks until paired; livedata tells how the search goes.
+	searching := make(chan struct{})
+	go reportSearching(control, pool, wait, searching, func(p matchProgress) {
+		rout.ldHub.direct<- directDelivery{
+			uid:     uid,
+			payload: map[string]matchProgress{"searching": p},
+		}
+	})
+	playRoomId, color, opp := rout.newMatch(uid, username, asked, control, pool, wait)
+	close(searching)
+	if playRoomId == "" {
+		writeAPIError(w, http.StatusRequestTimeout, apiError{
+			Code:    errorMatchTimeout,
+			Message: "No opponent found",
+		})
 		return
 	}
-
-	playRoomId, color, opp := rout.newMatch(uid, username, waiting, waitOpp)
 
 	res := map[string]string{
 		"color": color,
@@ -205,38 +520,182 @@ func (rout *router) handlePlay(w http.ResponseWriter, r *http.Request) {
 
 	resB, err := json.Marshal(res)
 	if err != nil {
-		log.Println("Could not marshal response:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	if _, err := w.Write(resB); err != nil {
-		log.Println(err)
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// playSeek is the message a client sends on /play/ws to seek a game.
+type playSeek struct {
+	Clock     int    `json:"clock"`
+	Increment int    `json:"increment"`
+	Color     string `json:"color"`
+	// Seconds to wait for an opponent, the match timeout if zero.
+	MaxWait int `json:"maxWait"`
+}
+
+// Seek a game in a pool over a WebSocket, which unlike /play can wait
+// past the write timeout. The client sends the seek and hears how the search
+// goes until paired; then the socket closes with the match, as on /wait.
+func (rout *router) handlePlayWS(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	lang := requestLanguage(r)
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
+	defer rout.conns.remove(uid, conn)
+
+	conn.SetReadLimit(conf.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	var seek playSeek
+	if err := conn.ReadJSON(&seek); err != nil {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeInvalidMessage, err), lang)
+		return
+	}
+	control, err := parseTimeControl(strconv.Itoa(seek.Clock), strconv.Itoa(seek.Increment))
+	if err != nil {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeInvalidClock), lang)
+		return
+	}
+	asked, err := parseColorPreference(seek.Color)
+	if err != nil {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeInvalidMessage, err), lang)
+		return
+	}
+	maxWait := ""
+	if seek.MaxWait != 0 {
+		maxWait = strconv.Itoa(seek.MaxWait)
+	}
+	wait, err := parseMatchWait(maxWait)
+	if err != nil {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeInvalidMessage, err), lang)
+		return
+	}
+
+	// Buffered so the reader can quit once the search is over.
+	cancel := make(chan bool, 1)
+	// reading goroutine
+	go func() {
+		defer func() {
+			cancel<- true
+		}()
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					requestLogger(r).warn("Matchmaking connection closed unexpectedly", "err", err)
+				}
+				break
+			}
+		}
+	}()
+	pool := rout.pool(control)
+	paired := make(chan map[string]string, 1)
+	go func() {
+		playRoomId, color, opp := rout.newMatch(uid, username, asked, control, pool, wait)
+		if playRoomId == "" {
+			paired<- nil
+			return
+		}
+		paired<- map[string]string{
+			"color":  color,
+			"roomId": playRoomId,
+			"opp":    opp,
+		}
+	}()
+	progress := make(chan matchProgress, 1)
+	searching := make(chan struct{})
+	defer close(searching)
+	go reportSearching(control, pool, wait, searching, func(p matchProgress) {
+		select {
+		case progress<- p:
+		default:
+		}
+	})
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer ticker.Stop()
+	for {
+		select {
+		case res := <-paired:
+			if res == nil {
+				closeWithNotice(conn, websocket.CloseTryAgainLater, newNotice(noticeNoOpponent), lang)
+				return
+			}
+			resB, err := json.Marshal(res)
+			if err != nil {
+				requestLogger(r).error("Could not marshal response", "err", err)
+				closeWithNotice(conn, websocket.CloseInternalServerErr, newNotice(noticeInternalError), lang)
+				return
+			}
+
+			payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(resB))
+			conn.WriteMessage(websocket.CloseMessage, payload)
+			return
+		case p := <-progress:
+			conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := conn.WriteJSON(map[string]matchProgress{"searching": p}); err != nil {
+				pool.Cancel(uid)
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				pool.Cancel(uid)
+				return
+			}
+		case <-cancel:
+			// Leave the pool, unless just paired.
+			pool.Cancel(uid)
+			return
+		}
 	}
 }
 
 func (rout *router) handleGame(w http.ResponseWriter, r *http.Request) {
 	session, err := rout.store.Get(r, "sess")
 	if err != nil {
-		log.Println("Error getting session:", err)
+		requestLogger(r).error("Error getting session", "err", err)
 	}
 	uidBlob, ok := session.Values["uid"]
 	if !ok {
-		log.Println("Unknown user")
-		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		requestLogger(r).warn("Unknown user")
+		writeError(w, "Unknown user", http.StatusUnauthorized)
 		return
 	}
 	var uid string
 	if uid, ok = uidBlob.(string); !ok {
-		log.Println("Could not type assert uidBlob to string")
-		http.Error(w, "Unknown user", http.StatusUnauthorized)
+		requestLogger(r).error("Could not type assert uidBlob to string")
+		writeError(w, "Unknown user", http.StatusUnauthorized)
 		return
 	}
 	vars := mux.Vars(r)
 	gameId := vars["id"]
-	match, ok := rout.matches[gameId]
+	match, ok := rout.matches.get(gameId)
 	if !ok {
-		log.Printf("Match %v not found\n", gameId)
-		http.Error(w, "Match not found", http.StatusNotFound)
+		if rout.proxyGame(w, r, gameId, uid) {
+			return
+		}
+		requestLogger(r).warn("Match not found", "game", gameId)
+		writeError(w, "Match not found", http.StatusNotFound)
 		return
 	}
 	color := ""
@@ -246,52 +705,74 @@ func (rout *router) handleGame(w http.ResponseWriter, r *http.Request) {
 	case match.black.id:
 		color = "black"
 	default:
-		log.Println("User is neither black nor white")
-		http.Error(w, "User is neither black nor white", http.StatusBadRequest)
-		return
-	}
-	cleanup := func() {
-		rout.m.Lock()
-		delete(rout.matches, gameId)
-		rout.m.Unlock()
-		rout.ldHub.finishGame<- match
-	}
-	switchColors := func() {
-		rout.m.Lock()
-		temp := match.white
-		match.white = match.black
-		match.black = temp
-		rout.matches[gameId] = match
-		rout.m.Unlock()
-	}
-	if vars["clock"] == "" {
-		log.Println("Unset clock")
-		http.Error(w, "Unset clock", http.StatusBadRequest)
-		return
-	}
-	clock, err := strconv.Atoi(vars["clock"])
-	if err != nil {
-		log.Println("Invalid clock")
-		http.Error(w, "Invalid clock", http.StatusBadRequest)
+		requestLogger(r).warn("User is neither black nor white")
+		writeError(w, "User is neither black nor white", http.StatusBadRequest)
 		return
 	}
+	cleanup, switchColors := rout.matchCallbacks(match)
 	usernameBlob := session.Values["username"]
 	username, ok := usernameBlob.(string)
 	if !ok {
 		username = DEFAULT_USERNAME
 	}
-	rout.serveGame(w, r, gameId, color, clock, cleanup, switchColors, username, uid)
+	device, _ := session.Values["device"].(string)
+	rout.signals.seen(uid, username, remoteIP(r), device)
+	// The clock of the game is the one of the match, regardless of the clock
+	// in the query.
+	rout.serveGame(w, r, gameId, color, match.control, match.baseFor(uid), match.setup, match.rated, cleanup, switchColors, username, uid)
+}
+
+// matchCallbacks returns the callbacks of the room of the match: the cleanup
+// after the game ends and the switch of colors on rematch.
+func (rout *router) matchCallbacks(match match) (cleanup, switchColors func()) {
+	gameId := match.gameId
+	cleanup = func() {
+		// The players may have switched colors since.
+		if m, ok := rout.matches.remove(gameId); ok {
+			match = m
+		}
+		rout.forgetMatch(gameId)
+		rout.bughouse.remove(gameId)
+		rout.rm.live.forgetDelay(gameId)
+		rout.ldHub.finishGame<- match
+		rout.spectatorChats.end(gameId)
+		if match.invite {
+			rout.rememberInvite(match)
+		}
+	}
+	switchColors = func() {
+		rout.matches.switchColors(gameId)
+	}
+	return cleanup, switchColors
 }
 
 func (rout *router) handlePostUsername(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
-	if username == "" {
+	if errs := validateUsername(username); len(errs) > 0 {
+		writeValidationErrors(w, r, errs)
+		return
+	}
+	// Usernames of registered accounts are reserved to their owners.
+	accountId, registered := rout.sessionAccount(r)
+	if owner, ok := rout.accounts.owner(username); ok && owner != accountId {
+		writeError(w, errUsernameTaken.Error(), http.StatusConflict)
 		return
 	}
+	if registered {
+		if err := rout.accounts.rename(accountId, username); err != nil {
+			if err == errUsernameTaken {
+				writeError(w, err.Error(), http.StatusConflict)
+				return
+			}
+			requestLogger(r).error("Could not rename account", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	session, _ := rout.store.Get(r, "sess")
 	session.Values["username"] = username
 	if err := rout.store.Save(r, w, session); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -305,9 +786,12 @@ func (rout *router) handleGetUsername(w http.ResponseWriter, r *http.Request) {
 
 // Set up a wait room and respond with the invitation id
 func (rout *router) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
 	session, err := rout.store.Get(r, "sess")
 	if err != nil {
-		log.Printf("Get cookie error: %v", err)
+		requestLogger(r).warn("Could not get session", "err", err)
 	}
 	uidBlob := session.Values["uid"]
 	var (
@@ -318,7 +802,7 @@ func (rout *router) handleInvite(w http.ResponseWriter, r *http.Request) {
 		uid = idGen.New().String()
 		session.Values["uid"] = uid
 		if err := rout.store.Save(r, w, session); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
@@ -330,61 +814,158 @@ func (rout *router) handleInvite(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	clock := vars["clock"]
 	if clock == "" {
-		http.Error(w, "Empty clock time", http.StatusBadRequest)
+		writeError(w, "Empty clock time", http.StatusBadRequest)
 		return
 	}
 
-	// Set up room to wait for host and invited users
-	var rooms map[string]*inviteRoom
-	switch clock {
-	case "1":
-		rooms = rout.wr.rooms1min
-	case "3":
-		rooms = rout.wr.rooms3min
-	case "5":
-		rooms = rout.wr.rooms5min
-	case "10":
-		rooms = rout.wr.rooms10min
-	default:
-		http.Error(w, "Invalid clock time:" + clock, http.StatusBadRequest)
+	expiration := conf.InviteExpiration
+	if expires := r.FormValue("expires"); expires != "" {
+		seconds, err := strconv.Atoi(expires)
+		if err != nil || seconds <= 0 {
+			writeError(w, "Invalid expiration: " + expires, http.StatusBadRequest)
+			return
+		}
+		expiration = time.Duration(seconds) * time.Second
+		if expiration > conf.MaxInviteExpiration {
+			expiration = conf.MaxInviteExpiration
+		}
+	}
+
+	if rout.refuseIfChallengeBanned(w, uid) {
+		return
+	}
+	if rout.inviteBursts.hit(uid, time.Now()) && !rout.passChallenge(w, r) {
+		return
+	}
+
+	// Any time control is allowed, increment included.
+	control, err := parseTimeControl(clock, r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid clock time: " + clock, http.StatusBadRequest)
+		return
+	}
+
+	variant := r.FormValue("variant")
+	if variant == "" {
+		variant = variantStandard
+	}
+	if !validVariant(variant) {
+		writeError(w, "Invalid variant: " + variant, http.StatusBadRequest)
 		return
 	}
-	inviteId := idGen.New().String()
-	rout.m.Lock()
-	rooms[inviteId] = &inviteRoom{
-		clock: clock,
-		host:  user{
+
+	// The host may give a piece as odds. Handicap games are never rated.
+	odds := r.FormValue("odds")
+	if !validOdds(odds) {
+		writeError(w, "Invalid odds: " + odds, http.StatusBadRequest)
+		return
+	}
+
+	// Or time odds, starting with a clock different from the friend's.
+	var guestBase time.Duration
+	if guestClock := r.FormValue("guestClock"); guestClock != "" {
+		guestControl, err := parseTimeControl(guestClock, "")
+		if err != nil {
+			writeError(w, "Invalid guest clock time: " + guestClock, http.StatusBadRequest)
+			return
+		}
+		if guestControl.base != control.base {
+			guestBase = guestControl.base
+		}
+	}
+
+	// Invite games are casual unless the host asks otherwise.
+	rated := false
+	if flag := r.FormValue("rated"); flag != "" {
+		if rated, err = strconv.ParseBool(flag); err != nil {
+			writeError(w, "Invalid rated flag: " + flag, http.StatusBadRequest)
+			return
+		}
+	}
+	rated = rated && odds == "" && guestBase == 0
+	if rated && rout.refuseIfNotAcknowledged(w, uid) {
+		return
+	}
+
+	hostColor, err := parseColorPreference(r.FormValue("color"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room := &inviteRoom{
+		control: control,
+		rated:   rated,
+		host:    user{
 			id:       uid,
 			username: username,
 		},
+		hostColor: hostColor,
+		variant: variant,
+		odds:    odds,
+		guestBase: guestBase,
+	}
+	if err := rout.openInvite(room, expiration); err != nil {
+		requestLogger(r).error("Could not open invite", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	rout.m.Unlock()
 
 	res := map[string]string{
-		"inviteId": inviteId,
+		"inviteId": room.id,
+		"code":     room.code,
+		"expires":  room.expires.Format(time.RFC3339),
 	}
 
 	resB, err := json.Marshal(res)
 	if err != nil {
-		log.Println("Could not marshal response:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	if _, err := w.Write(resB); err != nil {
-		log.Println(err)
+		requestLogger(r).error("Could not write response", "err", err)
 	}
 }
 
+// openInvite sets up the room to wait for the host and invited users. The
+// invite is open until the given expiration.
+func (rout *router) openInvite(room *inviteRoom, expiration time.Duration) error {
+	room.id = idGen.New().String()
+	room.expires = time.Now().Add(expiration)
+	room.open()
+
+	if err := rout.wr.add(room); err != nil {
+		return err
+	}
+	rout.watchInvite(room)
+	return nil
+}
+
+// watchInvite shares the invite with the other nodes and removes it when it
+// expires. Invites outlive the wait room of the host until then.
+func (rout *router) watchInvite(room *inviteRoom) {
+	rout.recordInvite(room)
+	time.AfterFunc(time.Until(room.expires), func() {
+		if rout.wr.expire(room) {
+			rout.forgetInvite(room)
+		}
+	})
+}
+
 // Wait room for private game with a friend
 func (rout *router) handleWait(w http.ResponseWriter, r *http.Request) {
+	if rout.proxyInvite(w, r, mux.Vars(r)["id"]) {
+		return
+	}
 	// Upgrade connection to websocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Could not upgrade conn", http.StatusInternalServerError)
+	conn := upgrade(w, r)
+	if conn == nil {
 		return
 	}
 	defer conn.Close()
+	lang := requestLanguage(r)
 	session, _ := rout.store.Get(r, "sess")
 	uidBlob := session.Values["uid"]
 	var (
@@ -395,54 +976,31 @@ func (rout *router) handleWait(w http.ResponseWriter, r *http.Request) {
 		uid = idGen.New().String()
 		session.Values["uid"] = uid
 		if err := rout.store.Save(r, w, session); err != nil {
-			payload := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
-			conn.WriteMessage(websocket.CloseMessage, payload)
+			requestLogger(r).error("Could not save session", "err", err)
+			closeWithNotice(conn, websocket.CloseInternalServerErr, newNotice(noticeInternalError), lang)
 			return
 		}
 	}
-	usernameBlob := session.Values["username"]
-	username, ok := usernameBlob.(string)
-	if !ok {
-		username = DEFAULT_USERNAME
+	if !rout.admitConn(uid, conn, r) {
+		return
 	}
+	defer rout.conns.remove(uid, conn)
 	vars := mux.Vars(r)
 	inviteId := vars["id"]
-	clock := vars["clock"]
-	if clock == "" {
-		payload := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "Unset clock")
-		conn.WriteMessage(websocket.CloseMessage, payload)
-		return
-	}
-	var rooms map[string]*inviteRoom
-	switch clock {
-	case "1":
-		rooms = rout.wr.rooms1min
-	case "3":
-		rooms = rout.wr.rooms3min
-	case "5":
-		rooms = rout.wr.rooms5min
-	case "10":
-		rooms = rout.wr.rooms10min
-	default:
-		payload := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "Invalid clock")
-		conn.WriteMessage(websocket.CloseMessage, payload)
+	if vars["clock"] == "" {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeUnsetClock), lang)
 		return
 	}
-	room, ok := rooms[inviteId]
-	if !ok {
-		payload := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "Room not found")
-		conn.WriteMessage(websocket.CloseMessage, payload)
-		return
-	}
-	// Prepare the private channel
-	rout.m.Lock()
-	room.opp = make(chan match)
-	rooms[inviteId] = room
-	rout.m.Unlock()
-	
-	conn.SetReadLimit(maxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(pongWait))
-	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	// The invite knows its own time control.
+	room, ok := rout.wr.find(inviteId)
+	if !ok || room.host.id != uid {
+		closeWithNotice(conn, websocket.CloseInvalidFramePayloadData, newNotice(noticeRoomNotFound), lang)
+		return
+	}
+
+	conn.SetReadLimit(conf.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
 	cancel := make(chan bool)
 	// reading goroutine
 	go func() {
@@ -453,73 +1011,162 @@ func (rout *router) handleWait(w http.ResponseWriter, r *http.Request) {
 			_, _, err := conn.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("error: %v", err)
+					requestLogger(r).warn("Wait room connection closed unexpectedly", "err", err)
 				}
 				break
 			}
 		}
 	}()
-	// Wait opponent for up to 1 minute
-	deadline := time.NewTimer(60 * time.Second)
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		// delete waitRoom
-		rout.m.Lock()
-		delete(rooms, inviteId)
-		rout.m.Unlock()
-		ticker.Stop()
-	}()
-	select {
-	case match := <-room.opp:
-		deadline.Stop()
-		if match.gameId == "" {
-			payload := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "You can't play against yourself")
+	// Wait opponent until the invite expires. If the host leaves, the invite
+	// remains open and they can come back to this room.
+	deadline := time.NewTimer(time.Until(room.expires))
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer ticker.Stop()
+	for {
+		select {
+		case match := <-room.opp:
+			deadline.Stop()
+			rout.wr.handOver(room)
+			rout.forgetInvite(room)
+			if match.gameId == "" {
+				closeWithNotice(conn, websocket.ClosePolicyViolation, newNotice(noticeSelfPlay), lang)
+				return
+			}
+			var color, opp string
+			if match.white.id == uid {
+				color = "white"
+				opp = match.black.username
+			} else {
+				color = "black"
+				opp = match.white.username
+			}
+
+			playRoomId := match.gameId
+			res := map[string]interface{}{
+				"color":  color,
+				"roomId": playRoomId,
+				"opp":    opp,
+				"rated":  match.rated,
+			}
+			resB, err := json.Marshal(res)
+			if err != nil {
+				requestLogger(r).error("Could not marshal response", "err", err)
+				closeWithNotice(conn, websocket.CloseInternalServerErr, newNotice(noticeInternalError), lang)
+				return
+			}
+
+			payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(resB))
 			conn.WriteMessage(websocket.CloseMessage, payload)
 			return
-		}
-		var color, opp string
-		if match.white.id != "" {
-			color = "black"
-			match.black = user{
-				id:       uid,
-				username: username,
+		case <-room.viewed:
+			// Let the host know the link reached someone.
+			conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := conn.WriteJSON(map[string]bool{"inviteViewed": true}); err != nil {
+				return
 			}
-			opp = match.white.username
-		} else {
-			color = "white"
-			match.white = user{
-				id: uid,
-				username: username,
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
 			}
-			opp = match.black.username
+		case <-deadline.C:
+			closeWithNotice(conn, websocket.CloseTryAgainLater, newNotice(noticeLinkExpired), lang)
+			return
+		case <-room.revoked:
+			deadline.Stop()
+			closeWithNotice(conn, closeInviteRevoked, newNotice(noticeInviteRevoked), lang)
+			return
+		case <-cancel:
+			return
 		}
-		rout.makeRoom(match)
+	}
+}
 
-		playRoomId := match.gameId
-		res := map[string]string{
-			"color":  color,
-			"roomId": playRoomId,
-			"opp":    opp,
-		}
-		resB, err := json.Marshal(res)
-		if err != nil {
-			log.Println("Could not marshal response:", err)
-			payload := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
-			conn.WriteMessage(websocket.CloseMessage, payload)
-			return
+// Details of an invite, looked up by its id or join code, for the invited
+// friend to see before accepting it.
+func (rout *router) handleInviteInfo(w http.ResponseWriter, r *http.Request) {
+	inviteId := mux.Vars(r)["id"]
+	if rout.proxyInvite(w, r, inviteId) {
+		return
+	}
+	room, ok := rout.wr.find(inviteId)
+	if !ok {
+		writeError(w, "Invite link not found", http.StatusNotFound)
+		return
+	}
+	session, _ := rout.store.Get(r, "sess")
+	if uid, _ := session.Values["uid"].(string); uid != room.host.id {
+		select {
+		case room.viewed<- struct{}{}:
+		default:
 		}
+	}
+
+	res := map[string]interface{}{
+		"inviteId": room.id,
+		"code":     room.code,
+		"host":     room.host.username,
+		"clock":     strconv.Itoa(room.control.minutes()),
+		"increment": room.control.seconds(),
+		"guestClock": strconv.Itoa(room.guestMinutes()),
+		"rated":    room.rated,
+		// Color the host asked for, empty if drawn.
+		"hostColor": room.hostColor,
+		"variant":  room.variant,
+		"odds":     room.odds,
+		// Whether the one giving the odds is the friend rather than the host.
+		"guestOdds": room.guestOdds,
+		"expires":  room.expires.Format(time.RFC3339),
+	}
 
-		payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(resB))
-		conn.WriteMessage(websocket.CloseMessage, payload)
-	case <-deadline.C:
-		payload := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Time is out - Link expired")
-		conn.WriteMessage(websocket.CloseMessage, payload)
-	case <-cancel:
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
 	}
 }
 
-// Join game from invite link
+// Cancel an outstanding invite. Only the host can revoke it.
+func (rout *router) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if rout.proxyInvite(w, r, mux.Vars(r)["id"]) {
+		return
+	}
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	room, err := rout.wr.take(mux.Vars(r)["id"], func(room *inviteRoom) error {
+		if room.host.id != uid {
+			return errNotInviteHost
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errInviteNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	rout.forgetInvite(room)
+	close(room.revoked)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Join game from invite link or join code
 func (rout *router) handleJoin(w http.ResponseWriter, r *http.Request) {
+	if rout.proxyInvite(w, r, mux.Vars(r)["id"]) || rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
 	session, _ := rout.store.Get(r, "sess")
 	uidBlob := session.Values["uid"]
 	var (
@@ -530,7 +1177,7 @@ func (rout *router) handleJoin(w http.ResponseWriter, r *http.Request) {
 		uid = idGen.New().String()
 		session.Values["uid"] = uid
 		if err := rout.store.Save(r, w, session); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
@@ -542,32 +1189,34 @@ func (rout *router) handleJoin(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	inviteId := vars["id"]
 	if inviteId == "" {
-		http.Error(w, "Empty invite link", http.StatusBadRequest)
+		writeError(w, "Empty invite link", http.StatusBadRequest)
 		return
 	}
-	clock := vars["clock"]
-	if clock == "" {
-		http.Error(w, "Empty clock time", http.StatusBadRequest)
-		return
-	}
-	var rooms map[string]*inviteRoom
-	switch clock {
-	case "1":
-		rooms = rout.wr.rooms1min
-	case "3":
-		rooms = rout.wr.rooms3min
-	case "5":
-		rooms = rout.wr.rooms5min
-	case "10":
-		rooms = rout.wr.rooms10min
-	default:
-		http.Error(w, "Invalid clock: " + clock, http.StatusBadRequest)
+	if vars["clock"] == "" {
+		writeError(w, "Empty clock time", http.StatusBadRequest)
+		return
+	}
+	guestColor, err := parseColorPreference(r.FormValue("color"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	room, ok := rooms[inviteId]
-	if !ok {
-		http.Error(w, "Invite link not found", http.StatusNotFound)
+	// The invite can be used only once. It's kept for the host to take the
+	// match, and shared with the other nodes until then.
+	room, err := rout.wr.accept(inviteId, func(room *inviteRoom) error {
+		if room.guest != "" && room.guest != uid && room.host.id != uid {
+			return errInviteForAnother
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errInviteNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
@@ -578,41 +1227,81 @@ func (rout *router) handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setup, err := newSetup(room.variant)
+	if err != nil {
+		requestLogger(r).error("Could not set up the game", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	gameId := idGen.New().String()
 	match := match{
-		gameId: gameId,
+		gameId:  gameId,
+		control: room.control,
+		rated:   room.rated && rout.ratedFor(room.host.id, uid),
+		invite:  true,
+		setup:   setup,
+	}
+	guest := user{
+		id: uid,
+		username: username,
+	}
+	// Give the host and the friend the colors they asked for, drawing them
+	// if neither did or both asked for the same one.
+	guestWhite := rand.Intn(2) % 2 == 0
+	switch {
+	case room.hostColor != "" && room.hostColor != guestColor:
+		guestWhite = room.hostColor == "black"
+	case guestColor != "" && guestColor != room.hostColor:
+		guestWhite = guestColor == "white"
 	}
-	// Randomly choose color
 	color := ""
-	if rand.Intn(2) % 2 == 0 {
+	if guestWhite {
 		color = "white"
-		match.white = user{
-			id: uid,
-			username: username,
-		}
+		match.white = guest
+		match.black = room.host
 	} else {
 		color = "black"
-		match.black = user{
-			id: uid,
-			username: username,
+		match.white = room.host
+		match.black = guest
+	}
+	if room.guestBase != 0 {
+		match.clocks = map[string]time.Duration{
+			room.host.id: room.control.base,
+			uid:          room.guestBase,
+		}
+	}
+	if room.odds != "" {
+		oddsBy := "white"
+		if (match.white.id == uid) != room.guestOdds {
+			oddsBy = "black"
+		}
+		if match.setup, err = match.setup.giveOdds(room.odds, oddsBy); err != nil {
+			requestLogger(r).error("Could not set up the game", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
+	rout.makeRoom(match)
+	// Let the host know, whether they are waiting right now or come back
+	// later.
 	room.opp<- match
 
-	res := map[string]string{
+	res := map[string]interface{}{
 		"color":  color,
 		"roomId": gameId,
 		"opp":    room.host.username,
+		"rated":  match.rated,
 	}
 
 	resB, err := json.Marshal(res)
 	if err != nil {
-		log.Println("Could not marshal response:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	if _, err := w.Write(resB); err != nil {
-		log.Println(err)
+		requestLogger(r).error("Could not write response", "err", err)
 	}
 }
 
@@ -620,8 +1309,7 @@ func (rout *router) handleJoin(w http.ResponseWriter, r *http.Request) {
 // correct size (16, 24 or 32 bytes). If it's too large it's truncated to the
 // max. If it's otherwise incorrect size wise an error is returned. Otherwise
 // the []byte version is returned.
-func getEncryptionKey() ([]byte, error) {
-	encKey := os.Getenv("PRINCE_ENC_KEY")
+func getEncryptionKey(encKey string) ([]byte, error) {
 	if encKey == "" {
 		env, err := godotenv.Read("cookie_hash.env")
 		if err != nil {
@@ -644,17 +1332,105 @@ func getEncryptionKey() ([]byte, error) {
 
 func main() {
 	// flag.Parse()
-	authKey := os.Getenv("PRINCE_SESSION_KEY")
+	c, err := loadConfig()
+	if err != nil {
+		rootLogger.fatal("Invalid config", "err", err)
+	}
+	conf = c
+	authKey := conf.SessionKey
 	if authKey == "" {
 		env, err := godotenv.Read("cookie_hash.env")
 		if err != nil {
-			log.Fatal(err)
+			rootLogger.fatal("Could not read session key", "err", err)
 		}
 		authKey = env["SESSION_KEY"]
 	}
-	encKeyB, err := getEncryptionKey()
+	encKeyB, err := getEncryptionKey(conf.EncKey)
+	if err != nil {
+		rootLogger.fatal("Could not get encryption key", "err", err)
+	}
+	if errs := checkStartup(authKey); len(errs) > 0 {
+		for _, err := range errs {
+			rootLogger.error("Invalid setup", "err", err)
+		}
+		rootLogger.fatal("Refusing to start", "problems", len(errs))
+	}
+	// Take the port now, so that a busy one stops the server right away.
+	ln, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		rootLogger.fatal("Could not listen", "addr", conf.Addr, "err", err)
+	}
+
+	accounts, err := newAccountStore()
+	if err != nil {
+		rootLogger.fatal("Could not load accounts", "err", err)
+	}
+	ratings, err := newRatingStore()
 	if err != nil {
-		log.Fatal(err)
+		rootLogger.fatal("Could not load ratings", "err", err)
+	}
+	bans, err := newBanStore(bansFile)
+	if err != nil {
+		rootLogger.fatal("Could not load bans", "err", err)
+	}
+	restrictions, err := newBanStore(restrictionsFile)
+	if err != nil {
+		rootLogger.fatal("Could not load restrictions", "err", err)
+	}
+	commentators, err := newBanStore(commentatorsFile)
+	if err != nil {
+		rootLogger.fatal("Could not load commentators", "err", err)
+	}
+	apiKeys, err := newAPIKeyStore()
+	if err != nil {
+		rootLogger.fatal("Could not load API keys", "err", err)
+	}
+	loginSessions, err := newLoginSessionStore()
+	if err != nil {
+		rootLogger.fatal("Could not load sessions", "err", err)
+	}
+	puzzles, err := newPuzzleStore()
+	if err != nil {
+		rootLogger.fatal("Could not load puzzles", "err", err)
+	}
+	reports, err := newReportStore()
+	if err != nil {
+		rootLogger.fatal("Could not load reports", "err", err)
+	}
+	commBans, err := newCommBanStore()
+	if err != nil {
+		rootLogger.fatal("Could not load communication bans", "err", err)
+	}
+	resultChains, err := newResultChainStore()
+	if err != nil {
+		rootLogger.fatal("Could not load result chains", "err", err)
+	}
+	signals, err := newAccountSignals()
+	if err != nil {
+		rootLogger.fatal("Could not load account signals", "err", err)
+	}
+	fairPlayAcks, err := newFairPlayAckStore()
+	if err != nil {
+		rootLogger.fatal("Could not load fair-play acknowledgements", "err", err)
+	}
+	abandonments, err := newAbandonmentStore()
+	if err != nil {
+		rootLogger.fatal("Could not load abandonments", "err", err)
+	}
+	messages, err := newMessageStore()
+	if err != nil {
+		rootLogger.fatal("Could not load messages", "err", err)
+	}
+	wr, err := newWaitRooms()
+	if err != nil {
+		rootLogger.fatal("Could not load invites", "err", err)
+	}
+
+	// Tokens sent by email are signed with the session key unless they have
+	// a key of their own.
+	tokenKey := conf.TokenKey
+	if tokenKey == "" {
+		tokenKey = authKey
 	}
 
 	sessStore := sessions.NewCookieStore([]byte(authKey), encKeyB)
@@ -664,51 +1440,147 @@ func main() {
 	    SameSite: http.SameSiteNoneMode,
 	}
 	rout := &router{
-		m:        &sync.Mutex{},
-		count:    0,
-		matches:  make(map[string]match),
-		store:    sessStore,
-		opp1min:  make(chan match),
-		opp3min:  make(chan match),
-		opp5min:  make(chan match),
-		opp10min: make(chan match),
-		rm:       newRoomMatcher(),
-		wr:       newWaitRooms(),
-		ldHub:    newLivedataHub(),
-	}
-	go rout.rm.listenAll()
+		m:               &sync.Mutex{},
+		matches:         newMatchTable(),
+		store:           sessStore,
+		pools:           matchmaking.NewRegistry(),
+		rm:              newRoomMatcher(),
+		wr:              wr,
+		ldHub:           newLivedataHub(),
+		messages:        messages,
+		accounts:        accounts,
+		ratings:         ratings,
+		bans:            bans,
+		restrictions:    restrictions,
+		commentators:    commentators,
+		conns:           newConnRegistry(),
+		tokens:          newTokenSigner([]byte(tokenKey)),
+		mailer:          newMailer(),
+		apiKeys:         apiKeys,
+		loginSessions:   loginSessions,
+		challenge:       newChallengeVerifier(),
+		inviteBursts:    newBurstCounter(conf.InviteBurst, conf.InviteBurstWindow),
+		spectatorChats:  newSpectatorChats(),
+		finishedInvites: newFinishedInvites(),
+		puzzles:         puzzles,
+		analyses:        newAnalysisStore(),
+		notable:         newNotableGames(),
+		bughouse:        newBughouseTable(),
+		pastRequests:    newPastRequests(),
+		stamps:          newCacheStamps(),
+		reports:         reports,
+		commBans:        commBans,
+		engineChecks:    make(chan engineCheckJob, engineCheckQueueSize),
+		results:         newResultHistory(),
+		resultChains:    resultChains,
+		signals:         signals,
+		fairPlayAcks:    fairPlayAcks,
+		abandonments:    abandonments,
+		seeks:           newSeekBoard(),
+		challenges:      newDirectChallenges(),
+	}
+	if conf.RedisAddr != "" {
+		redis := newRedisBroker(conf.RedisAddr, conf.RedisPassword)
+		if err := redis.ping(); err != nil {
+			rootLogger.fatal("Could not reach Redis", "addr", conf.RedisAddr, "err", err)
+		}
+		rout.ldHub.connect(redis)
+		rout.shared = redis
+		rout.sharedPools = newSharedPools(redis)
+		rout.wr.claimCode = rout.claimJoinCode
+	}
+	// Invites restored from the data directory expire as they would have.
+	for _, room := range rout.wr.open() {
+		rout.watchInvite(room)
+	}
+	rout.analyses.changed = func(gameId string) {
+		rout.stamps.touch(gameStamp(gameId))
+	}
+	go rout.analyses.run()
+	go rout.runEngineChecks()
+	rout.ldHub.full = rout.full
 	go rout.ldHub.run()
+	rout.ldHub.lobby.shadowed = rout.restricted
+	rout.ldHub.lobby.publicChat.silenced = func(uid string) (notice, bool) {
+		return rout.silenced(uid, "")
+	}
+	rout.spectatorChats.commentator = rout.commentator
+	rout.spectatorChats.commentary = rout.relayCommentary
+	rout.spectatorChats.silenced = rout.silenced
+	go rout.ldHub.lobby.run()
 
 	r := mux.NewRouter()
-	r.HandleFunc("/play", rout.handlePlay).Methods("GET").Queries("clock", "{clock}")
-	r.HandleFunc("/invite", rout.handleInvite).Methods("GET").Queries("clock", "{clock}")
-	r.HandleFunc("/game", rout.handleGame).Queries("id", "{id}", "clock", "{clock}")
-	r.HandleFunc("/wait", rout.handleWait).Queries("id", "{id}", "clock", "{clock}")
-	r.HandleFunc("/join", rout.handleJoin).Queries("id", "{id}", "clock", "{clock}")
-	r.HandleFunc("/username", rout.handlePostUsername).Methods("POST")
-	r.HandleFunc("/username", rout.handleGetUsername).Methods("GET")
-	r.HandleFunc("/livedata", rout.handleLivedata).Methods("GET")
-    c := cors.New(cors.Options{
-		AllowedOrigins: []string{"http://localhost:8080", "https://princechess.netlify.app"},
-		AllowCredentials: true,
-		// Enable Debugging for testing, consider disabling in production
-		Debug: false,
-	})
-	handler := c.Handler(r)
-	port := os.Getenv("PORT")
-	addr := ":" + port
-	if port == "" {
-		port = "8000"
-		addr = "127.0.0.1:" + port
-	}
+	r.NotFoundHandler = notFoundHandler
+	r.MethodNotAllowedHandler = methodNotAllowedHandler
+	rout.mountRoutes(r.PathPrefix(apiPrefix).Subrouter())
+	// The routes without the version, as the clients written before the API
+	// had one call them.
+	rout.mountRoutes(r)
+	r.HandleFunc("/metrics", requireAdmin(handleMetrics)).Methods("GET")
+	mountDebug(r)
+	r.Use(withRequestID)
+	r.Use(compressResponses)
+	r.Use(recoverPanics)
+	r.Use(rout.trackSession)
+	r.Use(rout.rejectBanned)
+	handler := cors.New(corsOptions()).Handler(r)
     srv := &http.Server{
         Handler: handler,
-        Addr:    addr,
+        Addr:    conf.Addr,
         // Good practice: enforce timeouts for servers you create!
-        WriteTimeout: 15 * time.Second,
-        ReadTimeout:  15 * time.Second,
+        WriteTimeout: conf.WriteTimeout,
+        ReadTimeout:  conf.ReadTimeout,
     }
 
-    log.Println("Listening")
-    log.Fatal(srv.ListenAndServe())
+	if conf.TLSCert != "" || len(conf.ACMEDomains) > 0 {
+		redirectHandler := http.Handler(http.HandlerFunc(redirectToHTTPS))
+		if len(conf.ACMEDomains) > 0 {
+			m := acmeManager()
+			srv.TLSConfig = acmeTLSConfig(m)
+			// Answers the HTTP challenges of Let's Encrypt.
+			redirectHandler = m.HTTPHandler(redirectHandler)
+		} else if srv.TLSConfig, err = tlsConfig(); err != nil {
+			rootLogger.fatal("Could not load TLS certificate", "err", err)
+		}
+		if conf.RedirectAddr != "" {
+			rootLogger.info("Redirecting to HTTPS", "addr", conf.RedirectAddr)
+			redirect := &http.Server{
+				Handler:      redirectHandler,
+				Addr:         conf.RedirectAddr,
+				WriteTimeout: conf.WriteTimeout,
+				ReadTimeout:  conf.ReadTimeout,
+			}
+			go func() {
+				if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+					rootLogger.fatal("Could not listen", "err", err)
+				}
+			}()
+		}
+	}
+
+    rootLogger.info("Listening", "addr", conf.Addr, "tls", srv.TLSConfig != nil)
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			rootLogger.fatal("Could not listen", "err", err)
+		}
+	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, _, err := rout.reloadConfig(); err != nil {
+				rootLogger.error("Could not reload settings", "err", err)
+			}
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	rout.shutdown(srv)
 }
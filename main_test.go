@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testInvite opens an invite of the host in the wait rooms.
+func testInvite(t *testing.T, wr *waitRooms, id string, expires time.Time) *inviteRoom {
+	t.Helper()
+	room := &inviteRoom{
+		id:      id,
+		control: timeControl{base: 5 * time.Minute, increment: 3 * time.Second},
+		host:    user{id: "host", username: "Host"},
+		expires: expires,
+		variant: variantStandard,
+		odds:    "knight",
+	}
+	room.open()
+	if err := wr.add(room); err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func acceptAny(*inviteRoom) error { return nil }
+
+func TestWaitRoomsKeepAcceptedInvitesForTheHost(t *testing.T) {
+	useTempDataDir(t)
+	wr, err := newWaitRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := testInvite(t, wr, "invite", time.Now().Add(time.Hour))
+
+	if _, err := wr.accept(room.code, acceptAny); err != nil {
+		t.Fatal(err)
+	}
+	// The friend's match waits for the host.
+	room.opp<- match{gameId: "game"}
+	if _, err := wr.accept(room.id, acceptAny); err != errInviteNotFound {
+		t.Errorf("accepting the invite again: %v, want %v", err, errInviteNotFound)
+	}
+	if _, ok := wr.find(room.code); ok {
+		t.Error("accepted invite found by its join code")
+	}
+	found, ok := wr.find(room.id)
+	if !ok || found != room {
+		t.Fatal("the host can't find the accepted invite")
+	}
+	if m := <-found.opp; m.gameId != "game" {
+		t.Errorf("host took match %q, want game", m.gameId)
+	}
+	wr.handOver(room)
+	if _, ok := wr.find(room.id); ok {
+		t.Error("invite found after the host took the match")
+	}
+	if wr.expire(room) {
+		t.Error("invite handed over expired")
+	}
+}
+
+func TestWaitRoomsExpireAcceptedInvites(t *testing.T) {
+	useTempDataDir(t)
+	wr, err := newWaitRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := testInvite(t, wr, "invite", time.Now().Add(time.Hour))
+	if _, err := wr.accept(room.id, acceptAny); err != nil {
+		t.Fatal(err)
+	}
+	if !wr.expire(room) {
+		t.Error("accepted invite not there to expire")
+	}
+	if _, ok := wr.find(room.id); ok {
+		t.Error("invite found after expiring")
+	}
+}
+
+func TestWaitRoomsRestoreOpenInvites(t *testing.T) {
+	useTempDataDir(t)
+	wr, err := newWaitRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := testInvite(t, wr, "open", time.Now().Add(time.Hour))
+	testInvite(t, wr, "stale", time.Now().Add(time.Millisecond))
+	accepted := testInvite(t, wr, "accepted", time.Now().Add(time.Hour))
+	if _, err := wr.accept(accepted.id, acceptAny); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	restored, err := newWaitRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rooms := restored.open()
+	if len(rooms) != 1 {
+		t.Fatalf("%d invites restored, want only the open one", len(rooms))
+	}
+	room, ok := restored.find(open.code)
+	if !ok {
+		t.Fatal("open invite not found by its join code")
+	}
+	if room.id != open.id || room.control != open.control || room.host != open.host ||
+		!room.expires.Equal(open.expires) || room.odds != open.odds || room.variant != open.variant {
+		t.Errorf("restored %+v, want %+v", room, open)
+	}
+	if room.opp == nil || room.revoked == nil || room.viewed == nil {
+		t.Error("restored invite can't be waited on")
+	}
+}
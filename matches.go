@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/matchmaking"
+	idGen "github.com/rs/xid"
+)
+
+// matchTable keeps the matches whose game is being played, by game id.
+type matchTable struct {
+	m       *sync.Mutex
+	count   int
+	matches map[string]match
+}
+
+func newMatchTable() *matchTable {
+	return &matchTable{
+		m:       &sync.Mutex{},
+		matches: make(map[string]match),
+	}
+}
+
+func (t *matchTable) add(m match) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.count++
+	t.matches[m.gameId] = m
+}
+
+// size returns the number of games being played.
+func (t *matchTable) size() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.matches)
+}
+
+func (t *matchTable) get(gameId string) (match, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	m, ok := t.matches[gameId]
+	return m, ok
+}
+
+// of returns the ids of the games the user is playing, in order.
+func (t *matchTable) of(uid string) []string {
+	t.m.Lock()
+	defer t.m.Unlock()
+	ids := []string{}
+	for id, m := range t.matches {
+		if m.white.id == uid || m.black.id == uid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// remove deletes the match, returning it as it was last.
+func (t *matchTable) remove(gameId string) (match, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	m, ok := t.matches[gameId]
+	delete(t.matches, gameId)
+	return m, ok
+}
+
+// training reports whether the game is a training game against the computer.
+func (t *matchTable) training(gameId string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.matches[gameId].training
+}
+
+// switchColors swaps the players of the match, for a rematch.
+func (t *matchTable) switchColors(gameId string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if m, ok := t.matches[gameId]; ok {
+		m.white, m.black = m.black, m.white
+		t.matches[gameId] = m
+	}
+}
+
+// newMatch pairs the user with the player waiting in the pool or, if there's
+// none, waits for an opponent for the given time. The user asks for the
+// color, if not empty. The player given white sets up the room.
+func (rout *router) newMatch(uid, username, color string, control timeControl, pool seekPool, wait time.Duration) (playRoomId, playColor, oppUsername string) {
+	seeker := matchmaking.Seeker{
+		ID:       uid,
+		Username: username,
+		Color:    color,
+	}
+	newID := func() string { return idGen.New().String() }
+	pairing, ok := pool.Seek(seeker, wait, newID)
+	if !ok {
+		return
+	}
+	if pairing.Black.ID == uid {
+		return pairing.GameID, "black", pairing.White.Username
+	}
+	rout.makeRoom(match{
+		gameId: pairing.GameID,
+		white:  user{
+			id: uid,
+			username: username,
+		},
+		black:  user{
+			id: pairing.Black.ID,
+			username: pairing.Black.Username,
+		},
+		control: control,
+		setup:   setup{
+			Variant: variantStandard,
+			FEN: standardFEN,
+		},
+	})
+	return pairing.GameID, "white", pairing.Black.Username
+}
+
+// parseColorPreference parses the color a player asks for: white, black, or
+// random or empty if either will do, returned as empty.
+func parseColorPreference(color string) (string, error) {
+	switch color {
+	case "white", "black":
+		return color, nil
+	case "", "random":
+		return "", nil
+	}
+	return "", errors.New("Invalid color: " + color)
+}
+
+// How often the players waiting in a pool hear that the search goes on.
+const matchProgressInterval = 2 * time.Second
+
+// parseMatchWait parses the seconds a player is willing to wait for an
+// opponent, the match timeout if empty, up to the longest wait allowed.
+func parseMatchWait(seconds string) (time.Duration, error) {
+	if seconds == "" {
+		return conf.MatchTimeout, nil
+	}
+	n, err := strconv.Atoi(seconds)
+	if err != nil || n <= 0 {
+		return 0, errors.New("Invalid wait: " + seconds)
+	}
+	wait := time.Duration(n) * time.Second
+	if wait > conf.MaxMatchWait {
+		wait = conf.MaxMatchWait
+	}
+	return wait, nil
+}
+
+// matchProgress is how the search for an opponent in a pool goes.
+type matchProgress struct {
+	Clock string `json:"clock"`
+	// Seconds waited so far, and at most.
+	Waited  int `json:"waited"`
+	MaxWait int `json:"maxWait"`
+	// Players waiting in the pool, the one searching included.
+	Waiting int `json:"waiting"`
+}
+
+// reportSearching passes how the search for an opponent goes to report,
+// every matchProgressInterval until done is closed.
+func reportSearching(control timeControl, pool seekPool, wait time.Duration, done <-chan struct{}, report func(matchProgress)) {
+	start := time.Now()
+	ticker := time.NewTicker(matchProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report(matchProgress{
+				Clock:   control.String(),
+				Waited:  int(time.Since(start) / time.Second),
+				MaxWait: int(wait / time.Second),
+				Waiting: pool.Waiting(),
+			})
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directMessage is a private message sent from one user to another outside
+// of a game.
+type directMessage struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Username string    `json:"username"`
+	Text     string    `json:"text"`
+	Sent     time.Time `json:"sent"`
+}
+
+const (
+	// Subdirectory of the data directory keeping each conversation in a
+	// file of its own, so that a message rewrites only its conversation.
+	messagesDir = "messages"
+
+	// File the conversations were kept in, all together, before. They are
+	// moved to messagesDir on loading.
+	messagesFile = "messages.json"
+
+	// Messages kept per conversation; older ones are dropped.
+	maxConversationLength = 500
+
+	// Conversations kept per user; the least recently active ones are
+	// dropped.
+	maxConversations = 100
+)
+
+// conversation holds the messages exchanged between two users and how many
+// of them each participant hasn't read yet.
+type conversation struct {
+	Messages []directMessage `json:"messages"`
+	Unread   map[string]int  `json:"unread,omitempty"`
+}
+
+// last returns the latest message of the conversation.
+func (c *conversation) last() directMessage {
+	return c.Messages[len(c.Messages)-1]
+}
+
+// conversationSummary is the listing entry of a conversation for one of its
+// participants.
+type conversationSummary struct {
+	With   string        `json:"with"`
+	Unread int           `json:"unread"`
+	Last   directMessage `json:"last"`
+}
+
+// messageStore keeps the 1:1 conversations, persisted to the data directory.
+type messageStore struct {
+	m *sync.Mutex
+
+	// Conversations mapped by conversationKey.
+	conversations map[string]*conversation
+
+	// Peers each user has a conversation with.
+	peers map[string]map[string]bool
+}
+
+func newMessageStore() (*messageStore, error) {
+	s := &messageStore{
+		m:             &sync.Mutex{},
+		conversations: make(map[string]*conversation),
+		peers:         make(map[string]map[string]bool),
+	}
+	if err := loadJSON(messagesFile, &s.conversations); err != nil {
+		return nil, err
+	}
+	legacy := len(s.conversations) > 0
+	names, err := listJSON(messagesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		c := &conversation{}
+		if err := loadJSON(name, c); err != nil {
+			return nil, err
+		}
+		if len(c.Messages) > 0 {
+			s.conversations[conversationKey(c.Messages[0].From, c.Messages[0].To)] = c
+		}
+	}
+	for key, c := range s.conversations {
+		if len(c.Messages) == 0 {
+			delete(s.conversations, key)
+			continue
+		}
+		if c.Unread == nil {
+			c.Unread = make(map[string]int)
+		}
+		s.addPeers(c.Messages[0].From, c.Messages[0].To)
+	}
+	if legacy {
+		for key := range s.conversations {
+			if err := s.save(key); err != nil {
+				return nil, err
+			}
+		}
+		if err := removeJSON(messagesFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// conversationKey returns the same key regardless of the order of the users.
+func conversationKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+// conversationFile names the file of the conversation in messagesDir.
+func conversationFile(key string) string {
+	return filepath.Join(messagesDir, base64.RawURLEncoding.EncodeToString([]byte(key))+".json")
+}
+
+// save writes the conversation to its file. The caller must hold the lock.
+func (s *messageStore) save(key string) error {
+	return saveJSON(conversationFile(key), s.conversations[key])
+}
+
+// addPeers records that the users have a conversation. The caller must hold
+// the lock.
+func (s *messageStore) addPeers(a, b string) {
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if s.peers[pair[0]] == nil {
+			s.peers[pair[0]] = make(map[string]bool)
+		}
+		s.peers[pair[0]][pair[1]] = true
+	}
+}
+
+// trim drops the least recently active conversations of the user beyond
+// maxConversations. The caller must hold the lock.
+func (s *messageStore) trim(uid string) error {
+	for len(s.peers[uid]) > maxConversations {
+		var (
+			oldest     string
+			oldestSent time.Time
+		)
+		for peer := range s.peers[uid] {
+			sent := s.conversations[conversationKey(uid, peer)].last().Sent
+			if oldest == "" || sent.Before(oldestSent) {
+				oldest, oldestSent = peer, sent
+			}
+		}
+		key := conversationKey(uid, oldest)
+		delete(s.conversations, key)
+		for _, pair := range [][2]string{{uid, oldest}, {oldest, uid}} {
+			delete(s.peers[pair[0]], pair[1])
+			if len(s.peers[pair[0]]) == 0 {
+				delete(s.peers, pair[0])
+			}
+		}
+		if err := removeJSON(conversationFile(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add stores the message and returns the number of unread messages the
+// recipient has in the conversation.
+func (s *messageStore) add(dm directMessage) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	key := conversationKey(dm.From, dm.To)
+	c, ok := s.conversations[key]
+	if !ok {
+		c = &conversation{Unread: make(map[string]int)}
+		s.conversations[key] = c
+	}
+	c.Messages = append(c.Messages, dm)
+	if len(c.Messages) > maxConversationLength {
+		c.Messages = c.Messages[len(c.Messages)-maxConversationLength:]
+	}
+	if c.Unread[dm.To] < maxConversationLength {
+		c.Unread[dm.To]++
+	}
+	unread := c.Unread[dm.To]
+	s.addPeers(dm.From, dm.To)
+	if err := s.save(key); err != nil {
+		return unread, err
+	}
+	for _, uid := range []string{dm.From, dm.To} {
+		if err := s.trim(uid); err != nil {
+			return unread, err
+		}
+	}
+	return unread, nil
+}
+
+// history returns the messages between uid and peer and marks them as read
+// by uid.
+func (s *messageStore) history(uid, peer string) ([]directMessage, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	key := conversationKey(uid, peer)
+	c, ok := s.conversations[key]
+	if !ok {
+		return []directMessage{}, nil
+	}
+	msgs := make([]directMessage, len(c.Messages))
+	copy(msgs, c.Messages)
+	if c.Unread[uid] == 0 {
+		return msgs, nil
+	}
+	delete(c.Unread, uid)
+	return msgs, s.save(key)
+}
+
+// list returns the conversations of uid, most recently active first.
+func (s *messageStore) list(uid string) []conversationSummary {
+	s.m.Lock()
+	defer s.m.Unlock()
+	list := []conversationSummary{}
+	for peer := range s.peers[uid] {
+		c := s.conversations[conversationKey(uid, peer)]
+		list = append(list, conversationSummary{
+			With:   peer,
+			Unread: c.Unread[uid],
+			Last:   c.last(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Last.Sent.After(list[j].Last.Sent)
+	})
+	return list
+}
+
+// Send a direct message to another user. It's delivered right away over the
+// livedata socket of the recipient if they are online.
+func (rout *router) handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	to := r.FormValue("to")
+	if to == "" {
+		writeError(w, "Empty recipient", http.StatusBadRequest)
+		return
+	}
+	if to == uid {
+		writeError(w, "You can't message yourself", http.StatusBadRequest)
+		return
+	}
+	if !rout.knownUser(to) {
+		writeError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	text := strings.TrimSpace(strings.Replace(r.FormValue("text"), newline, space, -1))
+	if text == "" {
+		writeError(w, "Empty message", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(text)) > conf.maxChatLength() {
+		writeError(w, "Messages can't be longer than " + strconv.Itoa(conf.maxChatLength()) + " characters", http.StatusBadRequest)
+		return
+	}
+	dm := directMessage{
+		From:     uid,
+		To:       to,
+		Username: username,
+		Text:     text,
+		Sent:     time.Now(),
+	}
+	unread, err := rout.messages.add(dm)
+	if err != nil {
+		requestLogger(r).error("Could not save messages", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rout.ldHub.direct<- directDelivery{
+		uid: to,
+		payload: map[string]interface{}{
+			"dm":     dm,
+			"unread": unread,
+		},
+	}
+
+	resB, err := json.Marshal(dm)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the conversations of the user along with their unread counts.
+func (rout *router) handleGetConversations(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resB, err := json.Marshal(rout.messages.list(uid))
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Fetch the history of the conversation with another user, marking it as
+// read.
+func (rout *router) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	peer := r.FormValue("with")
+	if peer == "" {
+		writeError(w, "Empty peer", http.StatusBadRequest)
+		return
+	}
+
+	msgs, err := rout.messages.history(uid, peer)
+	if err != nil {
+		requestLogger(r).error("Could not save messages", "err", err)
+	}
+
+	resB, err := json.Marshal(msgs)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// knownUser reports whether the uid is of a registered account or of a user
+// online, or in a cluster, of a user who opened a socket in any node lately.
+func (rout *router) knownUser(uid string) bool {
+	if _, ok := rout.accounts.get(uid); ok {
+		return true
+	}
+	return rout.conns.online(uid) || rout.seenInCluster(uid)
+}
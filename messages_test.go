@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestMessageStore(t *testing.T) *messageStore {
+	t.Helper()
+	s, err := newMessageStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func dm(from, to string, sent time.Time) directMessage {
+	return directMessage{From: from, To: to, Username: from, Text: "hi", Sent: sent}
+}
+
+func TestMessageStoreSavesEachConversation(t *testing.T) {
+	dir := useTempDataDir(t)
+	s := newTestMessageStore(t)
+	now := time.Now()
+	for _, m := range []directMessage{dm("a", "b", now), dm("b", "a", now), dm("c", "a", now)} {
+		if _, err := s.add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := listJSON(messagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("files %v, want one per conversation", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, messagesFile)); !os.IsNotExist(err) {
+		t.Errorf("conversations saved together: %v", err)
+	}
+
+	// Reading the conversation marks it read, and it stays read.
+	if msgs, err := s.history("a", "c"); err != nil || len(msgs) != 1 {
+		t.Fatalf("history = %v, %v", msgs, err)
+	}
+	s = newTestMessageStore(t)
+	unread := make(map[string]int)
+	for _, c := range s.list("a") {
+		unread[c.With] = c.Unread
+	}
+	if unread["b"] != 1 || unread["c"] != 0 || len(unread) != 2 {
+		t.Errorf("unread after reloading %v, want b: 1, c: 0", unread)
+	}
+}
+
+func TestMessageStoreMovesTheSingleFile(t *testing.T) {
+	dir := useTempDataDir(t)
+	legacy := map[string]*conversation{
+		conversationKey("a", "b"): {Messages: []directMessage{dm("a", "b", time.Now())}, Unread: map[string]int{"b": 1}},
+	}
+	if err := saveJSON(messagesFile, legacy); err != nil {
+		t.Fatal(err)
+	}
+	newTestMessageStore(t)
+	if _, err := os.Stat(filepath.Join(dir, messagesFile)); !os.IsNotExist(err) {
+		t.Errorf("%s left behind: %v", messagesFile, err)
+	}
+	s := newTestMessageStore(t)
+	if list := s.list("b"); len(list) != 1 || list[0].With != "a" || list[0].Unread != 1 {
+		t.Errorf("conversations of b %+v, want the one with a, unread", list)
+	}
+}
+
+func TestMessageStoreKeepsTheLatestConversations(t *testing.T) {
+	useTempDataDir(t)
+	s := newTestMessageStore(t)
+	start := time.Now()
+	for i := 0; i <= maxConversations; i++ {
+		if _, err := s.add(dm("peer"+strconv.Itoa(i), "a", start.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := s.list("a")
+	if len(list) != maxConversations {
+		t.Fatalf("a has %d conversations, want %d", len(list), maxConversations)
+	}
+	if last := list[len(list)-1].With; last != "peer1" {
+		t.Errorf("least recent conversation kept is with %s, want peer1", last)
+	}
+	if list := s.list("peer0"); len(list) != 0 {
+		t.Errorf("dropped conversation still listed for the peer: %+v", list)
+	}
+	names, err := listJSON(messagesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != maxConversations {
+		t.Errorf("%d conversation files, want %d", len(names), maxConversations)
+	}
+}
+
+func TestKnownUser(t *testing.T) {
+	useTempDataDir(t)
+	accounts, err := newAccountStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := accounts.register("", "Magnus", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rout := &router{accounts: accounts, conns: newConnRegistry()}
+	if !rout.knownUser(a.Id) {
+		t.Error("registered account unknown")
+	}
+	if rout.knownUser("guest") {
+		t.Error("guest never seen is known")
+	}
+
+	// In a cluster, the guest may be connected to another node.
+	cluster := newMemCluster()
+	rout.shared = cluster
+	if rout.knownUser("guest") {
+		t.Error("guest never seen in the cluster is known")
+	}
+	other := &router{shared: cluster}
+	other.recordPresence("guest")
+	if !rout.knownUser("guest") {
+		t.Error("guest connected to another node unknown")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Moves taking longer than this to be relayed by a room are logged, to spot
+// the hot ones.
+const slowBroadcast = 50 * time.Millisecond
+
+// Metrics of the rooms, summed over all of them and exposed to Prometheus at
+// /metrics.
+var (
+	roomMoves = newCounter("prince_room_moves_total",
+		"Moves relayed by the rooms.")
+	roomChats = newCounter("prince_room_chat_messages_total",
+		"Chat messages relayed by the rooms.")
+	roomDrops = newCounterVec("prince_room_dropped_messages_total",
+		"Messages the rooms dropped because the channel of a player was full.", "kind")
+	roomBroadcast = newHistogram("prince_room_broadcast_seconds",
+		"Time the rooms take to relay a move to both players.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+)
+
+// metric is written in the Prometheus text format.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var metrics []metric
+
+type counter struct {
+	name, help string
+	value      uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.value))
+}
+
+// counterVec is a counter split by the values of a label.
+type counterVec struct {
+	name, help, label string
+	m                 *sync.Mutex
+	values            map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		m:      &sync.Mutex{},
+		values: make(map[string]uint64),
+	}
+	metrics = append(metrics, c)
+	return c
+}
+
+func (c *counterVec) inc(value string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.values[value]++
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	values := make([]string, 0, len(c.values))
+	for v := range c.values {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, v, c.values[v])
+	}
+}
+
+type histogram struct {
+	name, help string
+	m          *sync.Mutex
+	bounds     []float64
+	// Observations in each bucket, the last one past every bound.
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	h := &histogram{
+		name:   name,
+		help:   help,
+		m:      &sync.Mutex{},
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, s)
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.counts[i]++
+	h.sum += s
+}
+
+func (h *histogram) write(w *bufio.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, le, total)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, total)
+}
+
+// writeGauges writes the rooms open by pool, as last seen by the goroutines
+// owning them.
+func writeGauges(w *bufio.Writer) {
+	for _, g := range []struct {
+		name, help string
+		values     map[string]int64
+	}{
+		{"prince_rooms_open", "Rooms open.", intMap(roomsOpen)},
+		{"prince_rooms_half_filled", "Rooms waiting for the second player.", intMap(roomsHalfFilled)},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		pools := make([]string, 0, len(g.values))
+		for pool := range g.values {
+			pools = append(pools, pool)
+		}
+		sort.Strings(pools)
+		for _, pool := range pools {
+			fmt.Fprintf(w, "%s{pool=%q} %d\n", g.name, pool, g.values[pool])
+		}
+	}
+}
+
+// Expose the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	writeGauges(bw)
+	if err := bw.Flush(); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// Thresholds of the checks of the timing of the moves of rated games. They
+// are meant to flag games for review, not to decide anything: a player
+// flagged by them may as well play fast and steadily.
+const (
+	// Plies of the opening, played from memory, left out of the timing.
+	openingPlies = 16
+	// Fewest moves of a player after the opening to judge their timing by.
+	minTimedMoves = 15
+	// Coefficient of variation of the time per move under which the timing
+	// is too even to be human.
+	flatTimingVariation = 0.2
+	// Positions with at least this many legal moves are complex, and the
+	// moves played in them within fastMoveTime are fast. Moves played short
+	// of time are left out, since anyone plays fast then.
+	complexPositionMoves = 35
+	fastMoveTime         = 1500 * time.Millisecond
+	lowClock             = 30 * time.Second
+	// Share of fast moves among at least minComplexMoves complex positions
+	// that flags the game. Games faster than minComplexBase are left out.
+	fastComplexShare = 0.7
+	minComplexMoves  = 8
+	minComplexBase   = 3 * time.Minute
+)
+
+// moveTiming is the time a player took for their moves after the opening.
+type moveTiming struct {
+	Moves int   `json:"moves"`
+	Mean  int64 `json:"meanMs"`
+	// Standard deviation of the times over their mean.
+	Variation float64 `json:"variation"`
+	// Non-capturing moves played in complex positions, and how many of them
+	// were fast.
+	ComplexMoves     int `json:"complexMoves"`
+	FastComplexMoves int `json:"fastComplexMoves"`
+}
+
+// timeMoves measures the timing of the moves of the player of the color, w or
+// b, in the game.
+func timeMoves(g finishedGame, color string) (moveTiming, error) {
+	var t moveTiming
+	pos, err := g.setup.variant().Position(g.setup.startFEN())
+	if err != nil {
+		return t, err
+	}
+	_, moves, err := rules.ParsePGN(pos, g.pgn)
+	if err != nil {
+		return t, err
+	}
+	side := "white"
+	if color == "b" {
+		side = "black"
+	}
+	var times []float64
+	for i, m := range moves {
+		if i >= len(g.moves) {
+			break
+		}
+		played := g.moves[i]
+		if i >= openingPlies && played.color == color {
+			after := played.after
+			times = append(times, float64(after))
+			left := time.Duration(played.clock[side]) * time.Millisecond
+			if left >= lowClock && !pos.IsCapture(m) && len(pos.LegalMoves()) >= complexPositionMoves {
+				t.ComplexMoves++
+				if after <= fastMoveTime {
+					t.FastComplexMoves++
+				}
+			}
+		}
+		pos = pos.Apply(m)
+	}
+	t.Moves = len(times)
+	if t.Moves == 0 {
+		return t, nil
+	}
+	var sum float64
+	for _, d := range times {
+		sum += d
+	}
+	mean := sum / float64(len(times))
+	var squares float64
+	for _, d := range times {
+		squares += (d - mean) * (d - mean)
+	}
+	t.Mean = time.Duration(mean).Milliseconds()
+	if mean > 0 {
+		t.Variation = math.Sqrt(squares/float64(len(times))) / mean
+	}
+	return t, nil
+}
+
+// suspicious returns the reasons the timing of a game with the time control
+// given looks inhuman, if any.
+func (t moveTiming) suspicious(control timeControl) []string {
+	var reasons []string
+	if t.Moves >= minTimedMoves && t.Variation < flatTimingVariation {
+		reasons = append(reasons, reasonFlatTiming)
+	}
+	if control.base >= minComplexBase && t.ComplexMoves >= minComplexMoves &&
+		float64(t.FastComplexMoves) >= fastComplexShare*float64(t.ComplexMoves) {
+		reasons = append(reasons, reasonFastComplexMoves)
+	}
+	return reasons
+}
+
+// checkMoveTimes flags the players of the rated game whose timing looks
+// inhuman into the moderation queue, where the engine checks their moves.
+func (rout *router) checkMoveTimes(g finishedGame) {
+	players := []struct {
+		color string
+		user  user
+	}{
+		{"w", g.white},
+		{"b", g.black},
+	}
+	for _, p := range players {
+		if strings.HasPrefix(p.user.id, engineUserPrefix) {
+			continue
+		}
+		timing, err := timeMoves(g, p.color)
+		if err != nil {
+			rootLogger.warn("Could not time the moves", "game", g.gameId, "err", err)
+			return
+		}
+		reasons := timing.suspicious(g.control)
+		if len(reasons) == 0 {
+			continue
+		}
+		rep, err := rout.fileReport(g, fairPlayReport{
+			Uid:      p.user.id,
+			Username: p.user.username,
+			Color:    p.color,
+			Reasons:  reasons,
+			Timing:   &timing,
+		})
+		if err != nil {
+			rootLogger.error("Could not save reports", "err", err)
+			continue
+		}
+		rootLogger.info("Game flagged for review", "report", rep.Id, "game", g.gameId,
+			"uid", p.user.id, "reasons", strings.Join(reasons, ","))
+	}
+}
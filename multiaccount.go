@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const accountSignalsFile = "account_signals.json"
+
+// Weights of the signals that two users are the same person, and the score
+// from which their link is suspected. The signals are soft: players behind
+// the same network or sharing a computer look alike too, so the links are
+// only surfaced to the admins.
+const (
+	// How long a signal counts after it was last seen.
+	accountSignalWindow = 30 * 24 * time.Hour
+	// Logging in to both accounts from the same browser.
+	sharedDeviceWeight = 50
+	// Playing from the same IP address, for each of them up to maxSharedIPs.
+	sharedIPWeight = 20
+	maxSharedIPs   = 2
+	// Playing at least linkedGames rated games against each other, and one of
+	// them winning at least farmingShare of them.
+	linkedGames         = 3
+	linkedGamesWeight   = 10
+	oneSidedGamesWeight = 20
+	suspectedLinkScore  = 60
+)
+
+// pairGames is the rated games between two users.
+type pairGames struct {
+	Games int            `json:"games"`
+	Wins  map[string]int `json:"wins"`
+	Last  time.Time      `json:"last"`
+}
+
+// signalLog is what was seen of the users, by the user ids.
+type signalLog struct {
+	// When each user was last seen from each IP address and browser.
+	IPs     map[string]map[string]time.Time `json:"ips"`
+	Devices map[string]map[string]time.Time `json:"devices"`
+	// Rated games between each pair of users, by pairKey.
+	Games map[string]*pairGames `json:"games"`
+	// Last username of each user seen.
+	Usernames map[string]string `json:"usernames"`
+}
+
+func pairKey(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+// accountSignals collects the signals of users sharing their IP addresses,
+// browsers and games, persisted to the data directory.
+type accountSignals struct {
+	m   *sync.Mutex
+	log signalLog
+}
+
+func newAccountSignals() (*accountSignals, error) {
+	s := &accountSignals{
+		m: &sync.Mutex{},
+		log: signalLog{
+			IPs:       make(map[string]map[string]time.Time),
+			Devices:   make(map[string]map[string]time.Time),
+			Games:     make(map[string]*pairGames),
+			Usernames: make(map[string]string),
+		},
+	}
+	if err := loadJSON(accountSignalsFile, &s.log); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// seen records the user at the IP address and, if not empty, the browser.
+func (s *accountSignals) seen(uid, username, ip, device string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	now := time.Now()
+	changed := s.log.Usernames[uid] != username
+	s.log.Usernames[uid] = username
+	if mark(s.log.IPs, ip, uid, now) {
+		changed = true
+	}
+	if device != "" && mark(s.log.Devices, device, uid, now) {
+		changed = true
+	}
+	if changed {
+		s.save()
+	}
+}
+
+// mark records that the user was seen by the key, reporting whether it's
+// worth saving: the user is new to the key or was last seen a while ago.
+func mark(seen map[string]map[string]time.Time, key, uid string, now time.Time) bool {
+	uids, ok := seen[key]
+	if !ok {
+		uids = make(map[string]time.Time)
+		seen[key] = uids
+	}
+	last, ok := uids[uid]
+	uids[uid] = now
+	return !ok || now.Sub(last) >= lastSeenResolution
+}
+
+// played records the result of a rated game between the players.
+func (s *accountSignals) played(g finishedGame) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	key := pairKey(g.white.id, g.black.id)
+	games, ok := s.log.Games[key]
+	if !ok {
+		games = &pairGames{Wins: make(map[string]int)}
+		s.log.Games[key] = games
+	}
+	games.Games++
+	games.Last = time.Now()
+	switch g.result {
+	case resultWhiteWins:
+		games.Wins[g.white.id]++
+	case resultBlackWins:
+		games.Wins[g.black.id]++
+	}
+	s.save()
+}
+
+// save forgets the signals out of the window and writes the rest. The caller
+// must hold the lock.
+func (s *accountSignals) save() {
+	since := time.Now().Add(-accountSignalWindow)
+	for _, seen := range []map[string]map[string]time.Time{s.log.IPs, s.log.Devices} {
+		for key, uids := range seen {
+			for uid, last := range uids {
+				if last.Before(since) {
+					delete(uids, uid)
+				}
+			}
+			if len(uids) == 0 {
+				delete(seen, key)
+			}
+		}
+	}
+	for key, games := range s.log.Games {
+		if games.Last.Before(since) {
+			delete(s.log.Games, key)
+		}
+	}
+	if err := saveJSON(accountSignalsFile, s.log); err != nil {
+		rootLogger.error("Could not save account signals", "err", err)
+	}
+}
+
+// accountLink is a pair of users who may be the same person, with the
+// signals that tie them.
+type accountLink struct {
+	Users         [2]gamePlayer `json:"users"`
+	SharedIPs     []string      `json:"sharedIPs"`
+	SharedDevices int           `json:"sharedDevices"`
+	// Rated games between them and the wins of each, by uid.
+	Games     int            `json:"games"`
+	Wins      map[string]int `json:"wins"`
+	Score     int            `json:"score"`
+	Suspected bool           `json:"suspected"`
+}
+
+var accountLinkListing = listing{
+	sorts:       []string{"score", "games"},
+	defaultSort: "-score",
+	filters: []param{
+		form("uid", "string", false, "Uid of either user"),
+		form("suspected", "bool", false, "Whether the score reaches " + strconv.Itoa(suspectedLinkScore)),
+	},
+}
+
+func (l accountLink) pageId() string {
+	return pairKey(l.Users[0].Id, l.Users[1].Id)
+}
+
+func (l accountLink) sortKey(field string) sortKey {
+	if field == "games" {
+		return sortKey{num: float64(l.Games)}
+	}
+	return sortKey{num: float64(l.Score)}
+}
+
+func (l accountLink) matches(filter, value string) bool {
+	switch filter {
+	case "uid":
+		return l.Users[0].Id == value || l.Users[1].Id == value
+	case "suspected":
+		return strconv.FormatBool(l.Suspected) == value
+	}
+	return true
+}
+
+// links returns the pairs of users who shared an IP address or a browser
+// within the window, scored by all of their signals.
+func (s *accountSignals) links() []accountLink {
+	s.m.Lock()
+	defer s.m.Unlock()
+	since := time.Now().Add(-accountSignalWindow)
+	links := make(map[string]*accountLink)
+	link := func(a, b string) *accountLink {
+		key := pairKey(a, b)
+		l, ok := links[key]
+		if !ok {
+			uids := strings.Split(key, " ")
+			l = &accountLink{SharedIPs: []string{}, Wins: map[string]int{}}
+			for i, uid := range uids {
+				l.Users[i] = gamePlayer{Id: uid, Username: s.log.Usernames[uid]}
+			}
+			links[key] = l
+		}
+		return l
+	}
+	forPairs := func(seen map[string]map[string]time.Time, f func(l *accountLink, key string)) {
+		for key, uids := range seen {
+			recent := []string{}
+			for uid, last := range uids {
+				if last.After(since) {
+					recent = append(recent, uid)
+				}
+			}
+			for i := range recent {
+				for _, other := range recent[i+1:] {
+					f(link(recent[i], other), key)
+				}
+			}
+		}
+	}
+	forPairs(s.log.IPs, func(l *accountLink, ip string) {
+		l.SharedIPs = append(l.SharedIPs, ip)
+	})
+	forPairs(s.log.Devices, func(l *accountLink, _ string) {
+		l.SharedDevices++
+	})
+
+	res := make([]accountLink, 0, len(links))
+	for key, l := range links {
+		sort.Strings(l.SharedIPs)
+		if l.SharedDevices > 0 {
+			l.Score += sharedDeviceWeight
+		}
+		shared := len(l.SharedIPs)
+		if shared > maxSharedIPs {
+			shared = maxSharedIPs
+		}
+		l.Score += shared * sharedIPWeight
+		if games, ok := s.log.Games[key]; ok && games.Last.After(since) {
+			l.Games = games.Games
+			for uid, n := range games.Wins {
+				l.Wins[uid] = n
+			}
+		}
+		if l.Games >= linkedGames {
+			l.Score += linkedGamesWeight
+			for _, n := range l.Wins {
+				if float64(n) >= farmingShare*float64(l.Games) {
+					l.Score += oneSidedGamesWeight
+				}
+			}
+		}
+		l.Suspected = l.Score >= suspectedLinkScore
+		res = append(res, *l)
+	}
+	return res
+}
+
+// List the pairs of users who may be the same person, by the IP addresses and
+// browsers they shared and the rated games between them, most suspected
+// first. Nothing is done to them: it's up to the admins.
+func (rout *router) handleAccountLinks(w http.ResponseWriter, r *http.Request) {
+	q, err := accountLinkListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	links := rout.signals.links()
+	items := make([]pageItem, 0, len(links))
+	for _, l := range links {
+		items = append(items, l)
+	}
+	page, next := paginate(items, q)
+	list := make([]accountLink, 0, len(page))
+	for _, item := range page {
+		list = append(list, item.(accountLink))
+	}
+	res := pageResponse("links", list, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
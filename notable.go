@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long finished games stay in the highlight reel, and how many of
+	// them are kept at most to pick from.
+	notableWindow        = 24 * time.Hour
+	maxNotableCandidates = 1000
+	// Games shown for each criterion.
+	notableGamesPerCriterion = 5
+	// Decisive games shorter than this are mostly resigned or abandoned
+	// right away rather than won over the board.
+	minDecisivePlies = 10
+
+	notableHighestRated     = "highestRated"
+	notableShortestDecisive = "shortestDecisive"
+	notableLongest          = "longest"
+)
+
+// notableGame is a finished game as shown in the highlight reel.
+type notableGame struct {
+	GameId   string    `json:"gameId"`
+	White    tvPlayer  `json:"white"`
+	Black    tvPlayer  `json:"black"`
+	Variant  string    `json:"variant"`
+	Result   string    `json:"result"`
+	Plies    int       `json:"plies"`
+	Finished time.Time `json:"finished"`
+}
+
+// notableGames keeps the games finished recently and picks the ones worth
+// highlighting for each criterion as they are kept.
+type notableGames struct {
+	m *sync.Mutex
+	// Games that can be picked, in the order they finished.
+	candidates []notableGame
+	// Games picked for each criterion, best first.
+	reel map[string][]notableGame
+}
+
+func newNotableGames() *notableGames {
+	return &notableGames{
+		m:    &sync.Mutex{},
+		reel: make(map[string][]notableGame),
+	}
+}
+
+// add keeps the game and picks the highlights again. A rematch replaces the
+// previous game of the room.
+func (n *notableGames) add(g notableGame) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	candidates := []notableGame{}
+	for _, c := range n.candidates {
+		if c.GameId != g.GameId && time.Since(c.Finished) < notableWindow {
+			candidates = append(candidates, c)
+		}
+	}
+	candidates = append(candidates, g)
+	if len(candidates) > maxNotableCandidates {
+		candidates = candidates[len(candidates)-maxNotableCandidates:]
+	}
+	n.candidates = candidates
+
+	n.reel = make(map[string][]notableGame)
+	for name, c := range notableCriteria {
+		n.reel[name] = pickNotable(candidates, c.filter, c.better, notableGamesPerCriterion)
+	}
+}
+
+// notableCriterion picks the games worth highlighting: the best ones among
+// those passing the filter, if any.
+type notableCriterion struct {
+	filter func(g notableGame) bool
+	better func(a, b notableGame) bool
+}
+
+var notableCriteria = map[string]notableCriterion{
+	notableHighestRated: {
+		better: func(a, b notableGame) bool {
+			return a.White.Rating+a.Black.Rating > b.White.Rating+b.Black.Rating
+		},
+	},
+	notableShortestDecisive: {
+		filter: func(g notableGame) bool {
+			return g.Result != resultDraw && g.Plies >= minDecisivePlies
+		},
+		better: func(a, b notableGame) bool {
+			return a.Plies < b.Plies
+		},
+	},
+	notableLongest: {
+		better: func(a, b notableGame) bool {
+			return a.Plies > b.Plies
+		},
+	},
+}
+
+// pickNotable returns up to n of the best games for a criterion among the
+// ones passing the filter, if any. Ties go to the most recent game.
+func pickNotable(games []notableGame, filter func(g notableGame) bool, better func(a, b notableGame) bool, n int) []notableGame {
+	picked := []notableGame{}
+	for i := len(games) - 1; i >= 0; i-- {
+		if filter == nil || filter(games[i]) {
+			picked = append(picked, games[i])
+		}
+	}
+	sort.SliceStable(picked, func(i, j int) bool {
+		return better(picked[i], picked[j])
+	})
+	if len(picked) > n {
+		picked = picked[:n]
+	}
+	return picked
+}
+
+var notableListing = listing{
+	filters: []param{
+		form("variant", "string", false, ""),
+		form("result", "string", false, "1-0, 0-1 or 1/2-1/2"),
+		form("player", "string", false, "Username of either player"),
+	},
+	defaultLimit: notableGamesPerCriterion,
+	unpaged:      true,
+}
+
+func (g notableGame) matches(filter, value string) bool {
+	switch filter {
+	case "variant":
+		return g.Variant == value
+	case "result":
+		return g.Result == value
+	case "player":
+		return g.White.Username == value || g.Black.Username == value
+	}
+	return true
+}
+
+// get returns the highlights for the criteria given, leaving out the games
+// that are no longer recent. Unless the query asks for the highlights as they
+// were picked, they are picked again among the games passing its filters.
+func (n *notableGames) get(criteria []string, q pageQuery) map[string][]notableGame {
+	n.m.Lock()
+	defer n.m.Unlock()
+	recent := func(games []notableGame) []notableGame {
+		list := []notableGame{}
+		for _, g := range games {
+			if time.Since(g.Finished) < notableWindow && q.matches(g) {
+				list = append(list, g)
+			}
+		}
+		return list
+	}
+	res := make(map[string][]notableGame)
+	for _, name := range criteria {
+		if len(q.filters) == 0 && q.limit == notableGamesPerCriterion {
+			res[name] = recent(n.reel[name])
+			continue
+		}
+		c := notableCriteria[name]
+		res[name] = pickNotable(recent(n.candidates), c.filter, c.better, q.limit)
+	}
+	return res
+}
+
+// keepGame records the finished game for analysis and replays and in the
+// histories of results of its players, has the timing of the moves of rated
+// games checked, and keeps the game for the highlight reel unless no move was
+// played, it's against the computer or one of its players is under shadow
+// restrictions.
+func (rout *router) keepGame(g finishedGame) {
+	if m, ok := rout.matches.get(g.gameId); ok {
+		g.control = m.control
+	}
+	g.finished = time.Now()
+	rout.analyses.keep(g)
+	rout.chainResults(g)
+	rout.stamps.touch(gamesStamp)
+	if g.rated {
+		go rout.checkMoveTimes(g)
+	}
+	if g.training || g.moves == nil {
+		return
+	}
+	for _, uid := range []string{g.white.id, g.black.id} {
+		if strings.HasPrefix(uid, engineUserPrefix) || rout.restricted(uid) {
+			return
+		}
+	}
+	white, black := rout.ratings.get(g.white.id), rout.ratings.get(g.black.id)
+	rout.notable.add(notableGame{
+		GameId:   g.gameId,
+		White:    tvPlayer{Username: g.white.username, Rating: int(white.Rating)},
+		Black:    tvPlayer{Username: g.black.username, Rating: int(black.Rating)},
+		Variant:  g.setup.variant().Name(),
+		Result:   g.result,
+		Plies:    len(g.moves),
+		Finished: g.finished,
+	})
+}
+
+// Games finished recently worth a look, for the front page: the ones between
+// the highest rated players, the shortest decisive ones and the longest
+// ones. The criteria parameter takes a comma separated list of them, all of
+// them by default.
+func (rout *router) handleNotableGames(w http.ResponseWriter, r *http.Request) {
+	q, err := notableListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	criteria := []string{notableHighestRated, notableShortestDecisive, notableLongest}
+	if c := r.FormValue("criteria"); c != "" {
+		criteria = strings.Split(c, ",")
+		for _, name := range criteria {
+			switch name {
+			case notableHighestRated, notableShortestDecisive, notableLongest:
+			default:
+				writeError(w, "Invalid criteria: " + name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	res := rout.notable.get(criteria, q)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
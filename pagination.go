@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var (
+	errInvalidLimit  = errors.New("Invalid limit")
+	errInvalidCursor = errors.New("Invalid cursor")
+	errCursorOrder   = errors.New("The cursor is for another order")
+)
+
+// listing describes how the items of a list endpoint can be paged through,
+// sorted and filtered. Every list endpoint takes the same parameters: limit,
+// cursor, sort, as the name of a field with a leading "-" for descending
+// order, and its filters by name.
+type listing struct {
+	// Fields the items can be sorted by, and the order of the list when the
+	// request doesn't ask for one.
+	sorts       []string
+	defaultSort string
+	// Filters, as query parameters.
+	filters []param
+	// Items per page when the request doesn't say, if not defaultPageSize.
+	defaultLimit int
+	// Whether the list is a single page, of up to limit items.
+	unpaged bool
+}
+
+// params describes the parameters of the listing, for the schema.
+func (l listing) params() []param {
+	params := []param{
+		form("limit", "int", false, "Items per page, up to " + strconv.Itoa(maxPageSize) +
+			"; " + strconv.Itoa(l.pageSize()) + " by default"),
+	}
+	if !l.unpaged {
+		params = append(params, form("cursor", "string", false, "nextCursor of the previous page"))
+	}
+	if len(l.sorts) > 0 {
+		params = append(params, form("sort", "string", false, "One of " +
+			strings.Join(l.sorts, ", ") + ", with a leading - for descending order; " +
+			l.defaultSort + " by default"))
+	}
+	return append(params, l.filters...)
+}
+
+func (l listing) pageSize() int {
+	if l.defaultLimit > 0 {
+		return l.defaultLimit
+	}
+	return defaultPageSize
+}
+
+// sortKey is the value an item is sorted by: a number or a string.
+type sortKey struct {
+	num float64
+	str string
+}
+
+func timeKey(t time.Time) sortKey {
+	return sortKey{num: float64(t.UnixNano())}
+}
+
+func (k sortKey) less(o sortKey) bool {
+	if k.num != o.num {
+		return k.num < o.num
+	}
+	return k.str < o.str
+}
+
+// filterable is an item of a list that can be filtered.
+type filterable interface {
+	// matches reports whether the item passes the filter with the value
+	// given.
+	matches(filter, value string) bool
+}
+
+// pageItem is an item of a list endpoint.
+type pageItem interface {
+	filterable
+	// pageId identifies the item in the list, breaking the ties of the
+	// order.
+	pageId() string
+	// sortKey returns the value of the field the list is sorted by.
+	sortKey(field string) sortKey
+}
+
+// pageCursor marks the last item of a page by the key it was sorted by and its
+// id, so that the next page starts right after it even if items were added or
+// removed meanwhile.
+type pageCursor struct {
+	Sort string  `json:"s"`
+	Num  float64 `json:"n,omitempty"`
+	Str  string  `json:"k,omitempty"`
+	Id   string  `json:"i"`
+}
+
+func (c pageCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// pageQuery is the page of a list asked for by a request.
+type pageQuery struct {
+	limit int
+	// Field sorted by, with a leading "-" for descending order.
+	sort    string
+	after   *pageCursor
+	filters map[string]string
+}
+
+// field returns the field sorted by and whether the order is descending.
+func (q pageQuery) field() (string, bool) {
+	return strings.TrimPrefix(q.sort, "-"), strings.HasPrefix(q.sort, "-")
+}
+
+// query reads the page asked for by the request.
+func (l listing) query(r *http.Request) (pageQuery, error) {
+	q := pageQuery{
+		limit:   l.pageSize(),
+		sort:    l.defaultSort,
+		filters: make(map[string]string),
+	}
+	if s := r.FormValue("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, errInvalidLimit
+		}
+		q.limit = n
+	}
+	if s := r.FormValue("sort"); s != "" {
+		valid := false
+		for _, field := range l.sorts {
+			if strings.TrimPrefix(s, "-") == field {
+				valid = true
+			}
+		}
+		if !valid {
+			return q, errors.New("Invalid sort: " + s)
+		}
+		q.sort = s
+	}
+	if s := r.FormValue("cursor"); s != "" && !l.unpaged {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+		if c.Sort != q.sort {
+			return q, errCursorOrder
+		}
+		q.after = &c
+	}
+	for _, f := range l.filters {
+		if v := r.FormValue(f.Name); v != "" {
+			q.filters[f.Name] = v
+		}
+	}
+	return q, nil
+}
+
+// matches reports whether the item passes every filter of the query.
+func (q pageQuery) matches(item filterable) bool {
+	for name, value := range q.filters {
+		if !item.matches(name, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// pageResponse is the body of the response with a page of the list under
+// the key given.
+func pageResponse(key string, items interface{}, next string) map[string]interface{} {
+	res := map[string]interface{}{key: items}
+	if next != "" {
+		res["nextCursor"] = next
+	}
+	return res
+}
+
+// paginate returns the page of the items asked for by the query, and the
+// cursor of the next one if there are more items.
+func paginate(items []pageItem, q pageQuery) ([]pageItem, string) {
+	field, desc := q.field()
+	list := make([]pageItem, 0, len(items))
+	for _, item := range items {
+		if q.matches(item) {
+			list = append(list, item)
+		}
+	}
+	before := func(ka sortKey, ida string, kb sortKey, idb string) bool {
+		if ka != kb {
+			return ka.less(kb) != desc
+		}
+		return ida < idb
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return before(list[i].sortKey(field), list[i].pageId(), list[j].sortKey(field), list[j].pageId())
+	})
+	start := 0
+	if c := q.after; c != nil {
+		key := sortKey{num: c.Num, str: c.Str}
+		start = sort.Search(len(list), func(i int) bool {
+			return before(key, c.Id, list[i].sortKey(field), list[i].pageId())
+		})
+	}
+	list = list[start:]
+	if len(list) <= q.limit {
+		return list, ""
+	}
+	list = list[:q.limit]
+	last := list[len(list) - 1]
+	key := last.sortKey(field)
+	next := pageCursor{Sort: q.sort, Num: key.num, Str: key.str, Id: last.pageId()}
+	return list, next.encode()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Panics recovered from, by where they happened.
+var panics = expvar.NewMap("panics")
+
+// reportPanic logs a recovered panic along with its stack and counts it.
+func reportPanic(log logger, where string, v interface{}) {
+	panics.Add(where, 1)
+	log.error("Recovered from panic", "where", where, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+}
+
+// recoverPanics is a middleware that answers with an internal error the
+// requests whose handler panics, instead of dropping the connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// The handler meant to abort the response.
+				panic(v)
+			}
+			reportPanic(requestLogger(r), "handler", v)
+			writeError(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// Result of a game being played, in PGN.
+const pgnOngoing = "*"
+
+// pgnEvent is what the PGN export needs to know of the messages sent to the
+// spectators.
+type pgnEvent struct {
+	Snapshot *struct {
+		White  string `json:"white"`
+		Black  string `json:"black"`
+		Pgn    string `json:"pgn"`
+		Result string `json:"result"`
+	} `json:"snapshot"`
+	Move *struct {
+		Pgn string `json:"pgn"`
+	} `json:"move"`
+	GameOver string `json:"gameOver"`
+}
+
+// pgnTags returns the tag pairs of a game.
+func pgnTags(s setup, white, black, result string) string {
+	return s.pgnHeaders() +
+		"[White \"" + white + "\"]\n" +
+		"[Black \"" + black + "\"]\n" +
+		"[Result \"" + result + "\"]\n\n"
+}
+
+// movetext returns the moves of the PGN sent by the players, formatted by
+// the server.
+func movetext(s setup, pgn string) (string, error) {
+	start, err := s.variant().Position(s.startFEN())
+	if err != nil {
+		return "", err
+	}
+	_, moves, err := rules.ParsePGN(start, pgn)
+	if err != nil {
+		return "", err
+	}
+	return rules.FormatMoves(start, moves), nil
+}
+
+// finished returns the game, if it finished recently.
+func (s *analysisStore) finished(gameId string) (finishedGame, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, ok := s.games[gameId]
+	if !ok {
+		return finishedGame{}, false
+	}
+	return a.game, true
+}
+
+// recent returns the games finished recently, in the order they finished.
+func (s *analysisStore) recent() []finishedGame {
+	s.m.Lock()
+	defer s.m.Unlock()
+	games := make([]finishedGame, 0, len(s.order))
+	for _, id := range s.order {
+		games = append(games, s.games[id].game)
+	}
+	return games
+}
+
+// Get the PGN of a game being played or recently finished. With live=1 the
+// response to a game being played stays open: its moves are appended as they
+// are played, as spectators see them, and the result once it ends. The
+// response ends early on a takeback or a rematch, and after a while as the
+// game stream; tools go on asking for it again.
+func (rout *router) handleGamePGN(w http.ResponseWriter, r *http.Request) {
+	gameId := mux.Vars(r)["id"]
+	m, ok := rout.matches.get(gameId)
+	room, hosted := rout.rm.live.get(gameId)
+	if !ok || !hosted {
+		g, ok := rout.analyses.finished(gameId)
+		if !ok {
+			writeError(w, "Game not found", http.StatusNotFound)
+			return
+		}
+		moves, err := movetext(g.setup, g.pgn)
+		if err != nil {
+			requestLogger(r).warn("Could not read the PGN of the game", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-chess-pgn")
+		pgn := pgnTags(g.setup, g.white.username, g.black.username, g.result) + moves + " " + g.result + "\n"
+		if _, err := w.Write([]byte(pgn)); err != nil {
+			requestLogger(r).error("Could not write response", "err", err)
+		}
+		return
+	}
+	live := r.FormValue("live") == "1"
+	flusher, ok := w.(http.Flusher)
+	if live && !ok {
+		writeError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	wt := &watcher{
+		room: room,
+		send: make(chan []byte, watcherBufferSize),
+	}
+	select {
+	case room.watch<- wt:
+	case <-room.closed:
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	defer room.leave(wt)
+
+	var window <-chan time.Time
+	if live && conf.WriteTimeout > 0 {
+		t := time.NewTimer(streamWindow())
+		defer t.Stop()
+		window = t.C
+	}
+	w.Header().Set("Content-Type", "application/x-chess-pgn")
+	// Moves written so far.
+	written := ""
+	started := false
+	for {
+		select {
+		case data, ok := <-wt.send:
+			if !ok {
+				return
+			}
+			var ev pgnEvent
+			if err := json.Unmarshal(data, &ev); err != nil {
+				requestLogger(r).error("Could not unmarshal PGN event", "err", err)
+				return
+			}
+			var text string
+			switch {
+			case ev.Snapshot != nil && !started:
+				s := ev.Snapshot
+				moves, err := movetext(m.setup, s.Pgn)
+				if err != nil {
+					requestLogger(r).warn("Could not read the PGN of the game", "err", err)
+					writeError(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				result := s.Result
+				if result == "" {
+					result = pgnOngoing
+				}
+				text = pgnTags(m.setup, s.White, s.Black, result) + moves
+				if s.Result != "" || !live {
+					w.Write([]byte(text + " " + result + "\n"))
+					return
+				}
+				started, written = true, moves
+			case ev.Snapshot != nil:
+				// Spectators beyond the cap of the room only get the state
+				// of the game. It ends the response if the game was taken
+				// back or started over.
+				moves, err := movetext(m.setup, ev.Snapshot.Pgn)
+				if err != nil || !strings.HasPrefix(moves, written) {
+					w.Write([]byte("\n"))
+					return
+				}
+				text, written = moves[len(written):], moves
+				if ev.Snapshot.Result != "" {
+					w.Write([]byte(text + " " + ev.Snapshot.Result + "\n"))
+					return
+				}
+			case ev.Move != nil:
+				moves, err := movetext(m.setup, ev.Move.Pgn)
+				if err != nil || !strings.HasPrefix(moves, written) {
+					w.Write([]byte("\n"))
+					return
+				}
+				text, written = moves[len(written):], moves
+			case ev.GameOver != "":
+				w.Write([]byte(" " + ev.GameOver + "\n"))
+				return
+			default:
+				continue
+			}
+			if _, err := w.Write([]byte(text)); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-window:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -6,26 +6,15 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
-)
-
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	"github.com/luisguve/princechess-server/internal/clock"
+	"github.com/luisguve/princechess-server/internal/game"
+	"github.com/luisguve/princechess-server/internal/protocol"
 )
 
 var (
@@ -36,7 +25,8 @@ var (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(_ *http.Request) bool {return true},
+	CheckOrigin: checkOrigin,
+	Error:       upgradeError,
 }
 
 // player is a middleman between the websocket connection and the hub.
@@ -44,11 +34,14 @@ type player struct {
 	room *Room
 
 	// The websocket connection.
-	conn *websocket.Conn
+	conn protocol.Conn
 
 	// Events channels
 	sendMove   chan []byte
 	sendChat   chan message
+	// Events besides the moves: progress of analyses and pieces passed in
+	// bughouse
+	sendEvent  chan []byte
 	oppRanOut  chan bool
 	disconnect chan bool
 
@@ -65,34 +58,97 @@ type player struct {
 
 	cleanup      func()
 	switchColors func()
+	recordResult func(g finishedGame)
+	recordGame   func(g finishedGame)
+	recordAbandonment func(uid, gameId string)
+	// Returns the notice for the user if they are banned from the chat of
+	// the game.
+	silenced func(uid string) (notice, bool)
+	// Sends the events of the game to its spectators
+	tellSpectators func(payload interface{})
+	bughouse     *bughouseBoard
+	training     bool
 	color        string
 	gameId       string
-	timeLeft     time.Duration
-	clock        *time.Timer
-	lastMove     time.Time
+	// Time the player starts each game with, and has left
+	game.Clock
+	increment    time.Duration
+	setup        setup
+	rated        bool
+	clock        clock.Timer
 	username     string
 	userId       string
+	lang         string
+	log          logger
 }
 
 type move struct {
 	Color string `json:"color"`
 	Pgn   string `json:"pgn"`
-	move  []byte
+	// In bughouse, the piece captured by the move and the piece dropped
+	// instead of moving, if any.
+	Capture string `json:"capture,omitempty"`
+	Drop    string `json:"drop,omitempty"`
 }
 
 // Chat message
 type message struct {
-	Move          move   `json:"move,omitempty"`
+	Move          move             `json:"move,omitempty"`
+	Premove       string           `json:"premove,omitempty"`
+	CancelPremove bool             `json:"cancelPremove"`
+	Takeback      bool             `json:"takeback"`
+	Hint          bool             `json:"hint"`
+	Blindfold     bool             `json:"blindfold"`
+	Text          string           `json:"chat"`
+	Username      string           `json:"from"`
+	Resign        bool             `json:"resign"`
+	DrawOffer     bool             `json:"drawOffer"`
+	AcceptDraw    bool             `json:"acceptDraw"`
+	GameOver      bool             `json:"gameOver"`
+	Result        string           `json:"result,omitempty"`
+	RematchOffer  bool             `json:"rematchOffer"`
+	AcceptRematch bool             `json:"acceptRematch"`
+	FinishRoom    bool             `json:"finishRoom"`
+	ChatError     *localizedNotice `json:"chatError,omitempty"`
+	userId        string
+}
+
+// playerMessage is a message from the player, holding a single action.
+type playerMessage struct {
+	Move          *move  `json:"move"`
+	Premove       string `json:"premove"`
+	CancelPremove bool   `json:"cancelPremove"`
+	Takeback      bool   `json:"takeback"`
+	Hint          bool   `json:"hint"`
+	Blindfold     bool   `json:"blindfold"`
 	Text          string `json:"chat"`
-	Username      string `json:"from"`
 	Resign        bool   `json:"resign"`
 	DrawOffer     bool   `json:"drawOffer"`
 	AcceptDraw    bool   `json:"acceptDraw"`
 	GameOver      bool   `json:"gameOver"`
+	Result        string `json:"result"`
 	RematchOffer  bool   `json:"rematchOffer"`
 	AcceptRematch bool   `json:"acceptRematch"`
 	FinishRoom    bool   `json:"finishRoom"`
-	userId        string
+}
+
+// validate checks the fields required by the action of the message.
+func (m playerMessage) validate() error {
+	if m.Move != nil {
+		if m.Move.Color != "w" && m.Move.Color != "b" {
+			return errors.New(`move: color must be "w" or "b"`)
+		}
+		if m.Move.Pgn == "" {
+			return errors.New("move: missing pgn")
+		}
+	}
+	if m.GameOver && !validResult(m.Result) {
+		return errors.New("gameOver: result must be 1-0, 0-1 or 1/2-1/2")
+	}
+	if !m.GameOver && m.Result != "" {
+		return errors.New("result without gameOver")
+	}
+	return nil
 }
 
 // readPump pumps messages from the websocket connection to the room's hub.
@@ -108,35 +164,63 @@ func (p *player) readPump() {
 		p.sendMove = nil
 		p.conn.Close()
 	}()
-	p.conn.SetReadLimit(maxMessageSize)
-	p.conn.SetReadDeadline(time.Now().Add(pongWait))
-	p.conn.SetPongHandler(func(string) error { p.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	defer func() {
+		if v := recover(); v != nil {
+			reportPanic(p.log, "player", v)
+		}
+	}()
+	p.conn.SetReadLimit(conf.MaxFrameSize)
+	p.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	p.conn.SetPongHandler(func(string) error { p.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
 	for {
-		_, msg, err := p.conn.ReadMessage()
+		msg, oversized, err := readMessage(p.conn)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway,
 				websocket.CloseAbnormalClosure,
 				websocket.CloseNormalClosure,
 			) {
-				log.Printf("%v player connection is gone with error: %v", p.color, err)
+				p.log.warn("Player connection is gone", "err", err)
 			}
 			break
 		}
-		// Unmarshal message just to get the color.
-		m := message{}
-		if err = json.Unmarshal(msg, &m); err != nil {
-			log.Println("Could not unmarshal msg:", err)
-			break
+		if oversized {
+			p.chatError(newNotice(noticeMessageTooLong))
+			continue
+		}
+		m := playerMessage{}
+		if err = protocol.Decode(msg, &m); err == nil {
+			err = m.validate()
+		}
+		if err != nil {
+			p.chatError(newNotice(noticeInvalidMessage, err))
+			continue
 		}
 		switch {
-		case m.Move.Color != "":
+		case m.Move != nil:
 			// It's a move
-			m.Move.move = msg
-			p.room.broadcastMove<- m.Move
+			if m.Move.Color != p.color[:1] {
+				p.chatError(newNotice(noticeInvalidMessage, "the move is not of your color"))
+				break
+			}
+			p.room.broadcastMove<- *m.Move
+		case m.Premove != "":
+			p.room.broadcastPremove<- premove{color: p.color[:1], uci: m.Premove}
+		case m.CancelPremove:
+			p.room.broadcastPremove<- premove{color: p.color[:1]}
+		case m.Takeback:
+			p.room.broadcastTakeback<- p.color
+		case m.Hint:
+			p.room.requestHint<- p.color
+		case m.Blindfold:
+			p.room.broadcastBlindfold<- p.color
 		case m.Text != "":
 			// It's a chat message
 			text := strings.TrimSpace(strings.Replace(m.Text, newline, space, -1))
+			if len([]rune(text)) > conf.maxChatLength() {
+				p.chatError(newNotice(noticeChatTooLong, conf.maxChatLength()))
+				break
+			}
 			p.room.broadcastChat<- message{
 				Text:     text,
 				Username: p.username,
@@ -149,7 +233,7 @@ func (p *player) readPump() {
 		case m.AcceptDraw:
 			p.room.broadcastAcceptDraw<- p.color
 		case m.GameOver:
-			p.room.stopClocks<- true
+			p.room.stopClocks<- m.Result
 		case m.RematchOffer:
 			p.room.broadcastRematchOffer<- p.color
 		case m.AcceptRematch:
@@ -157,29 +241,55 @@ func (p *player) readPump() {
 		case m.FinishRoom:
 			return
 		default:
-			log.Println("Unexpected message", m)
+			p.chatError(newNotice(noticeInvalidMessage, "no action in the message"))
 		}
 	}
 }
 
+// chatError tells the player why their message, chat or otherwise, was not
+// delivered.
+func (p *player) chatError(reason notice) {
+	n := reason.localize(p.lang)
+	select {
+	case p.sendChat<- message{ChatError: &n}:
+	default:
+	}
+}
+
 // writePump pumps messages from the room's hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (p *player) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(conf.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		p.conn.Close()
 	}()
+	defer func() {
+		if v := recover(); v != nil {
+			reportPanic(p.log, "player", v)
+		}
+	}()
+	if !p.setup.standard() {
+		// Tell the client where the pieces start, on every connection.
+		data := map[string]interface{}{
+			"setup":      p.setup,
+			"pgnHeaders": p.setup.pgnHeaders(),
+		}
+		if err := protocol.SendText(p.conn, data, conf.WriteWait); err != nil {
+			p.log.error("Could not send setup", "err", err)
+			return
+		}
+	}
 	for {
 		select {
 		case <-p.disconnect:
 			// Finish this goroutine to not to send messages anymore
 			return
 		case move, ok := <-p.sendMove: // Opponent moved a piece
-			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 			if !ok {
 				// The hub closed the channel.
 				payload := websocket.FormatCloseMessage(1001, "")
@@ -196,8 +306,14 @@ func (p *player) writePump() {
 			if err := w.Close(); err != nil {
 				return
 			}
+		case data := <-p.sendEvent: // Analysis progress, bughouse pieces
+			p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := p.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				p.log.error("Could not send event", "err", err)
+				return
+			}
 		case msg, ok := <-p.sendChat: // Chat msg
-			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 			if !ok {
 				// The hub closed the channel.
 				p.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -210,13 +326,13 @@ func (p *player) writePump() {
 
 			msgB, err := json.Marshal(msg)
 			if err != nil {
-				log.Println("Could not marshal data:", err)
+				p.log.error("Could not marshal data", "err", err)
 				break
 			}
 
 			w, err := p.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
-				log.Println("Could not make next writer:", err)
+				p.log.error("Could not make next writer", "err", err)
 				return
 			}
 			w.Write(msgB)
@@ -230,7 +346,7 @@ func (p *player) writePump() {
 				}
 				msgB, err := json.Marshal(msg)
 				if err != nil {
-					log.Println("Could not marshal data:", err)
+					p.log.error("Could not marshal data", "err", err)
 					break
 				}
 				w.Write([]byte(newline))
@@ -238,16 +354,16 @@ func (p *player) writePump() {
 			}
 
 			if err := w.Close(); err != nil {
-				log.Println("Could not close writer:", err)
+				p.log.error("Could not close writer", "err", err)
 				return
 			}
 		case <-ticker.C: // ping
-			p.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
 			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Println("Could not ping:", err)
+				p.log.error("Could not ping", "err", err)
 				return
 			}
-		case <-p.clock.C: // Player ran out ouf time
+		case <-p.clock.C(): // Player ran out ouf time
 			// Inform the opponent about this
 			p.room.broadcastNoTime<- p.color
 
@@ -255,7 +371,7 @@ func (p *player) writePump() {
 				"OOT": "MY_CLOCK",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppRanOut: // Opponent ran out ouf time
@@ -263,7 +379,7 @@ func (p *player) writePump() {
 				"OOT": "OPP_CLOCK",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.drawOffer: // Opponent offered draw
@@ -271,7 +387,7 @@ func (p *player) writePump() {
 				"drawOffer": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppAcceptedDraw: // opponent accepted draw
@@ -279,7 +395,7 @@ func (p *player) writePump() {
 				"oppAcceptedDraw": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppResigned: // opponent resigned
@@ -287,7 +403,7 @@ func (p *player) writePump() {
 				"oppResigned": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.rematchOffer: // Opponent offered rematch
@@ -295,7 +411,7 @@ func (p *player) writePump() {
 				"rematchOffer": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppAcceptedRematch: // opponent accepted rematch
@@ -303,7 +419,7 @@ func (p *player) writePump() {
 				"oppAcceptedRematch": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppReady: // opponent ready
@@ -311,7 +427,7 @@ func (p *player) writePump() {
 				"oppReady": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppDisconnected: // opponent disconnected
@@ -319,7 +435,7 @@ func (p *player) writePump() {
 				"waitingOpp": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppReconnected: // opponent reconnected
@@ -327,7 +443,7 @@ func (p *player) writePump() {
 				"oppReady": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		case <-p.oppGone: // opponent is gone
@@ -335,51 +451,64 @@ func (p *player) writePump() {
 				"oppGone": "true",
 			}
 			if err := sendTextMsg(data, p.conn); err != nil {
-				log.Println("Could not send text msg:", err)
+				p.log.error("Could not send text msg", "err", err)
 				return
 			}
 		}
 	}
 }
 
-// JSON-marshal and send message to the connection.
-func sendTextMsg(data map[string]string, conn *websocket.Conn) error {
-	dataB, err := json.Marshal(data)
-	if err != nil {
-		return err
-	}
-
-	conn.SetWriteDeadline(time.Now().Add(writeWait))
-
-	w, err := conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		return err
-	}
-	w.Write(dataB)
+// readMessage reads the next data message from the connection, reporting
+// the ones longer than the maximum message size as oversized.
+func readMessage(conn protocol.Conn) (msg []byte, oversized bool, err error) {
+	return protocol.ReadMessage(conn, conf.MaxMessageSize)
+}
 
-	return w.Close()
+// JSON-marshal and send message to the connection.
+func sendTextMsg(data map[string]string, conn protocol.Conn) error {
+	return protocol.SendText(conn, data, conf.WriteWait)
 }
 
 // serveGame handles websocket requests from the peer.
 func (rout *router) serveGame(w http.ResponseWriter, r *http.Request,
-	gameId, color string, minutes int, cleanup, switchColors func(),
+	gameId, color string, control timeControl, base time.Duration, setup setup, rated bool, cleanup, switchColors func(),
 	username, userId string) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Could not upgrade conn", http.StatusInternalServerError)
+	conn := upgrade(w, r)
+	if conn == nil {
 		return
 	}
-	playerClock := time.NewTimer(time.Duration(minutes) * time.Minute)
+	if !rout.admitConn(userId, conn, r) {
+		return
+	}
+	p := rout.newPlayer(conn, gameId, color, control, base, setup, rated, cleanup, switchColors,
+		username, userId, requestLanguage(r), requestLogger(r).with("game", gameId, "color", color, "uid", userId))
+	rout.seat(p, control)
+
+	// Allow collection of memory referenced by the caller by doing all work in
+	// new goroutines.
+	go p.writePump()
+	go func() {
+		p.readPump()
+		rout.conns.remove(userId, conn)
+	}()
+
+	rout.ldHub.joinPlayer<- userId
+}
+
+// newPlayer sets up a player of the game talking through the connection.
+func (rout *router) newPlayer(conn protocol.Conn,
+	gameId, color string, control timeControl, base time.Duration, setup setup, rated bool, cleanup, switchColors func(),
+	username, userId, lang string, log logger) *player {
+	playerClock := rout.rm.clock.NewTimer(base)
 	playerClock.Stop()
-	p := &player{
+	return &player{
 		cleanup:            cleanup,
 		clock:              playerClock,
 		color:              color,
 		conn:               conn,
 		gameId:             gameId,
 		oppRanOut:          make(chan bool, 1),
-		disconnect:         make(chan bool),
+		disconnect:         make(chan bool, 1),
 		drawOffer:          make(chan bool, 1),
 		oppAcceptedDraw:    make(chan bool, 1),
 		oppResigned:        make(chan bool, 1),
@@ -391,30 +520,33 @@ func (rout *router) serveGame(w http.ResponseWriter, r *http.Request,
 		oppReconnected:     make(chan bool, 1),
 		sendMove:           make(chan []byte, 2), // one for the clock, one for the move
 		sendChat:           make(chan message, 128),
+		sendEvent:          make(chan []byte, 8),
 		switchColors:       switchColors,
-		timeLeft:           time.Duration(minutes) * time.Minute,
+		recordResult:       rout.recordResult,
+		recordGame:         rout.keepGame,
+		recordAbandonment:  rout.recordAbandonment,
+		silenced:           func(uid string) (notice, bool) {
+			return rout.silenced(uid, gameId)
+		},
+		bughouse:           rout.bughouse.board(gameId),
+		training:           rout.matches.training(gameId),
+		tellSpectators:     func(payload interface{}) {
+			rout.spectatorChats.announce(gameId, payload)
+		},
+		Clock:              game.NewClock(base),
+		increment:          control.increment,
+		setup:              setup,
+		rated:              rated,
 		userId:             userId,
 		username:           username,
+		lang:               lang,
+		log:                log,
 	}
-	switch minutes {
-	case 1:
-		rout.rm.registerPlayer1Min<- p
-	case 3:
-		rout.rm.registerPlayer3Min<- p
-	case 5:
-		rout.rm.registerPlayer5Min<- p
-	case 10:
-		rout.rm.registerPlayer10Min<- p
-	default:
-		log.Println("Invalid clock time:", minutes)
-		http.Error(w, "Invalid clock time", http.StatusBadRequest)
-		return
-	}
-
-	// Allow collection of memory referenced by the caller by doing all work in
-	// new goroutines.
-	go p.writePump()
-	go p.readPump()
+}
 
-	rout.ldHub.joinPlayer<- userId
+// seat registers the player in the room of their game, which starts once
+// both players are in. Both players of a game must be seated with the time
+// control of the match, which picks the listener of the room matcher.
+func (rout *router) seat(p *player, control timeControl) {
+	rout.rm.pool(control).register<- p
 }
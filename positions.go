@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// legalMove is a legal move of a position, in UCI notation and in SAN.
+type legalMove struct {
+	UCI string `json:"uci"`
+	SAN string `json:"san"`
+}
+
+// Check a position set up in an editor, given in FEN, under the rules of the
+// variant, standard by default. Legal positions come back normalized, with
+// the side to move, whether the game is over there and the legal moves;
+// illegal ones with the reason.
+func (rout *router) handleValidatePosition(w http.ResponseWriter, r *http.Request) {
+	fen := r.FormValue("fen")
+	if fen == "" {
+		writeError(w, "Missing FEN", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("variant")
+	if name == "" {
+		name = variantStandard
+	}
+	if !validVariant(name) {
+		writeError(w, "Invalid variant: " + name, http.StatusBadRequest)
+		return
+	}
+	v := setup{Variant: name}.variant()
+	var res map[string]interface{}
+	pos, err := v.Position(fen)
+	if err != nil {
+		res = map[string]interface{}{
+			"legal": false,
+			"error": err.Error(),
+		}
+	} else {
+		turn := "white"
+		if pos.Turn() == rules.Black {
+			turn = "black"
+		}
+		moves := []legalMove{}
+		for _, m := range v.LegalMoves(pos) {
+			moves = append(moves, legalMove{UCI: m.String(), SAN: pos.SAN(m)})
+		}
+		result, status := v.Outcome(pos)
+		if status == "" {
+			status = rules.Ongoing
+		}
+		res = map[string]interface{}{
+			"legal":   true,
+			"variant": v.Name(),
+			"fen":     pos.FEN(),
+			"turn":    turn,
+			"inCheck": pos.InCheck(),
+			"status":  status,
+			"moves":   moves,
+		}
+		if result != "" {
+			res["result"] = result
+		}
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
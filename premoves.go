@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// premove is a move sent by the player not on turn, to be played as soon as
+// their opponent moves. An empty move cancels the premove of the player.
+type premove struct {
+	// "w" or "b", as in the moves.
+	color string
+	uci   string
+}
+
+// onTurn returns the color of the player on turn.
+func (r *Room) onTurn() string {
+	if r.lastMover == "w" {
+		return "b"
+	}
+	return "w"
+}
+
+// setPremove keeps the premove of the player, replacing the one they had.
+// If the opponent moved while it was on its way, it is played right away.
+func (r *Room) setPremove(pm premove) {
+	if pm.uci == "" {
+		if r.premoveColor == pm.color {
+			r.premove, r.premoveColor = "", ""
+		}
+		return
+	}
+	if r.result != "" || r.waitingPlayer || r.bughouse != nil {
+		r.discardPremove(pm.color)
+		return
+	}
+	r.premove, r.premoveColor = pm.uci, pm.color
+	r.playPremove()
+}
+
+// playPremove plays the premove of the player on turn if it's legal in the
+// position reached, and discards it otherwise. The player's clock barely
+// runs, since the move is relayed right after the opponent's one.
+func (r *Room) playPremove() {
+	if r.premove == "" || r.premoveColor != r.onTurn() {
+		return
+	}
+	uci, color := r.premove, r.premoveColor
+	r.premove, r.premoveColor = "", ""
+
+	setup := r.white.setup
+	start, pos, moves, err := r.position()
+	if err != nil {
+		r.log.warn("Could not follow the game for the premove", "err", err)
+		r.discardPremove(color)
+		return
+	}
+	m, err := pos.ParseMove(uci)
+	if err != nil {
+		// No longer legal.
+		r.discardPremove(color)
+		return
+	}
+	pm := move{
+		Color: color,
+		Pgn:   setup.pgnHeaders() + rules.FormatMoves(start, append(moves, m)),
+	}
+	r.relayMove(pm, true)
+}
+
+// discardPremove tells the player their premove was not played.
+func (r *Room) discardPremove(color string) {
+	p := r.white
+	if color == "b" {
+		p = r.black
+	}
+	data, err := json.Marshal(map[string]string{
+		"premove": "discarded",
+	})
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	select {
+	case p.sendMove<- data:
+	default:
+		r.drop("premove")
+	}
+}
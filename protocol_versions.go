@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// Layout of the date a version of the protocol stops being served.
+const sunsetLayout = "2006-01-02"
+
+// Code of the error responses to the websocket handshakes announcing a
+// version of the protocol the server doesn't speak.
+const errorUnsupportedProtocol = "UNSUPPORTED_PROTOCOL"
+
+// protocolVersion returns the version of the protocol announced by the client
+// in the protocol parameter of the handshake, protocol.Version1 if none.
+func protocolVersion(r *http.Request) (int, error) {
+	v := r.FormValue("protocol")
+	if v == "" {
+		return protocol.Version1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || !protocol.Supports(n) {
+		supported := make([]string, len(protocol.Supported))
+		for i, v := range protocol.Supported {
+			supported[i] = strconv.Itoa(v)
+		}
+		return 0, errors.New("Unsupported protocol version " + v + "; the server speaks " +
+			strings.Join(supported, ", "))
+	}
+	return n, nil
+}
+
+// upgrade upgrades the connection to a websocket once the version of the
+// protocol announced by the client is known to be spoken, and tells the client
+// the versions the server speaks, warning it if its own is deprecated. It
+// responds with an error and returns nil if the handshake fails.
+func upgrade(w http.ResponseWriter, r *http.Request) *websocket.Conn {
+	version, err := protocolVersion(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: errorUnsupportedProtocol, Message: err.Error()})
+		return nil
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		requestLogger(r).error("Could not upgrade connection", "err", err)
+		return nil
+	}
+	hello := map[string]interface{}{
+		"version":   version,
+		"current":   protocol.Current,
+		"supported": protocol.Supported,
+	}
+	sunset, deprecated := conf.protocolSunset(version)
+	if deprecated {
+		hello["deprecated"] = true
+		hello["sunset"] = sunset
+	}
+	if err := protocol.SendText(conn, map[string]interface{}{"protocol": hello}, conf.WriteWait); err != nil {
+		requestLogger(r).warn("Could not greet the client", "err", err)
+	}
+	if deprecated {
+		ev := noticeEvent{key: "protocolDeprecated", notice: newNotice(noticeProtocolDeprecated, sunset)}
+		if err := protocol.SendText(conn, ev.localize(requestLanguage(r)), conf.WriteWait); err != nil {
+			requestLogger(r).warn("Could not warn the client", "err", err)
+		}
+	}
+	return conn
+}
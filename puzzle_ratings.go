@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	puzzleRatingsFile = "puzzle_ratings.json"
+
+	// Glicko ratings and deviations puzzles and players start with.
+	defaultPuzzleRating = 1500
+	defaultPuzzleRD     = 350
+	// Deviations never shrink below this, so that ratings keep moving.
+	minPuzzleRD = 50
+
+	// Rating of the first puzzle of a streak and how much harder each of
+	// the next ones gets.
+	streakStartRating = 1000
+	streakStep        = 50
+)
+
+// glicko is a Glicko rating.
+type glicko struct {
+	Rating float64 `json:"rating"`
+	RD     float64 `json:"rd"`
+}
+
+func newGlicko() glicko {
+	return glicko{Rating: defaultPuzzleRating, RD: defaultPuzzleRD}
+}
+
+// update returns the rating after a game against the opponent, scoring 1 for
+// a win and 0 for a loss.
+func (g glicko) update(opp glicko, score float64) glicko {
+	const q = math.Ln10 / 400
+	gOpp := 1 / math.Sqrt(1+3*q*q*opp.RD*opp.RD/(math.Pi*math.Pi))
+	expected := 1 / (1 + math.Pow(10, -gOpp*(g.Rating-opp.Rating)/400))
+	d2 := 1 / (q * q * gOpp * gOpp * expected * (1 - expected))
+	variance := 1 / (1/(g.RD*g.RD) + 1/d2)
+	return glicko{
+		Rating: g.Rating + q*variance*gOpp*(score-expected),
+		RD:     math.Max(math.Sqrt(variance), minPuzzleRD),
+	}
+}
+
+// puzzleStats is how a user does in puzzles.
+type puzzleStats struct {
+	glicko
+	Attempts int `json:"attempts"`
+	Solved   int `json:"solved"`
+	// Puzzles solved in a row in the current streak, and in the best one.
+	Streak     int `json:"streak"`
+	BestStreak int `json:"bestStreak"`
+}
+
+// stats returns the puzzle rating and streaks of the user.
+func (s *puzzleStore) stats(uid string) puzzleStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if st, ok := s.ratings[uid]; ok {
+		return *st
+	}
+	return puzzleStats{glicko: newGlicko()}
+}
+
+// rate updates the ratings of the user and the puzzle with the result of the
+// first try of the user, and their streak if they are on one. The caller must
+// hold the lock.
+func (s *puzzleStore) rate(uid string, p *puzzle, solved, streak bool) {
+	st, ok := s.ratings[uid]
+	if !ok {
+		st = &puzzleStats{glicko: newGlicko()}
+		s.ratings[uid] = st
+	}
+	if p.RD == 0 {
+		p.glicko = newGlicko()
+	}
+	score := 0.0
+	if solved {
+		score = 1
+	}
+	st.glicko, p.glicko = st.update(p.glicko, score), p.update(st.glicko, 1-score)
+	st.Attempts++
+	if solved {
+		st.Solved++
+	}
+	if streak {
+		if solved {
+			st.Streak++
+		} else {
+			st.Streak = 0
+		}
+		if st.Streak > st.BestStreak {
+			st.BestStreak = st.Streak
+		}
+	}
+}
+
+// nextInStreak returns the next puzzle of the streak of the user: one they
+// haven't tried, as hard as the streak is long.
+func (s *puzzleStore) nextInStreak(uid string) (puzzle, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	target := float64(streakStartRating)
+	if st, ok := s.ratings[uid]; ok {
+		target += float64(streakStep * st.Streak)
+	}
+	var untried []*puzzle
+	for id, p := range s.puzzles {
+		if _, tried := s.history[uid][id]; !tried {
+			untried = append(untried, p)
+		}
+	}
+	if len(untried) == 0 {
+		return puzzle{}, errNoPuzzles
+	}
+	sort.Slice(untried, func(i, j int) bool {
+		if untried[i].rating() != untried[j].rating() {
+			return untried[i].rating() < untried[j].rating()
+		}
+		return untried[i].Id < untried[j].Id
+	})
+	for _, p := range untried {
+		if p.rating() >= target {
+			return *p, nil
+		}
+	}
+	return *untried[len(untried)-1], nil
+}
+
+// rating returns the rating of the puzzle, the default one if nobody tried it
+// yet.
+func (p *puzzle) rating() float64 {
+	if p.RD == 0 {
+		return defaultPuzzleRating
+	}
+	return p.Rating
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/luisguve/princechess-server/internal/rules"
+	idGen "github.com/rs/xid"
+)
+
+const (
+	puzzlesFile       = "puzzles.json"
+	puzzleHistoryFile = "puzzle_history.json"
+)
+
+var (
+	errPuzzleNotFound = errors.New("Puzzle not found")
+	errNoPuzzles      = errors.New("There are no puzzles yet")
+	errEmptySolution  = errors.New("Empty solution")
+)
+
+// puzzle is a position with a single winning line. The player on turn plays
+// the first move of the solution, and the moves in between are the replies
+// of the opponent.
+type puzzle struct {
+	Id       string    `json:"id"`
+	FEN      string    `json:"fen"`
+	Solution []string  `json:"solution"`
+	Themes   []string  `json:"themes,omitempty"`
+	Created  time.Time `json:"created"`
+	// Difficulty, rated against the users trying the puzzle.
+	glicko
+}
+
+// puzzleResult is how a user did in a puzzle. Only the first try counts.
+type puzzleResult struct {
+	Puzzle string    `json:"puzzle"`
+	Solved bool      `json:"solved"`
+	At     time.Time `json:"at"`
+}
+
+var puzzleHistoryListing = listing{
+	sorts:       []string{"at"},
+	defaultSort: "-at",
+	filters:     []param{form("solved", "bool", false, "")},
+}
+
+func (res puzzleResult) pageId() string {
+	return res.Puzzle
+}
+
+func (res puzzleResult) sortKey(field string) sortKey {
+	return timeKey(res.At)
+}
+
+func (res puzzleResult) matches(filter, value string) bool {
+	if filter == "solved" {
+		return strconv.FormatBool(res.Solved) == value
+	}
+	return true
+}
+
+// puzzleStore keeps the puzzles, the results of the users in them and their
+// puzzle ratings, persisted to the data directory.
+type puzzleStore struct {
+	m       *sync.Mutex
+	puzzles map[string]*puzzle
+	// Results by uid and puzzle id.
+	history map[string]map[string]puzzleResult
+	ratings map[string]*puzzleStats
+}
+
+func newPuzzleStore() (*puzzleStore, error) {
+	s := &puzzleStore{
+		m:       &sync.Mutex{},
+		puzzles: make(map[string]*puzzle),
+		history: make(map[string]map[string]puzzleResult),
+		ratings: make(map[string]*puzzleStats),
+	}
+	if err := loadJSON(puzzlesFile, &s.puzzles); err != nil {
+		return nil, err
+	}
+	if err := loadJSON(puzzleHistoryFile, &s.history); err != nil {
+		return nil, err
+	}
+	if err := loadJSON(puzzleRatingsFile, &s.ratings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// validate checks that the solution can be played from the position.
+func (p puzzle) validate() error {
+	if len(p.Solution) == 0 {
+		return errEmptySolution
+	}
+	pos, err := rules.ParseFEN(p.FEN)
+	if err != nil {
+		return err
+	}
+	for _, m := range p.Solution {
+		if pos, err = pos.PlayUCI(m); err != nil {
+			return errors.New("Invalid solution: " + m + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// add stores a new puzzle, returning it with its id.
+func (s *puzzleStore) add(p puzzle) (puzzle, error) {
+	p.Id = idGen.New().String()
+	p.Created = time.Now()
+	p.glicko = newGlicko()
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.puzzles[p.Id] = &p
+	return p, saveJSON(puzzlesFile, s.puzzles)
+}
+
+func (s *puzzleStore) get(id string) (puzzle, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.puzzles[id]
+	if !ok {
+		return puzzle{}, false
+	}
+	return *p, true
+}
+
+// daily returns the puzzle of the day. Every node picks the same one, going
+// through the puzzles in the order they were added.
+func (s *puzzleStore) daily(now time.Time) (puzzle, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.puzzles) == 0 {
+		return puzzle{}, errNoPuzzles
+	}
+	ids := make([]string, 0, len(s.puzzles))
+	for id := range s.puzzles {
+		ids = append(ids, id)
+	}
+	// Ids grow with the time they were made at.
+	sort.Strings(ids)
+	day := now.UTC().Unix() / int64(24*time.Hour/time.Second)
+	return *s.puzzles[ids[day%int64(len(ids))]], nil
+}
+
+// record keeps the result of the user in the puzzle and rates them, unless
+// they tried it before. Attempts in streak mode count for the streak.
+func (s *puzzleStore) record(uid, id string, solved, streak bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.puzzles[id]
+	if !ok {
+		return errPuzzleNotFound
+	}
+	results, ok := s.history[uid]
+	if !ok {
+		results = make(map[string]puzzleResult)
+		s.history[uid] = results
+	}
+	if _, tried := results[id]; tried {
+		return nil
+	}
+	results[id] = puzzleResult{
+		Puzzle: id,
+		Solved: solved,
+		At:     time.Now(),
+	}
+	s.rate(uid, p, solved, streak)
+	for file, v := range map[string]interface{}{
+		puzzleHistoryFile: s.history,
+		puzzleRatingsFile: s.ratings,
+		puzzlesFile:       s.puzzles,
+	} {
+		if err := saveJSON(file, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// results returns the results of the user, to page through.
+func (s *puzzleStore) results(uid string) []pageItem {
+	s.m.Lock()
+	defer s.m.Unlock()
+	list := make([]pageItem, 0, len(s.history[uid]))
+	for _, res := range s.history[uid] {
+		list = append(list, res)
+	}
+	return list
+}
+
+// check replays the moves of an attempt from the position of the puzzle. The
+// attempt is right so far if the moves follow the solution; a move mating
+// right away is right as well, even if it's not the one of the solution. It
+// returns the reply of the opponent to the last move, if the puzzle goes on.
+func (p puzzle) check(moves []string) (right, solved bool, reply string, err error) {
+	pos, err := rules.ParseFEN(p.FEN)
+	if err != nil {
+		return false, false, "", err
+	}
+	if len(moves) > len(p.Solution) {
+		return false, false, "", errors.New("Longer than the solution")
+	}
+	for i, m := range moves {
+		played, err := pos.ParseMove(m)
+		if err != nil {
+			return false, false, "", errors.New(m + ": " + err.Error())
+		}
+		// Compared as moves, since castling can be written two ways.
+		want, _ := pos.ParseMove(p.Solution[i])
+		if pos, err = pos.Play(played); err != nil {
+			return false, false, "", err
+		}
+		// Moves at even indices are the player's.
+		if i%2 == 0 && pos.Status() == rules.Checkmate {
+			return true, true, "", nil
+		}
+		if played != want {
+			return false, false, "", nil
+		}
+	}
+	if len(moves)%2 == 1 && len(moves) < len(p.Solution) {
+		reply = p.Solution[len(moves)]
+	}
+	// Solved once no move of the player is left in the solution.
+	solved = len(moves) >= len(p.Solution) || (reply != "" && len(moves)+1 == len(p.Solution))
+	return true, solved, reply, nil
+}
+
+// public returns what the users see of a puzzle before solving it.
+func (p puzzle) public() map[string]interface{} {
+	return map[string]interface{}{
+		"id":     p.Id,
+		"fen":    p.FEN,
+		"themes": p.Themes,
+		"moves":  len(p.Solution),
+		"rating": math.Round(p.rating()),
+	}
+}
+
+// Puzzle of the day. The solution is left out.
+func (rout *router) handleDailyPuzzle(w http.ResponseWriter, r *http.Request) {
+	p, err := rout.puzzles.daily(time.Now())
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	res := p.public()
+	res["date"] = time.Now().UTC().Format("2006-01-02")
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Check an attempt at a puzzle. The moves are the line played so far from the
+// position of the puzzle, replies included, in UCI separated by spaces. The
+// first wrong move fails the puzzle, and ends the streak of the user if
+// they are in streak mode.
+func (rout *router) handlePuzzleAttempt(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p, ok := rout.puzzles.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, errPuzzleNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	moves := strings.Fields(r.FormValue("moves"))
+	if len(moves) == 0 {
+		writeError(w, "Empty moves", http.StatusBadRequest)
+		return
+	}
+	streak := false
+	if flag := r.FormValue("streak"); flag != "" {
+		if streak, err = strconv.ParseBool(flag); err != nil {
+			writeError(w, "Invalid streak flag: " + flag, http.StatusBadRequest)
+			return
+		}
+	}
+	right, solved, reply, err := p.check(moves)
+	if err != nil {
+		writeError(w, "Invalid moves: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+	if solved || !right {
+		if err := rout.puzzles.record(uid, p.Id, solved, streak); err != nil {
+			requestLogger(r).error("Could not save puzzle history", "err", err)
+		}
+		rout.stamps.touch(profileStamp(uid))
+	}
+	res := map[string]interface{}{
+		"right":  right,
+		"solved": solved,
+	}
+	if solved || !right {
+		res["stats"] = rout.puzzles.stats(uid)
+	}
+	if reply != "" {
+		res["reply"] = reply
+	}
+	if !right {
+		res["solution"] = p.Solution
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Next puzzle of the streak of the user, which goes on until their first
+// miss. Attempts at it must be flagged as streak ones.
+func (rout *router) handlePuzzleStreak(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p, err := rout.puzzles.nextInStreak(uid)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	res := p.public()
+	res["streak"] = rout.puzzles.stats(uid).Streak
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Puzzles the user tried, latest first, a page at a time.
+func (rout *router) handlePuzzleHistory(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q, err := puzzleHistoryListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, next := paginate(rout.puzzles.results(uid), q)
+	history := make([]puzzleResult, 0, len(page))
+	for _, item := range page {
+		history = append(history, item.(puzzleResult))
+	}
+	res := pageResponse("history", history, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Add a puzzle. The solution is in UCI separated by spaces, the themes are
+// separated by commas.
+func (rout *router) handleAddPuzzle(w http.ResponseWriter, r *http.Request) {
+	p := puzzle{
+		FEN:      r.FormValue("fen"),
+		Solution: strings.Fields(r.FormValue("solution")),
+	}
+	for _, theme := range strings.Split(r.FormValue("themes"), ",") {
+		if theme = strings.TrimSpace(theme); theme != "" {
+			p.Themes = append(p.Themes, theme)
+		}
+	}
+	if err := p.validate(); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := rout.puzzles.add(p)
+	if err != nil {
+		requestLogger(r).error("Could not save puzzles", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resB, err := json.Marshal(p)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"time"
+)
+
+// Strikes are forgiven after this long without exceeding the limit.
+const chatStrikesReset = time.Hour
+
+// Chat timeouts applied on each consecutive strike. The last one is applied
+// to every strike beyond the length of the list.
+var chatTimeouts = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+type chatOffender struct {
+	strikes int
+	until   time.Time
+}
+
+// chatLimiter enforces per-user chat rate limits, escalating to temporary
+// timeouts when they are exceeded. It is not safe for concurrent use; it's
+// meant to be owned by the goroutine hosting the chat.
+type chatLimiter struct {
+	sent      map[string][]time.Time
+	offenders map[string]*chatOffender
+
+	// Last time the users who stopped chatting were forgotten.
+	swept time.Time
+}
+
+func newChatLimiter() *chatLimiter {
+	return &chatLimiter{
+		sent:      make(map[string][]time.Time),
+		offenders: make(map[string]*chatOffender),
+	}
+}
+
+// allow reports whether uid may send a message at the given time. If not, it
+// also returns the reason to tell the user.
+func (l *chatLimiter) allow(uid string, now time.Time) (bool, notice) {
+	burst, window := conf.chatLimits()
+	l.sweep(now, window)
+	o, ok := l.offenders[uid]
+	if ok {
+		if now.Before(o.until) {
+			return false, newNotice(noticeChatTimedOut, o.until.Sub(now).Round(time.Second))
+		}
+		if now.Sub(o.until) > chatStrikesReset {
+			delete(l.offenders, uid)
+			ok = false
+		}
+	}
+	// Forget messages out of the window.
+	sent := l.sent[uid]
+	for len(sent) > 0 && now.Sub(sent[0]) >= window {
+		sent = sent[1:]
+	}
+	if len(sent) >= burst {
+		if !ok {
+			o = &chatOffender{}
+			l.offenders[uid] = o
+		}
+		timeout := chatTimeouts[len(chatTimeouts)-1]
+		if o.strikes < len(chatTimeouts) {
+			timeout = chatTimeouts[o.strikes]
+		}
+		o.strikes++
+		o.until = now.Add(timeout)
+		delete(l.sent, uid)
+		return false, newNotice(noticeChatRateLimited, burst, window, timeout)
+	}
+	l.sent[uid] = append(sent, now)
+	return true, notice{}
+}
+
+// sweep forgets the users whose messages are all out of the window and the
+// offenders whose strikes were forgiven, at most once per window, so that the
+// users who stop chatting don't stay in the limiter.
+func (l *chatLimiter) sweep(now time.Time, window time.Duration) {
+	if now.Sub(l.swept) < window {
+		return
+	}
+	l.swept = now
+	for uid, sent := range l.sent {
+		if len(sent) == 0 || now.Sub(sent[len(sent)-1]) >= window {
+			delete(l.sent, uid)
+		}
+	}
+	for uid, o := range l.offenders {
+		if now.Sub(o.until) > chatStrikesReset {
+			delete(l.offenders, uid)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChatLimiterEscalatesTimeouts(t *testing.T) {
+	l := newChatLimiter()
+	burst, window := conf.chatLimits()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for strike, timeout := range chatTimeouts[:2] {
+		for i := 0; i < burst; i++ {
+			if ok, _ := l.allow("a", now); !ok {
+				t.Fatalf("message %d of the burst refused", i)
+			}
+		}
+		ok, reason := l.allow("a", now)
+		if ok || reason.code != noticeChatRateLimited {
+			t.Fatalf("message past the burst: %v, %q", ok, reason.code)
+		}
+		if ok, reason := l.allow("a", now.Add(timeout-time.Second)); ok || reason.code != noticeChatTimedOut {
+			t.Fatalf("strike %d: message during the timeout: %v, %q", strike+1, ok, reason.code)
+		}
+		now = now.Add(timeout)
+	}
+	// Others chat meanwhile.
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("another user refused")
+	}
+	now = now.Add(window)
+	if ok, _ := l.allow("a", now); !ok {
+		t.Error("message after the timeout refused")
+	}
+}
+
+func TestChatLimiterForgetsIdleUsers(t *testing.T) {
+	l := newChatLimiter()
+	burst, window := conf.chatLimits()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= burst; i++ {
+		l.allow("offender", now)
+	}
+	l.allow("idle", now)
+	if len(l.sent) != 1 || len(l.offenders) != 1 {
+		t.Fatalf("%d users sent, %d offenders; want 1, 1", len(l.sent), len(l.offenders))
+	}
+
+	// The idle user's messages leave the window.
+	now = now.Add(window)
+	l.allow("active", now)
+	if _, ok := l.sent["idle"]; ok {
+		t.Error("idle user kept past the window")
+	}
+	if _, ok := l.offenders["offender"]; !ok {
+		t.Error("offender forgiven before the strikes reset")
+	}
+
+	now = now.Add(chatTimeouts[0] + chatStrikesReset + time.Second)
+	l.allow("active", now)
+	if len(l.offenders) != 0 {
+		t.Errorf("%d offenders left after their strikes reset", len(l.offenders))
+	}
+	if len(l.sent) != 1 {
+		t.Errorf("%d users sent, want only the active one", len(l.sent))
+	}
+}
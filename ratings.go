@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ratingsFile = "ratings.json"
+
+	// Rating of players who haven't played rated games yet.
+	defaultRating = 1500
+
+	// Elo K-factor.
+	ratingK = 32
+
+	// Games needed to appear in the leaderboard.
+	leaderboardMinGames = 10
+)
+
+// Results of a game, as written in PGN.
+const (
+	resultWhiteWins = "1-0"
+	resultBlackWins = "0-1"
+	resultDraw      = "1/2-1/2"
+)
+
+func validResult(result string) bool {
+	switch result {
+	case resultWhiteWins, resultBlackWins, resultDraw:
+		return true
+	}
+	return false
+}
+
+// winner returns the result of the game won by the player of the given color.
+func winner(color string) string {
+	if color == "white" {
+		return resultWhiteWins
+	}
+	return resultBlackWins
+}
+
+// rating is the Elo rating of a player.
+type rating struct {
+	Rating float64 `json:"rating"`
+	Games  int     `json:"games"`
+
+	// Username of the player in their last rated game.
+	Username string `json:"username,omitempty"`
+}
+
+// leaderboardEntry is a player in the leaderboard.
+type leaderboardEntry struct {
+	Uid string `json:"uid"`
+	rating
+}
+
+// ratingStore is the ratings engine: it keeps the rating of every player,
+// persisted to the data directory, and updates them with the results of rated
+// games.
+type ratingStore struct {
+	m       *sync.Mutex
+	ratings map[string]*rating
+}
+
+func newRatingStore() (*ratingStore, error) {
+	s := &ratingStore{
+		m:       &sync.Mutex{},
+		ratings: make(map[string]*rating),
+	}
+	if err := loadJSON(ratingsFile, &s.ratings); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the rating of the player.
+func (s *ratingStore) get(uid string) rating {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if r, ok := s.ratings[uid]; ok {
+		return *r
+	}
+	return rating{Rating: defaultRating}
+}
+
+// record updates the ratings of both players with the result of a rated game.
+func (s *ratingStore) record(whiteUser, blackUser user, result string) {
+	var score float64
+	switch result {
+	case resultWhiteWins:
+		score = 1
+	case resultBlackWins:
+		score = 0
+	case resultDraw:
+		score = 0.5
+	default:
+		rootLogger.error("Invalid result", "result", result)
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	white, black := s.player(whiteUser.id), s.player(blackUser.id)
+	white.Username, black.Username = whiteUser.username, blackUser.username
+	expected := 1 / (1 + math.Pow(10, (black.Rating-white.Rating)/400))
+	delta := ratingK * (score - expected)
+	white.Rating += delta
+	black.Rating -= delta
+	white.Games++
+	black.Games++
+	if err := saveJSON(ratingsFile, s.ratings); err != nil {
+		rootLogger.error("Could not save ratings", "err", err)
+	}
+}
+
+// recordResult rates the game, marking the leaderboard and the profiles of its
+// players as changed, unless its result is withheld for review. Either way,
+// the game counts toward the signals that its players share an owner.
+func (rout *router) recordResult(g finishedGame) {
+	rout.signals.played(g)
+	if rout.withholdResult(g) {
+		return
+	}
+	rout.ratings.record(g.white, g.black, g.result)
+	rout.stamps.touch(leaderboardStamp, profileStamp(g.white.id), profileStamp(g.black.id))
+}
+
+// player returns the rating of the player, setting up a new one if needed.
+// The caller must hold the lock.
+func (s *ratingStore) player(uid string) *rating {
+	r, ok := s.ratings[uid]
+	if !ok {
+		r = &rating{Rating: defaultRating}
+		s.ratings[uid] = r
+	}
+	return r
+}
+
+var leaderboardListing = listing{
+	sorts:       []string{"rating", "games"},
+	defaultSort: "-rating",
+	filters: []param{
+		form("username", "string", false, "Beginning of the username, in any case"),
+		form("minGames", "int", false, "Rated games played at least"),
+	},
+}
+
+func (e leaderboardEntry) pageId() string {
+	return e.Uid
+}
+
+func (e leaderboardEntry) sortKey(field string) sortKey {
+	if field == "games" {
+		return sortKey{num: float64(e.Games)}
+	}
+	return sortKey{num: e.Rating}
+}
+
+func (e leaderboardEntry) matches(filter, value string) bool {
+	switch filter {
+	case "username":
+		return strings.HasPrefix(strings.ToLower(e.Username), strings.ToLower(value))
+	case "minGames":
+		n, _ := strconv.Atoi(value)
+		return e.Games >= n
+	}
+	return true
+}
+
+// leaderboard returns the players with enough rated games to be ranked,
+// leaving out those excluded.
+func (s *ratingStore) leaderboard(exclude func(uid string) bool) []pageItem {
+	s.m.Lock()
+	defer s.m.Unlock()
+	entries := []pageItem{}
+	for uid, r := range s.ratings {
+		if r.Games < leaderboardMinGames || exclude(uid) {
+			continue
+		}
+		entries = append(entries, leaderboardEntry{
+			Uid:    uid,
+			rating: *r,
+		})
+	}
+	return entries
+}
+
+// Ranked players, best rated first unless sorted otherwise. Players under
+// shadow restrictions are left out.
+func (rout *router) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	q, err := leaderboardListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, next := paginate(rout.ratings.leaderboard(rout.restricted), q)
+	entries := make([]leaderboardEntry, 0, len(page))
+	for _, item := range page {
+		entries = append(entries, item.(leaderboardEntry))
+	}
+	res := pageResponse("leaderboard", entries, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Public profile of a player, with the penalty for the games they abandoned.
+func (rout *router) handleProfile(w http.ResponseWriter, r *http.Request) {
+	uid := mux.Vars(r)["uid"]
+	res := map[string]interface{}{
+		"uid":         uid,
+		"rating":      rout.ratings.get(uid),
+		"puzzles":     rout.puzzles.stats(uid),
+		"abandonment": rout.abandonments.get(uid),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRatingStoreRecord(t *testing.T) {
+	useTempDataDir(t)
+	s, err := newRatingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := user{id: "a", username: "alice"}, user{id: "b", username: "bob"}
+
+	if r := s.get("a"); r.Rating != defaultRating || r.Games != 0 {
+		t.Fatalf("new player rated %+v", r)
+	}
+	// Even players trade half the K-factor.
+	s.record(alice, bob, resultWhiteWins)
+	if a, b := s.get("a"), s.get("b"); a.Rating != 1516 || b.Rating != 1484 {
+		t.Errorf("after a win ratings are %v/%v, want 1516/1484", a.Rating, b.Rating)
+	}
+	// A draw moves points from the favorite to the underdog.
+	s.record(bob, alice, resultDraw)
+	a, b := s.get("a"), s.get("b")
+	if a.Rating >= 1516 || b.Rating <= 1484 || math.Abs(a.Rating+b.Rating-3000) > 1e-9 {
+		t.Errorf("after a draw ratings are %v/%v", a.Rating, b.Rating)
+	}
+	if a.Games != 2 || b.Games != 2 || a.Username != "alice" {
+		t.Errorf("players are %+v and %+v", a, b)
+	}
+	// Invalid results are ignored.
+	s.record(alice, bob, "*")
+	if s.get("a") != a {
+		t.Errorf("invalid result changed the rating to %+v", s.get("a"))
+	}
+
+	reloaded, err := newRatingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.get("a") != a || reloaded.get("b") != b {
+		t.Errorf("reloaded %+v and %+v, want %+v and %+v", reloaded.get("a"), reloaded.get("b"), a, b)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	useTempDataDir(t)
+	s, err := newRatingStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, carol := user{id: "a"}, user{id: "b"}, user{id: "c"}
+	for i := 0; i < leaderboardMinGames; i++ {
+		s.record(alice, bob, resultWhiteWins)
+	}
+	s.record(alice, carol, resultWhiteWins)
+
+	entries := s.leaderboard(func(uid string) bool { return false })
+	if len(entries) != 2 {
+		t.Fatalf("%d players ranked, want 2", len(entries))
+	}
+	entries = s.leaderboard(func(uid string) bool { return uid == "b" })
+	if len(entries) != 1 || entries[0].pageId() != "a" {
+		t.Errorf("ranked %v, want only a", entries)
+	}
+}
+
+func TestValidResult(t *testing.T) {
+	for result, valid := range map[string]bool{
+		resultWhiteWins: true,
+		resultBlackWins: true,
+		resultDraw:      true,
+		"*":             false,
+		"":              false,
+		"1-1":           false,
+	} {
+		if validResult(result) != valid {
+			t.Errorf("validResult(%q) = %v", result, !valid)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+const (
+	// Validity of the links sent by email.
+	verifyEmailTTL   = 24 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// Set the email address of the logged in account and send the verification
+// link to it.
+func (rout *router) handleSetEmail(w http.ResponseWriter, r *http.Request) {
+	accountId, ok := rout.sessionAccount(r)
+	if !ok {
+		writeError(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	addr, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		writeError(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if err := rout.accounts.setEmail(accountId, addr.Address); err != nil {
+		requestLogger(r).error("Could not set email", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := rout.tokens.sign(tokenVerifyEmail, accountId, addr.Address, verifyEmailTTL)
+	link := conf.FrontendURL + "/verify?token=" + url.QueryEscape(token)
+	body := "Open this link to verify your email address:\n\n" + link
+	if err := rout.mailer.send(addr.Address, "Verify your email address", body); err != nil {
+		requestLogger(r).error("Could not send verification email", "err", err)
+		writeError(w, "Could not send email", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Verify the email address with the token of the link sent to it.
+func (rout *router) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	// The token is bound to the address it was sent to.
+	accountId, err := rout.tokens.verify(r.FormValue("token"), tokenVerifyEmail, func(id string) string {
+		a, _ := rout.accounts.get(id)
+		return a.Email
+	})
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rout.accounts.verifyEmail(accountId); err != nil {
+		if err == errEmailTaken {
+			writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		requestLogger(r).error("Could not verify email", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Send a password reset link to the verified email address of the account
+// with the given username or email. The response is the same whether the
+// account exists or not.
+func (rout *router) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	a, ok := rout.accounts.find(r.FormValue("login"))
+	if ok && a.EmailVerified {
+		// Bound to the current password, so the link works only once.
+		token := rout.tokens.sign(tokenResetPassword, a.Id, a.PasswordHash, resetPasswordTTL)
+		link := conf.FrontendURL + "/reset-password?token=" + url.QueryEscape(token)
+		body := "Hi " + a.Username + ", open this link to choose a new password:\n\n" + link
+		if err := rout.mailer.send(a.Email, "Reset your password", body); err != nil {
+			requestLogger(r).error("Could not send password reset email", "err", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Set a new password with the token of the reset link.
+func (rout *router) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	password := r.FormValue("password")
+	if len(password) < minPasswordLength {
+		writeError(w, "Password too short", http.StatusBadRequest)
+		return
+	}
+	accountId, err := rout.tokens.verify(r.FormValue("token"), tokenResetPassword, func(id string) string {
+		a, _ := rout.accounts.get(id)
+		return a.PasswordHash
+	})
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rout.accounts.setPassword(accountId, password); err != nil {
+		requestLogger(r).error("Could not set password", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Whoever knew the old password is logged out.
+	rout.loginSessions.endAll(accountId)
+	w.WriteHeader(http.StatusNoContent)
+}
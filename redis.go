@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// Time allowed to connect to Redis and for each command.
+	redisTimeout = 5 * time.Second
+
+	// Events waiting to be published. Events beyond it are dropped while
+	// Redis is unreachable.
+	redisQueue = 1024
+)
+
+// redisBroker relays events between the nodes of the server over Redis
+// pub/sub, and keeps the state they share. The client keeps a pool of
+// connections, so that a slow command doesn't hold up the others.
+type redisBroker struct {
+	client *redis.Client
+	out    chan redisPublication
+}
+
+type redisPublication struct {
+	topic string
+	event []byte
+}
+
+func newRedisBroker(addr, password string) *redisBroker {
+	b := &redisBroker{
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     password,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}),
+		out: make(chan redisPublication, redisQueue),
+	}
+	go b.publishLoop()
+	return b
+}
+
+// ping checks that Redis is reachable.
+func (b *redisBroker) ping() error {
+	return b.client.Ping(context.Background()).Err()
+}
+
+// publish queues the event to be published on the topic. Events are best
+// effort: they are dropped if the queue is full.
+func (b *redisBroker) publish(topic string, event []byte) {
+	select {
+	case b.out<- redisPublication{topic: topic, event: event}:
+	default:
+		rootLogger.warn("Redis queue is full, dropping event", "topic", topic)
+	}
+}
+
+func (b *redisBroker) publishLoop() {
+	for p := range b.out {
+		if err := b.client.Publish(context.Background(), p.topic, p.event).Err(); err != nil {
+			rootLogger.error("Could not publish to Redis", "topic", p.topic, "err", err)
+		}
+	}
+}
+
+// subscribe calls handle with every event published on the topic, from any
+// node, for as long as the server runs. The subscription is renewed when the
+// connection is lost.
+func (b *redisBroker) subscribe(topic string, handle func(event []byte)) {
+	sub := b.client.Subscribe(context.Background(), topic)
+	go func() {
+		for msg := range sub.Channel() {
+			handle([]byte(msg.Payload))
+		}
+	}()
+}
+
+// set stores the value under the key, expiring after ttl.
+func (b *redisBroker) set(key string, value []byte, ttl time.Duration) error {
+	return b.client.Set(context.Background(), key, value, ttl).Err()
+}
+
+// get returns the value stored under the key, reporting false if there is
+// none.
+func (b *redisBroker) get(key string) ([]byte, bool, error) {
+	value, err := b.client.Get(context.Background(), key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (b *redisBroker) del(key string) error {
+	return b.client.Del(context.Background(), key).Err()
+}
+
+// setNX stores the value under the key, expiring after ttl, unless the key is
+// taken. It reports whether the value was stored.
+func (b *redisBroker) setNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(context.Background(), key, value, ttl).Result()
+}
+
+// push appends the value to the list under the key.
+func (b *redisBroker) push(key string, value []byte) error {
+	return b.client.RPush(context.Background(), key, value).Err()
+}
+
+// pushExpiring appends the value to the list under the key, which expires
+// after ttl.
+func (b *redisBroker) pushExpiring(key string, value []byte, ttl time.Duration) error {
+	ctx := context.Background()
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, value)
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	return err
+}
+
+// pop removes the first value of the list under the key, reporting false if
+// the list is empty.
+func (b *redisBroker) pop(key string) ([]byte, bool, error) {
+	value, err := b.client.LPop(context.Background(), key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+// remove removes the value from the list under the key, reporting whether it
+// was there.
+func (b *redisBroker) remove(key string, value []byte) (bool, error) {
+	n, err := b.client.LRem(context.Background(), key, 1, value).Result()
+	return n > 0, err
+}
+
+// length returns the length of the list under the key.
+func (b *redisBroker) length(key string) (int, error) {
+	n, err := b.client.LLen(context.Background(), key).Result()
+	return int(n), err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// finishedInvites keeps the invite games that ended recently, by game id.
+type finishedInvites struct {
+	m     *sync.Mutex
+	games map[string]match
+}
+
+var (
+	errGameNotFound = errors.New("Game not found")
+	errNotPlayer    = errors.New("User is neither black nor white")
+)
+
+func newFinishedInvites() *finishedInvites {
+	return &finishedInvites{
+		m:     &sync.Mutex{},
+		games: make(map[string]match),
+	}
+}
+
+func (f *finishedInvites) size() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return len(f.games)
+}
+
+// take removes the game if the user played it.
+func (f *finishedInvites) take(gameId, uid string) (match, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	m, ok := f.games[gameId]
+	if !ok {
+		return match{}, errGameNotFound
+	}
+	if uid != m.white.id && uid != m.black.id {
+		return match{}, errNotPlayer
+	}
+	delete(f.games, gameId)
+	return m, nil
+}
+
+// rememberInvite keeps the finished invite game for a while so that either
+// player can invite the other again.
+func (rout *router) rememberInvite(m match) {
+	f := rout.finishedInvites
+	f.m.Lock()
+	f.games[m.gameId] = m
+	f.m.Unlock()
+	time.AfterFunc(conf.ReinviteWindow, func() {
+		f.m.Lock()
+		delete(f.games, m.gameId)
+		f.m.Unlock()
+	})
+}
+
+// Invite the opponent of a finished invite game to another one with the same
+// clock and colors switched. The invite is delivered to the opponent over
+// livedata and only they can accept it.
+func (rout *router) handleReinvite(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rout.refuseIfChallengeBanned(w, uid) {
+		return
+	}
+	// One new invite per game is enough.
+	m, err := rout.finishedInvites.take(r.FormValue("id"), uid)
+	switch err {
+	case nil:
+	case errGameNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hostColor, opp := "white", m.white
+	if uid == m.white.id {
+		hostColor, opp = "black", m.black
+	}
+
+	// Each player keeps the time they started with.
+	control := m.control
+	control.base = m.baseFor(uid)
+	var guestBase time.Duration
+	if m.clocks != nil {
+		guestBase = m.baseFor(opp.id)
+	}
+	room := &inviteRoom{
+		control:   control,
+		rated:     m.rated,
+		host:      user{
+			id:       uid,
+			username: username,
+		},
+		guest:     opp.id,
+		hostColor: hostColor,
+		variant:   m.setup.Variant,
+		// The same player gives the odds again.
+		odds:      m.setup.Odds,
+		guestOdds: m.setup.Odds != "" && m.setup.OddsBy != hostColor,
+		guestBase: guestBase,
+	}
+	if err := rout.openInvite(room, conf.InviteExpiration); err != nil {
+		requestLogger(r).error("Could not open invite", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oppColor := "white"
+	if hostColor == "white" {
+		oppColor = "black"
+	}
+	rout.ldHub.direct<- directDelivery{
+		uid: opp.id,
+		payload: map[string]interface{}{
+			"reinvite": map[string]interface{}{
+				"inviteId":  room.id,
+				"code":      room.code,
+				"from":      username,
+				"color":     oppColor,
+				"clock":     strconv.Itoa(room.guestMinutes()),
+				"increment": room.control.seconds(),
+				"oppClock":  strconv.Itoa(room.control.minutes()),
+				"rated":     room.rated,
+				"odds":      room.odds,
+				"giveOdds":  room.guestOdds,
+				"expires":   room.expires.Format(time.RFC3339),
+			},
+		},
+	}
+
+	res := map[string]string{
+		"inviteId": room.id,
+		"code":     room.code,
+		"color":    hostColor,
+		"expires":  room.expires.Format(time.RFC3339),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// reloadConfig reads the settings again and applies the ones that can change
+// while the server runs; games in progress go on. It returns the settings
+// applied and the ones that changed but need a restart.
+func (rout *router) reloadConfig() (applied, ignored []string, err error) {
+	next, err := loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	applied, ignored = conf.update(next)
+	rout.inviteBursts.setLimit(next.InviteBurst, next.InviteBurstWindow)
+	// Show the new banner, if any.
+	rout.ldHub.refresh<- struct{}{}
+	rootLogger.info("Reloaded settings", "applied", applied)
+	if len(ignored) > 0 {
+		rootLogger.warn("Some settings need a restart to change", "settings", ignored)
+	}
+	return applied, ignored, nil
+}
+
+// Reload the settings, as on SIGHUP.
+func (rout *router) handleReload(w http.ResponseWriter, r *http.Request) {
+	applied, ignored, err := rout.reloadConfig()
+	if err != nil {
+		requestLogger(r).error("Could not reload settings", "err", err)
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := map[string][]string{
+		"applied":         applied,
+		"restartRequired": ignored,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// Speeds a replay can be played at, as multiples of the original timing.
+const (
+	minReplaySpeed = 0.25
+	maxReplaySpeed = 64
+)
+
+// replayMove is a move of a game as its spectators saw it, with the clocks
+// after it and the time it came after the previous move.
+type replayMove struct {
+	color string
+	pgn   string
+	clock map[string]int64
+	after time.Duration
+}
+
+// recordMove keeps the move relayed at the given time for the replays of the
+// game.
+func (r *Room) recordMove(m move, now time.Time) {
+	var after time.Duration
+	if !r.movedAt.IsZero() {
+		after = now.Sub(r.movedAt)
+	}
+	r.played = append(r.played, replayMove{
+		color: m.Color,
+		pgn:   m.Pgn,
+		clock: r.clocks(),
+		after: after,
+	})
+	r.movedAt = now
+}
+
+// replayer plays a finished game back to a viewer as if it was being played.
+type replayer struct {
+	uid  string
+	lang string
+	conn protocol.Conn
+	game finishedGame
+	// Inbound speed asked by the viewer, buffered for one, and what's wrong
+	// with the last message that didn't fit its schema.
+	speed   chan float64
+	invalid chan error
+	// Closed once the viewer's connection goes away.
+	gone chan struct{}
+}
+
+// Reading goroutine - the viewer only asks for the speed of the replay.
+func (p *replayer) readPump() {
+	defer func() {
+		close(p.gone)
+		p.conn.Close()
+	}()
+	p.conn.SetReadLimit(conf.MaxFrameSize)
+	p.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	p.conn.SetPongHandler(func(string) error { p.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	for {
+		data, oversized, err := readMessage(p.conn)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				rootLogger.warn("Replay connection closed unexpectedly", "uid", p.uid, "err", err)
+			}
+			return
+		}
+		if oversized {
+			continue
+		}
+		var msg struct {
+			Speed *float64 `json:"speed"`
+		}
+		err = protocol.Decode(data, &msg)
+		if err == nil && msg.Speed == nil {
+			err = errors.New("missing speed")
+		}
+		if err != nil {
+			select {
+			case <-p.invalid:
+			default:
+			}
+			p.invalid<- err
+			continue
+		}
+		// The speed asked before is dropped if it wasn't taken yet.
+		select {
+		case <-p.speed:
+		default:
+		}
+		p.speed<- *msg.Speed
+	}
+}
+
+// run is the writing goroutine: it sends the state of the game at its start,
+// then each move as long after the previous one as it was played, divided by
+// the speed, and the result.
+func (p *replayer) run() {
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer func() {
+		ticker.Stop()
+		p.conn.Close()
+	}()
+	g := p.game
+	blindfold := []string{}
+	if g.whiteBlindfold {
+		blindfold = append(blindfold, "white")
+	}
+	if g.blackBlindfold {
+		blindfold = append(blindfold, "black")
+	}
+	snapshot := map[string]interface{}{
+		"snapshot": map[string]interface{}{
+			"gameId":    g.gameId,
+			"variant":   g.setup.variant().Name(),
+			"white":     g.white.username,
+			"black":     g.black.username,
+			"pgn":       "",
+			"ply":       0,
+			"clock":     g.clock,
+			"turn":      "white",
+			"blindfold": blindfold,
+		},
+	}
+	if !p.write(snapshot) {
+		return
+	}
+	speed := 1.0
+	for i, m := range g.moves {
+		// Time of the original game left before the move.
+		left := m.after
+		for left > 0 {
+			start := time.Now()
+			t := time.NewTimer(time.Duration(float64(left) / speed))
+			select {
+			case <-t.C:
+				left = 0
+			case s := <-p.speed:
+				t.Stop()
+				left -= time.Duration(float64(time.Since(start)) * speed)
+				if s < minReplaySpeed || s > maxReplaySpeed {
+					if !p.write(map[string]string{"speedRefused": "true"}) {
+						return
+					}
+					break
+				}
+				speed = s
+				if !p.write(map[string]float64{"speed": speed}) {
+					return
+				}
+			case err := <-p.invalid:
+				t.Stop()
+				left -= time.Duration(float64(time.Since(start)) * speed)
+				ev := noticeEvent{key: "error", notice: newNotice(noticeInvalidMessage, err)}
+				if !p.write(ev.localize(p.lang)) {
+					return
+				}
+			case <-ticker.C:
+				t.Stop()
+				left -= time.Duration(float64(time.Since(start)) * speed)
+				p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+				if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			case <-p.gone:
+				t.Stop()
+				return
+			}
+		}
+		ok := p.write(map[string]interface{}{
+			"move": map[string]string{
+				"color": m.color,
+				"pgn":   m.pgn,
+			},
+			"ply":   i + 1,
+			"clock": m.clock,
+		})
+		if !ok {
+			return
+		}
+	}
+	if !p.write(map[string]string{"gameOver": g.result}) {
+		return
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+	p.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+func (p *replayer) write(payload interface{}) bool {
+	p.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+	return p.conn.WriteJSON(payload) == nil
+}
+
+// Replay a recently finished game as in /watch, with the moves coming as
+// long after each other as they were played. The viewer may send
+// {"speed": x} to play it x times faster, or slower below 1.
+func (rout *router) handleReplay(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	g, ok := rout.analyses.finished(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
+	p := &replayer{
+		uid:     uid,
+		lang:    requestLanguage(r),
+		conn:    conn,
+		game:    g,
+		speed:   make(chan float64, 1),
+		invalid: make(chan error, 1),
+		gone:    make(chan struct{}),
+	}
+	go p.run()
+	go func() {
+		p.readPump()
+		rout.conns.remove(uid, conn)
+	}()
+}
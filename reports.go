@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	idGen "github.com/rs/xid"
+)
+
+const reportsFile = "reports.json"
+
+// Reasons a game is flagged for.
+const (
+	// The player took about the same time for every move.
+	reasonFlatTiming = "flatTiming"
+	// The player answered most of the complex positions within moments.
+	reasonFastComplexMoves = "fastComplexMoves"
+	// A moderator reported the game.
+	reasonReported = "reported"
+)
+
+// fairPlayReport flags the play of a user in a rated game for the moderators
+// to review, along with how their moves compare with the engine's once it's
+// gone through the game. Reports of the results of a user, rather than of
+// their play, name the games of the sequence flagged and hold the results of
+// the user's next games back from the ratings. A report stays in the queue
+// until a moderator dismisses it.
+type fairPlayReport struct {
+	Id       string       `json:"id"`
+	GameId   string       `json:"gameId"`
+	Uid      string       `json:"uid"`
+	Username string       `json:"username"`
+	Color    string       `json:"color,omitempty"`
+	Reasons  []string     `json:"reasons"`
+	Timing   *moveTiming  `json:"timing,omitempty"`
+	Engine   *engineCheck `json:"engine,omitempty"`
+	// Uid of the opponent the user kept beating, when farming.
+	Opponent string           `json:"opponent,omitempty"`
+	Games    []string         `json:"games,omitempty"`
+	Withheld []withheldResult `json:"withheld,omitempty"`
+	Created  time.Time        `json:"created"`
+}
+
+var reportListing = listing{
+	sorts:       []string{"created", "score"},
+	defaultSort: "-created",
+	filters: []param{
+		form("uid", "string", false, ""),
+		form("gameId", "string", false, ""),
+		form("reason", "string", false, "flatTiming, fastComplexMoves, reported, fastLosses or farming"),
+	},
+}
+
+func (rep fairPlayReport) pageId() string {
+	return rep.Id
+}
+
+func (rep fairPlayReport) sortKey(field string) sortKey {
+	if field == "score" {
+		// Unscored ones first.
+		if rep.Engine == nil || rep.Engine.Status != analysisDone {
+			return sortKey{num: -1}
+		}
+		return sortKey{num: float64(rep.Engine.Score)}
+	}
+	return timeKey(rep.Created)
+}
+
+func (rep fairPlayReport) matches(filter, value string) bool {
+	switch filter {
+	case "uid":
+		return rep.Uid == value
+	case "gameId":
+		return rep.GameId == value
+	case "reason":
+		for _, reason := range rep.Reasons {
+			if reason == value {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// reportStore is the moderation queue: the fair-play reports pending review,
+// by id.
+type reportStore struct {
+	m       *sync.Mutex
+	reports map[string]fairPlayReport
+}
+
+func newReportStore() (*reportStore, error) {
+	s := &reportStore{
+		m:       &sync.Mutex{},
+		reports: make(map[string]fairPlayReport),
+	}
+	if err := loadJSON(reportsFile, &s.reports); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// add queues the report, giving it an id.
+func (s *reportStore) add(rep fairPlayReport) (fairPlayReport, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rep.Id = idGen.New().String()
+	s.reports[rep.Id] = rep
+	return rep, saveJSON(reportsFile, s.reports)
+}
+
+// update changes the report with f, reporting whether it's still queued.
+func (s *reportStore) update(id string, f func(rep *fairPlayReport)) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rep, ok := s.reports[id]
+	if !ok {
+		return false, nil
+	}
+	f(&rep)
+	s.reports[id] = rep
+	return true, saveJSON(reportsFile, s.reports)
+}
+
+// abandonEngineChecks fails the engine checks of the reports that were
+// waiting for the engine or being checked.
+func (s *reportStore) abandonEngineChecks() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	changed := false
+	for id, rep := range s.reports {
+		if rep.Engine == nil || (rep.Engine.Status != analysisQueued && rep.Engine.Status != analysisRunning) {
+			continue
+		}
+		rep.Engine = &engineCheck{Status: analysisFailed, Error: "The server restarted before the check"}
+		s.reports[id] = rep
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return saveJSON(reportsFile, s.reports)
+}
+
+// withhold adds the result to the withheld ones of the report under review
+// for the results of either of its players, as for the farming ones, of both
+// of them. It reports whether there was such a report.
+func (s *reportStore) withhold(res withheldResult) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for id, rep := range s.reports {
+		if len(rep.Withheld) == 0 {
+			continue
+		}
+		player := rep.Uid == res.White.Id || rep.Uid == res.Black.Id
+		opponent := rep.Opponent == res.White.Id || rep.Opponent == res.Black.Id
+		if !player || (rep.Opponent != "" && !opponent) {
+			continue
+		}
+		rep.Withheld = append(rep.Withheld, res)
+		s.reports[id] = rep
+		return true, saveJSON(reportsFile, s.reports)
+	}
+	return false, nil
+}
+
+// dismiss removes the report, returning it if it was queued.
+func (s *reportStore) dismiss(id string) (fairPlayReport, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rep, ok := s.reports[id]
+	if !ok {
+		return rep, false, nil
+	}
+	delete(s.reports, id)
+	return rep, true, saveJSON(reportsFile, s.reports)
+}
+
+// pendingUids returns the uids of the users with reports pending review.
+func (s *reportStore) pendingUids() map[string]bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	uids := make(map[string]bool)
+	for _, rep := range s.reports {
+		uids[rep.Uid] = true
+	}
+	return uids
+}
+
+func (s *reportStore) list() []fairPlayReport {
+	s.m.Lock()
+	defer s.m.Unlock()
+	reports := make([]fairPlayReport, 0, len(s.reports))
+	for _, rep := range s.reports {
+		reports = append(reports, rep)
+	}
+	return reports
+}
+
+// fileReport queues the report of the player of the color in the rated game,
+// to be checked with the engine, and has the player acknowledge the fair-play
+// policy again.
+func (rout *router) fileReport(g finishedGame, rep fairPlayReport) (fairPlayReport, error) {
+	rep.GameId = g.gameId
+	rep.Engine = &engineCheck{Status: analysisQueued}
+	rep.Created = time.Now()
+	rep, err := rout.reports.add(rep)
+	if err != nil {
+		return rep, err
+	}
+	rout.flagged(rep)
+	rout.queueEngineCheck(rep, g)
+	return rep, nil
+}
+
+// Report the play of a user in a rated game that finished recently, for the
+// engine to go through it.
+func (rout *router) handleReportGame(w http.ResponseWriter, r *http.Request) {
+	g, ok := rout.analyses.finished(r.FormValue("gameId"))
+	if !ok {
+		writeError(w, errGameNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !g.rated {
+		writeError(w, "Only rated games are reviewed", http.StatusBadRequest)
+		return
+	}
+	rep := fairPlayReport{Reasons: []string{reasonReported}}
+	switch uid := r.FormValue("uid"); uid {
+	case g.white.id:
+		rep.Uid, rep.Username, rep.Color = uid, g.white.username, "w"
+	case g.black.id:
+		rep.Uid, rep.Username, rep.Color = uid, g.black.username, "b"
+	default:
+		writeError(w, errNotPlayer.Error(), http.StatusBadRequest)
+		return
+	}
+	rep, err := rout.fileReport(g, rep)
+	if err != nil {
+		requestLogger(r).error("Could not save reports", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resB, err := json.Marshal(rep)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the fair-play reports pending review, latest first.
+func (rout *router) handleGetReports(w http.ResponseWriter, r *http.Request) {
+	q, err := reportListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reports := rout.reports.list()
+	items := make([]pageItem, 0, len(reports))
+	for _, rep := range reports {
+		items = append(items, rep)
+	}
+	page, next := paginate(items, q)
+	list := make([]fairPlayReport, 0, len(page))
+	for _, item := range page {
+		list = append(list, item.(fairPlayReport))
+	}
+	res := pageResponse("reports", list, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Dismiss a fair-play report once it's reviewed. The results it held back
+// are rated then, unless they are voided.
+func (rout *router) handleDismissReport(w http.ResponseWriter, r *http.Request) {
+	rep, ok, err := rout.reports.dismiss(mux.Vars(r)["id"])
+	if err != nil {
+		requestLogger(r).error("Could not save reports", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if r.FormValue("void") != "true" {
+		rout.releaseWithheld(rep)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Shadow restrictions keep flagged users out of rated games, the leaderboard
+// and the lobby chat while their case is investigated. Unlike bans, they are
+// applied silently: restricted users can still play and see their own lobby
+// messages, but nobody else does and their games are not rated. Both players
+// of a game asked to be rated learn it isn't before it starts, though not
+// why.
+
+// restricted reports whether the user is under a shadow restriction.
+func (rout *router) restricted(uid string) bool {
+	_, ok := rout.restrictions.banned(uid)
+	return ok
+}
+
+// ratedFor reports whether a game between the users can be rated: none of
+// them is restricted and all of them acknowledged the fair-play policy. The
+// responses pairing the players say whether their game is rated.
+func (rout *router) ratedFor(uids ...string) bool {
+	for _, uid := range uids {
+		if rout.restricted(uid) || !rout.fairPlayAcks.acknowledged(uid) {
+			return false
+		}
+	}
+	return true
+}
+
+// Put a user under a shadow restriction.
+func (rout *router) handleRestrict(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if uid == "" {
+		writeError(w, "Empty uid", http.StatusBadRequest)
+		return
+	}
+	restriction := ban{
+		Uid:     uid,
+		Reason:  r.FormValue("reason"),
+		Created: time.Now(),
+	}
+	if err := rout.restrictions.add(restriction); err != nil {
+		requestLogger(r).error("Could not save restrictions", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Their games and rating are left out of the lists.
+	rout.stamps.touch(leaderboardStamp, gamesStamp)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List the users under shadow restrictions.
+func (rout *router) handleGetRestrictions(w http.ResponseWriter, r *http.Request) {
+	restrictions, err := rout.restrictions.list()
+	if err != nil {
+		requestLogger(r).error("Could not save restrictions", "err", err)
+	}
+	bansPage(w, r, "restrictions", restrictions)
+}
+
+// Lift the shadow restriction of a user.
+func (rout *router) handleLiftRestriction(w http.ResponseWriter, r *http.Request) {
+	ok, err := rout.restrictions.lift(mux.Vars(r)["uid"])
+	if err != nil {
+		requestLogger(r).error("Could not save restrictions", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeError(w, "Restriction not found", http.StatusNotFound)
+		return
+	}
+	rout.stamps.touch(leaderboardStamp, gamesStamp)
+	w.WriteHeader(http.StatusNoContent)
+}
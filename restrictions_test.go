@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRatedFor(t *testing.T) {
+	useTempDataDir(t)
+	restrictions, err := newBanStore(restrictionsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acks, err := newFairPlayAckStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rout := &router{restrictions: restrictions, fairPlayAcks: acks}
+	for _, uid := range []string{"a", "b", "restricted"} {
+		if _, err := acks.acknowledge(uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := restrictions.add(ban{Uid: "restricted", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uids  []string
+		rated bool
+	}{
+		{[]string{"a", "b"}, true},
+		{[]string{"a", "restricted"}, false},
+		{[]string{"a", "unacknowledged"}, false},
+	}
+	for _, tt := range tests {
+		if rated := rout.ratedFor(tt.uids...); rated != tt.rated {
+			t.Errorf("ratedFor(%v) = %v, want %v", tt.uids, rated, tt.rated)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const resultChainsFile = "result_chains.json"
+
+// Hash the first result of a chain links to.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// chainedResult is a finished game in the history of one of its players. Each
+// one carries the hash of the one before, so that no result can be changed,
+// removed or slipped in without breaking every hash after it.
+type chainedResult struct {
+	// Position in the history of the player, from 1.
+	Seq     int        `json:"seq"`
+	GameId  string     `json:"gameId"`
+	White   gamePlayer `json:"white"`
+	Black   gamePlayer `json:"black"`
+	Variant string     `json:"variant"`
+	Result  string     `json:"result"`
+	Rated   bool       `json:"rated"`
+	// SHA-256 of the PGN of the game, in hex, to tell the moves apart too.
+	PGNHash  string    `json:"pgnHash"`
+	Finished time.Time `json:"finished"`
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash"`
+}
+
+// digest returns the hash of the result: the SHA-256, in hex, of its fields
+// but the hash itself, one per line, with the finish time in RFC 3339 UTC.
+func (c chainedResult) digest() string {
+	fields := []string{
+		strconv.Itoa(c.Seq),
+		c.Prev,
+		c.GameId,
+		c.White.Id,
+		c.White.Username,
+		c.Black.Id,
+		c.Black.Username,
+		c.Variant,
+		c.Result,
+		strconv.FormatBool(c.Rated),
+		c.PGNHash,
+		c.Finished.UTC().Format(time.RFC3339Nano),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+var resultChainListing = listing{
+	sorts:       []string{"seq"},
+	defaultSort: "-seq",
+	filters: []param{
+		form("result", "string", false, "1-0, 0-1 or 1/2-1/2"),
+		form("rated", "bool", false, ""),
+	},
+}
+
+func (c chainedResult) pageId() string {
+	return strconv.Itoa(c.Seq)
+}
+
+func (c chainedResult) sortKey(field string) sortKey {
+	return sortKey{num: float64(c.Seq)}
+}
+
+func (c chainedResult) matches(filter, value string) bool {
+	switch filter {
+	case "result":
+		return c.Result == value
+	case "rated":
+		return strconv.FormatBool(c.Rated) == value
+	}
+	return true
+}
+
+// chainBreak is where a history stops adding up.
+type chainBreak struct {
+	Seq    int    `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// verifyChain checks that each result hashes to its hash and links to the one
+// before, from the first one, returning the first one that doesn't.
+func verifyChain(chain []chainedResult) (chainBreak, bool) {
+	prev := genesisHash
+	for i, c := range chain {
+		switch {
+		case c.Seq != i+1:
+			return chainBreak{Seq: c.Seq, Reason: "Out of sequence"}, false
+		case c.Prev != prev:
+			return chainBreak{Seq: c.Seq, Reason: "Not linked to the previous result"}, false
+		case c.digest() != c.Hash:
+			return chainBreak{Seq: c.Seq, Reason: "Hash doesn't match the result"}, false
+		}
+		prev = c.Hash
+	}
+	return chainBreak{}, true
+}
+
+// resultChainStore keeps the history of results of each player, persisted to
+// the data directory.
+type resultChainStore struct {
+	m      *sync.Mutex
+	chains map[string][]chainedResult
+}
+
+func newResultChainStore() (*resultChainStore, error) {
+	s := &resultChainStore{
+		m:      &sync.Mutex{},
+		chains: make(map[string][]chainedResult),
+	}
+	if err := loadJSON(resultChainsFile, &s.chains); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// append adds the game to the histories of its players, but the computer's.
+func (s *resultChainStore) append(g finishedGame) error {
+	sum := sha256.Sum256([]byte(g.pgn))
+	res := chainedResult{
+		GameId:   g.gameId,
+		White:    gamePlayer{Id: g.white.id, Username: g.white.username},
+		Black:    gamePlayer{Id: g.black.id, Username: g.black.username},
+		Variant:  g.setup.variant().Name(),
+		Result:   g.result,
+		Rated:    g.rated,
+		PGNHash:  hex.EncodeToString(sum[:]),
+		Finished: g.finished,
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, uid := range []string{g.white.id, g.black.id} {
+		if strings.HasPrefix(uid, engineUserPrefix) {
+			continue
+		}
+		chain := s.chains[uid]
+		res.Seq, res.Prev = len(chain)+1, genesisHash
+		if len(chain) > 0 {
+			res.Prev = chain[len(chain)-1].Hash
+		}
+		res.Hash = res.digest()
+		s.chains[uid] = append(chain, res)
+	}
+	return saveJSON(resultChainsFile, s.chains)
+}
+
+// get returns the history of the player, oldest first.
+func (s *resultChainStore) get(uid string) []chainedResult {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]chainedResult(nil), s.chains[uid]...)
+}
+
+// head returns the hash of the latest result of the chain, which vouches for
+// all of them.
+func head(chain []chainedResult) string {
+	if len(chain) == 0 {
+		return genesisHash
+	}
+	return chain[len(chain)-1].Hash
+}
+
+// chainResults adds the finished game to the histories of its players.
+func (rout *router) chainResults(g finishedGame) {
+	if err := rout.resultChains.append(g); err != nil {
+		rootLogger.error("Could not save result chains", "err", err)
+		return
+	}
+	rout.stamps.touch(profileStamp(g.white.id), profileStamp(g.black.id))
+}
+
+// List the results of a player, each with the hash of the one before, and the
+// hash of the latest one.
+func (rout *router) handleResultChain(w http.ResponseWriter, r *http.Request) {
+	q, err := resultChainListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chain := rout.resultChains.get(mux.Vars(r)["uid"])
+	items := make([]pageItem, 0, len(chain))
+	for _, c := range chain {
+		items = append(items, c)
+	}
+	page, next := paginate(items, q)
+	results := make([]chainedResult, 0, len(page))
+	for _, item := range page {
+		results = append(results, item.(chainedResult))
+	}
+	res := pageResponse("results", results, next)
+	res["head"] = head(chain)
+	res["length"] = len(chain)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// chainVerification is the outcome of checking a history of results.
+type chainVerification struct {
+	Valid  bool `json:"valid"`
+	Length int  `json:"length"`
+	// Hash of the latest result of the history kept by the server.
+	Head   string      `json:"head"`
+	Broken *chainBreak `json:"broken,omitempty"`
+}
+
+// Verify the history of results of a player as kept by the server or, given
+// an export of it, that the export is part of it unchanged.
+func (rout *router) handleVerifyResultChain(w http.ResponseWriter, r *http.Request) {
+	chain := rout.resultChains.get(mux.Vars(r)["uid"])
+	res := chainVerification{Valid: true, Length: len(chain), Head: head(chain)}
+	if broken, ok := verifyChain(chain); !ok {
+		requestLogger(r).warn("Result chain broken", "uid", mux.Vars(r)["uid"], "seq", broken.Seq)
+		res.Valid, res.Broken = false, &broken
+	} else if records := r.FormValue("records"); records != "" {
+		var exported []chainedResult
+		if err := json.Unmarshal([]byte(records), &exported); err != nil {
+			writeError(w, "Invalid records: " + err.Error(), http.StatusBadRequest)
+			return
+		}
+		if broken, ok := verifyExport(chain, exported); !ok {
+			res.Valid, res.Broken = false, &broken
+		}
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// verifyExport checks that the exported results hash to their hashes and are
+// the same as those of the chain, in any order and any subset of them.
+func verifyExport(chain []chainedResult, exported []chainedResult) (chainBreak, bool) {
+	if len(exported) == 0 {
+		return chainBreak{Reason: "No records given"}, false
+	}
+	for _, c := range exported {
+		if c.digest() != c.Hash {
+			return chainBreak{Seq: c.Seq, Reason: "Hash doesn't match the result"}, false
+		}
+		if c.Seq < 1 || c.Seq > len(chain) || chain[c.Seq-1].Hash != c.Hash {
+			return chainBreak{Seq: c.Seq, Reason: "Not in the history of the player"}, false
+		}
+	}
+	return chainBreak{}, true
+}
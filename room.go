@@ -2,8 +2,18 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"time"
+
+	"github.com/luisguve/princechess-server/internal/clock"
+	"github.com/luisguve/princechess-server/internal/game"
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+var (
+	errMoveOffTurn   = errors.New("it's not your turn")
+	errMoveAfterGame = errors.New("the game is over")
+	errMoveIllegal   = errors.New("the move is not legal in the game")
 )
 
 // Room maintains a couple of active clients (black & white) and broadcasts
@@ -12,8 +22,8 @@ type Room struct {
 	white *player
 	black *player
 
-	// Duration of the game in minutes
-	duration time.Duration
+	// Time added to the clock of a player after each of their moves
+	increment time.Duration
 
 	// Unregister players.
 	unregister chan *player
@@ -21,14 +31,86 @@ type Room struct {
 	// Inbound moves from the players.
 	broadcastMove chan move
 
+	// Inbound premoves of the players not on turn.
+	broadcastPremove chan premove
+
+	// Move premoved by a player, in UCI, and their color: "w" or "b".
+	premove      string
+	premoveColor string
+
+	// Color of the player who made the last move, empty before the first
+	// move of the game.
+	lastMover string
+	// Plies played in the current game.
+	plies int
+	// Moves of the current game as the spectators saw them, for replays,
+	// and when the last one was played.
+	played  []replayMove
+	movedAt time.Time
+
+	// Board of the room in a bughouse game, nil in games of two.
+	bughouse *bughouseBoard
+
+	// Whether the room is for training against the computer, with takebacks
+	// and hints.
+	training bool
+	// Inbound player colors asking to take their last move back, and for a
+	// hint.
+	broadcastTakeback chan string
+	requestHint       chan string
+
+	// Inbound player colors going blindfold, and the user ids of the players
+	// playing the current game blindfold.
+	broadcastBlindfold chan string
+	blindfold          map[string]bool
+	// Callback to send the events of the game to its spectators
+	tellSpectators func(payload interface{})
+
+	// Spectators following the game, and the ones coming and going.
+	watchers map[*watcher]bool
+	// Spectators beyond conf.MaxWatchers, following the cache instead.
+	overflow map[*watcher]bool
+	cache    *spectatorCache
+	watch    chan *watcher
+	unwatch  chan *watcher
+	// Closed once the room stops hosting the game.
+	closed chan struct{}
+	// Spectators the players were last told they have.
+	spectators int
+	// Inbound messages of the commentators, for the spectators.
+	commentary chan publicMessage
+	// Inbound requests of the dashboard for the state of the room.
+	inspections chan chan roomSummary
+
+	// How long the spectators are kept behind the players, and the operator
+	// changing it.
+	broadcastDelay    time.Duration
+	setBroadcastDelay chan time.Duration
+	// Messages held back from the spectators, in order, and the timer
+	// releasing the first one.
+	heldBack  []spectatorUpdate
+	heldTimer clock.Timer
+	// State of the game as the spectators see it, while behind, and
+	// whether it's over there.
+	spectatorView     []byte
+	spectatorViewOver bool
+
 	// Inbound chat messages from the players.
 	broadcastChat chan message
 
+	// Chat rate limits of the players, and the bans from the chat of the
+	// game.
+	chatLimiter *chatLimiter
+	silenced    func(uid string) (notice, bool)
+
 	// Channel to listen to when one of the players' clocks reached zero.
 	broadcastNoTime chan string
 
 	// Inbound player color offering draw
 	broadcastDrawOffer chan string
+	// Color of the player whose draw offer stands, until their opponent
+	// moves or the game ends; empty if none.
+	drawOffer string
 
 	// Inbound player color accepting draw
 	broadcastAcceptDraw chan string
@@ -37,8 +119,10 @@ type Room struct {
 	broadcastResign chan string
 
 	// Channel to listen to when the game is over by checkmate, prince promoted,
-	// stalemate or drawn position.
-	stopClocks chan bool
+	// stalemate or drawn position. It carries the result reported by the
+	// player, if any, which rated games don't take: the server ends those
+	// by the rules.
+	stopClocks chan string
 
 	// Inbound player color offering rematch
 	broadcastRematchOffer chan string
@@ -52,17 +136,72 @@ type Room struct {
 	// Callback to switch colors on rematch
 	switchColors func()
 
+	// Whether the results of the games in the room update the ratings
+	rated bool
+	// Callback to update the ratings with the result of a rated game
+	recordResult func(g finishedGame)
+	// Result of the current game; empty while it is being played
+	result string
+	// Callback to keep the finished games for analysis
+	recordGame func(g finishedGame)
+	// Callback to count a rated game left when losing against the player
+	recordAbandonment func(uid, gameId string)
+	// Progress of the analyses of the games of the room, for the players
+	analysisProgress chan []byte
+
 	// Channel to listen to when one of the players disconnects
 	disconnect chan *player
 	// Channel to listen to when one of the players reconnects
 	reconnect chan *player
 	// Variable to know when one of the players disconnected
 	waitingPlayer bool
-	waitingTimer *time.Timer
+	waitingTimer clock.Timer
+	// Aborts the current game if nobody moves in time; nil once the first
+	// move is made.
+	firstMoveTimer clock.Timer
+
+	// Closed when the server shuts down
+	shutdown <-chan struct{}
+
+	// Time source of the clocks and the reconnect window
+	clock clock.Clock
+
+	// Logger tagging the lines with the game id
+	log logger
+
+	// Moves and chat messages relayed, and messages dropped
+	moves int
+	chats int
+	drops int
 
 	pgn string
 }
 
+// startFirstMoveTimer gives the players conf.FirstMoveTimeout to make the
+// first move of the game.
+func (r *Room) startFirstMoveTimer() {
+	r.stopFirstMoveTimer()
+	if d := conf.firstMoveTimeout(); d > 0 {
+		r.firstMoveTimer = r.clock.NewTimer(d)
+	}
+}
+
+func (r *Room) stopFirstMoveTimer() {
+	if r.firstMoveTimer != nil {
+		r.firstMoveTimer.Stop()
+		r.firstMoveTimer = nil
+	}
+}
+
+// firstMoveDue fires when the players ran out of time to make the first move,
+// never once it's made.
+func (r *Room) firstMoveDue() <-chan time.Time {
+	if r.firstMoveTimer == nil {
+		return nil
+	}
+	return r.firstMoveTimer.C()
+}
+
 func (r Room) stopTimers() {
 	if r.white.clock != nil {
 		r.white.clock.Stop()
@@ -72,6 +211,140 @@ func (r Room) stopTimers() {
 	}
 }
 
+// finish records the result of the current game. Only the first result of
+// each game counts, since both players may report it.
+func (r *Room) finish(result string) {
+	if r.result != "" || !validResult(result) {
+		return
+	}
+	r.result = result
+	r.premove, r.premoveColor = "", ""
+	r.drawOffer = ""
+	r.tellWatchers(map[string]string{"gameOver": result})
+	if r.bughouse != nil {
+		// Drops can't be analyzed, and the result decides the other board
+		// too.
+		r.bughouse.decide(result)
+		return
+	}
+	g := finishedGame{
+		gameId:         r.white.gameId,
+		white:          user{id: r.white.userId, username: r.white.username},
+		black:          user{id: r.black.userId, username: r.black.username},
+		setup:          r.white.setup,
+		pgn:            r.pgn,
+		result:         result,
+		moves:          r.played,
+		clock: map[string]int64{
+			"white": r.white.Base.Milliseconds(),
+			"black": r.black.Base.Milliseconds(),
+		},
+		training:       r.training,
+		rated:          r.rated,
+		whiteBlindfold: r.blindfold[r.white.userId],
+		blackBlindfold: r.blindfold[r.black.userId],
+		notify: func(data []byte) {
+			select {
+			case r.analysisProgress<- data:
+			default:
+			}
+		},
+	}
+	r.recordGame(g)
+	if r.rated {
+		r.recordResult(g)
+	}
+}
+
+// drop counts a message not delivered to a player because their channel was
+// full.
+func (r *Room) drop(kind string) {
+	r.drops++
+	roomDrops.inc(kind)
+}
+
+// clockUpdate tells a player the time left in the clocks, along with the move
+// of the opponent that stopped theirs, if any.
+type clockUpdate struct {
+	Move *move `json:"move,omitempty"`
+	// Time left of each player and the color on turn, as of the time of the
+	// server, in milliseconds since the epoch.
+	WhiteClockMs int64  `json:"whiteClockMs"`
+	BlackClockMs int64  `json:"blackClockMs"`
+	Turn         string `json:"turn"`
+	ServerTimeMs int64  `json:"serverTimeMs"`
+	// Time added to the clock of a player after each of their moves, in
+	// milliseconds.
+	IncrementMs int64 `json:"incrementMs,omitempty"`
+	// Time left of the player told and of their opponent, as the clients
+	// older than the fields above read it.
+	Clock    int64 `json:"clock"`
+	OppClock int64 `json:"oppClock"`
+	// Tells the player their premove was played, and the game after it.
+	Premove string `json:"premove,omitempty"`
+	Pgn     string `json:"pgn,omitempty"`
+	// Result of the game and how it ended, when the move ended it.
+	GameOver string `json:"gameOver,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// clockUpdate returns the clocks for the player as of now.
+func (r *Room) clockUpdate(p *player, now time.Time) clockUpdate {
+	opp := r.white
+	if p == r.white {
+		opp = r.black
+	}
+	turn := "white"
+	if r.onTurn() == "b" {
+		turn = "black"
+	}
+	return clockUpdate{
+		WhiteClockMs: r.white.TimeLeft.Milliseconds(),
+		BlackClockMs: r.black.TimeLeft.Milliseconds(),
+		Turn:         turn,
+		ServerTimeMs: now.UnixNano() / int64(time.Millisecond),
+		IncrementMs:  r.increment.Milliseconds(),
+		Clock:        p.TimeLeft.Milliseconds(),
+		OppClock:     opp.TimeLeft.Milliseconds(),
+	}
+}
+
+// sendClocks tells both players the time left in their clocks, when the
+// players started with different times.
+func (r *Room) sendClocks() {
+	now := r.clock.Now()
+	for _, p := range []*player{r.white, r.black} {
+		data, err := json.Marshal(r.clockUpdate(p, now))
+		if err != nil {
+			r.log.error("Could not marshal data", "err", err)
+			return
+		}
+		select {
+		case p.sendMove<- data:
+		default:
+			r.drop("clock")
+		}
+	}
+}
+
+// notifyBoth sends the notice to both players, unless their connection is
+// busy or gone.
+func (r *Room) notifyBoth(n notice) {
+	for _, p := range []*player{r.white, r.black} {
+		data, err := json.Marshal(map[string]localizedNotice{
+			"notice": n.localize(p.lang),
+		})
+		if err != nil {
+			r.log.error("Could not marshal data", "err", err)
+			continue
+		}
+		select {
+		case p.sendMove<- data:
+		default:
+		}
+	}
+}
+
 func (r *Room) hostGame() {
 	defer r.cleanup()
 	defer func() {
@@ -84,16 +357,45 @@ func (r *Room) hostGame() {
 		if r.waitingTimer != nil {
 			r.waitingTimer.Stop()
 		}
+		r.stopFirstMoveTimer()
 		r.stopTimers()
+		if r.heldTimer != nil {
+			r.heldTimer.Stop()
+		}
+		close(r.closed)
+		for w := range r.watchers {
+			close(w.send)
+		}
+	}()
+	defer func() {
+		// A bug in one game must not take down the others. The game is
+		// aborted: it is left unrated and the room is closed as usual.
+		if v := recover(); v != nil {
+			reportPanic(r.log, "room", v)
+			r.notifyBoth(newNotice(noticeGameAborted))
+		}
 	}()
 	// Inform both players that the opponent is ready.
 	r.white.oppReady<- true
 	r.black.oppReady<- true
+	if r.white.Base != r.black.Base {
+		r.sendClocks()
+	}
+	if r.broadcastDelay > 0 {
+		r.startBroadcastDelay()
+	}
+	r.startFirstMoveTimer()
+	spectatorCount := time.NewTicker(spectatorCountInterval)
+	defer spectatorCount.Stop()
 	for {
-		ChannelSelector:
 		select {
 		case p := <-r.disconnect:
 			p.disconnect<- true
+			if p != r.white && p != r.black {
+				// The connection was replaced by a reconnect before
+				// it was noticed to be gone.
+				break
+			}
 			if r.waitingPlayer {
 				// Both players left the room
 				return
@@ -107,24 +409,33 @@ func (r *Room) hostGame() {
 				// Black disconnected - inform white player
 				notify = r.white
 			default:
-				log.Println("Invalid color player:", p.color)
+				r.log.error("Invalid color player", "color", p.color)
 				return
 			}
 			notify.oppDisconnected<- true
-			// Wait player for 25 seconds
-			r.waitingTimer = time.AfterFunc(5 * time.Second, func() {
+			// Leaving a rated game for good when losing counts as
+			// abandoning it.
+			abandoned := r.rated && r.result == "" && r.losing(p.color)
+			uid, gameId := p.userId, p.gameId
+			// Give the player some time to reconnect
+			r.waitingTimer = r.clock.AfterFunc(conf.reconnectGrace(), func() {
 				notify.oppGone<- true
+				if abandoned {
+					r.recordAbandonment(uid, gameId)
+				}
 			})
 			r.waitingPlayer = true
 		case p := <-r.reconnect:
-			r.waitingTimer.Stop()
+			if r.waitingTimer != nil {
+				r.waitingTimer.Stop()
+			}
 			r.waitingPlayer = false
 			switch p.color {
 			case "white":
 				// reset player clock
 				p.clock = r.white.clock
-				p.lastMove = r.white.lastMove
-				p.timeLeft = r.white.timeLeft
+				p.LastMove = r.white.LastMove
+				p.TimeLeft = r.white.TimeLeft
 				// set room
 				p.room = r
 				// reset player
@@ -134,8 +445,8 @@ func (r *Room) hostGame() {
 			case "black":
 				// reset player clock
 				p.clock = r.black.clock
-				p.lastMove = r.black.lastMove
-				p.timeLeft = r.black.timeLeft
+				p.LastMove = r.black.LastMove
+				p.TimeLeft = r.black.TimeLeft
 				// set room
 				p.room = r
 				// reset player
@@ -143,7 +454,7 @@ func (r *Room) hostGame() {
 				// Black reconnected - inform white player
 				r.white.oppReconnected<- true
 			default:
-				log.Println("Invalid color player:", p.color)
+				r.log.error("Invalid color player", "color", p.color)
 				return
 			}
 			data := map[string]string{
@@ -151,7 +462,7 @@ func (r *Room) hostGame() {
 			}
 			pgn, err := json.Marshal(data)
 			if err != nil {
-				log.Println("Could not marshal data:", err)
+				r.log.error("Could not marshal data", "err", err)
 				break
 			}
 			select {
@@ -159,90 +470,91 @@ func (r *Room) hostGame() {
 			default:
 				return
 			}
+			if r.spectators > 0 {
+				r.sendEvent(p, map[string]int{"spectators": r.spectators})
+			}
 		case <-r.unregister:
 			return
+		case w := <-r.watch:
+			r.addWatcher(w)
+		case w := <-r.unwatch:
+			r.removeWatcher(w)
+		case <-spectatorCount.C:
+			r.sendSpectatorCount()
+		case msg := <-r.commentary:
+			r.comment(msg)
+		case d := <-r.setBroadcastDelay:
+			r.changeBroadcastDelay(d)
+		case reply := <-r.inspections:
+			reply<- r.summary()
+		case <-r.heldBackDue():
+			r.releaseHeldBack()
+		case playerColor := <-r.broadcastTakeback:
+			r.takeback(playerColor)
+		case playerColor := <-r.requestHint:
+			r.hint(playerColor)
+		case playerColor := <-r.broadcastBlindfold:
+			r.declareBlindfold(playerColor)
+		case ev := <-r.bughouse.eventsFor():
+			r.handleBughouseEvent(ev)
+		case data := <-r.analysisProgress:
+			for _, p := range []*player{r.white, r.black} {
+				select {
+				case p.sendEvent<- data:
+				default:
+				}
+			}
+		case <-r.firstMoveDue():
+			// Nobody started the game: it's aborted with no result, so
+			// that the players are free to play another one.
+			r.log.info("Game aborted: no first move")
+			r.notifyBoth(newNotice(noticeNoFirstMove, conf.firstMoveTimeout()))
+			return
+		case <-r.shutdown:
+			// The game is aborted, so it doesn't count for the ratings.
+			r.notifyBoth(newNotice(noticeServerShutdown))
+			return
 		case msg := <-r.broadcastChat:
+			ok, reason := r.chatLimiter.allow(msg.userId, r.clock.Now())
+			if n, banned := r.silenced(msg.userId); banned {
+				ok, reason = false, n
+			}
+			if !ok {
+				sender := r.white
+				if r.black.userId == msg.userId {
+					sender = r.black
+				}
+				sender.chatError(reason)
+				break
+			}
 			select {
 			case r.white.sendChat<- msg:
 			default:
-				log.Println("Returning: white's chat channel buffer is full")
+				r.drop("chat")
+				r.log.error("Returning: white's chat channel buffer is full")
 				return
 			}
 			select {
 			case r.black.sendChat<- msg:
 			default:
-				log.Println("Returning: black's chat channel buffer is full")
+				r.drop("chat")
+				r.log.error("Returning: black's chat channel buffer is full")
 				return
 			}
+			r.chats++
+			roomChats.inc()
 		case move := <-r.broadcastMove:
-			// Save pgn
-			r.pgn = move.Pgn
-			var turn, opp *player
-
-			switch move.Color {
-			case "w":
-				turn = r.white
-				opp = r.black
-			case "b":
-				turn = r.black
-				opp = r.white
-			default:
-				log.Println("Invalid color move:", move.Color)
-				break ChannelSelector
-			}
-
-			elapsed := 0 * time.Second
-			now := time.Now()
-
-			// Update elapsed time if not the first move
-			if !turn.lastMove.IsZero() && !opp.lastMove.IsZero() {
-				elapsed = now.Sub(opp.lastMove)
-			}
-			// Opponent has moved? reset his clock
-			if !opp.lastMove.IsZero() {
-				opp.clock.Reset(opp.timeLeft)
-			}
-
-			turn.lastMove = now
-			turn.timeLeft -= elapsed
-			turn.clock.Stop()
-
-			// Send my time left along with my move to the opponent.
-			// Also send him his time left.
-			data := make(map[string]interface{})
-			err := json.Unmarshal(move.move, &data)
-			if err != nil {
-				log.Println("Could not unmarshal move:", err)
-				break
-			}
-
-			data["oppClock"] = turn.timeLeft.Milliseconds()
-			data["clock"] = opp.timeLeft.Milliseconds()
-			if move.move, err = json.Marshal(data); err != nil {
-				log.Println("Could not marshal data:", err)
+			if r.bughouse != nil && !r.playBughouse(move) {
 				break
 			}
-			data = map[string]interface{}{
-				"oppClock": opp.timeLeft.Milliseconds(),
-				"clock":    turn.timeLeft.Milliseconds(),
-			}
-
-			select {
-			case opp.sendMove<- move.move:
-			default:
-				// Opponent's connection was lost.
-			}
-			// Send me the opponent's time left.
-			var oppTimeLeft []byte
-			if oppTimeLeft, err = json.Marshal(data); err != nil {
-				log.Println("Could not marshal oppTimeLeft:", err)
-				break
-			}
-			select {
-			case turn.sendMove<- oppTimeLeft:
-			default:
-				// Turn's connection was lost.
+			if move.Color == r.premoveColor {
+				// The player moved themselves.
+				r.premove, r.premoveColor = "", ""
 			}
+			r.relayMove(move, false)
+			r.playPremove()
+		case pm := <-r.broadcastPremove:
+			r.setPremove(pm)
 		case playerColor := <-r.broadcastNoTime:
 			if r.waitingPlayer {
 				break
@@ -252,15 +564,17 @@ func (r *Room) hostGame() {
 			case "white":
 				// White ran out ouf time - inform black player
 				r.black.oppRanOut<- true
+				r.finish(resultBlackWins)
 			case "black":
 				// Black ran out ouf time - inform white player
 				r.white.oppRanOut<- true
+				r.finish(resultWhiteWins)
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
 		case playerColor := <-r.broadcastDrawOffer:
-			if r.waitingPlayer {
+			if r.waitingPlayer || r.result != "" {
 				break
 			}
 			// Who is offering draw?
@@ -272,11 +586,13 @@ func (r *Room) hostGame() {
 				// Send draw offer to white player.
 				r.white.drawOffer<- true
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
+			r.drawOffer = playerColor
 		case playerColor := <-r.broadcastAcceptDraw:
-			if r.waitingPlayer {
+			if r.waitingPlayer || r.drawOffer == "" || r.drawOffer == playerColor {
+				// There's no draw offer of the opponent to accept.
 				break
 			}
 			// Who is accepting draw?
@@ -288,10 +604,11 @@ func (r *Room) hostGame() {
 				// Send draw accept signal to white player.
 				r.white.oppAcceptedDraw<- true
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
 			r.stopTimers()
+			r.finish(resultDraw)
 		case playerColor := <-r.broadcastResign:
 			if r.waitingPlayer {
 				break
@@ -301,18 +618,25 @@ func (r *Room) hostGame() {
 			case "white":
 				// White resigned - inform black player
 				r.black.oppResigned<- true
+				r.finish(resultBlackWins)
 			case "black":
 				// Black resigned - inform white player
 				r.white.oppResigned<- true
+				r.finish(resultWhiteWins)
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
 			r.stopTimers()
-		case <-r.stopClocks:
+		case result := <-r.stopClocks:
+			if r.rated {
+				break
+			}
 			r.stopTimers()
+			r.finish(result)
 		case playerColor := <-r.broadcastRematchOffer:
-			if r.waitingPlayer {
+			if r.waitingPlayer || r.bughouse != nil {
+				// Teams can't be kept in a rematch of a single board.
 				break
 			}
 			// Who is offering rematch?
@@ -324,7 +648,7 @@ func (r *Room) hostGame() {
 				// Send rematch offer to white player
 				r.white.rematchOffer<- true
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
 		case playerColor := <-r.broadcastAcceptRematch:
@@ -340,21 +664,187 @@ func (r *Room) hostGame() {
 				// Send rematch response to white player
 				r.white.oppAcceptedRematch<- true
 			default:
-				log.Println("Invalid color player:", playerColor)
+				r.log.error("Invalid color player", "color", playerColor)
 				return
 			}
 			// Switch colors and reset clocks
 			r.switchColors()
 			r.white, r.black = switchColors(r.white, r.black)
-			r.white.timeLeft = r.duration
-			r.white.lastMove = time.Time{}
-			r.black.timeLeft = r.duration
-			r.black.lastMove = time.Time{}
+			r.white.Restart()
+			r.black.Restart()
+			r.result = ""
+			r.lastMover = ""
+			r.drawOffer = ""
+			r.pgn = ""
+			r.plies = 0
+			r.played, r.movedAt = nil, time.Time{}
+			r.premove, r.premoveColor = "", ""
+			r.blindfold = make(map[string]bool)
+			if r.white.Base != r.black.Base {
+				r.sendClocks()
+			}
+			r.startFirstMoveTimer()
+			r.tellWatchers(r.snapshot())
 		}
 	}
 }
 
 
+// followMove checks that the game of the move is the game of the room plus
+// the move, legal in the position reached. The PGN of the move is rewritten
+// as the server writes it. It returns the position after the move, nil in
+// bughouse games, whose drops the rules don't know of.
+func (r *Room) followMove(m *move) (*rules.Position, error) {
+	if r.result != "" {
+		return nil, errMoveAfterGame
+	}
+	if m.Color != r.onTurn() {
+		return nil, errMoveOffTurn
+	}
+	if r.bughouse != nil {
+		return nil, nil
+	}
+	start, _, moves, err := r.position()
+	if err != nil {
+		return nil, err
+	}
+	pos, next, err := rules.ParsePGN(start, m.Pgn)
+	if err != nil || len(next) != len(moves)+1 {
+		return nil, errMoveIllegal
+	}
+	for i := range moves {
+		if next[i] != moves[i] {
+			return nil, errMoveIllegal
+		}
+	}
+	m.Pgn = r.white.setup.pgnHeaders() + rules.FormatMoves(start, next)
+	return pos, nil
+}
+
+// refuseMove tells the player their move was not played, and the game as it
+// stands for their client to catch up.
+func (r *Room) refuseMove(p *player, reason error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"moveRefused": newNotice(noticeIllegalMove, reason).localize(p.lang),
+		"pgn":         r.pgn,
+	})
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	select {
+	case p.sendMove<- data:
+	default:
+		r.drop("move")
+	}
+}
+
+// relayMove saves the move and sends it to the opponent of the player who
+// made it, with the clocks updated, unless it's not legal in the game.
+// Premoves tell the player who made them they were played. The game is over
+// if the move ends it by the rules.
+func (r *Room) relayMove(move move, premove bool) {
+	start := time.Now()
+	var turn, opp *player
+
+	switch move.Color {
+	case "w":
+		turn = r.white
+		opp = r.black
+	case "b":
+		turn = r.black
+		opp = r.white
+	default:
+		r.log.error("Invalid color move", "color", move.Color)
+		return
+	}
+	pos, err := r.followMove(&move)
+	if err != nil {
+		r.log.info("Move refused", "color", move.Color, "err", err)
+		r.refuseMove(turn, err)
+		return
+	}
+	var result, reason string
+	if pos != nil {
+		result, reason = r.white.setup.variant().Outcome(pos)
+	}
+
+	// Save pgn
+	r.pgn = move.Pgn
+	r.lastMover = move.Color
+	r.plies++
+	if r.drawOffer != "" && r.drawOffer[:1] != move.Color {
+		// Moving declines the draw offered.
+		r.drawOffer = ""
+	}
+	r.stopFirstMoveTimer()
+
+	now := r.clock.Now()
+
+	// Opponent has moved? reset his clock
+	if opp.Moved() {
+		opp.clock.Reset(opp.TimeLeft)
+	}
+	game.Move(&turn.Clock, &opp.Clock, r.increment, now)
+	turn.clock.Stop()
+
+	// Send my move to the opponent along with the clocks, and the clocks to
+	// me.
+	relayed := r.clockUpdate(opp, now)
+	relayed.Move = &move
+	relayed.GameOver, relayed.Reason = result, reason
+	data, err := json.Marshal(relayed)
+	if err != nil {
+		r.log.error("Could not marshal move", "err", err)
+		return
+	}
+	ack := r.clockUpdate(turn, now)
+	ack.GameOver, ack.Reason = result, reason
+	if premove {
+		// The player's client learns the move it premoved was played.
+		ack.Premove = "played"
+		ack.Pgn = move.Pgn
+	}
+
+	select {
+	case opp.sendMove<- data:
+	default:
+		// Opponent's connection was lost.
+		r.drop("move")
+	}
+	// Send me the clocks.
+	if data, err = json.Marshal(ack); err != nil {
+		r.log.error("Could not marshal clocks", "err", err)
+		return
+	}
+	select {
+	case turn.sendMove<- data:
+	default:
+		// Turn's connection was lost.
+		r.drop("clock")
+	}
+	r.tellWatchers(map[string]interface{}{
+		"move": map[string]string{
+			"color": move.Color,
+			"pgn":   move.Pgn,
+		},
+		"ply":   r.plies,
+		"clock": r.clocks(),
+	})
+	r.recordMove(move, now)
+	if result != "" {
+		r.stopTimers()
+		r.finish(result)
+	}
+	r.moves++
+	roomMoves.inc()
+	took := time.Since(start)
+	roomBroadcast.observe(took)
+	if took > slowBroadcast {
+		r.log.warn("Slow move broadcast", "took", took, "moves", r.moves, "chats", r.chats, "drops", r.drops)
+	}
+}
+
 func switchColors(white, black *player) (*player, *player) {
 	white.color = "black"
 	black.color = "white"
@@ -5,7 +5,26 @@
 package main
 
 import (
-	"log"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/clock"
+)
+
+// Close code of the game connection of a player whose opponent never showed
+// up.
+const closeRoomAbandoned = 4005
+
+var (
+	// Number of rooms closed because one of the players never joined them.
+	roomsCollected = expvar.NewInt("roomsCollected")
+
+	// Rooms open, and the ones of them waiting for the second player, by
+	// pool.
+	roomsOpen       = expvar.NewMap("roomsOpen")
+	roomsHalfFilled = expvar.NewMap("roomsHalfFilled")
 )
 
 type players struct {
@@ -13,49 +32,83 @@ type players struct {
 	black *player
 }
 
-// roomMatcher listens for players and matches them according to the minutes specified.
+// roomMatcher listens for players and matches them according to the time
+// control of their game, with a listener for each time control started the
+// first time a player is seated with it.
 type roomMatcher struct {
-	// Rooms mapped to players.
-	rooms1Min  map[string]players
-	rooms3Min  map[string]players
-	rooms5Min  map[string]players
-	rooms10Min map[string]players
-
-	// Inbound channels to register players into rooms.
-	registerPlayer1Min  chan *player
-	registerPlayer3Min  chan *player
-	registerPlayer5Min  chan *player
-	registerPlayer10Min chan *player
-
-	// Channels to notify when a game finished
-	finish1MinGame  chan string
-	finish3MinGame  chan string
-	finish5MinGame  chan string
-	finish10MinGame chan string
+	m *sync.Mutex
+	// Listeners by time control.
+	pools map[timeControl]*roomPool
+
+	// Closed when the server shuts down, to abort the games in progress.
+	shutdown chan struct{}
+
+	// Games being hosted.
+	games *sync.WaitGroup
+
+	// Time source of the games.
+	clock clock.Clock
+
+	// Rooms hosting a game, for the spectators.
+	live *liveRooms
 }
 
 func newRoomMatcher() *roomMatcher {
 	return &roomMatcher{
-		rooms1Min:           make(map[string]players),
-		rooms3Min:           make(map[string]players),
-		rooms5Min:           make(map[string]players),
-		rooms10Min:          make(map[string]players),
-		registerPlayer1Min:  make(chan *player),
-		registerPlayer3Min:  make(chan *player),
-		registerPlayer5Min:  make(chan *player),
-		registerPlayer10Min: make(chan *player),
-		finish1MinGame:      make(chan string),
-		finish3MinGame:      make(chan string),
-		finish5MinGame:      make(chan string),
-		finish10MinGame:     make(chan string),
+		m:        &sync.Mutex{},
+		pools:    make(map[timeControl]*roomPool),
+		shutdown: make(chan struct{}),
+		games:    &sync.WaitGroup{},
+		clock:    clock.Real,
+		live:     newLiveRooms(),
+	}
+}
+
+// roomPool is the listener of the rooms of a time control.
+type roomPool struct {
+	// Rooms mapped to players.
+	rooms map[string]players
+
+	// Inbound channel to register players into rooms.
+	register chan *player
+
+	// Channel to notify when a game finished
+	finishGame chan string
+}
+
+// pool returns the listener of the rooms of the time control, starting it if
+// it's the first game with it.
+func (wr *roomMatcher) pool(control timeControl) *roomPool {
+	wr.m.Lock()
+	defer wr.m.Unlock()
+	rp, ok := wr.pools[control]
+	if !ok {
+		rp = &roomPool{
+			rooms:      make(map[string]players),
+			register:   make(chan *player),
+			finishGame: make(chan string),
+		}
+		wr.pools[control] = rp
+		go wr.listen(control.String(), rp)
 	}
+	return rp
 }
 
-func (*roomMatcher) listen(register chan *player, finishGame chan string, rooms map[string]players) {
+func (wr *roomMatcher) listen(pool string, rp *roomPool) {
+	rooms := rp.rooms
+	// Time the first player joined each of the rooms waiting for the second.
+	halfFilled := make(map[string]time.Time)
+	sweep := time.NewTicker(conf.RoomSweepInterval)
+	defer sweep.Stop()
+	open, waiting := new(expvar.Int), new(expvar.Int)
+	roomsOpen.Set(pool, open)
+	roomsHalfFilled.Set(pool, waiting)
 	for {
+		open.Set(int64(len(rooms)))
+		waiting.Set(int64(len(halfFilled)))
 		MatchSelector:
 		select {
-		case p := <-register:
+		case p := <-rp.register:
 			pp := rooms[p.gameId]
 			// See if user is reconnecting
 			if pp.white != nil && pp.black != nil {
@@ -68,7 +121,7 @@ func (*roomMatcher) listen(register chan *player, finishGame chan string, rooms
 			case "black":
 				pp.black = p
 			default:
-				log.Println("Invalid color player:", p.color)
+				p.log.error("Invalid color player", "color", p.color)
 				break MatchSelector
 			}
 			// Set up room if both players have joined
@@ -76,39 +129,95 @@ func (*roomMatcher) listen(register chan *player, finishGame chan string, rooms
 				r := &Room{
 					white:                  pp.white,
 					black:                  pp.black,
-					duration:               p.timeLeft,
+					increment:              p.increment,
 					unregister:             make(chan *player),
 					broadcastMove:          make(chan move),
+					broadcastPremove:       make(chan premove),
 					broadcastChat:          make(chan message),
+					chatLimiter:            newChatLimiter(),
 					broadcastNoTime:        make(chan string),
 					broadcastDrawOffer:     make(chan string),
 					broadcastAcceptDraw:    make(chan string),
 					broadcastResign:        make(chan string),
 					broadcastRematchOffer:  make(chan string),
 					broadcastAcceptRematch: make(chan string),
-					stopClocks:             make(chan bool),
+					stopClocks:             make(chan string),
+					broadcastTakeback:      make(chan string),
+					requestHint:            make(chan string),
+					broadcastBlindfold:     make(chan string),
+					setBroadcastDelay:      make(chan time.Duration),
+					commentary:             make(chan publicMessage),
+					inspections:            make(chan chan roomSummary),
 					cleanup: func() {
-						finishGame<- p.gameId
+						rp.finishGame<- p.gameId
 						p.cleanup()
 					},
-					switchColors: p.switchColors,
-					disconnect:   make(chan *player),
-					reconnect:    make(chan *player),
+					switchColors:     p.switchColors,
+					rated:            p.rated,
+					recordResult:     p.recordResult,
+					recordGame:       p.recordGame,
+					recordAbandonment: p.recordAbandonment,
+					silenced:         p.silenced,
+					analysisProgress: make(chan []byte, 8),
+					bughouse:         p.bughouse,
+					training:         p.training,
+					blindfold:        make(map[string]bool),
+					tellSpectators:   p.tellSpectators,
+					watchers:         make(map[*watcher]bool),
+					overflow:         make(map[*watcher]bool),
+					cache:            newSpectatorCache(),
+					watch:            make(chan *watcher),
+					unwatch:          make(chan *watcher),
+					closed:           make(chan struct{}),
+					broadcastDelay:   wr.live.delay(p.gameId),
+					disconnect:       make(chan *player),
+					reconnect:        make(chan *player),
+					shutdown:         wr.shutdown,
+					clock:            wr.clock,
+					log:              rootLogger.with("game", p.gameId),
 				}
-				go r.hostGame()
+				// Seated before the room tells them it's ready.
 				pp.white.room = r
 				pp.black.room = r
+				wr.games.Add(1)
+				wr.live.add(p.gameId, r)
+				go func() {
+					defer wr.games.Done()
+					defer wr.live.remove(r.white.gameId, r)
+					r.hostGame()
+				}()
+				delete(halfFilled, p.gameId)
+			} else if _, ok := halfFilled[p.gameId]; !ok {
+				halfFilled[p.gameId] = wr.clock.Now()
 			}
 			rooms[p.gameId] = pp
-		case gameId := <-finishGame:
+		case gameId := <-rp.finishGame:
 			delete(rooms, gameId)
+		case <-sweep.C:
+			now := wr.clock.Now()
+			for gameId, since := range halfFilled {
+				if now.Sub(since) < conf.HalfRoomTTL {
+					continue
+				}
+				collectRoom(rooms[gameId])
+				delete(rooms, gameId)
+				delete(halfFilled, gameId)
+				roomsCollected.Add(1)
+			}
 		}
 	}
 }
 
-func (wr *roomMatcher) listenAll() {
-	go wr.listen(wr.registerPlayer1Min, wr.finish1MinGame, wr.rooms1Min)    // 1 minute games
-	go wr.listen(wr.registerPlayer3Min, wr.finish3MinGame, wr.rooms3Min)    // 3 minute games
-	go wr.listen(wr.registerPlayer5Min, wr.finish5MinGame, wr.rooms5Min)    // 5 minute games
-	go wr.listen(wr.registerPlayer10Min, wr.finish10MinGame, wr.rooms10Min) // 10 minute games
+// collectRoom closes a room whose second player never joined, disconnecting
+// the player waiting in it.
+func collectRoom(pp players) {
+	p := pp.white
+	if p == nil {
+		p = pp.black
+	}
+	p.log.info("Closing abandoned room")
+	payload := websocket.FormatCloseMessage(closeRoomAbandoned, "OPPONENT_NEVER_JOINED")
+	p.conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(conf.WriteWait))
+	p.conn.Close()
+	p.cleanup()
 }
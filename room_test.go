@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/clock"
+	"github.com/luisguve/princechess-server/internal/protocol/protocoltest"
+)
+
+// testGame seats two players in a room running on a fake clock, starting from
+// the setup. The players have no connection: the test reads what the room
+// sends them. Finished games aren't recorded.
+func testGame(t *testing.T, control timeControl, s setup) (r *Room, white, black *player, c *clock.Fake) {
+	t.Helper()
+	return seatTestGame(t, control, s, false)
+}
+
+// testRatedGame is testGame for a rated game. The ratings aren't updated.
+func testRatedGame(t *testing.T, control timeControl, s setup) (r *Room, white, black *player, c *clock.Fake) {
+	t.Helper()
+	return seatTestGame(t, control, s, true)
+}
+
+func seatTestGame(t *testing.T, control timeControl, s setup, rated bool) (r *Room, white, black *player, c *clock.Fake) {
+	t.Helper()
+	c = clock.NewFake(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	rout := &router{
+		rm:       newRoomMatcher(),
+		matches:  newMatchTable(),
+		bughouse: newBughouseTable(),
+	}
+	rout.rm.clock = c
+	const gameId = "game"
+	newPlayer := func(color string) *player {
+		p := rout.newPlayer(nil, gameId, color, control, control.base, s, rated, func() {}, func() {},
+			color, color + "Id", "en", rootLogger)
+		p.recordGame = func(finishedGame) {}
+		p.recordResult = func(finishedGame) {}
+		return p
+	}
+	white, black = newPlayer("white"), newPlayer("black")
+	rout.seat(white, control)
+	rout.seat(black, control)
+	<-white.oppReady
+	<-black.oppReady
+	r, ok := rout.rm.live.get(gameId)
+	if !ok {
+		t.Fatal("room not set up")
+	}
+	return r, white, black, c
+}
+
+// play has the room relay the game, one move longer, returning the clocks the
+// player moving was sent back.
+func play(t *testing.T, r *Room, turn, opp *player, color, pgn string) clockUpdate {
+	t.Helper()
+	r.broadcastMove<- move{Color: color, Pgn: pgn}
+	<-opp.sendMove
+	var ack clockUpdate
+	if err := json.Unmarshal(<-turn.sendMove, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack
+}
+
+func TestRoomIncrement(t *testing.T) {
+	control := timeControl{base: time.Minute, increment: 2 * time.Second}
+	r, white, black, c := testGame(t, control, setup{})
+	defer func() { r.unregister<- white }()
+
+	// The first move of each player takes no time off their clock.
+	if ack := play(t, r, white, black, "w", "1. e4"); ack.WhiteClockMs != 62000 {
+		t.Errorf("white has %dms after the first move, want 62000", ack.WhiteClockMs)
+	}
+	c.Advance(5 * time.Second)
+	if ack := play(t, r, black, white, "b", "1. e4 e5"); ack.BlackClockMs != 62000 {
+		t.Errorf("black has %dms after the first move, want 62000", ack.BlackClockMs)
+	}
+	c.Advance(3 * time.Second)
+	ack := play(t, r, white, black, "w", "1. e4 e5 2. Nf3")
+	if ack.WhiteClockMs != 61000 || ack.BlackClockMs != 62000 {
+		t.Errorf("clocks are %d/%d after a 3s move, want 61000/62000", ack.WhiteClockMs, ack.BlackClockMs)
+	}
+	if ack.IncrementMs != 2000 {
+		t.Errorf("increment is %dms, want 2000", ack.IncrementMs)
+	}
+}
+
+func TestRoomFlag(t *testing.T) {
+	control := timeControl{base: time.Minute}
+	r, white, black, c := testGame(t, control, setup{})
+	defer func() { r.unregister<- white }()
+
+	play(t, r, white, black, "w", "1. e4")
+	play(t, r, black, white, "b", "1. e4 e5")
+	// White's clock runs from black's move on.
+	c.Advance(time.Minute - time.Millisecond)
+	select {
+	case <-white.clock.C():
+		t.Fatal("white flagged with time left")
+	default:
+	}
+	c.Advance(time.Millisecond)
+	select {
+	case <-white.clock.C():
+	default:
+		t.Fatal("white didn't flag")
+	}
+	select {
+	case <-black.clock.C():
+		t.Fatal("black flagged while white was on turn")
+	default:
+	}
+
+	// What the write pump of white does on flagging.
+	r.broadcastNoTime<- "white"
+	<-black.oppRanOut
+	inspect := make(chan roomSummary)
+	r.inspections<- inspect
+	if s := <-inspect; s.Result != resultBlackWins {
+		t.Errorf("result is %q, want %q", s.Result, resultBlackWins)
+	}
+}
+
+// refused reads what the room told the player about their refused move.
+func refused(t *testing.T, p *player) string {
+	t.Helper()
+	var res struct {
+		MoveRefused localizedNotice `json:"moveRefused"`
+	}
+	if err := json.Unmarshal(<-p.sendMove, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.MoveRefused.Code
+}
+
+func TestRoomRefusesMoves(t *testing.T) {
+	r, white, black, _ := testGame(t, timeControl{base: time.Minute}, setup{})
+	defer func() { r.unregister<- white }()
+
+	tests := []struct {
+		p     *player
+		color string
+		pgn   string
+	}{
+		{black, "b", "1... e5"},
+		{white, "w", "1. e5"},
+		{white, "w", "1. e4 e5"},
+		{white, "w", "1. Qh5"},
+	}
+	for _, tt := range tests {
+		r.broadcastMove<- move{Color: tt.color, Pgn: tt.pgn}
+		if code := refused(t, tt.p); code != noticeIllegalMove {
+			t.Errorf("%s playing %q told %q, want %q", tt.color, tt.pgn, code, noticeIllegalMove)
+		}
+	}
+	// The game goes on from where it was.
+	play(t, r, white, black, "w", "1. e4")
+	r.broadcastMove<- move{Color: "b", Pgn: "1. d4 e5"}
+	if code := refused(t, black); code != noticeIllegalMove {
+		t.Errorf("move after another game told %q, want %q", code, noticeIllegalMove)
+	}
+}
+
+func TestRoomEndsTheGameOnPromotedPrince(t *testing.T) {
+	s := setup{Variant: variantStandard, FEN: "4k3/2I5/8/8/8/8/8/4K3 w - - 0 1"}
+	r, white, black, _ := testGame(t, timeControl{base: time.Minute}, s)
+	defer func() { r.unregister<- white }()
+
+	ack := play(t, r, white, black, "w", "1. Ic8")
+	if ack.GameOver != resultWhiteWins || ack.Reason != "princePromoted" {
+		t.Errorf("game over %q by %q, want %q by princePromoted", ack.GameOver, ack.Reason, resultWhiteWins)
+	}
+	inspect := make(chan roomSummary)
+	r.inspections<- inspect
+	if s := <-inspect; s.Result != resultWhiteWins {
+		t.Errorf("result is %q, want %q", s.Result, resultWhiteWins)
+	}
+	r.broadcastMove<- move{Color: "b", Pgn: "1. Ic8 Kd7"}
+	if code := refused(t, black); code != noticeIllegalMove {
+		t.Errorf("move after the game told %q, want %q", code, noticeIllegalMove)
+	}
+}
+
+// result asks the room for the result of its game.
+func result(r *Room) string {
+	inspect := make(chan roomSummary)
+	r.inspections<- inspect
+	return (<-inspect).Result
+}
+
+func TestRoomDrawNeedsAnOffer(t *testing.T) {
+	r, white, black, _ := testGame(t, timeControl{base: time.Minute}, setup{})
+	defer func() { r.unregister<- white }()
+
+	r.broadcastAcceptDraw<- "black"
+	if res := result(r); res != "" {
+		t.Fatalf("draw accepted without an offer: %q", res)
+	}
+
+	// Moving declines the offer.
+	play(t, r, white, black, "w", "1. e4")
+	r.broadcastDrawOffer<- "white"
+	<-black.drawOffer
+	play(t, r, black, white, "b", "1. e4 e5")
+	r.broadcastAcceptDraw<- "black"
+	if res := result(r); res != "" {
+		t.Fatalf("declined draw accepted: %q", res)
+	}
+
+	// Players can't accept their own offer.
+	r.broadcastDrawOffer<- "white"
+	<-black.drawOffer
+	r.broadcastAcceptDraw<- "white"
+	if res := result(r); res != "" {
+		t.Fatalf("own draw offer accepted: %q", res)
+	}
+	r.broadcastAcceptDraw<- "black"
+	<-white.oppAcceptedDraw
+	if res := result(r); res != resultDraw {
+		t.Fatalf("result is %q after the draw was accepted, want %q", res, resultDraw)
+	}
+}
+
+func TestRoomIgnoresReportedResultsOfRatedGames(t *testing.T) {
+	r, white, black, _ := testRatedGame(t, timeControl{base: time.Minute}, setup{})
+	defer func() { r.unregister<- white }()
+
+	play(t, r, white, black, "w", "1. e4")
+	r.stopClocks<- resultWhiteWins
+	if res := result(r); res != "" {
+		t.Fatalf("rated game ended on the result reported by a player: %q", res)
+	}
+	play(t, r, black, white, "b", "1. e4 e5")
+}
+
+func TestPlayerCantMoveForTheOpponent(t *testing.T) {
+	r, white, black, _ := testGame(t, timeControl{base: time.Minute}, setup{})
+	conn := protocoltest.NewConn()
+	white.conn = conn
+	go white.readPump()
+	defer close(conn.In)
+
+	conn.In<- []byte(`{"move":{"color":"b","pgn":"1. e4"}}`)
+	msg := <-white.sendChat
+	if msg.ChatError == nil || msg.ChatError.Code != noticeInvalidMessage {
+		t.Fatalf("move for the opponent answered with %+v, want %s", msg, noticeInvalidMessage)
+	}
+	conn.In<- []byte(`{"move":{"color":"w","pgn":"1. e4"}}`)
+	var relayed clockUpdate
+	if err := json.Unmarshal(<-black.sendMove, &relayed); err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Move == nil || relayed.Move.Color != "w" {
+		t.Fatalf("black was sent %+v, want white's move", relayed)
+	}
+	if res := result(r); res != "" {
+		t.Fatalf("result is %q", res)
+	}
+}
@@ -0,0 +1,943 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Path prefix of the current version of the HTTP API. A change breaking the
+// clients ships under the next version, keeping this one until they move.
+const apiPrefix = "/api/v1"
+
+// Responses of the endpoints built as maps, described for the schema.
+type (
+	seekResponse struct {
+		Color  string `json:"color"`
+		RoomId string `json:"roomId"`
+		Opp    string `json:"opp"`
+	}
+	// The games set up by accepting an invite, a seek or a challenge may be
+	// rated; the players learn whether they are before they start.
+	pairingResponse struct {
+		seekResponse
+		Rated bool `json:"rated"`
+	}
+	inviteResponse struct {
+		InviteId string `json:"inviteId"`
+		Code     string `json:"code"`
+		Expires  string `json:"expires"`
+	}
+	accountResponse struct {
+		Uid      string `json:"uid"`
+		Username string `json:"username"`
+	}
+	analysisResponse struct {
+		GameId    string          `json:"gameId"`
+		Variant   string          `json:"variant"`
+		White     string          `json:"white"`
+		Black     string          `json:"black"`
+		Result    string          `json:"result"`
+		Training  bool            `json:"training"`
+		Blindfold map[string]bool `json:"blindfold"`
+		Status    string          `json:"status"`
+		Done      int             `json:"done"`
+		Total     int             `json:"total"`
+		Moves     []analyzedMove  `json:"moves,omitempty"`
+		Pgn       string          `json:"pgn,omitempty"`
+		Error     string          `json:"error,omitempty"`
+	}
+	puzzleResponse struct {
+		Id     string   `json:"id"`
+		FEN    string   `json:"fen"`
+		Themes []string `json:"themes"`
+		Moves  int      `json:"moves"`
+		Rating float64  `json:"rating"`
+		Date   string   `json:"date,omitempty"`
+		Streak int      `json:"streak,omitempty"`
+	}
+)
+
+// mountRoutes registers the endpoints of the API on the router, the schema
+// describing them among them. The metrics and the profiler are for the
+// operators only and stay out of it.
+func (rout *router) mountRoutes(r *mux.Router) {
+	a := &apiRoutes{rout: rout, r: r}
+	seekParams := []param{
+		query("clock", "int", true, "Minutes of each player"),
+		form("increment", "int", false, "Seconds added to the clock after each move"),
+	}
+	colorParam := form("color", "string", false, "white, black or random; drawn if both players ask for the same")
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/play",
+		Doc:    "Seek a game in the matchmaking pool of the clock",
+		Scope:  scopeBotPlay,
+		Params: append(seekParams, colorParam,
+			form("maxWait", "int", false, "Seconds to wait for an opponent, up to the longest wait allowed"),
+		),
+		Response:   seekResponse{},
+		Idempotent: true,
+		handler:    rout.handlePlay,
+	})
+	a.handle(endpoint{
+		Path:      "/play/ws",
+		Doc:       "Seek a game in a matchmaking pool, sending the clock, increment, color and maxWait of /play as the first message, and hear how the search goes until the socket closes with the match",
+		Scope:     scopeBotPlay,
+		WebSocket: true,
+		handler:   rout.handlePlayWS,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/bughouse",
+		Doc:    "Seek a bughouse game, in a team of two",
+		Scope:  scopeBotPlay,
+		Params: seekParams,
+		Response: struct {
+			seekResponse
+			Partner       string `json:"partner"`
+			PartnerRoomId string `json:"partnerRoomId"`
+		}{},
+		Idempotent: true,
+		handler:    rout.handleBughouse,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/play/ai",
+		Doc:    "Play against the computer",
+		Scope:  scopeBotPlay,
+		Params: append([]param{
+			query("level", "int", true, "Strength of the computer"),
+			form("color", "string", false, "white or black; drawn if empty"),
+			form("training", "bool", false, "Allow takebacks and hints"),
+		}, seekParams...),
+		Response: struct {
+			seekResponse
+			Training bool `json:"training"`
+		}{},
+		Idempotent: true,
+		handler:    rout.handlePlayAI,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/invite",
+		Doc:    "Invite a friend to a game",
+		Scope:  scopeWriteChallenge,
+		Params: append(seekParams[:1:1],
+			form("increment", "int", false, "Seconds added to the clock after each move"),
+			form("guestClock", "int", false, "Minutes of the friend, if different"),
+			form("variant", "string", false, "Variant of the game"),
+			form("odds", "string", false, "Piece given as odds"),
+			form("rated", "bool", false, "Whether the game is rated"),
+			form("expires", "int", false, "Seconds the invite lasts"),
+			colorParam,
+		),
+		Response:   inviteResponse{},
+		Idempotent: true,
+		handler:    rout.handleInvite,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/invite/{id}",
+		Doc:    "Details of an invite, by its id or join code",
+		Scope:  scopeReadGames,
+		Response: struct {
+			InviteId   string `json:"inviteId"`
+			Code       string `json:"code"`
+			Host       string `json:"host"`
+			Clock      string `json:"clock"`
+			Increment  int    `json:"increment"`
+			GuestClock string `json:"guestClock"`
+			Rated      bool   `json:"rated"`
+			HostColor  string `json:"hostColor"`
+			Variant    string `json:"variant"`
+			Odds       string `json:"odds"`
+			GuestOdds  bool   `json:"guestOdds"`
+			Expires    string `json:"expires"`
+		}{},
+		handler: rout.handleInviteInfo,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/invite/{id}",
+		Doc:     "Revoke an invite",
+		Scope:   scopeWriteChallenge,
+		handler: rout.handleRevokeInvite,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/seeks",
+		Doc:    "Post an open seek for others to accept, announced through livedata",
+		Scope:  scopeWriteChallenge,
+		Params: []param{
+			form("clock", "int", true, "Minutes of each player"),
+			form("increment", "int", false, "Seconds added to the clock after each move"),
+			form("rated", "bool", false, "Whether the game is rated"),
+			form("minRating", "int", false, "Lowest rating of the player accepting it"),
+			form("maxRating", "int", false, "Highest rating of the player accepting it"),
+		},
+		Response:   openSeek{},
+		Idempotent: true,
+		handler:    rout.handlePostSeek,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/seeks",
+		Doc:    "Open seeks",
+		Scope:  scopeReadGames,
+		Params: seekListing.params(),
+		Response: struct {
+			Seeks      []openSeek `json:"seeks"`
+			NextCursor string     `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetSeeks,
+	})
+	a.handle(endpoint{
+		Method:     "POST",
+		Path:       "/seeks/{id}/accept",
+		Doc:        "Accept an open seek",
+		Scope:      scopeWriteChallenge,
+		Response:   pairingResponse{},
+		Idempotent: true,
+		handler:    rout.handleAcceptSeek,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/seeks/{id}",
+		Doc:     "Cancel an open seek",
+		Scope:   scopeWriteChallenge,
+		handler: rout.handleCancelSeek,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/challenge",
+		Doc:    "Challenge an online player to a game, delivered through their livedata",
+		Scope:  scopeWriteChallenge,
+		Params: []param{
+			form("to", "string", true, "Uid or username of the opponent"),
+			form("clock", "int", true, "Minutes of each player"),
+			form("increment", "int", false, "Seconds added to the clock after each move"),
+			form("rated", "bool", false, "Whether the game is rated"),
+			colorParam,
+		},
+		Response:   directChallenge{},
+		Idempotent: true,
+		handler:    rout.handleDirectChallenge,
+	})
+	a.handle(endpoint{
+		Method:     "POST",
+		Path:       "/challenge/{id}/accept",
+		Doc:        "Accept a challenge",
+		Scope:      scopeWriteChallenge,
+		Response:   pairingResponse{},
+		Idempotent: true,
+		handler:    rout.handleAcceptDirectChallenge,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/challenge/{id}/decline",
+		Doc:     "Decline a challenge",
+		Scope:   scopeWriteChallenge,
+		handler: rout.handleDeclineDirectChallenge,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/challenge/{id}",
+		Doc:     "Cancel a challenge",
+		Scope:   scopeWriteChallenge,
+		handler: rout.handleCancelDirectChallenge,
+	})
+	gameParams := []param{
+		query("id", "string", true, "Id of the game"),
+		query("clock", "int", true, "Minutes of each player"),
+	}
+	a.handle(endpoint{
+		Path:      "/game",
+		Doc:       "Play a game",
+		Scope:     scopeBotPlay,
+		Params:    gameParams,
+		WebSocket: true,
+		handler:   rout.handleGame,
+	})
+	a.handle(endpoint{
+		Path:      "/wait",
+		Doc:       "Wait for the friend invited to join",
+		Scope:     scopeBotPlay,
+		Params:    gameParams,
+		WebSocket: true,
+		handler:   rout.handleWait,
+	})
+	a.handle(endpoint{
+		Path:       "/join",
+		Doc:        "Accept an invite",
+		Scope:      scopeWriteChallenge,
+		Params:     append(gameParams, colorParam),
+		Response:   pairingResponse{},
+		Idempotent: true,
+		handler:    rout.handleJoin,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/reinvite",
+		Doc:    "Invite the opponent of a finished invite game again",
+		Scope:  scopeWriteChallenge,
+		Params: []param{form("id", "string", true, "Id of the finished game")},
+		Response: struct {
+			inviteResponse
+			Color string `json:"color"`
+		}{},
+		Idempotent: true,
+		handler:    rout.handleReinvite,
+	})
+
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/game/{id}",
+		Doc:      "Status of a game: waiting for its players, being played or finished",
+		Scope:    scopeReadGames,
+		Response: gameStatus{},
+		Cached:   rout.finishedGameStampOf,
+		handler:  rout.handleGameStatus,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/games/batch",
+		Doc:    "Status of several games at once",
+		Scope:  scopeReadGames,
+		Params: []param{form("ids", "[]string", true, "Comma separated game ids")},
+		Response: struct {
+			Games    []gameStatus `json:"games"`
+			NotFound []string     `json:"notFound"`
+		}{},
+		handler: rout.handleGamesBatch,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/game/{id}/analysis",
+		Doc:      "Analysis of a finished game",
+		Scope:    scopeReadGames,
+		Response: analysisResponse{},
+		Cached:   gameStampOf,
+		handler:  rout.handleGetAnalysis,
+	})
+	a.handle(endpoint{
+		Method:   "POST",
+		Path:     "/game/{id}/analysis",
+		Doc:      "Ask for the analysis of a finished game, as one of its players",
+		Scope:    scopeReadGames,
+		Response: analysisResponse{},
+		handler:  rout.handleRequestAnalysis,
+	})
+	a.handle(endpoint{
+		Method:      "GET",
+		Path:        "/game/{id}/stream",
+		Doc:         "Follow a game being played as the messages of /watch, one per line",
+		Scope:       scopeReadGames,
+		Params:      []param{form("cursor", "int", false, "Last ply received")},
+		ContentType: "application/x-ndjson",
+		handler:     rout.handleGameStream,
+	})
+	a.handle(endpoint{
+		Method:      "GET",
+		Path:        "/game/{id}/pgn",
+		Doc:         "PGN of a game being played or recently finished",
+		Scope:       scopeReadGames,
+		Params:      []param{form("live", "bool", false, "Append the moves as they are played")},
+		ContentType: "application/x-chess-pgn",
+		Cached:      rout.finishedGameStampOf,
+		handler:     rout.handleGamePGN,
+	})
+
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/username",
+		Doc:     "Set the username of the session",
+		Params:  []param{form("username", "string", true, "")},
+		handler: rout.handlePostUsername,
+	})
+	a.handle(endpoint{
+		Method:      "GET",
+		Path:        "/username",
+		Doc:         "Username of the session",
+		ContentType: "text/plain",
+		handler:     rout.handleGetUsername,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/me",
+		Doc:      "User of the session, with their ratings and the games they are playing",
+		Response: meResponse{},
+		handler:  rout.handleMe,
+	})
+	a.handle(endpoint{
+		Method:   "POST",
+		Path:     "/fairplay/ack",
+		Doc:      "Acknowledge the fair-play policy, before the first rated game and after being flagged for review",
+		Response: fairPlayAck{},
+		handler:  rout.handleFairPlayAck,
+	})
+	credentials := []param{
+		form("username", "string", true, ""),
+		form("password", "string", true, ""),
+	}
+	a.handle(endpoint{
+		Method:   "POST",
+		Path:     "/register",
+		Doc:      "Register an account and log in to it",
+		Params:   credentials,
+		Response: accountResponse{},
+		handler:  rout.handleRegister,
+	})
+	a.handle(endpoint{
+		Method:   "POST",
+		Path:     "/login",
+		Doc:      "Log in to an account",
+		Params:   credentials,
+		Response: accountResponse{},
+		handler:  rout.handleLogin,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/logout",
+		Doc:     "Log out of the account",
+		handler: rout.handleLogout,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/password/forgot",
+		Doc:     "Send a link to reset the password to the email of the account",
+		Params:  []param{form("login", "string", true, "Username or email")},
+		handler: rout.handleForgotPassword,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/password/reset",
+		Doc:    "Reset the password with the token of the link sent",
+		Params: []param{
+			form("token", "string", true, ""),
+			form("password", "string", true, ""),
+		},
+		handler: rout.handleResetPassword,
+	})
+
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/account/email",
+		Doc:     "Set the email of the account, to be verified",
+		Params:  []param{form("email", "string", true, "")},
+		handler: rout.handleSetEmail,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/account/verify",
+		Doc:     "Verify the email with the token of the link sent",
+		Params:  []param{form("token", "string", true, "")},
+		handler: rout.handleVerifyEmail,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/account/sessions",
+		Doc:    "Devices logged in to the account",
+		Response: struct {
+			Sessions []loginSession `json:"sessions"`
+			Current  string         `json:"current"`
+		}{},
+		handler: rout.handleGetSessions,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/account/sessions/{id}",
+		Doc:     "Log a device out",
+		handler: rout.handleRevokeSession,
+	})
+
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/profile/{uid}",
+		Doc:    "Public profile of a player",
+		Scope:  scopeReadGames,
+		Response: struct {
+			Uid         string         `json:"uid"`
+			Rating      rating         `json:"rating"`
+			Puzzles     puzzleStats    `json:"puzzles"`
+			Abandonment abandonPenalty `json:"abandonment"`
+		}{},
+		Cached:  profileStampOf,
+		handler: rout.handleProfile,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/profile/{uid}/results",
+		Doc:    "Results of a player, each with the hash of the one before",
+		Scope:  scopeReadGames,
+		Params: resultChainListing.params(),
+		Response: struct {
+			Results    []chainedResult `json:"results"`
+			Head       string          `json:"head"`
+			Length     int             `json:"length"`
+			NextCursor string          `json:"nextCursor,omitempty"`
+		}{},
+		Cached:  profileStampOf,
+		handler: rout.handleResultChain,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/profile/{uid}/results/verify",
+		Doc:    "Verify the results of a player, and that an export of them wasn't changed",
+		Scope:  scopeReadGames,
+		Params: []param{
+			form("records", "string", false, "JSON array of exported results"),
+		},
+		Response: chainVerification{},
+		handler:  rout.handleVerifyResultChain,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/leaderboard",
+		Doc:    "Ranked players, best rated first",
+		Params: leaderboardListing.params(),
+		Response: struct {
+			Leaderboard []leaderboardEntry `json:"leaderboard"`
+			NextCursor  string             `json:"nextCursor,omitempty"`
+		}{},
+		Cached:  stampOf(leaderboardStamp),
+		handler: rout.handleLeaderboard,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/games",
+		Doc:    "Games finished recently, latest first",
+		Scope:  scopeReadGames,
+		Params: gameHistoryListing.params(),
+		Response: struct {
+			Games      []gameSummary `json:"games"`
+			NextCursor string        `json:"nextCursor,omitempty"`
+		}{},
+		Cached:  stampOf(gamesStamp),
+		handler: rout.handleGameHistory,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/games/notable",
+		Doc:    "Games finished recently worth a look",
+		Scope:  scopeReadGames,
+		Params: append([]param{
+			form("criteria", "[]string", false, "highestRated, shortestDecisive or longest, comma separated"),
+		}, notableListing.params()...),
+		Response: map[string][]notableGame{},
+		Cached:   stampOf(gamesStamp),
+		handler:  rout.handleNotableGames,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/apikeys",
+		Doc:    "Issue an API key for the account",
+		Params: []param{
+			form("name", "string", true, ""),
+			form("scopes", "[]string", true, "Comma separated"),
+		},
+		Response: struct {
+			Id     string   `json:"id"`
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+			Key    string   `json:"key"`
+		}{},
+		handler: rout.handleCreateAPIKey,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/apikeys",
+		Doc:    "API keys of the account",
+		Response: struct {
+			Keys []apiKey `json:"keys"`
+		}{},
+		handler: rout.handleGetAPIKeys,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/apikeys/{id}",
+		Doc:     "Revoke an API key",
+		handler: rout.handleRevokeAPIKey,
+	})
+	a.handle(endpoint{
+		Method:    "GET",
+		Path:      "/livedata",
+		Doc:       "Players online, lobby, invites and open seeks",
+		WebSocket: true,
+		handler:   rout.handleLivedata,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/messages",
+		Doc:    "Send a direct message",
+		Params: []param{
+			form("to", "string", true, "Uid of the recipient"),
+			form("text", "string", true, ""),
+		},
+		Response: directMessage{},
+		handler:  rout.handlePostMessage,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/messages",
+		Doc:      "Messages exchanged with a user",
+		Params:   []param{query("with", "string", true, "Uid of the user")},
+		Response: []directMessage{},
+		handler:  rout.handleGetMessages,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/messages",
+		Doc:      "Conversations of the user",
+		Response: []conversationSummary{},
+		handler:  rout.handleGetConversations,
+	})
+
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/puzzle/daily",
+		Doc:      "Puzzle of the day",
+		Scope:    scopeReadGames,
+		Response: puzzleResponse{},
+		handler:  rout.handleDailyPuzzle,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/puzzle/streak",
+		Doc:      "Next puzzle of the streak of the user",
+		Response: puzzleResponse{},
+		handler:  rout.handlePuzzleStreak,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/puzzle/history",
+		Doc:    "Puzzles tried by the user",
+		Params: puzzleHistoryListing.params(),
+		Response: struct {
+			History    []puzzleResult `json:"history"`
+			NextCursor string         `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handlePuzzleHistory,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/puzzle/{id}/attempt",
+		Doc:    "Try to solve a puzzle",
+		Params: []param{
+			form("moves", "[]string", true, "Moves played, in UCI, space separated"),
+			form("streak", "bool", false, "Whether the puzzle is part of a streak"),
+		},
+		Response: struct {
+			Right    bool         `json:"right"`
+			Solved   bool         `json:"solved"`
+			Stats    *puzzleStats `json:"stats,omitempty"`
+			Reply    string       `json:"reply,omitempty"`
+			Solution []string     `json:"solution,omitempty"`
+		}{},
+		handler: rout.handlePuzzleAttempt,
+	})
+
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/position/validate",
+		Doc:    "Check a position and list its legal moves",
+		Params: []param{
+			form("fen", "string", true, ""),
+			form("variant", "string", false, ""),
+		},
+		Response: struct {
+			Legal   bool        `json:"legal"`
+			Error   string      `json:"error,omitempty"`
+			Variant string      `json:"variant,omitempty"`
+			FEN     string      `json:"fen,omitempty"`
+			Turn    string      `json:"turn,omitempty"`
+			InCheck bool        `json:"inCheck,omitempty"`
+			Status  string      `json:"status,omitempty"`
+			Moves   []legalMove `json:"moves,omitempty"`
+			Result  string      `json:"result,omitempty"`
+		}{},
+		handler: rout.handleValidatePosition,
+	})
+	watchParams := []param{query("id", "string", true, "Id of the game")}
+	a.handle(endpoint{
+		Path:      "/spectate/chat",
+		Doc:       "Chat of the spectators of a game",
+		Params:    watchParams,
+		WebSocket: true,
+		handler:   rout.handleSpectatorChat,
+	})
+	a.handle(endpoint{
+		Path:      "/watch",
+		Doc:       "Watch a game being played",
+		Scope:     scopeReadGames,
+		Params:    watchParams,
+		WebSocket: true,
+		handler:   rout.handleWatch,
+	})
+	a.handle(endpoint{
+		Path:      "/tv",
+		Doc:       "Watch the featured game",
+		Scope:     scopeReadGames,
+		WebSocket: true,
+		handler:   rout.handleTV,
+	})
+	a.handle(endpoint{
+		Path:      "/replay",
+		Doc:       "Replay a finished game with its original timing",
+		Scope:     scopeReadGames,
+		Params:    watchParams,
+		WebSocket: true,
+		handler:   rout.handleReplay,
+	})
+
+	uid := []param{form("uid", "string", true, "")}
+	duration := form("duration", "int", false, "Seconds it lasts; forever if empty")
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/bans",
+		Doc:     "Ban a user",
+		Admin:   true,
+		Params:  append(uid, form("reason", "string", false, ""), duration),
+		handler: rout.handleBan,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/bans",
+		Doc:    "Users banned",
+		Admin:  true,
+		Params: banListing.params(),
+		Response: struct {
+			Bans       []ban  `json:"bans"`
+			NextCursor string `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetBans,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/bans/{uid}",
+		Doc:     "Lift a ban",
+		Admin:   true,
+		handler: rout.handleLiftBan,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/lobby/mutes",
+		Doc:     "Silence a user in the lobby chat",
+		Admin:   true,
+		Params:  append(uid, form("duration", "int", true, "Seconds it lasts")),
+		handler: rout.handleMuteLobbyChat,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/lobby/messages/{id}",
+		Doc:     "Delete a message from the lobby chat",
+		Admin:   true,
+		handler: rout.handleDeleteLobbyMessage,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/admin/communication-bans",
+		Doc:    "Ban a user from the chats, the chats of a game or challenging others, without keeping them from playing",
+		Admin:  true,
+		Params: append(uid,
+			form("kind", "string", true, "chat, gameChat or challenge"),
+			form("gameId", "string", false, "Game whose chats the user is banned from, for gameChat"),
+			duration,
+			form("reason", "string", false, ""),
+		),
+		Response: commBan{},
+		handler:  rout.handleCommBan,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/communication-bans",
+		Doc:    "Communication bans in effect",
+		Admin:  true,
+		Params: commBanListing.params(),
+		Response: struct {
+			Bans       []commBan `json:"bans"`
+			NextCursor string    `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetCommBans,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/communication-bans/{id}",
+		Doc:     "Lift a communication ban",
+		Admin:   true,
+		handler: rout.handleLiftCommBan,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/kick",
+		Doc:     "Close the connections of a user",
+		Admin:   true,
+		Params:  uid,
+		handler: rout.handleKick,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/games/{id}/delay",
+		Doc:     "Keep the spectators of a game behind its players",
+		Admin:   true,
+		Params:  []param{form("seconds", "int", true, "")},
+		handler: rout.handleSetBroadcastDelay,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/games/{id}/chat/mutes",
+		Doc:     "Silence a user in the spectator chat of a game",
+		Admin:   true,
+		Params:  append(uid, form("duration", "int", true, "Seconds it lasts")),
+		handler: rout.handleMuteSpectatorChat,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/games/{id}/chat/messages/{messageId}",
+		Doc:     "Delete a message from the spectator chat of a game",
+		Admin:   true,
+		handler: rout.handleDeleteSpectatorMessage,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/admin/puzzles",
+		Doc:    "Add a puzzle",
+		Admin:  true,
+		Params: []param{
+			form("fen", "string", true, ""),
+			form("solution", "[]string", true, "Moves in UCI, space separated"),
+			form("themes", "[]string", false, "Comma separated"),
+		},
+		Response: puzzle{},
+		handler:  rout.handleAddPuzzle,
+	})
+	a.handle(endpoint{
+		Method:   "GET",
+		Path:     "/admin/stats",
+		Doc:      "Load of the server",
+		Admin:    true,
+		Response: map[string]interface{}{},
+		handler:  rout.handleStats,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/admin/reload",
+		Doc:    "Reload the configuration",
+		Admin:  true,
+		Response: struct {
+			Applied         []string `json:"applied"`
+			RestartRequired []string `json:"restartRequired"`
+		}{},
+		handler: rout.handleReload,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/restrictions",
+		Doc:     "Put a user under shadow restrictions",
+		Admin:   true,
+		Params:  append(uid, form("reason", "string", false, "")),
+		handler: rout.handleRestrict,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/restrictions",
+		Doc:    "Users under shadow restrictions",
+		Admin:  true,
+		Params: banListing.params(),
+		Response: struct {
+			Restrictions []ban  `json:"restrictions"`
+			NextCursor   string `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetRestrictions,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/restrictions/{uid}",
+		Doc:     "Lift the shadow restrictions of a user",
+		Admin:   true,
+		handler: rout.handleLiftRestriction,
+	})
+	a.handle(endpoint{
+		Path:      "/admin/dashboard",
+		Doc:       "Rooms being hosted, streamed, with a hidden view of any of them",
+		Admin:     true,
+		WebSocket: true,
+		handler:   rout.handleDashboard,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/reports",
+		Doc:    "Games flagged for fair-play review",
+		Admin:  true,
+		Params: reportListing.params(),
+		Response: struct {
+			Reports    []fairPlayReport `json:"reports"`
+			NextCursor string           `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetReports,
+	})
+	a.handle(endpoint{
+		Method: "POST",
+		Path:   "/admin/reports",
+		Doc:    "Report the play of a user in a rated game that finished recently, for the engine to check",
+		Admin:  true,
+		Params: []param{
+			form("gameId", "string", true, ""),
+			form("uid", "string", true, "Uid of the reported player"),
+		},
+		Response: fairPlayReport{},
+		handler:  rout.handleReportGame,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/reports/{id}",
+		Doc:     "Dismiss a fair-play report once reviewed, rating the results it held back",
+		Admin:   true,
+		Params:  []param{form("void", "bool", false, "Discard the results held back instead of rating them")},
+		handler: rout.handleDismissReport,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/account-links",
+		Doc:    "Pairs of users who may be the same person, by the IP addresses and browsers they shared and their games",
+		Admin:  true,
+		Params: accountLinkListing.params(),
+		Response: struct {
+			Links      []accountLink `json:"links"`
+			NextCursor string        `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleAccountLinks,
+	})
+	a.handle(endpoint{
+		Method:  "POST",
+		Path:    "/admin/commentators",
+		Doc:     "Let a user comment the games",
+		Admin:   true,
+		Params:  append(uid, form("event", "string", false, "Event they comment"), duration),
+		handler: rout.handleGrantCommentator,
+	})
+	a.handle(endpoint{
+		Method: "GET",
+		Path:   "/admin/commentators",
+		Doc:    "Users who may comment the games",
+		Admin:  true,
+		Params: banListing.params(),
+		Response: struct {
+			Commentators []ban  `json:"commentators"`
+			NextCursor   string `json:"nextCursor,omitempty"`
+		}{},
+		handler: rout.handleGetCommentators,
+	})
+	a.handle(endpoint{
+		Method:  "DELETE",
+		Path:    "/admin/commentators/{uid}",
+		Doc:     "Take the commentator role away from a user",
+		Admin:   true,
+		handler: rout.handleRevokeCommentator,
+	})
+
+	a.handle(endpoint{
+		Method:  "GET",
+		Path:    "/schema",
+		Doc:     "This description of the API",
+		handler: a.handleSchema,
+	})
+}
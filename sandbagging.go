@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Thresholds of the checks of the results of rated games for deliberate
+// losses and win farming between accounts. Results are remembered for
+// sandbaggingWindow, in memory, so the checks start over with the server.
+const (
+	sandbaggingWindow = 24 * time.Hour
+	// Games lost in fewer plies than this are lost fast, and this many of
+	// them by a player within the window are deliberate losses.
+	fastLossPlies = 12
+	fastLosses    = 3
+	// Games between the same players within the window, at least this many
+	// of them, won by one of them at least farmingShare of the times.
+	farmingGames = 5
+	farmingShare = 0.8
+)
+
+// Reasons the results of a player are held back from the ratings.
+const (
+	// The player lost several games within a few moves.
+	reasonFastLosses = "fastLosses"
+	// The player kept beating the same opponent.
+	reasonFarming = "farming"
+)
+
+// withheldResult is the result of a rated game held back from the ratings
+// while its report is reviewed.
+type withheldResult struct {
+	GameId string     `json:"gameId"`
+	White  gamePlayer `json:"white"`
+	Black  gamePlayer `json:"black"`
+	Result string     `json:"result"`
+}
+
+// ratedResult is the result of a rated game, as remembered to check the
+// next ones.
+type ratedResult struct {
+	gameId   string
+	white    string
+	black    string
+	result   string
+	plies    int
+	finished time.Time
+}
+
+// loser returns the uid of the player who lost the game, "" on a draw.
+func (res ratedResult) loser() string {
+	switch res.result {
+	case resultWhiteWins:
+		return res.black
+	case resultBlackWins:
+		return res.white
+	}
+	return ""
+}
+
+func (res ratedResult) between(a, b string) bool {
+	return (res.white == a && res.black == b) || (res.white == b && res.black == a)
+}
+
+// resultHistory keeps the results of the rated games finished within the
+// window, in the order they finished.
+type resultHistory struct {
+	m       *sync.Mutex
+	results []ratedResult
+}
+
+func newResultHistory() *resultHistory {
+	return &resultHistory{m: &sync.Mutex{}}
+}
+
+// add remembers the result, forgetting the ones out of the window, and
+// returns the results of the window.
+func (h *resultHistory) add(res ratedResult) []ratedResult {
+	h.m.Lock()
+	defer h.m.Unlock()
+	i := 0
+	for i < len(h.results) && res.finished.Sub(h.results[i].finished) > sandbaggingWindow {
+		i++
+	}
+	h.results = append(h.results[i:], res)
+	return append([]ratedResult(nil), h.results...)
+}
+
+// suspectResults returns the report of the sequence of results of the window,
+// ending with the latest one, that looks like deliberate losses or farming,
+// if any.
+func suspectResults(results []ratedResult) (fairPlayReport, bool) {
+	last := results[len(results)-1]
+	if loser := last.loser(); loser != "" && last.plies < fastLossPlies {
+		var games []string
+		for _, res := range results {
+			if res.loser() == loser && res.plies < fastLossPlies {
+				games = append(games, res.gameId)
+			}
+		}
+		if len(games) >= fastLosses {
+			return fairPlayReport{Uid: loser, Reasons: []string{reasonFastLosses}, Games: games}, true
+		}
+	}
+	var games []string
+	wins := make(map[string]int)
+	for _, res := range results {
+		if !res.between(last.white, last.black) {
+			continue
+		}
+		games = append(games, res.gameId)
+		switch res.result {
+		case resultWhiteWins:
+			wins[res.white]++
+		case resultBlackWins:
+			wins[res.black]++
+		}
+	}
+	if len(games) < farmingGames {
+		return fairPlayReport{}, false
+	}
+	for uid, n := range wins {
+		if float64(n) >= farmingShare*float64(len(games)) {
+			opponent := last.white
+			if uid == last.white {
+				opponent = last.black
+			}
+			return fairPlayReport{Uid: uid, Opponent: opponent, Reasons: []string{reasonFarming}, Games: games}, true
+		}
+	}
+	return fairPlayReport{}, false
+}
+
+// withholdResult holds the result of the rated game back from the ratings if
+// its players are under review for the results they got, or if it completes a
+// sequence of results that looks like deliberate losses or farming, reporting
+// it then. It reports whether the result is withheld.
+func (rout *router) withholdResult(g finishedGame) bool {
+	withheld := withheldResult{
+		GameId: g.gameId,
+		White:  gamePlayer{Id: g.white.id, Username: g.white.username},
+		Black:  gamePlayer{Id: g.black.id, Username: g.black.username},
+		Result: g.result,
+	}
+	ok, err := rout.reports.withhold(withheld)
+	if err != nil {
+		rootLogger.error("Could not save reports", "err", err)
+	}
+	if ok {
+		return true
+	}
+	results := rout.results.add(ratedResult{
+		gameId:   g.gameId,
+		white:    g.white.id,
+		black:    g.black.id,
+		result:   g.result,
+		plies:    len(g.moves),
+		finished: time.Now(),
+	})
+	rep, suspect := suspectResults(results)
+	if !suspect {
+		return false
+	}
+	rep.Username = g.white.username
+	if rep.Uid == g.black.id {
+		rep.Username = g.black.username
+	}
+	rep.GameId = g.gameId
+	rep.Withheld = []withheldResult{withheld}
+	rep.Created = time.Now()
+	rep, err = rout.reports.add(rep)
+	if err != nil {
+		rootLogger.error("Could not save reports", "err", err)
+		// Better rated than lost.
+		return false
+	}
+	rout.flagged(rep)
+	rootLogger.info("Results withheld for review", "report", rep.Id, "uid", rep.Uid, "reasons", rep.Reasons[0])
+	return true
+}
+
+// releaseWithheld rates the games whose results the report held back.
+func (rout *router) releaseWithheld(rep fairPlayReport) {
+	for _, res := range rep.Withheld {
+		white := user{id: res.White.Id, username: res.White.Username}
+		black := user{id: res.Black.Id, username: res.Black.Username}
+		rout.ratings.record(white, black, res.Result)
+		rout.stamps.touch(leaderboardStamp, profileStamp(white.id), profileStamp(black.id))
+	}
+}
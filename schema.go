@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// param is a parameter of an endpoint of the API.
+type param struct {
+	Name string `json:"name"`
+	// Where it goes: "path", "query", or "form" for the ones read from the
+	// body or the query alike.
+	In   string `json:"in"`
+	Type string `json:"type"`
+	// Required query parameters are part of the route: requests without
+	// them don't match it.
+	Required bool   `json:"required,omitempty"`
+	Doc      string `json:"doc,omitempty"`
+}
+
+func query(name, typ string, required bool, doc string) param {
+	return param{Name: name, In: "query", Type: typ, Required: required, Doc: doc}
+}
+
+func form(name, typ string, required bool, doc string) param {
+	return param{Name: name, In: "form", Type: typ, Required: required, Doc: doc}
+}
+
+// endpoint is a route of the API, registered from its description so that
+// the schema of the API can't drift from the routes served.
+type endpoint struct {
+	// Method matched by the route; any method if empty.
+	Method string
+	Path   string
+	Doc    string
+	// Scope of the API keys allowed to call it, if they are.
+	Scope string
+	// Whether only the operators holding the admin token can call it.
+	Admin  bool
+	Params []param
+	// Zero value of the type of the successful responses in JSON, if they
+	// have a body. Anonymous structs describe the ones built as maps.
+	Response interface{}
+	// Media type of the responses not in JSON, as the streams.
+	ContentType string
+	// Whether the endpoint upgrades to a WebSocket.
+	WebSocket bool
+	// Whether the retries of a request carrying a request id get its
+	// response rather than doing it again.
+	Idempotent bool
+	// Key of the stamp of the resource the responses depend on, for the
+	// endpoints whose responses can be cached; "" if the request's can't.
+	Cached func(r *http.Request) string
+
+	handler http.HandlerFunc
+}
+
+// Parameters in the path of a route, as in /game/{id}.
+var pathParamPattern = regexp.MustCompile(`{(\w+)}`)
+
+// apiRoutes registers the endpoints on a router and keeps their descriptions
+// for the schema.
+type apiRoutes struct {
+	rout      *router
+	r         *mux.Router
+	endpoints []endpoint
+}
+
+// handle registers the endpoint, behind the checks of its scope or the
+// admin token.
+func (a *apiRoutes) handle(e endpoint) {
+	h := e.handler
+	if e.Cached != nil {
+		h = a.rout.cached(e.Cached, h)
+	}
+	if e.Idempotent {
+		h = a.rout.idempotent(h)
+		e.Params = append(e.Params[:len(e.Params):len(e.Params)],
+			form(requestIdParam, "string", false, "Id of the request, for its retries"))
+	}
+	if e.WebSocket {
+		e.Params = append(e.Params[:len(e.Params):len(e.Params)],
+			form("protocol", "int", false, "Version of the protocol spoken by the client, 1 if none"))
+	}
+	switch {
+	case e.Admin:
+		h = requireAdmin(h)
+	case e.Scope != "":
+		h = a.rout.requireScope(e.Scope, h)
+	}
+	route := a.r.HandleFunc(e.Path, h)
+	if e.Method != "" {
+		route.Methods(e.Method)
+	}
+	var queries []string
+	for _, p := range e.Params {
+		if p.In == "query" && p.Required {
+			queries = append(queries, p.Name, "{" + p.Name + "}")
+		}
+	}
+	if len(queries) > 0 {
+		route.Queries(queries...)
+	}
+	a.endpoints = append(a.endpoints, e)
+}
+
+// schema describes the endpoints, with their paths under the prefix given.
+func (a *apiRoutes) schema(prefix string) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(a.endpoints))
+	for _, e := range a.endpoints {
+		params := []param{}
+		for _, m := range pathParamPattern.FindAllStringSubmatch(e.Path, -1) {
+			params = append(params, param{Name: m[1], In: "path", Type: "string", Required: true})
+		}
+		params = append(params, e.Params...)
+		d := map[string]interface{}{
+			"path":   prefix + e.Path,
+			"params": params,
+		}
+		if e.Method != "" {
+			d["method"] = e.Method
+		}
+		if e.Doc != "" {
+			d["doc"] = e.Doc
+		}
+		if e.Scope != "" {
+			d["scope"] = e.Scope
+		}
+		if e.Admin {
+			d["admin"] = true
+		}
+		if e.WebSocket {
+			d["websocket"] = true
+		}
+		if e.Response != nil {
+			d["contentType"] = "application/json"
+			d["response"] = typeSchema(reflect.TypeOf(e.Response))
+		}
+		if e.ContentType != "" {
+			d["contentType"] = e.ContentType
+		}
+		list = append(list, d)
+	}
+	return list
+}
+
+// typeSchema describes the JSON encoding of the type as a JSON Schema.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		required := []string{}
+		structFields(t, props, &required)
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	// Any value.
+	return map[string]interface{}{}
+}
+
+// structFields adds the fields of the struct, as encoding/json sees them, to
+// the properties of its schema. The fields of embedded structs are promoted.
+func structFields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			structFields(f.Type, props, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type)
+		if !strings.Contains(tag, ",omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// Describe the endpoints of this version of the API: their methods, paths,
+// parameters and responses, for client generators.
+func (a *apiRoutes) handleSchema(w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{
+		"version":   strings.TrimPrefix(apiPrefix, "/api/"),
+		"endpoints": a.schema(apiPrefix),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	idGen "github.com/rs/xid"
+)
+
+const (
+	// How long an open seek waits for someone to accept it.
+	seekExpiration = 15 * time.Minute
+	// Open seeks a player may have at once.
+	maxOpenSeeks = 3
+)
+
+// Code of the error responses to the players who can't accept a seek for
+// their rating.
+const errorSeekOutOfRange = "SEEK_OUT_OF_RANGE"
+
+var (
+	errSeekNotFound   = errors.New("Seek not found")
+	errNotSeekPoster  = errors.New("Only the player who posted the seek can cancel it")
+	errOwnSeek        = errors.New("You can't accept your own seek")
+	errSeekOutOfRange = errors.New("Your rating is out of the range of the seek")
+	errTooManySeeks   = errors.New("Too many open seeks; cancel one first")
+)
+
+// openSeek is a game offered to anyone in the lobby, as opposed to the blind
+// matching of the pools, for other players to pick.
+type openSeek struct {
+	Id        string     `json:"id"`
+	Poster    gamePlayer `json:"poster"`
+	Rating    float64    `json:"rating"`
+	Clock     int        `json:"clock"`
+	Increment int        `json:"increment"`
+	Rated     bool       `json:"rated"`
+	// Ratings of the players who may accept it, unbounded if zero.
+	MinRating int       `json:"minRating,omitempty"`
+	MaxRating int       `json:"maxRating,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+
+	control timeControl
+}
+
+// admits reports whether a player with the rating may accept the seek.
+func (s openSeek) admits(rating float64) bool {
+	if s.MinRating != 0 && rating < float64(s.MinRating) {
+		return false
+	}
+	return s.MaxRating == 0 || rating <= float64(s.MaxRating)
+}
+
+var seekListing = listing{
+	sorts:       []string{"created", "rating"},
+	defaultSort: "-created",
+	filters: []param{
+		form("clock", "int", false, "Minutes of each player"),
+		form("rated", "bool", false, ""),
+		form("eligible", "bool", false, "Whether the rating of the user falls in the range of the seek"),
+	},
+}
+
+func (s openSeek) pageId() string {
+	return s.Id
+}
+
+func (s openSeek) sortKey(field string) sortKey {
+	if field == "rating" {
+		return sortKey{num: s.Rating}
+	}
+	return timeKey(s.Created)
+}
+
+func (s openSeek) matches(filter, value string) bool {
+	switch filter {
+	case "clock":
+		return strconv.Itoa(s.Clock) == value
+	case "rated":
+		return strconv.FormatBool(s.Rated) == value
+	}
+	return true
+}
+
+// seekBoard keeps the open seeks by id, until they are accepted, cancelled
+// or expire.
+type seekBoard struct {
+	m     *sync.Mutex
+	seeks map[string]openSeek
+}
+
+func newSeekBoard() *seekBoard {
+	return &seekBoard{
+		m:     &sync.Mutex{},
+		seeks: make(map[string]openSeek),
+	}
+}
+
+// add posts the seek unless its poster has too many open already.
+func (b *seekBoard) add(s openSeek) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	open := 0
+	for _, other := range b.seeks {
+		if other.Poster.Id == s.Poster.Id {
+			open++
+		}
+	}
+	if open >= maxOpenSeeks {
+		return errTooManySeeks
+	}
+	b.seeks[s.Id] = s
+	return nil
+}
+
+// find looks up the seek, leaving it open.
+func (b *seekBoard) find(id string) (openSeek, bool) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	s, ok := b.seeks[id]
+	return s, ok
+}
+
+// take removes the seek if check accepts it; otherwise the error of check is
+// returned.
+func (b *seekBoard) take(id string, check func(s openSeek) error) (openSeek, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	s, ok := b.seeks[id]
+	if !ok {
+		return openSeek{}, errSeekNotFound
+	}
+	if err := check(s); err != nil {
+		return openSeek{}, err
+	}
+	delete(b.seeks, id)
+	return s, nil
+}
+
+// expire removes the seek, reporting whether it was still open.
+func (b *seekBoard) expire(id string) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if _, ok := b.seeks[id]; !ok {
+		return false
+	}
+	delete(b.seeks, id)
+	return true
+}
+
+// list returns the open seeks.
+func (b *seekBoard) list() []openSeek {
+	b.m.Lock()
+	defer b.m.Unlock()
+	seeks := make([]openSeek, 0, len(b.seeks))
+	for _, s := range b.seeks {
+		seeks = append(seeks, s)
+	}
+	return seeks
+}
+
+func (b *seekBoard) size() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.seeks)
+}
+
+// seekRemoved lets the lobby know the seek is no longer open, for the reason
+// given: accepted, cancelled or expired.
+func (rout *router) seekRemoved(id, reason string) {
+	rout.ldHub.broadcast<- map[string]interface{}{
+		"seekRemoved": map[string]string{
+			"id":     id,
+			"reason": reason,
+		},
+	}
+}
+
+// parseRatingBound parses a bound of the rating range of a seek, zero if
+// empty.
+func parseRatingBound(bound string) (int, error) {
+	if bound == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(bound)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid rating bound: " + bound)
+	}
+	return n, nil
+}
+
+// Post an open seek to the lobby. The poster hears of the player accepting
+// it through livedata.
+func (rout *router) handlePostSeek(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rout.refuseIfChallengeBanned(w, uid) {
+		return
+	}
+	clock := r.FormValue("clock")
+	control, err := parseTimeControl(clock, r.FormValue("increment"))
+	if err != nil {
+		writeError(w, "Invalid time control: " + clock + "+" + r.FormValue("increment"), http.StatusBadRequest)
+		return
+	}
+	rated := false
+	if flag := r.FormValue("rated"); flag != "" {
+		if rated, err = strconv.ParseBool(flag); err != nil {
+			writeError(w, "Invalid rated flag: " + flag, http.StatusBadRequest)
+			return
+		}
+	}
+	if rated && (rout.refuseIfNotAcknowledged(w, uid) || rout.refuseIfCoolingDown(w, uid)) {
+		return
+	}
+	minRating, err := parseRatingBound(r.FormValue("minRating"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxRating, err := parseRatingBound(r.FormValue("maxRating"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxRating != 0 && maxRating < minRating {
+		writeError(w, "The maximum rating is below the minimum", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	s := openSeek{
+		Id:        idGen.New().String(),
+		Poster:    gamePlayer{Id: uid, Username: username},
+		Rating:    rout.ratings.get(uid).Rating,
+		Clock:     control.minutes(),
+		Increment: control.seconds(),
+		Rated:     rated,
+		MinRating: minRating,
+		MaxRating: maxRating,
+		Created:   now,
+		Expires:   now.Add(seekExpiration),
+		control:   control,
+	}
+	if err := rout.seeks.add(s); err != nil {
+		writeError(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	time.AfterFunc(seekExpiration, func() {
+		if rout.seeks.expire(s.Id) {
+			rout.seekRemoved(s.Id, "expired")
+		}
+	})
+	rout.ldHub.broadcast<- map[string]interface{}{"seekPosted": s}
+
+	resB, err := json.Marshal(s)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// List the open seeks, newest first.
+func (rout *router) handleGetSeeks(w http.ResponseWriter, r *http.Request) {
+	q, err := seekListing.query(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seeks := rout.seeks.list()
+	// Whether the user may accept each seek depends on their rating, so the
+	// filter is applied here rather than by the seek.
+	if eligible := r.FormValue("eligible"); eligible != "" {
+		uid, _, err := rout.sessionUser(w, r)
+		if err != nil {
+			requestLogger(r).error("Could not save session", "err", err)
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rating := rout.ratings.get(uid).Rating
+		kept := seeks[:0]
+		for _, s := range seeks {
+			if strconv.FormatBool(s.admits(rating) && s.Poster.Id != uid) == eligible {
+				kept = append(kept, s)
+			}
+		}
+		seeks = kept
+	}
+	items := make([]pageItem, 0, len(seeks))
+	for _, s := range seeks {
+		items = append(items, s)
+	}
+	page, next := paginate(items, q)
+	list := make([]openSeek, 0, len(page))
+	for _, item := range page {
+		list = append(list, item.(openSeek))
+	}
+	res := pageResponse("seeks", list, next)
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
+
+// Cancel an open seek. Only the player who posted it can.
+func (rout *router) handleCancelSeek(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s, err := rout.seeks.take(mux.Vars(r)["id"], func(s openSeek) error {
+		if s.Poster.Id != uid {
+			return errNotSeekPoster
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errSeekNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	rout.seekRemoved(s.Id, "cancelled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Accept an open seek, starting the game right away. The colors are drawn.
+func (rout *router) handleAcceptSeek(w http.ResponseWriter, r *http.Request) {
+	if rout.refuseIfDraining(w) || rout.refuseIfFull(w, r) {
+		return
+	}
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if s, ok := rout.seeks.find(id); ok && s.Rated {
+		if rout.refuseIfNotAcknowledged(w, uid) || rout.refuseIfCoolingDown(w, uid) {
+			return
+		}
+	}
+	rating := rout.ratings.get(uid).Rating
+	// The seek can be accepted only once.
+	s, err := rout.seeks.take(id, func(s openSeek) error {
+		if s.Poster.Id == uid {
+			return errOwnSeek
+		}
+		if !s.admits(rating) {
+			return errSeekOutOfRange
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errSeekNotFound:
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	case errSeekOutOfRange:
+		writeAPIError(w, http.StatusForbidden, apiError{Code: errorSeekOutOfRange, Message: err.Error()})
+		return
+	default:
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	rout.seekRemoved(s.Id, "accepted")
+
+	poster := user{id: s.Poster.Id, username: s.Poster.Username}
+	guest := user{id: uid, username: username}
+	m := match{
+		gameId:  idGen.New().String(),
+		control: s.control,
+		rated:   s.Rated && rout.ratedFor(poster.id, uid),
+	}
+	color := "white"
+	m.white, m.black = guest, poster
+	if rand.Intn(2) == 0 {
+		color = "black"
+		m.white, m.black = poster, guest
+	}
+	rout.makeRoom(m)
+	posterColor := "white"
+	if color == "white" {
+		posterColor = "black"
+	}
+	rout.ldHub.direct<- directDelivery{
+		uid: poster.id,
+		payload: map[string]interface{}{
+			"seekAccepted": map[string]interface{}{
+				"seekId": s.Id,
+				"color":  posterColor,
+				"roomId": m.gameId,
+				"opp":    username,
+				"rated":  m.rated,
+			},
+		},
+	}
+	requestLogger(r).info("Seek accepted", "seekId", s.Id, "gameId", m.gameId)
+
+	res := map[string]interface{}{
+		"color":  color,
+		"roomId": m.gameId,
+		"opp":    poster.username,
+		"rated":  m.rated,
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Shortest session key accepted. The cookies are signed with HMAC-SHA256,
+// whose key should be at least as long as the hash.
+const minSessionKeyLength = 32
+
+// checkStartup looks for mistakes in the settings and the environment before
+// the server starts, so that a bad setup stops it at boot with errors saying
+// what to fix, instead of failing at the first request that needs it.
+func checkStartup(sessionKey string) []error {
+	var errs []error
+	if len(sessionKey) < minSessionKeyLength {
+		errs = append(errs, fmt.Errorf("the session key must be at least %d characters long, was %d: set PRINCE_SESSION_KEY or SESSION_KEY in cookie_hash.env", minSessionKeyLength, len(sessionKey)))
+	}
+	for _, origin := range conf.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		if err := checkOriginURL(origin); err != nil {
+			errs = append(errs, fmt.Errorf("corsOrigins: %q %v", origin, err))
+		}
+	}
+	if err := checkBaseURL(conf.FrontendURL); err != nil {
+		errs = append(errs, fmt.Errorf("frontendURL: %q %v", conf.FrontendURL, err))
+	}
+	if conf.AdvertiseURL != "" {
+		if err := checkBaseURL(conf.AdvertiseURL); err != nil {
+			errs = append(errs, fmt.Errorf("advertiseURL: %q %v", conf.AdvertiseURL, err))
+		}
+	}
+	if err := checkDataDir(conf.DataDir); err != nil {
+		errs = append(errs, fmt.Errorf("dataDir: %v", err))
+	}
+	for _, s := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"writeWait", conf.WriteWait},
+		{"pongWait", conf.PongWait},
+		{"matchTimeout", conf.MatchTimeout},
+		{"maxMatchWait", conf.MaxMatchWait},
+		{"halfRoomTTL", conf.HalfRoomTTL},
+		{"roomSweepInterval", conf.RoomSweepInterval},
+	} {
+		// Timers and tickers of these would fire at once or panic.
+		if s.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, was %v", s.key, s.value))
+		}
+	}
+	if conf.FirstMoveTimeout < 0 {
+		errs = append(errs, fmt.Errorf("firstMoveTimeout must not be negative, was %v", conf.FirstMoveTimeout))
+	}
+	return errs
+}
+
+// checkOriginURL reports why the origin is not a scheme and a host, as sent
+// by browsers in the Origin header.
+func checkOriginURL(origin string) error {
+	u, err := url.Parse(origin)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("must start with http:// or https://")
+	case u.Host == "":
+		return fmt.Errorf("has no host")
+	case u.Path != "" || u.RawQuery != "":
+		return fmt.Errorf("must not have a path; browsers send only the scheme and the host")
+	}
+	return nil
+}
+
+// checkBaseURL reports why the URL is not an absolute http(s) URL.
+func checkBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("must start with http:// or https://")
+	case u.Host == "":
+		return fmt.Errorf("has no host")
+	}
+	return nil
+}
+
+// checkDataDir makes sure the stores can write to the data directory.
+func checkDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/matchmaking"
+	idGen "github.com/rs/xid"
+)
+
+const (
+	// Prefix of the keys of the queues of the pools in the shared store.
+	poolKeyPrefix = "prince:pool:"
+
+	// Prefix of the keys the pairings are handed over under, by the token
+	// of the seek, and how long they wait there for the seeker's node.
+	pairingKeyPrefix = "prince:pairing:"
+	pairingTTL       = time.Minute
+
+	// How often a seeker looks for their pairing in the shared store.
+	pairingPoll = 250 * time.Millisecond
+
+	// Time a seeker waits for the pairing after being taken off the queue,
+	// in case the node pairing them goes down before handing it over.
+	pairingGrace = 5 * time.Second
+)
+
+// seekPool pairs the players seeking a game with a time control: a
+// matchmaking.Pool, or a sharedPool when the server runs in several nodes.
+type seekPool interface {
+	Seek(s matchmaking.Seeker, timeout time.Duration, newID func() string) (matchmaking.Pairing, bool)
+	Cancel(id string)
+	Waiting() int
+}
+
+// pool returns the pool of the time control. Each time control, increment
+// included, has its own.
+func (rout *router) pool(control timeControl) seekPool {
+	if rout.sharedPools != nil {
+		return rout.sharedPools.pool(control.String())
+	}
+	return rout.pools.Pool(control.String())
+}
+
+// sharedQueue keeps lists of values shared by the nodes.
+type sharedQueue interface {
+	push(key string, value []byte) error
+	// pushExpiring pushes the value to a list that expires after ttl.
+	pushExpiring(key string, value []byte, ttl time.Duration) error
+	pop(key string) ([]byte, bool, error)
+	remove(key string, value []byte) (bool, error)
+	length(key string) (int, error)
+}
+
+// queuedSeek is a seeker waiting in a shared pool, as queued in the store.
+type queuedSeek struct {
+	// Tells apart the seeks of the same player.
+	Token  string             `json:"token"`
+	Seeker matchmaking.Seeker `json:"seeker"`
+	// Seeks left behind by a node going down are skipped after it.
+	Expires time.Time `json:"expires"`
+}
+
+// sharedPools queues the seekers of every node in the shared store, so that
+// players are paired regardless of the node they seek from. Like in a
+// matchmaking.Pool, each seeker is paired with the one waiting the longest.
+// The node taking them off the queue leaves them the pairing in the store,
+// under the token of the seek, until their node picks it up; an empty
+// pairing tells the seeker to give up.
+type sharedPools struct {
+	queue sharedQueue
+
+	m *sync.Mutex
+	// Seeks of this node waiting in the queues, by token.
+	waiting map[string]*sharedSeek
+	// Pools sought in from this node, for the stats.
+	keys map[string]bool
+}
+
+// sharedSeek is a seek of this node waiting in a queue.
+type sharedSeek struct {
+	token  string
+	key    string
+	entry  []byte
+	seeker string
+	// Pairings from this node. Buffered, so that the pairing is never held
+	// up by the seeker.
+	paired chan matchmaking.Pairing
+}
+
+func newSharedPools(queue sharedQueue) *sharedPools {
+	return &sharedPools{
+		queue:   queue,
+		m:       &sync.Mutex{},
+		waiting: make(map[string]*sharedSeek),
+		keys:    make(map[string]bool),
+	}
+}
+
+func (sp *sharedPools) pool(key string) *sharedPool {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	sp.keys[key] = true
+	return &sharedPool{key: key, pools: sp}
+}
+
+// Waiting returns the number of seekers waiting in each pool sought in from
+// this node, by key.
+func (sp *sharedPools) Waiting() map[string]int {
+	sp.m.Lock()
+	keys := make([]string, 0, len(sp.keys))
+	for key := range sp.keys {
+		keys = append(keys, key)
+	}
+	sp.m.Unlock()
+	waiting := make(map[string]int, len(keys))
+	for _, key := range keys {
+		n, err := sp.queue.length(poolKeyPrefix + key)
+		if err != nil {
+			rootLogger.error("Could not count seekers", "pool", key, "err", err)
+			continue
+		}
+		waiting[key] = n
+	}
+	return waiting
+}
+
+// send hands the pairing to the seek with the token: right away if it's of
+// this node, through the shared store otherwise.
+func (sp *sharedPools) send(token string, pairing matchmaking.Pairing) {
+	sp.m.Lock()
+	own, ok := sp.waiting[token]
+	delete(sp.waiting, token)
+	sp.m.Unlock()
+	if ok {
+		own.paired<- pairing
+		return
+	}
+	data, err := json.Marshal(pairing)
+	if err != nil {
+		rootLogger.error("Could not marshal pairing", "err", err)
+		return
+	}
+	if err := sp.queue.pushExpiring(pairingKeyPrefix+token, data, pairingTTL); err != nil {
+		rootLogger.error("Could not hand over pairing", "err", err)
+	}
+}
+
+// collect picks up the pairing left in the shared store for the seek, if
+// any.
+func (sp *sharedPools) collect(own *sharedSeek) (matchmaking.Pairing, bool) {
+	data, ok, err := sp.queue.pop(pairingKeyPrefix + own.token)
+	if err != nil {
+		rootLogger.error("Could not look for pairing", "pool", own.key, "err", err)
+		return matchmaking.Pairing{}, false
+	}
+	if !ok {
+		return matchmaking.Pairing{}, false
+	}
+	var pairing matchmaking.Pairing
+	if err := json.Unmarshal(data, &pairing); err != nil {
+		rootLogger.error("Could not unmarshal pairing", "pool", own.key, "err", err)
+	}
+	sp.forget(own)
+	return pairing, true
+}
+
+// forget stops listening for the pairing of the seek, reporting whether it
+// was still waiting for one.
+func (sp *sharedPools) forget(own *sharedSeek) bool {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	if _, ok := sp.waiting[own.token]; !ok {
+		return false
+	}
+	delete(sp.waiting, own.token)
+	return true
+}
+
+// cancel takes the seeks of the player off the queue of the pool. Those
+// already taken off by an opponent are left to get their pairing.
+func (sp *sharedPools) cancel(key, id string) {
+	sp.m.Lock()
+	var seeks []*sharedSeek
+	for _, own := range sp.waiting {
+		if own.key == key && own.seeker == id {
+			seeks = append(seeks, own)
+		}
+	}
+	sp.m.Unlock()
+	for _, own := range seeks {
+		removed, err := sp.queue.remove(poolKeyPrefix+key, own.entry)
+		if err != nil {
+			rootLogger.error("Could not cancel seek", "pool", key, "err", err)
+		}
+		if (removed || err != nil) && sp.forget(own) {
+			own.paired<- matchmaking.Pairing{}
+		}
+	}
+}
+
+// sharedPool is the pool of a time control in the shared store.
+type sharedPool struct {
+	key   string
+	pools *sharedPools
+}
+
+// Seek pairs the seeker with the one waiting the longest in the pool, in any
+// node, or waits in the queue for an opponent until the timeout.
+func (p *sharedPool) Seek(s matchmaking.Seeker, timeout time.Duration, newID func() string) (matchmaking.Pairing, bool) {
+	sp, key := p.pools, poolKeyPrefix+p.key
+	// The same player seeking again, e.g. from another tab, cancels the
+	// previous seek.
+	sp.cancel(p.key, s.ID)
+	for {
+		entry, ok, err := sp.queue.pop(key)
+		if err != nil {
+			rootLogger.error("Could not look for seekers", "pool", p.key, "err", err)
+			return matchmaking.Pairing{}, false
+		}
+		if !ok {
+			break
+		}
+		var waiting queuedSeek
+		if err := json.Unmarshal(entry, &waiting); err != nil {
+			rootLogger.error("Could not unmarshal seek", "pool", p.key, "err", err)
+			continue
+		}
+		if time.Now().After(waiting.Expires) {
+			continue
+		}
+		if waiting.Seeker.ID == s.ID {
+			// A seek of the player from another node.
+			sp.send(waiting.Token, matchmaking.Pairing{})
+			continue
+		}
+		pairing := matchmaking.Pair(newID(), waiting.Seeker, s)
+		sp.send(waiting.Token, pairing)
+		return pairing, true
+	}
+	return p.await(s, timeout)
+}
+
+// await queues the seeker and waits for the pairing until the timeout.
+func (p *sharedPool) await(s matchmaking.Seeker, timeout time.Duration) (matchmaking.Pairing, bool) {
+	sp, key := p.pools, poolKeyPrefix+p.key
+	token := idGen.New().String()
+	entry, err := json.Marshal(queuedSeek{
+		Token:   token,
+		Seeker:  s,
+		Expires: time.Now().Add(timeout),
+	})
+	if err != nil {
+		rootLogger.error("Could not marshal seek", "err", err)
+		return matchmaking.Pairing{}, false
+	}
+	own := &sharedSeek{
+		token:  token,
+		key:    p.key,
+		entry:  entry,
+		seeker: s.ID,
+		paired: make(chan matchmaking.Pairing, 1),
+	}
+	// Listen before queueing, so that the pairing isn't missed.
+	sp.m.Lock()
+	sp.waiting[token] = own
+	sp.m.Unlock()
+	if err := sp.queue.push(key, entry); err != nil {
+		rootLogger.error("Could not queue seek", "pool", p.key, "err", err)
+		sp.forget(own)
+		return matchmaking.Pairing{}, false
+	}
+
+	if pairing, ok := p.wait(own, timeout); ok {
+		return pairing, pairing.GameID != ""
+	}
+	removed, err := sp.queue.remove(key, entry)
+	if err != nil {
+		rootLogger.error("Could not leave pool", "pool", p.key, "err", err)
+	}
+	if (removed || err != nil) && sp.forget(own) {
+		return matchmaking.Pairing{}, false
+	}
+	// An opponent took the seek off the queue as the deadline fired, and is
+	// about to hand over the pairing.
+	if pairing, ok := p.wait(own, pairingGrace); ok {
+		return pairing, pairing.GameID != ""
+	}
+	sp.forget(own)
+	return matchmaking.Pairing{}, false
+}
+
+// wait waits for the pairing of the seek until the timeout, from this node or
+// left in the shared store by another, reporting false if it didn't come.
+func (p *sharedPool) wait(own *sharedSeek, timeout time.Duration) (matchmaking.Pairing, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(pairingPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case pairing := <-own.paired:
+			return pairing, true
+		case <-poll.C:
+			if pairing, ok := p.pools.collect(own); ok {
+				return pairing, true
+			}
+		case <-deadline.C:
+			return matchmaking.Pairing{}, false
+		}
+	}
+}
+
+// Cancel takes the seeker with the id off the queue, if waiting; their Seek
+// reports false.
+func (p *sharedPool) Cancel(id string) {
+	p.pools.cancel(p.key, id)
+}
+
+// Waiting returns the number of seekers waiting in the pool, in every node.
+func (p *sharedPool) Waiting() int {
+	n, err := p.pools.queue.length(poolKeyPrefix + p.key)
+	if err != nil {
+		rootLogger.error("Could not count seekers", "pool", p.key, "err", err)
+	}
+	return n
+}
+
+// poolsWaiting returns the number of seekers waiting in each pool, by key.
+func (rout *router) poolsWaiting() map[string]int {
+	if rout.sharedPools != nil {
+		return rout.sharedPools.Waiting()
+	}
+	return rout.pools.Waiting()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/matchmaking"
+)
+
+// memCluster stands in for Redis: the queues and the values shared by the
+// nodes of a test. Nothing expires.
+type memCluster struct {
+	m      sync.Mutex
+	queues map[string][][]byte
+	values map[string][]byte
+	// Time to live of the expiring queues.
+	ttls map[string]time.Duration
+}
+
+func newMemCluster() *memCluster {
+	return &memCluster{
+		queues: make(map[string][][]byte),
+		values: make(map[string][]byte),
+		ttls:   make(map[string]time.Duration),
+	}
+}
+
+func (c *memCluster) set(key string, value []byte, ttl time.Duration) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *memCluster) setNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.values[key]; ok {
+		return false, nil
+	}
+	c.values[key] = value
+	return true, nil
+}
+
+func (c *memCluster) get(key string) ([]byte, bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	value, ok := c.values[key]
+	return value, ok, nil
+}
+
+func (c *memCluster) del(key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func (c *memCluster) push(key string, value []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.queues[key] = append(c.queues[key], value)
+	return nil
+}
+
+func (c *memCluster) pushExpiring(key string, value []byte, ttl time.Duration) error {
+	c.m.Lock()
+	c.ttls[key] = ttl
+	c.m.Unlock()
+	return c.push(key, value)
+}
+
+func (c *memCluster) pop(key string) ([]byte, bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	q := c.queues[key]
+	if len(q) == 0 {
+		return nil, false, nil
+	}
+	c.queues[key] = q[1:]
+	return q[0], true, nil
+}
+
+func (c *memCluster) remove(key string, value []byte) (bool, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	q := c.queues[key]
+	for i, v := range q {
+		if bytes.Equal(v, value) {
+			c.queues[key] = append(q[:i:i], q[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *memCluster) length(key string) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.queues[key]), nil
+}
+
+type sharedSeekResult struct {
+	pairing matchmaking.Pairing
+	ok      bool
+}
+
+// seekShared seeks in the background, waiting until the seeker is queued.
+func seekShared(t *testing.T, p *sharedPool, s matchmaking.Seeker, timeout time.Duration) <-chan sharedSeekResult {
+	t.Helper()
+	waiting := p.Waiting()
+	res := make(chan sharedSeekResult, 1)
+	go func() {
+		pairing, ok := p.Seek(s, timeout, func() string { return "game" })
+		res<- sharedSeekResult{pairing, ok}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for p.Waiting() != waiting+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("seeker not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return res
+}
+
+func receiveShared(t *testing.T, res <-chan sharedSeekResult) sharedSeekResult {
+	t.Helper()
+	select {
+	case r := <-res:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("seek didn't return")
+	}
+	return sharedSeekResult{}
+}
+
+func TestSharedPoolPairsAcrossNodes(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+	b := newSharedPools(c).pool("5+0")
+
+	first := seekShared(t, a, matchmaking.Seeker{ID: "a", Color: "white"}, time.Minute)
+	pairing, ok := b.Seek(matchmaking.Seeker{ID: "b"}, time.Minute, func() string { return "game" })
+	if !ok {
+		t.Fatal("b wasn't paired with a waiting in the other node")
+	}
+	if pairing.White.ID != "a" || pairing.Black.ID != "b" || pairing.GameID != "game" {
+		t.Fatalf("b paired as %+v, want a as white", pairing)
+	}
+	if r := receiveShared(t, first); !r.ok || r.pairing != pairing {
+		t.Fatalf("a got %+v, %v, want %+v", r.pairing, r.ok, pairing)
+	}
+	if n := a.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+}
+
+func TestSharedPoolCancel(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+	res := seekShared(t, a, matchmaking.Seeker{ID: "a"}, time.Minute)
+	a.Cancel("a")
+	if r := receiveShared(t, res); r.ok {
+		t.Fatalf("cancelled seek paired as %+v", r.pairing)
+	}
+	if n := a.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+}
+
+func TestSharedPoolSeekingFromAnotherNodeCancelsTheFirstSeek(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+	b := newSharedPools(c).pool("5+0")
+	first := seekShared(t, a, matchmaking.Seeker{ID: "a"}, time.Minute)
+	// The seek of a in the other node is taken off the queue rather than
+	// paired with a.
+	second := make(chan sharedSeekResult, 1)
+	go func() {
+		pairing, ok := b.Seek(matchmaking.Seeker{ID: "a"}, time.Minute, func() string { return "game" })
+		second<- sharedSeekResult{pairing, ok}
+	}()
+	if r := receiveShared(t, first); r.ok {
+		t.Fatalf("replaced seek paired as %+v", r.pairing)
+	}
+	deadline := time.Now().Add(time.Second)
+	for b.Waiting() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("second seek not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Cancel("a")
+	receiveShared(t, second)
+}
+
+func TestSharedPoolTimeout(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+	if pairing, ok := a.Seek(matchmaking.Seeker{ID: "a"}, 10*time.Millisecond, func() string { return "game" }); ok {
+		t.Fatalf("timed out seek paired as %+v", pairing)
+	}
+	if n := a.Waiting(); n != 0 {
+		t.Errorf("%d seekers waiting, want 0", n)
+	}
+}
+
+func TestSharedPoolHandsOverPairingsThroughTheStore(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+	b := newSharedPools(c).pool("5+0")
+
+	first := seekShared(t, a, matchmaking.Seeker{ID: "a"}, time.Minute)
+	c.m.Lock()
+	var entry queuedSeek
+	if err := json.Unmarshal(c.queues[poolKeyPrefix+"5+0"][0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	c.m.Unlock()
+	pairing, ok := b.Seek(matchmaking.Seeker{ID: "b"}, time.Minute, func() string { return "game" })
+	if !ok {
+		t.Fatal("b wasn't paired")
+	}
+	// The pairing waits for the node of a under the token of the seek, for
+	// a while.
+	c.m.Lock()
+	ttl := c.ttls[pairingKeyPrefix+entry.Token]
+	c.m.Unlock()
+	if ttl != pairingTTL {
+		t.Errorf("pairing kept for %v, want %v", ttl, pairingTTL)
+	}
+	if r := receiveShared(t, first); !r.ok || r.pairing != pairing {
+		t.Fatalf("a got %+v, %v, want %+v", r.pairing, r.ok, pairing)
+	}
+	if n, _ := c.length(pairingKeyPrefix + entry.Token); n != 0 {
+		t.Errorf("%d pairings left in the store after a took theirs", n)
+	}
+}
+
+func TestSharedPoolPairsInTheSameNode(t *testing.T) {
+	c := newMemCluster()
+	a := newSharedPools(c).pool("5+0")
+
+	first := seekShared(t, a, matchmaking.Seeker{ID: "a"}, time.Minute)
+	pairing, ok := a.Seek(matchmaking.Seeker{ID: "b"}, time.Minute, func() string { return "game" })
+	if !ok {
+		t.Fatal("b wasn't paired")
+	}
+	if r := receiveShared(t, first); !r.ok || r.pairing != pairing {
+		t.Fatalf("a got %+v, %v, want %+v", r.pairing, r.ok, pairing)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	for key := range c.ttls {
+		t.Errorf("pairing in the same node went through the store under %s", key)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+
+// draining reports whether the server is shutting down.
+func (rout *router) draining() bool {
+	rout.m.Lock()
+	defer rout.m.Unlock()
+	return rout.closing
+}
+
+// refuseIfDraining responds with an error if the server is shutting down, so
+// that no new games are paired.
+func (rout *router) refuseIfDraining(w http.ResponseWriter) bool {
+	if rout.draining() {
+		writeError(w, "The server is shutting down", http.StatusServiceUnavailable)
+		return true
+	}
+	return false
+}
+
+// shutdown stops the server gracefully: new pairings are refused, ongoing
+// requests are allowed to finish and the games in progress are aborted, with
+// both players told why. Ratings, accounts and the other stores are written
+// to disk as they change, so there is nothing left to flush afterwards.
+func (rout *router) shutdown(srv *http.Server) {
+	rootLogger.info("Shutting down")
+	rout.m.Lock()
+	rout.closing = true
+	rout.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		rootLogger.error("Could not shut down the server", "err", err)
+	}
+
+	// Websockets are hijacked, so they are not closed by srv.Shutdown.
+	close(rout.rm.shutdown)
+	done := make(chan struct{})
+	go func() {
+		rout.rm.games.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(conf.AdjudicationTimeout):
+		rootLogger.warn("Some games didn't finish in time")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// spectatorChats keeps a chat room per watched game, independent of the chat
+// between the players.
+type spectatorChats struct {
+	m     *sync.Mutex
+	rooms map[string]*spectatorChat
+
+	// Reports whether the user comments the games, and hands the messages
+	// of the commentators to the spectators of the game outside the chat.
+	commentator func(uid string) bool
+	commentary  func(gameId string, msg publicMessage)
+	// Returns the notice for the user if they are banned from the chat of
+	// the game.
+	silenced func(uid, gameId string) (notice, bool)
+}
+
+func newSpectatorChats() *spectatorChats {
+	return &spectatorChats{
+		m:           &sync.Mutex{},
+		rooms:       make(map[string]*spectatorChat),
+		commentator: func(string) bool { return false },
+		commentary:  func(string, publicMessage) {},
+		silenced:    func(string, string) (notice, bool) { return notice{}, false },
+	}
+}
+
+func (sc *spectatorChats) size() int {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return len(sc.rooms)
+}
+
+// get returns the spectator chat of the game, setting it up if there is none.
+func (sc *spectatorChats) get(gameId string) *spectatorChat {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	c, ok := sc.rooms[gameId]
+	if !ok {
+		c = newSpectatorChat()
+		c.gameId = gameId
+		c.commentator, c.commentary = sc.commentator, sc.commentary
+		c.publicChat.silenced = func(uid string) (notice, bool) {
+			return sc.silenced(uid, gameId)
+		}
+		sc.rooms[gameId] = c
+		go c.run()
+	}
+	return c
+}
+
+// find returns the spectator chat of the game, if it's open.
+func (sc *spectatorChats) find(gameId string) (*spectatorChat, bool) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	c, ok := sc.rooms[gameId]
+	return c, ok
+}
+
+// end closes the spectator chat of the game, if any.
+func (sc *spectatorChats) end(gameId string) {
+	sc.m.Lock()
+	c, ok := sc.rooms[gameId]
+	delete(sc.rooms, gameId)
+	sc.m.Unlock()
+	if ok {
+		close(c.end)
+	}
+}
+
+// spectatorChat is the chat room of the spectators of a single game.
+type spectatorChat struct {
+	publicChat
+
+	gameId string
+	// See spectatorChats.
+	commentator func(uid string) bool
+	commentary  func(gameId string, msg publicMessage)
+
+	clients map[*chatClient]bool
+
+	// Register requests from the spectators.
+	join chan *chatClient
+
+	// Unregister requests from the spectators.
+	leave chan *chatClient
+
+	// Inbound messages from the spectators.
+	broadcast chan publicMessage
+
+	// Moderation: silence a user until the given time.
+	mute chan muteRequest
+
+	// Moderation: delete a message by id.
+	remove chan string
+
+	// Events of the game sent by its room, e.g. a player going blindfold.
+	announcements chan interface{}
+
+	// Closed when the game is over.
+	end chan struct{}
+}
+
+func newSpectatorChat() *spectatorChat {
+	return &spectatorChat{
+		publicChat: newPublicChat(),
+		clients:    make(map[*chatClient]bool),
+		join:       make(chan *chatClient),
+		leave:      make(chan *chatClient),
+		broadcast:  make(chan publicMessage),
+		mute:       make(chan muteRequest),
+		remove:     make(chan string),
+		end:        make(chan struct{}),
+
+		announcements: make(chan interface{}, 16),
+	}
+}
+
+func (c *spectatorChat) run() {
+	defer func() {
+		for client := range c.clients {
+			close(client.send)
+		}
+	}()
+	for {
+		select {
+		case client := <-c.join:
+			c.clients[client] = true
+			c.deliver(client, map[string]interface{}{
+				"spectatorChatHistory": c.history(),
+			})
+		case client := <-c.leave:
+			if _, ok := c.clients[client]; ok {
+				delete(c.clients, client)
+				close(client.send)
+			}
+		case msg := <-c.broadcast:
+			msg.Commentator = c.commentator(msg.userId)
+			msg, ok, reason := c.post(msg)
+			if !ok {
+				if reason.code != "" {
+					for client := range c.clients {
+						if client.uid == msg.userId {
+							c.deliver(client, noticeEvent{
+								key:    "spectatorChatError",
+								notice: reason,
+							})
+						}
+					}
+				}
+				break
+			}
+			c.deliverAll(map[string]interface{}{
+				"spectatorChat": msg,
+			})
+			if msg.Commentator {
+				c.commentary(c.gameId, msg)
+			}
+		case req := <-c.mute:
+			c.muted[req.Uid] = req.Until
+		case id := <-c.remove:
+			c.delete(id)
+			c.deliverAll(map[string]string{
+				"spectatorChatDeleted": id,
+			})
+		case payload := <-c.announcements:
+			c.deliverAll(payload)
+		case <-c.end:
+			return
+		}
+	}
+}
+
+func (c *spectatorChat) deliver(client *chatClient, payload interface{}) {
+	select {
+	case client.send<- payload:
+	default:
+		close(client.send)
+		delete(c.clients, client)
+	}
+}
+
+func (c *spectatorChat) deliverAll(payload interface{}) {
+	for client := range c.clients {
+		c.deliver(client, payload)
+	}
+}
+
+// chatClient is a middleman between a spectator's websocket connection and
+// the spectator chat.
+type chatClient struct {
+	uid      string
+	username string
+	lang     string
+	chat     *spectatorChat
+	conn     protocol.Conn
+
+	// Buffered channel of outbound messages.
+	send chan interface{}
+}
+
+// Reading goroutine - it reads ping messages and chat messages.
+func (c *chatClient) readPump() {
+	defer func() {
+		select {
+		case c.chat.leave<- c:
+		case <-c.chat.end:
+		}
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(conf.MaxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	for {
+		msg, oversized, err := readMessage(c.conn)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				rootLogger.warn("Spectator chat connection closed unexpectedly", "uid", c.uid, "err", err)
+			}
+			break
+		}
+		if oversized {
+			select {
+			case c.chat.broadcast<- publicMessage{userId: c.uid, tooLong: true}:
+			case <-c.chat.end:
+				return
+			}
+			continue
+		}
+		m, err := decodeChatInput(msg)
+		select {
+		case c.chat.broadcast<- publicMessage{
+			Text:     m.Text,
+			Username: c.username,
+			userId:   c.uid,
+			invalid:  err,
+		}:
+		case <-c.chat.end:
+			return
+		}
+	}
+}
+
+// Writing goroutine - it sends chat messages and ping messages to the client.
+func (c *chatClient) writePump() {
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if !ok {
+				// The chat closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if ev, ok := payload.(noticeEvent); ok {
+				payload = ev.localize(c.lang)
+			}
+			if err := c.conn.WriteJSON(payload); err != nil {
+				rootLogger.error("Could not write spectator chat payload", "err", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Join the chat room of the spectators of a game.
+func (rout *router) handleSpectatorChat(w http.ResponseWriter, r *http.Request) {
+	uid, username, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gameId := mux.Vars(r)["id"]
+	_, ok := rout.matches.get(gameId)
+	if !ok {
+		writeError(w, "Match not found", http.StatusNotFound)
+		return
+	}
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
+	chat := rout.spectatorChats.get(gameId)
+	client := &chatClient{
+		uid:      uid,
+		username: username,
+		lang:     requestLanguage(r),
+		chat:     chat,
+		conn:     conn,
+		send:     make(chan interface{}, 256),
+	}
+	select {
+	case chat.join<- client:
+	case <-chat.end:
+		closeWithNotice(conn, websocket.CloseNormalClosure, newNotice(noticeGameOver), client.lang)
+		conn.Close()
+		rout.conns.remove(uid, conn)
+		return
+	}
+
+	// Allow collection of memory referenced by the caller by doing all work in
+	// new goroutines.
+	go client.writePump()
+	go func() {
+		client.readPump()
+		rout.conns.remove(uid, conn)
+	}()
+}
+
+// Silence a user in the spectator chat of a game for a while.
+func (rout *router) handleMuteSpectatorChat(w http.ResponseWriter, r *http.Request) {
+	req, err := parseMuteRequest(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chat, ok := rout.spectatorChats.find(mux.Vars(r)["id"])
+	if ok {
+		select {
+		case chat.mute<- req:
+		case <-chat.end:
+			ok = false
+		}
+	}
+	if !ok {
+		writeError(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete a message from the spectator chat of a game.
+func (rout *router) handleDeleteSpectatorMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	chat, ok := rout.spectatorChats.find(vars["id"])
+	if ok {
+		select {
+		case chat.remove<- vars["messageId"]:
+		case <-chat.end:
+			ok = false
+		}
+	}
+	if !ok {
+		writeError(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"runtime"
+)
+
+// intMap reads an expvar map of ints, as set by the goroutines owning the
+// structures counted.
+func intMap(m *expvar.Map) map[string]int64 {
+	res := make(map[string]int64)
+	m.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			res[kv.Key] = v.Value()
+		}
+	})
+	return res
+}
+
+// Report the goroutines, heap usage and the size of the in-memory structures
+// of the server, so that leaks show up without attaching a profiler. Sizes of
+// the structures owned by goroutines are the ones they last saw.
+func (rout *router) handleStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	res := map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"heap": map[string]uint64{
+			"alloc":   mem.HeapAlloc,
+			"inuse":   mem.HeapInuse,
+			"objects": mem.HeapObjects,
+			"sys":     mem.Sys,
+			"numGC":   uint64(mem.NumGC),
+		},
+		"matches":         rout.matches.size(),
+		"rooms":           intMap(roomsOpen),
+		"roomsHalfFilled": intMap(roomsHalfFilled),
+		"invites":         rout.wr.sizes(),
+		"pools":           rout.poolsWaiting(),
+		"seeks":           rout.seeks.size(),
+		"challenges":      rout.challenges.size(),
+		"finishedInvites": rout.finishedInvites.size(),
+		"inviteBursts":    rout.inviteBursts.size(),
+		"livedataClients": livedataClients.Value(),
+		"playersInGames":  playersInGames.Value(),
+		"sockets":         rout.conns.sizes(),
+		"spectatorChats":  rout.spectatorChats.size(),
+		"panics":          intMap(panics),
+	}
+
+	resB, err := json.Marshal(res)
+	if err != nil {
+		requestLogger(r).error("Could not marshal response", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resB); err != nil {
+		requestLogger(r).error("Could not write response", "err", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// loadJSON reads the named file from the data directory into v. A missing
+// file leaves v untouched.
+func loadJSON(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(conf.DataDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveJSON writes v to the named file of the data directory, replacing it
+// atomically. The name may be in a subdirectory, made if missing.
+func saveJSON(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(conf.DataDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeJSON deletes the named file of the data directory, if there is one.
+func removeJSON(name string) error {
+	err := os.Remove(filepath.Join(conf.DataDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// listJSON returns the names of the JSON files in the subdirectory of the
+// data directory, as given to loadJSON. A missing subdirectory has none.
+func listJSON(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(conf.DataDir, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".json" {
+			names = append(names, filepath.Join(dir, info.Name()))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempDataDir points the data directory to a new one for the test.
+func useTempDataDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "prince")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := conf.DataDir
+	conf.DataDir = dir
+	t.Cleanup(func() {
+		conf.DataDir = old
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestSaveAndLoadJSON(t *testing.T) {
+	dir := useTempDataDir(t)
+
+	var missing map[string]int
+	if err := loadJSON("missing.json", &missing); err != nil || missing != nil {
+		t.Fatalf("loading a missing file: %v, %v", missing, err)
+	}
+
+	saved := map[string]int{"a": 1, "b": 2}
+	if err := saveJSON("store.json", saved); err != nil {
+		t.Fatal(err)
+	}
+	var loaded map[string]int
+	if err := loadJSON("store.json", &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded["a"] != 1 || loaded["b"] != 2 {
+		t.Errorf("loaded %v, want %v", loaded, saved)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "store.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadJSON("bad.json", &loaded); err == nil {
+		t.Error("loaded a corrupt file")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// streamEvent is what the game stream needs to know of the messages sent to
+// the spectators.
+type streamEvent struct {
+	Snapshot *struct {
+		Ply    int    `json:"ply"`
+		Result string `json:"result"`
+	} `json:"snapshot"`
+}
+
+// streamWindow is how long a request to the game stream is kept open. It
+// ends before the server's write timeout; the client goes on with the ply it
+// reached as the cursor.
+func streamWindow() time.Duration {
+	return conf.WriteTimeout * 4 / 5
+}
+
+// Follow a game being played as newline delimited JSON, for sites embedding
+// it without a WebSocket client. The lines are the ones sent on /watch: the
+// state of the game, unless the client has seen every ply up to it already,
+// then the moves and the result. The request ends after a while; the client
+// asks again with the last ply it got as the cursor to go on where it left.
+func (rout *router) handleGameStream(w http.ResponseWriter, r *http.Request) {
+	cursor := 0
+	if c := r.FormValue("cursor"); c != "" {
+		var err error
+		if cursor, err = strconv.Atoi(c); err != nil || cursor < 0 {
+			writeError(w, "Invalid cursor: " + c, http.StatusBadRequest)
+			return
+		}
+	}
+	room, ok := rout.rm.live.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	wt := &watcher{
+		room: room,
+		send: make(chan []byte, watcherBufferSize),
+	}
+	select {
+	case room.watch<- wt:
+	case <-room.closed:
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	defer room.leave(wt)
+
+	var window <-chan time.Time
+	if conf.WriteTimeout > 0 {
+		t := time.NewTimer(streamWindow())
+		defer t.Stop()
+		window = t.C
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		select {
+		case data, ok := <-wt.send:
+			if !ok {
+				// The room closed.
+				return
+			}
+			var ev streamEvent
+			if err := json.Unmarshal(data, &ev); err != nil {
+				requestLogger(r).error("Could not unmarshal stream event", "err", err)
+				continue
+			}
+			// The moves come after the state, so only the state can be
+			// known to the client already. A rematch starts over.
+			if s := ev.Snapshot; s != nil && cursor != 0 && s.Ply == cursor && s.Result == "" {
+				continue
+			}
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-window:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
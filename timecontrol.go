@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var errInvalidTimeControl = errors.New("Invalid time control")
+
+// timeControl is the clock of a game: the time each player starts with plus
+// the increment added to their clock after each of their moves.
+type timeControl struct {
+	base      time.Duration
+	increment time.Duration
+}
+
+// parseTimeControl parses the base time in minutes and the optional increment
+// in seconds of a time control.
+func parseTimeControl(minutes, increment string) (timeControl, error) {
+	base, err := strconv.Atoi(minutes)
+	if err != nil || base <= 0 || base > conf.MaxBaseMinutes {
+		return timeControl{}, errInvalidTimeControl
+	}
+	inc := 0
+	if increment != "" {
+		inc, err = strconv.Atoi(increment)
+		if err != nil || inc < 0 || inc > conf.MaxIncrementSeconds {
+			return timeControl{}, errInvalidTimeControl
+		}
+	}
+	return timeControl{
+		base:      time.Duration(base) * time.Minute,
+		increment: time.Duration(inc) * time.Second,
+	}, nil
+}
+
+// minutes returns the base time in minutes.
+func (tc timeControl) minutes() int {
+	return int(tc.base / time.Minute)
+}
+
+// seconds returns the increment in seconds.
+func (tc timeControl) seconds() int {
+	return int(tc.increment / time.Second)
+}
+
+// String formats the time control as "base+increment", e.g. "5+5".
+func (tc timeControl) String() string {
+	return strconv.Itoa(tc.minutes()) + "+" + strconv.Itoa(tc.seconds())
+}
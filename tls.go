@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certReloader serves the TLS certificate of the server from the configured
+// files, loading them again whenever the certificate file changes so that
+// renewed certificates are picked up without restarting.
+type certReloader struct {
+	m        *sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// newCertReloader loads the certificate, failing if it can't be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		m:        &sync.Mutex{},
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := c.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If a changed
+// certificate can't be loaded, the previous one keeps being served.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil && !info.ModTime().After(c.modTime) {
+		return c.cert, nil
+	}
+	// Remember the attempt even if it fails, so that a broken certificate is
+	// only reported once.
+	c.modTime = info.ModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			rootLogger.error("Could not reload TLS certificate", "err", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		rootLogger.info("Reloaded TLS certificate", "file", c.certFile)
+	}
+	c.cert = &cert
+	return c.cert, nil
+}
+
+// tlsConfig returns the TLS settings of the server, serving the configured
+// certificate.
+func tlsConfig() (*tls.Config, error) {
+	certs, err := newCertReloader(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// acmeManager gets and renews the certificates of the ACME domains from
+// Let's Encrypt, refusing to ask for any other host.
+func acmeManager() *autocert.Manager {
+	dir := conf.ACMECacheDir
+	if dir == "" {
+		dir = filepath.Join(conf.DataDir, "acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(conf.ACMEDomains...),
+		Email:      conf.ACMEEmail,
+	}
+}
+
+// acmeTLSConfig returns the TLS settings of the server, serving the
+// certificates of the manager.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	c := m.TLSConfig()
+	c.MinVersion = tls.VersionTLS12
+	return c
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the same URL on the HTTPS
+// address of the server.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(conf.Addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = host
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
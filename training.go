@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/luisguve/princechess-server/internal/engine"
+	"github.com/luisguve/princechess-server/internal/rules"
+)
+
+// Plies the engine searches for the hints of training games.
+const hintDepth = 3
+
+// position returns the position reached in the current game of the room,
+// with its starting position and the moves played.
+func (r *Room) position() (start, pos *rules.Position, moves []rules.Move, err error) {
+	setup := r.white.setup
+	start, err = setup.variant().Position(setup.startFEN())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pos, moves, err = rules.ParsePGN(start, r.pgn)
+	return start, pos, moves, err
+}
+
+// takeback takes back the last move of the player and the reply of the
+// computer, in training games. The player must be on turn, so that the
+// computer isn't thinking about a move being taken back.
+func (r *Room) takeback(color string) {
+	p, opp := r.white, r.black
+	if color == "black" {
+		p, opp = r.black, r.white
+	}
+	if !r.training || r.result != "" || r.waitingPlayer || color[:1] != r.onTurn() {
+		r.sendEvent(p, map[string]string{"takebackRefused": "true"})
+		return
+	}
+	start, _, moves, err := r.position()
+	if err != nil || len(moves) < 2 {
+		r.sendEvent(p, map[string]string{"takebackRefused": "true"})
+		return
+	}
+	moves = moves[:len(moves)-2]
+	r.plies = len(moves)
+	if len(r.played) > len(moves) {
+		r.played = r.played[:len(moves)]
+	}
+	r.pgn = r.white.setup.pgnHeaders() + rules.FormatMoves(start, moves)
+
+	// The player's clock runs from now on, unless no move is left.
+	opp.clock.Stop()
+	now := r.clock.Now()
+	if len(moves) == 0 {
+		r.lastMover = ""
+		r.white.LastMove, r.black.LastMove = time.Time{}, time.Time{}
+		r.movedAt = time.Time{}
+		p.clock.Stop()
+	} else {
+		opp.LastMove = now
+		r.movedAt = now
+		if !p.Moved() {
+			// Took back the first move of the player.
+			p.clock.Stop()
+		} else {
+			p.clock.Reset(p.TimeLeft)
+		}
+	}
+	data := map[string]string{
+		"takeback": "true",
+		"pgn":      r.pgn,
+	}
+	r.sendEvent(r.white, data)
+	r.sendEvent(r.black, data)
+	r.tellWatchers(r.snapshot())
+}
+
+// hint sends the player the move the engine suggests, in training games. The
+// engine thinks in the background, not to hold the room up.
+func (r *Room) hint(color string) {
+	p := r.white
+	if color == "black" {
+		p = r.black
+	}
+	if !r.training || r.result != "" || color[:1] != r.onTurn() {
+		r.sendEvent(p, map[string]string{"hintRefused": "true"})
+		return
+	}
+	_, pos, _, err := r.position()
+	if err != nil {
+		r.log.warn("Could not follow the game for a hint", "err", err)
+		r.sendEvent(p, map[string]string{"hintRefused": "true"})
+		return
+	}
+	go func() {
+		res := map[string]interface{}{"hintRefused": "true"}
+		if m, _, err := engine.Analyze(pos, hintDepth); err == nil {
+			res = map[string]interface{}{
+				"hint": map[string]string{
+					"uci": m.String(),
+					"san": pos.SAN(m),
+				},
+			}
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			rootLogger.error("Could not marshal data", "err", err)
+			return
+		}
+		// The room's drop count is not touched from this goroutine.
+		select {
+		case p.sendEvent<- data:
+		default:
+		}
+	}()
+}
+
+// sendEvent sends the data to the player, unless their connection is busy or
+// gone.
+func (r *Room) sendEvent(p *player, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	select {
+	case p.sendEvent<- b:
+	default:
+		r.drop("event")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+// How often the TV looks for a game to show while none is being played.
+const tvIdlePoll = 5 * time.Second
+
+// tvPlayer is a player of the featured game, as shown on the TV.
+type tvPlayer struct {
+	Username string `json:"username"`
+	Rating   int    `json:"rating"`
+}
+
+// tvGame tells the TV viewers the game they are watching from now on.
+type tvGame struct {
+	GameId  string   `json:"gameId"`
+	White   tvPlayer `json:"white"`
+	Black   tvPlayer `json:"black"`
+	Rated   bool     `json:"rated"`
+	Variant string   `json:"variant"`
+}
+
+// ids returns the ids of the games being hosted.
+func (l *liveRooms) ids() []string {
+	l.m.Lock()
+	defer l.m.Unlock()
+	ids := make([]string, 0, len(l.rooms))
+	for id := range l.rooms {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// featuredGame picks the game to show on the TV among the ones being played,
+// leaving out the skipped ones: rated games first, then the one with the
+// strongest players. Training games are never featured.
+func (rout *router) featuredGame(skip map[string]bool) (*Room, tvGame, bool) {
+	ids := rout.rm.live.ids()
+	sort.Strings(ids)
+	var (
+		best      *Room
+		bestGame  tvGame
+		bestScore float64
+	)
+	for _, id := range ids {
+		if skip[id] {
+			continue
+		}
+		m, ok := rout.matches.get(id)
+		if !ok || m.training {
+			continue
+		}
+		room, ok := rout.rm.live.get(id)
+		if !ok {
+			continue
+		}
+		white, black := rout.ratings.get(m.white.id), rout.ratings.get(m.black.id)
+		score := white.Rating + black.Rating
+		if best != nil {
+			if bestGame.Rated && !m.rated {
+				continue
+			}
+			if bestGame.Rated == m.rated && score <= bestScore {
+				continue
+			}
+		}
+		best, bestScore = room, score
+		bestGame = tvGame{
+			GameId:  id,
+			White:   tvPlayer{Username: m.white.username, Rating: int(white.Rating)},
+			Black:   tvPlayer{Username: m.black.username, Rating: int(black.Rating)},
+			Rated:   m.rated,
+			Variant: m.setup.variant().Name(),
+		}
+	}
+	return best, bestGame, best != nil
+}
+
+// tvViewer follows the featured game and moves on to the next one once it
+// ends.
+type tvViewer struct {
+	uid  string
+	conn protocol.Conn
+	// Closed once the viewer's connection goes away.
+	gone chan struct{}
+}
+
+// Reading goroutine - viewers don't send anything but pongs.
+func (t *tvViewer) readPump() {
+	defer func() {
+		close(t.gone)
+		t.conn.Close()
+	}()
+	t.conn.SetReadLimit(conf.MaxFrameSize)
+	t.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	t.conn.SetPongHandler(func(string) error { t.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	for {
+		if _, _, err := readMessage(t.conn); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				rootLogger.warn("TV connection closed unexpectedly", "uid", t.uid, "err", err)
+			}
+			return
+		}
+	}
+}
+
+// run is the writing goroutine: it tells the viewer which game is on, then
+// relays it until it ends and switches to the next one.
+func (t *tvViewer) run(rout *router) {
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer func() {
+		ticker.Stop()
+		t.conn.Close()
+	}()
+	// Games not to be shown again right away: the one that just ended and
+	// the ones found over since.
+	skip := make(map[string]bool)
+	// Whether the viewer was told there's no game to show.
+	idle := false
+	for {
+		room, game, ok := rout.featuredGame(skip)
+		if !ok {
+			if !idle && !t.write(map[string]interface{}{"tvGame": nil}) {
+				return
+			}
+			idle, skip = true, make(map[string]bool)
+			if !t.wait(ticker) {
+				return
+			}
+			continue
+		}
+		w := &watcher{
+			uid:             t.uid,
+			room:            room,
+			send:            make(chan []byte, watcherBufferSize),
+			leaveOnGameOver: true,
+		}
+		skip[game.GameId] = true
+		select {
+		case room.watch<- w:
+		case <-room.closed:
+			continue
+		case <-t.gone:
+			return
+		}
+		// The room lets the watcher go right away if the game is over.
+		var snapshot []byte
+		select {
+		case snapshot, ok = <-w.send:
+		case <-t.gone:
+			room.leave(w)
+			return
+		}
+		if !ok {
+			continue
+		}
+		idle, skip = false, map[string]bool{game.GameId: true}
+		if !t.write(map[string]tvGame{"tvGame": game}) || !t.relay(snapshot) {
+			room.leave(w)
+			return
+		}
+		if !t.follow(room, w, ticker) {
+			return
+		}
+	}
+}
+
+// wait waits for a while before looking for a game again, keeping the
+// connection alive. It reports false if the viewer is gone.
+func (t *tvViewer) wait(ticker *time.Ticker) bool {
+	idle := time.NewTimer(tvIdlePoll)
+	defer idle.Stop()
+	for {
+		select {
+		case <-idle.C:
+			return true
+		case <-ticker.C:
+			t.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := t.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return false
+			}
+		case <-t.gone:
+			return false
+		}
+	}
+}
+
+// follow relays the game to the viewer until the room lets the watcher go.
+// It reports false if the viewer is gone.
+func (t *tvViewer) follow(room *Room, w *watcher, ticker *time.Ticker) bool {
+	for {
+		select {
+		case data, ok := <-w.send:
+			if !ok {
+				return true
+			}
+			if !t.relay(data) {
+				room.leave(w)
+				return false
+			}
+		case <-ticker.C:
+			t.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := t.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				room.leave(w)
+				return false
+			}
+		case <-t.gone:
+			room.leave(w)
+			return false
+		}
+	}
+}
+
+func (t *tvViewer) relay(data []byte) bool {
+	t.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+	return t.conn.WriteMessage(websocket.TextMessage, data) == nil
+}
+
+func (t *tvViewer) write(payload interface{}) bool {
+	t.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+	return t.conn.WriteJSON(payload) == nil
+}
+
+// Watch the featured game, the one between the strongest players being
+// played. The viewer is told which game is on and its players, gets it as
+// in /watch, and is switched to the next featured game once it ends.
+func (rout *router) handleTV(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
+	t := &tvViewer{
+		uid:  uid,
+		conn: conn,
+		gone: make(chan struct{}),
+	}
+	go t.run(rout)
+	go func() {
+		t.readPump()
+		rout.conns.remove(uid, conn)
+	}()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+// Names used by the server itself, which users can't take.
+var systemUsernames = []string{
+	DEFAULT_USERNAME,
+	"you",
+	"admin",
+	"administrator",
+	"moderator",
+	"system",
+	"server",
+	"princechess",
+}
+
+// Words not allowed anywhere in a username. The list can be extended with the
+// bannedWords setting.
+var bannedWords = []string{
+	"fuck",
+	"shit",
+	"bitch",
+	"cunt",
+	"asshole",
+	"puta",
+	"mierda",
+}
+
+// validateUsername checks the username against the naming rules, returning
+// every rule it breaks.
+func validateUsername(username string) []notice {
+	var errs []notice
+	length := len([]rune(username))
+	if length < minUsernameLength {
+		errs = append(errs, newNotice(noticeUsernameTooShort, minUsernameLength))
+	}
+	if length > maxUsernameLength {
+		errs = append(errs, newNotice(noticeUsernameTooLong, maxUsernameLength))
+	}
+	for _, c := range username {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' {
+			errs = append(errs, newNotice(noticeUsernameInvalidChars))
+			break
+		}
+	}
+	lower := strings.ToLower(username)
+	for _, name := range systemUsernames {
+		if lower == name {
+			errs = append(errs, newNotice(noticeUsernameReserved))
+			break
+		}
+	}
+	words := append(bannedWords[:len(bannedWords):len(bannedWords)], conf.bannedWords()...)
+	for _, word := range words {
+		if word != "" && strings.Contains(lower, strings.ToLower(word)) {
+			errs = append(errs, newNotice(noticeUsernameProfane))
+			break
+		}
+	}
+	return errs
+}
+
+// writeValidationErrors responds with the localized validation errors.
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, errs []notice) {
+	writeNotices(w, r, http.StatusBadRequest, errs...)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/luisguve/princechess-server/internal/variant"
+)
+
+// Variant of the games that don't ask for another.
+const variantStandard = variant.StandardName
+
+const standardFEN = variant.StandardFEN
+
+var errInvalidVariant = errors.New("Invalid variant")
+
+// setup is how a game starts: its variant and the starting position, in FEN.
+type setup struct {
+	Variant string `json:"variant"`
+	FEN     string `json:"fen"`
+	// Piece the player of the color OddsBy starts without, if any.
+	Odds   string `json:"odds,omitempty"`
+	OddsBy string `json:"oddsBy,omitempty"`
+}
+
+// newSetup draws the starting position of a game of the variant. An empty
+// variant is a standard game.
+func newSetup(name string) (setup, error) {
+	if name == "" {
+		name = variantStandard
+	}
+	v, ok := variant.Get(name)
+	if !ok {
+		return setup{}, errInvalidVariant
+	}
+	fen, err := v.InitialFEN()
+	if err != nil {
+		return setup{}, err
+	}
+	return setup{Variant: v.Name(), FEN: fen}, nil
+}
+
+// validVariant reports whether games can be played in the variant.
+func validVariant(name string) bool {
+	_, ok := variant.Get(name)
+	return ok
+}
+
+// variant returns the rules of the game. Games from before variants were
+// named are standard.
+func (s setup) variant() variant.Variant {
+	if v, ok := variant.Get(s.Variant); ok {
+		return v
+	}
+	return variant.Standard
+}
+
+// standard reports whether the game starts from the usual position.
+func (s setup) standard() bool {
+	return s.FEN == "" || s.FEN == standardFEN
+}
+
+// startFEN returns the starting position of the game, the usual one for the
+// games of the pools, which have no setup.
+func (s setup) startFEN() string {
+	if s.FEN == "" {
+		return standardFEN
+	}
+	return s.FEN
+}
+
+// pgnHeaders returns the PGN tags recording the variant and the starting
+// position of games that don't start from the usual one. Handicap games are
+// tagged with the odds given.
+func (s setup) pgnHeaders() string {
+	if s.standard() {
+		return ""
+	}
+	headers := "[Variant \"" + s.Variant + "\"]\n"
+	if s.Odds != "" {
+		headers += "[Handicap \"" + s.OddsBy + " without " + s.Odds + "\"]\n"
+	}
+	return headers + "[SetUp \"1\"]\n[FEN \"" + s.FEN + "\"]\n"
+}
+
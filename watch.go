@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/luisguve/princechess-server/internal/game"
+	"github.com/luisguve/princechess-server/internal/protocol"
+)
+
+const (
+	// Outbound messages buffered for each spectator before they are dropped.
+	watcherBufferSize = 64
+	// How often the players are told how many spectators they have, if it
+	// changed.
+	spectatorCountInterval = 5 * time.Second
+)
+
+// liveRooms keeps the rooms hosting a game, by game id, for the spectators,
+// and the broadcast delays set for the games.
+type liveRooms struct {
+	m      *sync.Mutex
+	rooms  map[string]*Room
+	delays map[string]time.Duration
+}
+
+func newLiveRooms() *liveRooms {
+	return &liveRooms{
+		m:      &sync.Mutex{},
+		rooms:  make(map[string]*Room),
+		delays: make(map[string]time.Duration),
+	}
+}
+
+func (l *liveRooms) add(gameId string, r *Room) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rooms[gameId] = r
+}
+
+func (l *liveRooms) remove(gameId string, r *Room) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.rooms[gameId] == r {
+		delete(l.rooms, gameId)
+	}
+}
+
+func (l *liveRooms) get(gameId string) (*Room, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	r, ok := l.rooms[gameId]
+	return r, ok
+}
+
+// watcher is a spectator following a game over a read-only connection.
+type watcher struct {
+	uid  string
+	room *Room
+	conn protocol.Conn
+
+	// Buffered channel of outbound messages, closed by the room.
+	send chan []byte
+	// Whether the room lets the watcher go once the game ends, rather than
+	// when the room closes.
+	leaveOnGameOver bool
+	// Closed when a watcher following the spectator cache leaves.
+	stop chan struct{}
+	// Whether the watcher is left out of the spectators the players are
+	// told they have, as the admins viewing the game from the dashboard.
+	hidden bool
+}
+
+// clocks returns the time left of both players, counting the time the
+// player on turn has been thinking.
+func (r *Room) clocks() map[string]int64 {
+	white, black := r.white.TimeLeft, r.black.TimeLeft
+	if r.result == "" {
+		if r.onTurn() == "w" {
+			white, black = game.Remaining(r.white.Clock, r.black.Clock, r.clock.Now())
+		} else {
+			black, white = game.Remaining(r.black.Clock, r.white.Clock, r.clock.Now())
+		}
+	}
+	return map[string]int64{
+		"white": white.Milliseconds(),
+		"black": black.Milliseconds(),
+	}
+}
+
+// snapshot returns the state of the game for a spectator arriving at it.
+func (r *Room) snapshot() map[string]interface{} {
+	turn := "white"
+	if r.onTurn() == "b" {
+		turn = "black"
+	}
+	blindfold := []string{}
+	for _, p := range []*player{r.white, r.black} {
+		if r.blindfold[p.userId] {
+			blindfold = append(blindfold, p.color)
+		}
+	}
+	s := map[string]interface{}{
+		"gameId":    r.white.gameId,
+		"variant":   r.white.setup.variant().Name(),
+		"white":     r.white.username,
+		"black":     r.black.username,
+		"pgn":       r.pgn,
+		"ply":       r.plies,
+		"clock":     r.clocks(),
+		"turn":      turn,
+		"blindfold": blindfold,
+	}
+	if r.result != "" {
+		s["result"] = r.result
+	}
+	return map[string]interface{}{"snapshot": s}
+}
+
+// spectatorUpdate is a message for the spectators of the room.
+type spectatorUpdate struct {
+	data []byte
+	// Whether the game was over as of the message.
+	over bool
+	// Only for the messages held back by the broadcast delay: the state of
+	// the game as of the message, for the spectators arriving meanwhile, and
+	// when it is due.
+	snapshot []byte
+	due      time.Time
+}
+
+// tellWatchers sends the payload to every spectator of the room, right away
+// unless the game is broadcast with a delay.
+func (r *Room) tellWatchers(payload interface{}) {
+	if len(r.watchers) == 0 && r.broadcastDelay == 0 {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		r.log.error("Could not marshal data", "err", err)
+		return
+	}
+	u := spectatorUpdate{data: data, over: r.result != ""}
+	if r.broadcastDelay > 0 {
+		r.holdBack(u)
+		return
+	}
+	r.deliver(u)
+}
+
+// deliver sends the update to the spectators. The ones too slow to keep up
+// are let go, and so are the ones leaving once the game is over.
+func (r *Room) deliver(u spectatorUpdate) {
+	for w := range r.watchers {
+		r.sendWatcher(w, u.data)
+		if u.over && w.leaveOnGameOver {
+			r.removeWatcher(w)
+		}
+	}
+	if u.snapshot != nil {
+		r.spectatorView, r.spectatorViewOver = u.snapshot, u.over
+	}
+	if len(r.overflow) > 0 {
+		r.refreshCache(u)
+	}
+}
+
+func (r *Room) sendWatcher(w *watcher, data []byte) {
+	select {
+	case w.send<- data:
+	default:
+		r.drop("watcher")
+		delete(r.watchers, w)
+		close(w.send)
+	}
+}
+
+// addWatcher registers the spectator and sends them the state of the game,
+// as far as the spectators have seen it.
+func (r *Room) addWatcher(w *watcher) {
+	data, over := r.spectatorView, r.spectatorViewOver
+	if r.broadcastDelay == 0 || data == nil {
+		var err error
+		if data, err = json.Marshal(r.snapshot()); err != nil {
+			r.log.error("Could not marshal snapshot", "err", err)
+			close(w.send)
+			return
+		}
+		over = r.result != ""
+	}
+	if w.leaveOnGameOver && over {
+		close(w.send)
+		return
+	}
+	if conf.MaxWatchers > 0 && len(r.watchers) >= conf.MaxWatchers {
+		r.addOverflow(w, data, over)
+		return
+	}
+	r.watchers[w] = true
+	r.sendWatcher(w, data)
+}
+
+func (r *Room) removeWatcher(w *watcher) {
+	if r.watchers[w] {
+		delete(r.watchers, w)
+		close(w.send)
+	}
+	if r.overflow[w] {
+		delete(r.overflow, w)
+		close(w.stop)
+	}
+}
+
+// leave unregisters the watcher from the room, if it is still open.
+func (r *Room) leave(w *watcher) {
+	select {
+	case r.unwatch<- w:
+	case <-r.closed:
+	}
+}
+
+// sendSpectatorCount tells the players how many spectators they have, unless
+// they already know.
+func (r *Room) sendSpectatorCount() {
+	n := r.spectatorCount()
+	if n == r.spectators {
+		return
+	}
+	r.spectators = n
+	data := map[string]int{"spectators": r.spectators}
+	r.sendEvent(r.white, data)
+	r.sendEvent(r.black, data)
+}
+
+// spectatorCount returns the number of spectators of the room, leaving out
+// the hidden ones.
+func (r *Room) spectatorCount() int {
+	n := 0
+	for _, watchers := range []map[*watcher]bool{r.watchers, r.overflow} {
+		for w := range watchers {
+			if !w.hidden {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Reading goroutine - the spectators can't say anything to the room, so
+// it only reads pings and notices the connection going away.
+func (w *watcher) readPump() {
+	defer func() {
+		w.room.leave(w)
+		w.conn.Close()
+	}()
+	w.conn.SetReadLimit(conf.MaxFrameSize)
+	w.conn.SetReadDeadline(time.Now().Add(conf.PongWait))
+	w.conn.SetPongHandler(func(string) error { w.conn.SetReadDeadline(time.Now().Add(conf.PongWait)); return nil })
+	for {
+		if _, _, err := readMessage(w.conn); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				rootLogger.warn("Spectator connection closed unexpectedly", "uid", w.uid, "err", err)
+			}
+			return
+		}
+	}
+}
+
+// Writing goroutine - it sends the game and ping messages to the spectator.
+func (w *watcher) writePump() {
+	ticker := time.NewTicker(conf.pingPeriod())
+	defer func() {
+		ticker.Stop()
+		w.conn.Close()
+	}()
+	for {
+		select {
+		case data, ok := <-w.send:
+			w.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if !ok {
+				// The room closed the channel.
+				w.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := w.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			w.conn.SetWriteDeadline(time.Now().Add(conf.WriteWait))
+			if err := w.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Watch a game being played. The spectator gets the state of the game first,
+// then its moves with the clocks of both players as they are played, and
+// can't send anything to the room.
+func (rout *router) handleWatch(w http.ResponseWriter, r *http.Request) {
+	uid, _, err := rout.sessionUser(w, r)
+	if err != nil {
+		requestLogger(r).error("Could not save session", "err", err)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	room, ok := rout.rm.live.get(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, "Game not found", http.StatusNotFound)
+		return
+	}
+	conn := upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	if !rout.admitConn(uid, conn, r) {
+		return
+	}
+	wt := &watcher{
+		uid:  uid,
+		room: room,
+		conn: conn,
+		send: make(chan []byte, watcherBufferSize),
+	}
+	select {
+	case room.watch<- wt:
+	case <-room.closed:
+		closeWithNotice(conn, websocket.CloseNormalClosure, newNotice(noticeGameOver), requestLanguage(r))
+		conn.Close()
+		rout.conns.remove(uid, conn)
+		return
+	}
+
+	go wt.writePump()
+	go func() {
+		wt.readPump()
+		rout.conns.remove(uid, conn)
+	}()
+}